@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
+	"github.com/example/ms-ecommerce/internal/pkg/apikey"
+	"github.com/example/ms-ecommerce/internal/pkg/audit"
 	"github.com/example/ms-ecommerce/internal/pkg/db"
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	"github.com/example/ms-ecommerce/internal/pkg/introspect"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 	address "github.com/example/ms-ecommerce/internal/services/address"
 	"github.com/gin-gonic/gin"
 )
@@ -17,12 +24,35 @@ func main() {
 	if err != nil {
 		log.Fatalf("db connect: %v", err)
 	}
+	// validate JWT key configuration before serving requests
+	if err := jwtpkg.LoadKeys(); err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
+	// reject access tokens revoked by the auth service (logout, force logout)
+	middleware.SetDenylist(denylist.NewFromEnv())
+	// role permissions are managed in the role_permissions table
+	middleware.SetPermissionResolver(rbac.NewDBResolver(dbConn, rbac.DefaultTTL))
+	// scripts and integrations authenticate with X-API-Key
+	middleware.SetAPIKeyResolver(apikey.NewDBResolver(dbConn))
+	// requests made while impersonating a user are kept in audit_log
+	middleware.SetAuditSink(audit.NewDBSink(dbConn))
+	// with INTROSPECTION_URL set, also ask the auth service whether tokens are
+	// still active (suspended accounts, changed roles)
+	ins := introspect.NewFromEnv()
+	if err := introspect.CheckCredentials(context.Background(), ins); err != nil {
+		log.Fatalf("introspection: %v", err)
+	}
+	middleware.SetIntrospector(ins)
 	// Ensure minimal auth-related tables exist (avoids startup failure when
 	// the DB was not initialized from `sql/` files).
 	if err := db.EnsureAuthTables(dbConn); err != nil {
 		log.Fatalf("ensure auth tables: %v", err)
 	}
 	r := gin.New()
+	// client addresses come from X-Forwarded-For only behind TRUSTED_PROXIES
+	if err := middleware.SetTrustedProxiesFromEnv(r); err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
 	// attach middleware for logging and recovery to help with debugging
 	r.Use(middleware.GinLogging())
 	r.Use(middleware.GinRecover())
@@ -4,8 +4,18 @@ import (
 	"log"
 	"os"
 
+	"github.com/example/ms-ecommerce/internal/pkg/apikey"
+	"github.com/example/ms-ecommerce/internal/pkg/audit"
 	"github.com/example/ms-ecommerce/internal/pkg/db"
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+	"github.com/example/ms-ecommerce/internal/pkg/loginguard"
+	"github.com/example/ms-ecommerce/internal/pkg/mail"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
+	"github.com/example/ms-ecommerce/internal/pkg/oidc"
+	"github.com/example/ms-ecommerce/internal/pkg/password"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
+	"github.com/example/ms-ecommerce/internal/pkg/sms"
 	auth "github.com/example/ms-ecommerce/internal/services/auth"
 	category "github.com/example/ms-ecommerce/internal/services/category"
 	"github.com/gin-gonic/gin"
@@ -19,18 +29,43 @@ func main() {
 	if err != nil {
 		log.Fatalf("db connect: %v", err)
 	}
+	// validate JWT key configuration before serving requests
+	if err := jwtpkg.LoadKeys(); err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
+	// revoked access tokens are shared with the other services through Redis
+	dl := denylist.NewFromEnv()
+	middleware.SetDenylist(dl)
 	// Ensure minimal auth-related tables exist (avoids startup failure when
 	// the DB was not initialized from `sql/` files).
 	if err := db.EnsureAuthTables(dbConn); err != nil {
 		log.Fatalf("ensure auth tables: %v", err)
 	}
+	// role permissions are managed in the role_permissions table
+	middleware.SetPermissionResolver(rbac.NewDBResolver(dbConn, rbac.DefaultTTL))
+	// scripts and integrations authenticate with X-API-Key
+	middleware.SetAPIKeyResolver(apikey.NewDBResolver(dbConn))
+	// requests made while impersonating a user are kept in audit_log
+	middleware.SetAuditSink(audit.NewDBSink(dbConn))
 	r := gin.New()
+	// client addresses come from X-Forwarded-For only behind TRUSTED_PROXIES
+	if err := middleware.SetTrustedProxiesFromEnv(r); err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
 	// attach middleware for logging and recovery to help with debugging
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 	r.Use(middleware.GinRateLimit())
 	r.Use(middleware.GinMetricsMiddleware("auth"))
-	auth.RegisterRoutes(r, dbConn)
+	sso, errs := oidc.NewRegistryFromEnv()
+	for _, err := range errs {
+		log.Printf("sso: %v", err)
+	}
+	passwords, err := password.NewCheckerFromEnv()
+	if err != nil {
+		log.Fatalf("password policy: %v", err)
+	}
+	auth.RegisterRoutes(r, dbConn, mail.NewFromEnv(), dl, sso, loginguard.NewFromEnv(), passwords, sms.NewFromEnv())
 	category.RegisterRoutes(r, dbConn)
 
 	// Add metrics endpoint
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
 	"github.com/example/ms-ecommerce/internal/pkg/db"
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	"github.com/example/ms-ecommerce/internal/pkg/introspect"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
 	file "github.com/example/ms-ecommerce/internal/services/file"
 	"github.com/gin-gonic/gin"
@@ -16,7 +20,24 @@ func main() {
 	if err != nil {
 		log.Fatalf("db connect: %v", err)
 	}
+	// validate JWT key configuration before serving requests
+	if err := jwtpkg.LoadKeys(); err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
+	// reject access tokens revoked by the auth service (logout, force logout)
+	middleware.SetDenylist(denylist.NewFromEnv())
+	// with INTROSPECTION_URL set, also ask the auth service whether tokens are
+	// still active (suspended accounts, changed roles)
+	ins := introspect.NewFromEnv()
+	if err := introspect.CheckCredentials(context.Background(), ins); err != nil {
+		log.Fatalf("introspection: %v", err)
+	}
+	middleware.SetIntrospector(ins)
 	r := gin.New()
+	// client addresses come from X-Forwarded-For only behind TRUSTED_PROXIES
+	if err := middleware.SetTrustedProxiesFromEnv(r); err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
 	r.Use(middleware.GinLogging())
 	r.Use(middleware.GinRecover())
 	file.RegisterRoutes(r, dbConn)
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
+	"github.com/example/ms-ecommerce/internal/pkg/apikey"
+	"github.com/example/ms-ecommerce/internal/pkg/audit"
 	"github.com/example/ms-ecommerce/internal/pkg/cache"
 	"github.com/example/ms-ecommerce/internal/pkg/db"
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	"github.com/example/ms-ecommerce/internal/pkg/introspect"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 	product "github.com/example/ms-ecommerce/internal/services/product"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -18,6 +25,29 @@ func main() {
 	if err != nil {
 		log.Fatalf("db connect: %v", err)
 	}
+	// product tables added after the initial release (variants, images)
+	if err := db.EnsureCatalogTables(dbConn); err != nil {
+		log.Fatalf("ensure catalog tables: %v", err)
+	}
+	// validate JWT key configuration before serving requests
+	if err := jwtpkg.LoadKeys(); err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
+	// reject access tokens revoked by the auth service (logout, force logout)
+	middleware.SetDenylist(denylist.NewFromEnv())
+	// role permissions are managed in the role_permissions table
+	middleware.SetPermissionResolver(rbac.NewDBResolver(dbConn, rbac.DefaultTTL))
+	// scripts and integrations authenticate with X-API-Key
+	middleware.SetAPIKeyResolver(apikey.NewDBResolver(dbConn))
+	// requests made while impersonating a user are kept in audit_log
+	middleware.SetAuditSink(audit.NewDBSink(dbConn))
+	// with INTROSPECTION_URL set, also ask the auth service whether tokens are
+	// still active (suspended accounts, changed roles)
+	ins := introspect.NewFromEnv()
+	if err := introspect.CheckCredentials(context.Background(), ins); err != nil {
+		log.Fatalf("introspection: %v", err)
+	}
+	middleware.SetIntrospector(ins)
 
 	// Initialize Redis cache
 	redisClient, err := db.NewRedis()
@@ -31,6 +61,10 @@ func main() {
 	}
 
 	r := gin.New()
+	// client addresses come from X-Forwarded-For only behind TRUSTED_PROXIES
+	if err := middleware.SetTrustedProxiesFromEnv(r); err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
 	r.Use(middleware.GinLogging())
 	r.Use(middleware.GinRecover())
 	r.Use(middleware.GinRateLimit())
@@ -0,0 +1,104 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Header is the request header carrying an API key
+const Header = "X-API-Key"
+
+// keyPrefix marks our keys so leaked ones are easy to find by secret scanners
+const keyPrefix = "msk_"
+
+// lastUsedResolution is how stale last_used_at may get before it is written again
+const lastUsedResolution = time.Minute
+
+// ErrInvalidKey is returned for unknown, expired or malformed keys and keys whose
+// owner is no longer active
+var ErrInvalidKey = errors.New("invalid api key")
+
+// Generate returns a new key "msk_<id>_<secret>", its public prefix "msk_<id>"
+// (shown in listings to tell keys apart) and the hash to store. The key itself
+// is never stored.
+func Generate() (key, prefix, hash string, err error) {
+	b := make([]byte, 36)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	prefix = keyPrefix + hex.EncodeToString(b[:4])
+	key = prefix + "_" + hex.EncodeToString(b[4:])
+	return key, prefix, Hash(key), nil
+}
+
+// Hash returns the hex sha256 of a key for storage and lookup
+func Hash(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// JoinScopes and SplitScopes convert scopes to and from their stored,
+// space separated form
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func SplitScopes(s string) []string {
+	return strings.Fields(s)
+}
+
+// Principal is who a request authenticated with an API key acts as: the key's
+// owner, limited to the key's scopes
+type Principal struct {
+	KeyID  int64
+	UserID int64
+	Role   string
+	Scopes []string
+}
+
+// Resolver looks up the principal of a key
+type Resolver interface {
+	Resolve(key string) (*Principal, error)
+}
+
+type dbResolver struct {
+	db *sql.DB
+}
+
+// NewDBResolver resolves keys from the api_keys table
+func NewDBResolver(db *sql.DB) Resolver {
+	return &dbResolver{db: db}
+}
+
+func (r *dbResolver) Resolve(key string) (*Principal, error) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return nil, ErrInvalidKey
+	}
+	p := &Principal{}
+	var scopes string
+	var lastUsed sql.NullTime
+	err := r.db.QueryRow(`SELECT k.id, k.user_id, u.role, k.scopes, k.last_used_at
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = ? AND (k.expires_at IS NULL OR k.expires_at > NOW()) AND u.status = 'active'`, Hash(key)).
+		Scan(&p.KeyID, &p.UserID, &p.Role, &scopes, &lastUsed)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Scopes = SplitScopes(scopes)
+	// keys are used for every request of a script; only write when the value is stale
+	if !lastUsed.Valid || time.Since(lastUsed.Time) > lastUsedResolution {
+		if _, err := r.db.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE id = ?", p.KeyID); err != nil {
+			log.Printf("apikey: updating last_used_at failed: %v", err)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,58 @@
+package audit
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Entry is one request made with an impersonation token
+type Entry struct {
+	// ActorID is the staff member acting as UserID
+	ActorID int64
+	UserID  int64
+	Method  string
+	Path    string
+	Status  int
+	IP      string
+	Time    time.Time
+}
+
+// Sink stores audit entries
+type Sink interface {
+	Record(e Entry) error
+}
+
+type logSink struct{}
+
+// NewLogSink writes entries to the service log
+func NewLogSink() Sink {
+	return logSink{}
+}
+
+func (logSink) Record(e Entry) error {
+	log.Printf("audit: user %d acting as user %d: %s %s -> %d (%s)", e.ActorID, e.UserID, e.Method, e.Path, e.Status, e.IP)
+	return nil
+}
+
+type dbSink struct {
+	db *sql.DB
+}
+
+// NewDBSink writes entries to the audit_log table
+func NewDBSink(db *sql.DB) Sink {
+	return &dbSink{db: db}
+}
+
+func (s *dbSink) Record(e Entry) error {
+	_, err := s.db.Exec("INSERT INTO audit_log (actor_id, user_id, method, path, status, ip_address, created_at) VALUES (?,?,?,?,?,?,?)",
+		e.ActorID, e.UserID, e.Method, truncate(e.Path, 255), e.Status, truncate(e.IP, 64), e.Time)
+	return err
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
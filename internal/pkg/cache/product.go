@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/example/ms-ecommerce/internal/pkg/db"
@@ -18,11 +19,29 @@ func NewProductCache(cache *db.RedisCache) *ProductCache {
 	return &ProductCache{cache: cache}
 }
 
-// GetProductsCacheKey generates cache key for product list
+// GetProductsCacheKey generates cache key for product list, including its
+// filters and sort order
 func (c *ProductCache) GetProductsCacheKey(filters map[string]string, page, limit int) string {
-	key := fmt.Sprintf("products:list:%d:%d", page, limit)
-	for k, v := range filters {
-		if v != "" {
+	return fmt.Sprintf("products:list:%d:%d", page, limit) + filterKey(filters, "")
+}
+
+// GetFacetsCacheKey generates cache key for the facets of a product list. The
+// sort order does not change facets and is left out.
+func (c *ProductCache) GetFacetsCacheKey(filters map[string]string) string {
+	return "products:facets" + filterKey(filters, "sort")
+}
+
+// filterKey formats filters in name order so that the same filters always give
+// the same key. Multi-value filters must be normalized (sorted) by the caller.
+func filterKey(filters map[string]string, skip string) string {
+	names := make([]string, 0, len(filters))
+	for k := range filters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	key := ""
+	for _, k := range names {
+		if v := filters[k]; v != "" && k != skip {
 			key += fmt.Sprintf(":%s=%s", k, v)
 		}
 	}
@@ -34,6 +53,11 @@ func (c *ProductCache) GetProductCacheKey(id int64) string {
 	return fmt.Sprintf("products:id:%d", id)
 }
 
+// GetCatalogProductCacheKey generates cache key for a product of the public catalog
+func (c *ProductCache) GetCatalogProductCacheKey(id int64) string {
+	return fmt.Sprintf("products:catalog:%d", id)
+}
+
 // SetProducts caches product list with filters
 func (c *ProductCache) SetProducts(key string, products []*models.Product, total int, expiration time.Duration) error {
 	cacheData := struct {
@@ -59,6 +83,20 @@ func (c *ProductCache) GetProducts(key string) ([]*models.Product, int, error) {
 	return cacheData.Products, cacheData.Total, nil
 }
 
+// SetFacets caches the facets of a product list
+func (c *ProductCache) SetFacets(key string, facets *models.ProductFacets, expiration time.Duration) error {
+	return c.cache.SetJSON(key, facets, expiration)
+}
+
+// GetFacets retrieves cached facets
+func (c *ProductCache) GetFacets(key string) (*models.ProductFacets, error) {
+	var facets models.ProductFacets
+	if err := c.cache.GetJSON(key, &facets); err != nil {
+		return nil, err
+	}
+	return &facets, nil
+}
+
 // SetProduct caches single product
 func (c *ProductCache) SetProduct(key string, product *models.Product, expiration time.Duration) error {
 	return c.cache.SetJSON(key, product, expiration)
@@ -79,9 +117,8 @@ func (c *ProductCache) DeleteProduct(key string) error {
 	return c.cache.Delete(key)
 }
 
-// InvalidateProductsCache invalidates all product-related cache
+// InvalidateProductsCache invalidates all product-related cache. Only the
+// "products:" keys are removed: the same Redis database holds security state.
 func (c *ProductCache) InvalidateProductsCache() error {
-	// In a production system, you might want to use Redis SCAN or KEYS
-	// For simplicity, we'll flush all cache (not recommended for production)
-	return c.cache.FlushAll()
+	return c.cache.DeletePrefix("products:")
 }
@@ -0,0 +1,25 @@
+package cache
+
+import "testing"
+
+func TestGetProductsCacheKey(t *testing.T) {
+	c := &ProductCache{}
+	filters := map[string]string{"store_id": "3", "published": "1", "in_stock": "1", "search": ""}
+	want := "products:list:2:10:in_stock=1:published=1:store_id=3"
+	for i := 0; i < 10; i++ {
+		if got := c.GetProductsCacheKey(filters, 2, 10); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestGetFacetsCacheKey(t *testing.T) {
+	c := &ProductCache{}
+	filters := map[string]string{"category_id": "2,5", "sort": "price_asc", "published": "1"}
+	if got := c.GetFacetsCacheKey(filters); got != "products:facets:category_id=2,5:published=1" {
+		t.Fatalf("unexpected facets key %q", got)
+	}
+	if got := c.GetProductsCacheKey(filters, 1, 10); got != "products:list:1:10:category_id=2,5:published=1:sort=price_asc" {
+		t.Fatalf("unexpected list key %q", got)
+	}
+}
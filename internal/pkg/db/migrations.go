@@ -2,21 +2,355 @@ package db
 
 import (
 	"database/sql"
+
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 )
 
-// EnsureAuthTables creates minimal auth-related tables that the service expects.
-// This is intentionally narrow: it only creates the `refresh_tokens` table if missing
-// so running the service will not fail when the SQL init scripts were not applied.
-func EnsureAuthTables(db *sql.DB) error {
-	const q = `CREATE TABLE IF NOT EXISTS refresh_tokens (
+// authTables are the auth-related tables that the service expects. Keep these in
+// sync with `sql/schema.sql`.
+var authTables = []string{
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
   id BIGINT AUTO_INCREMENT PRIMARY KEY,
   user_id BIGINT NOT NULL,
   token_hash VARCHAR(128) NOT NULL,
+  family_id VARCHAR(64) NOT NULL DEFAULT '',
+  parent_id BIGINT NULL,
+  rotated_at DATETIME NULL,
+  user_agent VARCHAR(255) NOT NULL DEFAULT '',
+  ip_address VARCHAR(64) NOT NULL DEFAULT '',
+  session_created_at DATETIME NULL,
+  last_used_at DATETIME NULL,
+  client_id VARCHAR(64) NULL,
+  scope VARCHAR(1024) NOT NULL DEFAULT '',
   expires_at DATETIME NOT NULL,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   INDEX (token_hash),
+  INDEX idx_refresh_tokens_family (family_id),
+  INDEX idx_refresh_tokens_client (client_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS user_identities (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  provider VARCHAR(64) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  email VARCHAR(255) NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_user_identities_subject (provider, subject),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS security_events (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NULL,
+  event_type VARCHAR(64) NOT NULL,
+  detail TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX (user_id),
+  INDEX (event_type)
+);`,
+	`CREATE TABLE IF NOT EXISTS role_permissions (
+  role VARCHAR(50) NOT NULL,
+  permission VARCHAR(100) NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (role, permission)
+);`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  name VARCHAR(100) NOT NULL,
+  prefix VARCHAR(32) NOT NULL,
+  key_hash VARCHAR(128) NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  expires_at DATETIME NULL,
+  last_used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_api_keys_hash (key_hash),
+  INDEX (user_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS login_tokens (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  channel VARCHAR(16) NOT NULL,
+  destination VARCHAR(255) NOT NULL,
+  token_hash VARCHAR(128) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_login_tokens_hash (token_hash),
+  INDEX idx_login_tokens_destination (channel, destination, created_at),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS oauth_clients (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  client_id VARCHAR(64) NOT NULL,
+  secret_hash VARCHAR(128) NULL,
+  name VARCHAR(100) NOT NULL,
+  owner_id BIGINT NOT NULL,
+  redirect_uris TEXT NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  grant_types VARCHAR(255) NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  revoked_at DATETIME NULL,
+  UNIQUE KEY uq_oauth_clients_client_id (client_id),
+  FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  code_hash VARCHAR(128) NOT NULL,
+  client_id VARCHAR(64) NOT NULL,
+  user_id BIGINT NOT NULL,
+  redirect_uri VARCHAR(1024) NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  code_challenge VARCHAR(128) NOT NULL,
+  family_id VARCHAR(64) NULL,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_oauth_codes_hash (code_hash),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS oauth_consents (
+  user_id BIGINT NOT NULL,
+  client_id VARCHAR(64) NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, client_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  actor_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  method VARCHAR(10) NOT NULL,
+  path VARCHAR(255) NOT NULL,
+  status INT NOT NULL,
+  ip_address VARCHAR(64) NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  INDEX (actor_id),
+  INDEX (user_id, created_at)
+);`,
+	`CREATE TABLE IF NOT EXISTS user_mfa (
+  user_id BIGINT PRIMARY KEY,
+  secret VARCHAR(64) NOT NULL,
+  enabled TINYINT(1) NOT NULL DEFAULT 0,
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  code_hash VARCHAR(128) NOT NULL,
+  used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX (user_id),
   FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-);`
-	_, err := db.Exec(q)
+);`,
+}
+
+// authColumns are columns added to pre-existing tables after their initial
+// release, as {table, column, definition}.
+var authColumns = [][3]string{
+	{"users", "email_verified_at", "DATETIME NULL"},
+	{"users", "status", "VARCHAR(16) NOT NULL DEFAULT 'active'"},
+	{"users", "token_version", "INT NOT NULL DEFAULT 0"},
+	{"refresh_tokens", "family_id", "VARCHAR(64) NOT NULL DEFAULT '', ADD INDEX idx_refresh_tokens_family (family_id)"},
+	{"refresh_tokens", "parent_id", "BIGINT NULL"},
+	{"refresh_tokens", "rotated_at", "DATETIME NULL"},
+	{"refresh_tokens", "user_agent", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"refresh_tokens", "ip_address", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"refresh_tokens", "session_created_at", "DATETIME NULL"},
+	{"refresh_tokens", "last_used_at", "DATETIME NULL"},
+	{"refresh_tokens", "client_id", "VARCHAR(64) NULL, ADD INDEX idx_refresh_tokens_client (client_id)"},
+	{"refresh_tokens", "scope", "VARCHAR(1024) NOT NULL DEFAULT ''"},
+}
+
+// authNullableColumns were NOT NULL in earlier releases, as {table, column, definition}
+var authNullableColumns = [][3]string{
+	// SSO users have no phone; NULLs do not collide in the UNIQUE index, '' does
+	{"users", "phone", "VARCHAR(50) NULL"},
+}
+
+// authBackfills are idempotent data fixes run after authColumns.
+var authBackfills = []string{
+	"UPDATE users SET phone = NULL WHERE phone = ''",
+	// refresh tokens issued before token families existed become their own session
+	"UPDATE refresh_tokens SET family_id = CONCAT('legacy-', id) WHERE family_id = ''",
+}
+
+// EnsureAuthTables creates minimal auth-related tables that the service expects.
+// This is intentionally narrow: it only creates auth tables (refresh tokens, 2FA)
+// if missing so running the service will not fail when the SQL init scripts were
+// not applied. Columns added to `users` later are also back-filled on older databases.
+func EnsureAuthTables(db *sql.DB) error {
+	for _, q := range authTables {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	for _, c := range authColumns {
+		if err := ensureColumn(db, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	for _, c := range authNullableColumns {
+		if err := ensureNullable(db, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	for _, q := range authBackfills {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return seedRolePermissions(db)
+}
+
+// catalogTables are the product tables added after the initial release. Keep
+// these in sync with `sql/schema.sql`.
+var catalogTables = []string{
+	`CREATE TABLE IF NOT EXISTS product_variants (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  product_id BIGINT NOT NULL,
+  store_id BIGINT NOT NULL,
+  sku VARCHAR(64) NOT NULL,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  options JSON NULL,
+  price DECIMAL(12,2) NULL,
+  stock INT NOT NULL DEFAULT 0,
+  image_url VARCHAR(1024),
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_product_variants_sku (store_id, sku),
+  INDEX idx_product_variants_product (product_id),
+  FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+  FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE
+);`,
+	`CREATE TABLE IF NOT EXISTS product_images (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  product_id BIGINT NOT NULL,
+  url VARCHAR(1024) NOT NULL,
+  alt_text VARCHAR(255) NOT NULL DEFAULT '',
+  position INT NOT NULL DEFAULT 0,
+  is_primary TINYINT(1) NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_product_images_product (product_id, position),
+  FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);`,
+}
+
+// catalogColumns are columns added to the product tables, as {table, column, definition}
+var catalogColumns = [][3]string{
+	{"product_logs", "variant_id", "BIGINT NULL"},
+	{"product_logs", "variant_sku", "VARCHAR(64) NULL"},
+	{"product_logs", "variant_name", "VARCHAR(255) NULL"},
+	{"product_logs", "variant_options", "JSON NULL"},
+	{"products", "published", "TINYINT(1) NOT NULL DEFAULT 1"},
+	{"products", "search_terms", "TEXT NULL"},
+	{"products", "rating", "DECIMAL(3,2) NOT NULL DEFAULT 0"},
+}
+
+// catalogIndexes are indexes added to the product tables, as {table, index, definition}
+var catalogIndexes = [][3]string{
+	{"products", "ft_products_search", "FULLTEXT INDEX ft_products_search (search_terms) WITH PARSER ngram"},
+}
+
+// catalogBackfills are idempotent data fixes run after catalogColumns.
+var catalogBackfills = []string{
+	// products created before product_images get their image as the primary one
+	`INSERT INTO product_images (product_id, url, is_primary)
+  SELECT p.id, p.image_url, 1 FROM products p
+  WHERE p.image_url IS NOT NULL AND p.image_url <> ''
+    AND NOT EXISTS (SELECT 1 FROM product_images i WHERE i.product_id = p.id)`,
+}
+
+// EnsureCatalogTables brings the product tables of an older database up to date,
+// like EnsureAuthTables does for the auth tables. Used by the product and
+// transaction services.
+func EnsureCatalogTables(db *sql.DB) error {
+	for _, q := range catalogTables {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	for _, c := range catalogColumns {
+		if err := ensureColumn(db, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	for _, ix := range catalogIndexes {
+		if err := ensureIndex(db, ix[0], ix[1], ix[2]); err != nil {
+			return err
+		}
+	}
+	for _, q := range catalogBackfills {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureNullable redefines a NOT NULL column as nullable, once
+func ensureNullable(db *sql.DB, table, column, definition string) error {
+	var nullable string
+	err := db.QueryRow("SELECT IS_NULLABLE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&nullable)
+	if err != nil || nullable == "YES" {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " MODIFY COLUMN " + column + " " + definition)
+	return err
+}
+
+// seedRolePermissions inserts rbac.Defaults into an empty role_permissions table.
+// Once the table has rows it is managed by operators and never touched again.
+func seedRolePermissions(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(1) FROM role_permissions").Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	for role, perms := range rbac.Defaults {
+		for _, perm := range perms {
+			if _, err := db.Exec("INSERT IGNORE INTO role_permissions (role, permission) VALUES (?, ?)", role, perm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds a column if it does not exist yet (MySQL has no
+// ADD COLUMN IF NOT EXISTS).
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(1) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// ensureIndex adds an index if it does not exist yet. It is checked on its own
+// rather than with the column it covers, so a column left behind by an earlier
+// partial run still gets its index.
+func ensureIndex(db *sql.DB, table, index, definition string) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(1) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?", table, index).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD " + definition)
 	return err
 }
@@ -2,12 +2,13 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 func NewMySQL() (*sql.DB, error) {
@@ -77,3 +78,22 @@ func getenv(k, fallback string) string {
 	}
 	return v
 }
+
+// DuplicateKey reports whether err is a MySQL unique constraint violation
+// (error 1062) and returns the name of the violated key, e.g. "email". MySQL 8
+// qualifies the name with the table ("users.email"); the table is stripped.
+func DuplicateKey(err error) (string, bool) {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) || me.Number != 1062 {
+		return "", false
+	}
+	i := strings.LastIndex(me.Message, "for key '")
+	if i < 0 {
+		return "", true
+	}
+	key := strings.TrimSuffix(me.Message[i+len("for key '"):], "'")
+	if j := strings.LastIndex(key, "."); j >= 0 {
+		key = key[j+1:]
+	}
+	return key, true
+}
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDuplicateKey(t *testing.T) {
+	cases := []struct {
+		err error
+		key string
+		dup bool
+	}{
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a@example.com' for key 'users.email'"}, "email", true},
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '0811' for key 'phone'"}, "phone", true},
+		{fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'x' for key 'uq_user_identities_subject'"}), "uq_user_identities_subject", true},
+		{&mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row"}, "", false},
+		{errors.New("boom"), "", false},
+		{nil, "", false},
+	}
+	for _, tc := range cases {
+		key, dup := DuplicateKey(tc.err)
+		if key != tc.key || dup != tc.dup {
+			t.Errorf("DuplicateKey(%v) = %q, %v; want %q, %v", tc.err, key, dup, tc.key, tc.dup)
+		}
+	}
+}
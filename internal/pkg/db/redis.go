@@ -64,6 +64,24 @@ func (c *RedisCache) Exists(key string) (bool, error) {
 	return count > 0, err
 }
 
+// Incr increments a counter. The expiration is only set when the key is created,
+// so the counter covers a fixed window starting at the first increment.
+func (c *RedisCache) Incr(key string, expiration time.Duration) (int64, error) {
+	pipe := c.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, expiration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// TTL returns the remaining time to live of a key, or a negative duration if the
+// key does not exist or has no expiration
+func (c *RedisCache) TTL(key string) (time.Duration, error) {
+	return c.client.TTL(ctx, key).Result()
+}
+
 // SetJSON stores a JSON-serializable object
 func (c *RedisCache) SetJSON(key string, value interface{}, expiration time.Duration) error {
 	return c.client.Set(ctx, key, value, expiration).Err()
@@ -74,7 +92,26 @@ func (c *RedisCache) GetJSON(key string, dest interface{}) error {
 	return c.client.Get(ctx, key).Scan(dest)
 }
 
-// FlushAll clears all cache
-func (c *RedisCache) FlushAll() error {
-	return c.client.FlushAll(ctx).Err()
+// DeletePrefix removes every key starting with prefix. It walks the keyspace
+// with SCAN rather than flushing the database, which also holds the token
+// denylist and login lockouts.
+func (c *RedisCache) DeletePrefix(prefix string) error {
+	iter := c.client.Scan(ctx, 0, prefix+"*", 500).Iterator()
+	keys := []string{}
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 500 {
+			if err := c.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return c.client.Del(ctx, keys...).Err()
+	}
+	return nil
 }
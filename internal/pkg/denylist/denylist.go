@@ -0,0 +1,170 @@
+package denylist
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/example/ms-ecommerce/internal/pkg/db"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+	"github.com/redis/go-redis/v9"
+)
+
+// Denylist records revoked access tokens. Entries only need to live as long as
+// the tokens they deny, so everything expires after at most jwtpkg.AccessTokenTTL.
+type Denylist interface {
+	// RevokeToken denies a single token (by jti) until it expires
+	RevokeToken(jti string, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
+	// RevokeUserTokens denies every token of userID issued before at
+	RevokeUserTokens(userID int64, at time.Time) error
+	// UserRevokedAt returns the cutoff set by RevokeUserTokens, or zero time
+	UserRevokedAt(userID int64) (time.Time, error)
+}
+
+// NewFromEnv connects to Redis (REDIS_HOST/REDIS_PORT) so revocations are shared
+// between services, falling back to a process-local list when Redis is unavailable.
+func NewFromEnv() Denylist {
+	client, err := db.NewRedis()
+	if err != nil {
+		log.Printf("denylist: redis unavailable, using in-memory denylist: %v", err)
+		return NewMemory()
+	}
+	return NewRedis(db.NewRedisCache(client))
+}
+
+// IsRevoked reports whether the token described by claims has been revoked
+func IsRevoked(d Denylist, c *jwtpkg.Claims) (bool, error) {
+	if c.ID != "" {
+		revoked, err := d.IsTokenRevoked(c.ID)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	cutoff, err := d.UserRevokedAt(c.UserID)
+	if err != nil || cutoff.IsZero() {
+		return false, err
+	}
+	if !c.PreciseIssuedAt {
+		// iat alone has second precision: deny the cutoff's whole second
+		return !c.IssuedAt.After(cutoff.Truncate(time.Second)), nil
+	}
+	// iat_us is truncated to the microsecond; so is the cutoff kept in Redis
+	return c.IssuedAt.Before(cutoff.Truncate(time.Microsecond)), nil
+}
+
+// secondsCutoffLimit tells cutoffs stored in seconds (until year 5138) from
+// ones stored in microseconds
+const secondsCutoffLimit = 1e11
+
+func jtiKey(jti string) string    { return "denylist:jti:" + jti }
+func userKey(userID int64) string { return "denylist:user:" + strconv.FormatInt(userID, 10) }
+
+type redisDenylist struct {
+	cache *db.RedisCache
+}
+
+func NewRedis(cache *db.RedisCache) Denylist {
+	return &redisDenylist{cache: cache}
+}
+
+func (d *redisDenylist) RevokeToken(jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.cache.Set(jtiKey(jti), "1", ttl)
+}
+
+func (d *redisDenylist) IsTokenRevoked(jti string) (bool, error) {
+	return d.cache.Exists(jtiKey(jti))
+}
+
+func (d *redisDenylist) RevokeUserTokens(userID int64, at time.Time) error {
+	return d.cache.Set(userKey(userID), strconv.FormatInt(at.UnixMicro(), 10), jwtpkg.AccessTokenTTL)
+}
+
+func (d *redisDenylist) UserRevokedAt(userID int64) (time.Time, error) {
+	v, err := d.cache.Get(userKey(userID))
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	us, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if us < secondsCutoffLimit {
+		// written in seconds by an older release
+		return time.Unix(us, 0), nil
+	}
+	return time.UnixMicro(us), nil
+}
+
+type memoryEntry struct {
+	value     time.Time
+	expiresAt time.Time
+}
+
+type memoryDenylist struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time // jti -> token expiry
+	users  map[int64]memoryEntry
+}
+
+// NewMemory returns a process-local denylist (tests, or when Redis is down)
+func NewMemory() Denylist {
+	return &memoryDenylist{tokens: map[string]time.Time{}, users: map[int64]memoryEntry{}}
+}
+
+func (d *memoryDenylist) RevokeToken(jti string, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	d.tokens[jti] = expiresAt
+	return nil
+}
+
+func (d *memoryDenylist) IsTokenRevoked(jti string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	exp, ok := d.tokens[jti]
+	return ok && time.Now().Before(exp), nil
+}
+
+func (d *memoryDenylist) RevokeUserTokens(userID int64, at time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	d.users[userID] = memoryEntry{value: at, expiresAt: time.Now().Add(jwtpkg.AccessTokenTTL)}
+	return nil
+}
+
+func (d *memoryDenylist) UserRevokedAt(userID int64) (time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.users[userID]
+	if !ok || time.Now().After(e.expiresAt) {
+		return time.Time{}, nil
+	}
+	return e.value, nil
+}
+
+// prune drops expired entries; callers hold d.mu
+func (d *memoryDenylist) prune() {
+	now := time.Now()
+	for k, exp := range d.tokens {
+		if now.After(exp) {
+			delete(d.tokens, k)
+		}
+	}
+	for k, e := range d.users {
+		if now.After(e.expiresAt) {
+			delete(d.users, k)
+		}
+	}
+}
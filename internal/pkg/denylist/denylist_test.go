@@ -0,0 +1,55 @@
+package denylist
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Exit(m.Run())
+}
+
+func TestIsRevoked_UserCutoff(t *testing.T) {
+	d := NewMemory()
+	cutoff := time.Now()
+	if err := d.RevokeUserTokens(5, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		claims  jwtpkg.Claims
+		revoked bool
+	}{
+		{jwtpkg.Claims{UserID: 5, IssuedAt: cutoff.Add(-time.Microsecond), PreciseIssuedAt: true}, true},
+		// issued right after the cutoff, within the same second
+		{jwtpkg.Claims{UserID: 5, IssuedAt: cutoff.Add(time.Microsecond), PreciseIssuedAt: true}, false},
+		{jwtpkg.Claims{UserID: 6, IssuedAt: cutoff.Add(-time.Hour), PreciseIssuedAt: true}, false},
+		// tokens with iat only are denied for the cutoff's whole second
+		{jwtpkg.Claims{UserID: 5, IssuedAt: cutoff.Truncate(time.Second)}, true},
+		{jwtpkg.Claims{UserID: 5, IssuedAt: cutoff.Truncate(time.Second).Add(time.Second)}, false},
+	}
+	for i, c := range cases {
+		if got, err := IsRevoked(d, &c.claims); err != nil || got != c.revoked {
+			t.Fatalf("case %d: revoked = %v, %v; want %v", i, got, err, c.revoked)
+		}
+	}
+}
+
+func TestIsRevoked_IssuedAfterCutoff(t *testing.T) {
+	d := NewMemory()
+	before, _ := jwtpkg.GenerateToken(5, "user")
+	d.RevokeUserTokens(5, time.Now())
+	after, _ := jwtpkg.GenerateToken(5, "user")
+	for tok, want := range map[string]bool{before: true, after: false} {
+		c, err := jwtpkg.ParseClaims(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := IsRevoked(d, c); got != want {
+			t.Fatalf("revoked = %v, want %v", got, want)
+		}
+	}
+}
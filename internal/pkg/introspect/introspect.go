@@ -0,0 +1,230 @@
+package introspect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token types reported in Result.TokenType
+const (
+	TypeAccessToken  = "access_token"
+	TypeRefreshToken = "refresh_token"
+)
+
+// DefaultCacheTTL is how long Client reuses an answer, i.e. how long a
+// revocation may take to reach a service using introspection
+const DefaultCacheTTL = 30 * time.Second
+
+// Result is an RFC 7662 introspection response. Inactive tokens (invalid,
+// expired, revoked, or of a suspended or deleted account) carry only Active.
+type Result struct {
+	Active    bool   `json:"active"`
+	TokenType string `json:"token_type,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+	Role      string `json:"role,omitempty"`
+	// Status is the account status (users.status)
+	Status       string `json:"status,omitempty"`
+	TokenVersion int64  `json:"token_version,omitempty"`
+	// ActorID is the staff member acting as the user (impersonation tokens)
+	ActorID int64 `json:"actor_id,omitempty"`
+	// ClientID and Scope are set for tokens issued to OAuth clients
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	JTI       string `json:"jti,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// StatusError is a response from the introspection endpoint other than 200
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("introspection: status %d", e.Status)
+}
+
+// Refused reports whether err is the auth service turning the request down
+// (a 4xx status: wrong client credentials, a client without the introspect
+// scope, a wrong URL) rather than failing to answer. Refusals are configuration
+// errors; retrying will not help.
+func Refused(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Status < 500
+}
+
+// Introspector asks the auth service about a token
+type Introspector interface {
+	Introspect(ctx context.Context, token string) (*Result, error)
+}
+
+// Client calls the auth service's introspection endpoint and caches the answers
+// for TTL (never past the token's expiry).
+type Client struct {
+	URL string
+	TTL time.Duration
+	// ClientID and ClientSecret authenticate the service with HTTP Basic; the
+	// auth service only answers OAuth clients with the introspect scope
+	ClientID     string
+	ClientSecret string
+	// HTTPClient is used for requests (default: 5s timeout)
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	cache  map[string]cacheEntry
+	pruned time.Time
+}
+
+type cacheEntry struct {
+	result    *Result
+	expiresAt time.Time
+}
+
+func NewClient(url string, ttl time.Duration) *Client {
+	return &Client{URL: url, TTL: ttl, cache: map[string]cacheEntry{}}
+}
+
+// NewFromEnv returns a Client for INTROSPECTION_URL (e.g.
+// http://auth:8080/api/v1/auth/introspect) caching for INTROSPECTION_CACHE_TTL
+// and authenticating as INTROSPECTION_CLIENT_ID/INTROSPECTION_CLIENT_SECRET,
+// or nil when no URL is configured.
+func NewFromEnv() Introspector {
+	u := strings.TrimSpace(os.Getenv("INTROSPECTION_URL"))
+	if u == "" {
+		return nil
+	}
+	ttl := DefaultCacheTTL
+	if v, err := time.ParseDuration(os.Getenv("INTROSPECTION_CACHE_TTL")); err == nil {
+		ttl = v
+	}
+	c := NewClient(u, ttl)
+	c.ClientID = strings.TrimSpace(os.Getenv("INTROSPECTION_CLIENT_ID"))
+	c.ClientSecret = strings.TrimSpace(os.Getenv("INTROSPECTION_CLIENT_SECRET"))
+	return c
+}
+
+func (c *Client) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 5 * time.Second}
+}
+
+// cacheKey hashes the token so the cache holds no usable credentials
+func cacheKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *Client) Introspect(ctx context.Context, token string) (*Result, error) {
+	key := cacheKey(token)
+	if r, ok := c.cached(key); ok {
+		return r, nil
+	}
+	r, err := c.fetch(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, r)
+	return r, nil
+}
+
+func (c *Client) fetch(ctx context.Context, token string) (*Result, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {TypeAccessToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientID != "" {
+		// form-urlencoded credentials, RFC 6749 section 2.3.1
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Status: resp.StatusCode}
+	}
+	var r Result
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("introspection: %w", err)
+	}
+	return &r, nil
+}
+
+// CheckCredentials asks about an invalid token, so that wrong client
+// credentials show at startup instead of on every request. It returns the
+// refusal (see Refused) or nil; an auth service that cannot be reached yet is
+// only logged. A nil Introspector (introspection disabled) passes.
+func CheckCredentials(ctx context.Context, i Introspector) error {
+	c, ok := i.(*Client)
+	if !ok || c == nil {
+		return nil
+	}
+	_, err := c.fetch(ctx, "credentials-check")
+	if Refused(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("introspection: cannot check client credentials yet: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) cached(key string) (*Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		return nil, false
+	}
+	return e.result, true
+}
+
+func (c *Client) store(key string, r *Result) {
+	if c.TTL <= 0 {
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(c.TTL)
+	// an active answer must not outlive the token
+	if r.Active && r.ExpiresAt > 0 && time.Unix(r.ExpiresAt, 0).Before(expiresAt) {
+		expiresAt = time.Unix(r.ExpiresAt, 0)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[string]cacheEntry{}
+	}
+	c.prune(now)
+	c.cache[key] = cacheEntry{result: r, expiresAt: expiresAt}
+}
+
+// prune drops expired entries at most once per TTL; callers hold c.mu
+func (c *Client) prune(now time.Time) {
+	if now.Sub(c.pruned) < c.TTL {
+		return
+	}
+	c.pruned = now
+	for k, e := range c.cache {
+		if now.After(e.expiresAt) {
+			delete(c.cache, k)
+		}
+	}
+}
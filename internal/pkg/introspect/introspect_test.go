@@ -0,0 +1,105 @@
+package introspect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_CachesAnswers(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.PostFormValue("token")
+		mu.Lock()
+		calls[token]++
+		mu.Unlock()
+		r2 := Result{}
+		if token == "good" {
+			r2 = Result{Active: true, UserID: 5, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+		}
+		if token == "expiring" {
+			r2 = Result{Active: true, UserID: 5, ExpiresAt: time.Now().Add(-time.Second).Unix()}
+		}
+		json.NewEncoder(w).Encode(r2)
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, time.Minute)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		r, err := c.Introspect(ctx, "good")
+		if err != nil || !r.Active || r.UserID != 5 {
+			t.Fatalf("introspect: %+v %v", r, err)
+		}
+		if r, err := c.Introspect(ctx, "revoked"); err != nil || r.Active {
+			t.Fatalf("expected inactive, got %+v %v", r, err)
+		}
+	}
+	if calls["good"] != 1 || calls["revoked"] != 1 {
+		t.Fatalf("expected one request per token, got %v", calls)
+	}
+
+	// an answer is not reused past the token's expiry
+	c.Introspect(ctx, "expiring")
+	c.Introspect(ctx, "expiring")
+	if calls["expiring"] != 2 {
+		t.Fatalf("expected expired answer refetched, got %d requests", calls["expiring"])
+	}
+}
+
+func TestClient_ReportsServerErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	_, err := NewClient(srv.URL, time.Minute).Introspect(context.Background(), "good")
+	if err == nil || Refused(err) {
+		t.Fatalf("expected status 500 reported as a failure, got %v", err)
+	}
+}
+
+func TestClient_SendsClientCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "cl_gateway" || secret != "cs_secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(Result{Active: true})
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, time.Minute)
+	if _, err := c.Introspect(context.Background(), "good"); !Refused(err) {
+		t.Fatalf("expected unauthenticated request refused, got %v", err)
+	}
+	if err := CheckCredentials(context.Background(), c); !Refused(err) {
+		t.Fatalf("expected credentials check to fail, got %v", err)
+	}
+	c.ClientID, c.ClientSecret = "cl_gateway", "cs_secret"
+	if err := CheckCredentials(context.Background(), c); err != nil {
+		t.Fatalf("credentials check: %v", err)
+	}
+	if r, err := c.Introspect(context.Background(), "good"); err != nil || !r.Active {
+		t.Fatalf("introspect: %+v %v", r, err)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv("INTROSPECTION_URL", "")
+	if NewFromEnv() != nil {
+		t.Fatalf("expected introspection disabled without a URL")
+	}
+	t.Setenv("INTROSPECTION_URL", "http://auth:8080/api/v1/auth/introspect")
+	t.Setenv("INTROSPECTION_CACHE_TTL", "5s")
+	t.Setenv("INTROSPECTION_CLIENT_ID", "cl_gateway")
+	t.Setenv("INTROSPECTION_CLIENT_SECRET", "cs_secret")
+	c, ok := NewFromEnv().(*Client)
+	if !ok || c.TTL != 5*time.Second || c.ClientID != "cl_gateway" || c.ClientSecret != "cs_secret" {
+		t.Fatalf("unexpected client %+v", c)
+	}
+}
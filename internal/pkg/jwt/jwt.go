@@ -1,92 +1,311 @@
 package jwtpkg
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte(getenv("JWT_SECRET", "supersecretjwtkey"))
+// Token purposes. Access tokens carry no purpose claim; every other token we
+// mint is scoped to exactly one flow and must not be accepted as an access token.
+const (
+	PurposeReset      = "reset"
+	PurposeMFAPending = "mfa_pending"
+	PurposeVerifyMail = "verify_email"
+	PurposeSSONonce   = "sso_nonce"
+)
 
-func getenv(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
-	}
-	return fallback
+// MFATokenTTL is how long a user has to enter their second factor after
+// a successful password check.
+const MFATokenTTL = 5 * time.Minute
+
+// EmailVerifyTokenTTL is the lifetime of email verification links
+const EmailVerifyTokenTTL = 24 * time.Hour
+
+// SSONonceTTL is how long a client has to complete an SSO login after asking for a nonce
+const SSONonceTTL = 10 * time.Minute
+
+// AccessTokenTTL is the lifetime of access tokens
+const AccessTokenTTL = 24 * time.Hour
+
+// Claims are the verified claims of an access token
+type Claims struct {
+	UserID int64
+	Role   string
+	ID     string // jti, used for revocation
+	// users.token_version at issue time; bumped whenever the role changes
+	TokenVersion int64
+	// IssuedAt has microsecond precision (iat_us claim), so a revocation cutoff
+	// can tell apart tokens issued just before and just after it. Tokens minted
+	// before iat_us existed only have iat, in seconds: see PreciseIssuedAt.
+	IssuedAt        time.Time
+	PreciseIssuedAt bool
+	ExpiresAt       time.Time
+	// ActorID is the staff member acting as UserID (act claim); 0 if the token
+	// is the user's own
+	ActorID int64
+	// ClientID is the OAuth client the token was issued to (client_id claim),
+	// limited to Scopes; "" for tokens of our own apps
+	ClientID string
+	Scopes   []string
 }
 
+// ImpersonationTokenTTL is the lifetime of tokens issued to act as another user
+const ImpersonationTokenTTL = 15 * time.Minute
+
+// GenerateToken creates an access token with token version 0
 func GenerateToken(userID int64, role string) (string, error) {
+	return GenerateVersionedToken(userID, role, 0)
+}
+
+// GenerateVersionedToken creates an access token carrying the user's current
+// token version (tv claim)
+func GenerateVersionedToken(userID int64, role string, version int64) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := jwt.MapClaims{
 		"user_id": userID,
 		"role":    role,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
+		"jti":     jti,
+		"tv":      version,
+		"iat":     now.Unix(),
+		"iat_us":  now.UnixMicro(),
+		"exp":     now.Add(AccessTokenTTL).Unix(),
+	}
+	return sign(claims)
+}
+
+// GenerateImpersonationToken creates a short-lived access token for userID on
+// behalf of actorID. The actor is recorded in the act claim (RFC 8693).
+func GenerateImpersonationToken(userID int64, role string, version int64, actorID int64) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"role":    role,
+		"jti":     jti,
+		"tv":      version,
+		"act":     map[string]interface{}{"user_id": actorID},
+		"iat":     now.Unix(),
+		"iat_us":  now.UnixMicro(),
+		"exp":     now.Add(ImpersonationTokenTTL).Unix(),
+	}
+	return sign(claims)
+}
+
+// OAuthAccessTokenTTL is the lifetime of access tokens issued to OAuth clients
+const OAuthAccessTokenTTL = time.Hour
+
+// GenerateClientToken creates an access token for an OAuth client acting as
+// userID, limited to scopes (client_id and scope claims, RFC 9068)
+func GenerateClientToken(userID int64, role string, version int64, clientID string, scopes []string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id":   userID,
+		"role":      role,
+		"jti":       jti,
+		"tv":        version,
+		"client_id": clientID,
+		"scope":     strings.Join(scopes, " "),
+		"iat":       now.Unix(),
+		"iat_us":    now.UnixMicro(),
+		"exp":       now.Add(OAuthAccessTokenTTL).Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return sign(claims)
 }
 
 // ParseToken verifies the token and returns userID and role
 func ParseToken(tokenStr string) (int64, string, error) {
-	t, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
+	c, err := ParseClaims(tokenStr)
 	if err != nil {
 		return 0, "", err
 	}
-	if claims, ok := t.Claims.(jwt.MapClaims); ok && t.Valid {
-		// extract user_id and role
-		var uid int64
-		switch v := claims["user_id"].(type) {
-		case float64:
-			uid = int64(v)
-		case int64:
-			uid = v
+	return c.UserID, c.Role, nil
+}
+
+// ParseClaims verifies an access token and returns its claims
+func ParseClaims(tokenStr string) (*Claims, error) {
+	claims, err := parse(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	// purpose-scoped tokens (reset, mfa_pending) are not access tokens
+	if _, ok := claims["purpose"]; ok {
+		return nil, errors.New("invalid token purpose")
+	}
+	c := &Claims{UserID: claimUserID(claims)}
+	c.Role, _ = claims["role"].(string)
+	c.ID, _ = claims["jti"].(string)
+	if tv, ok := claims["tv"].(float64); ok {
+		c.TokenVersion = int64(tv)
+	}
+	if act, ok := claims["act"].(map[string]interface{}); ok {
+		c.ActorID = claimUserID(act)
+		if c.ActorID == 0 {
+			return nil, errors.New("invalid act claim")
 		}
-		role, _ := claims["role"].(string)
-		return uid, role, nil
 	}
-	return 0, "", errors.New("invalid token")
+	if cid, ok := claims["client_id"].(string); ok && cid != "" {
+		c.ClientID = cid
+		scope, _ := claims["scope"].(string)
+		c.Scopes = strings.Fields(scope)
+	}
+	if us, ok := claims["iat_us"].(float64); ok {
+		c.IssuedAt, c.PreciseIssuedAt = time.UnixMicro(int64(us)), true
+	} else if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		c.IssuedAt = iat.Time
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		c.ExpiresAt = exp.Time
+	}
+	return c, nil
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // GenerateResetToken creates a short-lived token for password reset
 func GenerateResetToken(userID int64) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"purpose": "reset",
-		"exp":     time.Now().Add(1 * time.Hour).Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return generatePurposeToken(userID, PurposeReset, 1*time.Hour, nil)
 }
 
 // ParseResetToken verifies reset token and returns userID if purpose matches
 func ParseResetToken(tokenStr string) (int64, error) {
-	t, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
+	return parsePurposeToken(tokenStr, PurposeReset)
+}
+
+// GenerateMFAToken creates the intermediate token handed out after a correct
+// password when the account has two-factor authentication enabled. Its jti
+// lets the auth service count attempts per token and spend it once used.
+func GenerateMFAToken(userID int64) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	return generatePurposeToken(userID, PurposeMFAPending, MFATokenTTL, jwt.MapClaims{"jti": jti})
+}
+
+// ParseMFAToken verifies an mfa_pending token and returns the userID and the
+// token's jti
+func ParseMFAToken(tokenStr string) (int64, string, error) {
+	claims, err := parsePurposeClaims(tokenStr, PurposeMFAPending)
+	if err != nil {
+		return 0, "", err
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return 0, "", errors.New("invalid token")
+	}
+	return claimUserID(claims), jti, nil
+}
+
+// GenerateEmailVerifyToken creates a token proving control of email. The address
+// is embedded so the link stops working if the user's email changes meanwhile.
+func GenerateEmailVerifyToken(userID int64, email string) (string, error) {
+	return generatePurposeToken(userID, PurposeVerifyMail, EmailVerifyTokenTTL, jwt.MapClaims{"email": email})
+}
+
+// ParseEmailVerifyToken verifies an email verification token and returns userID and email
+func ParseEmailVerifyToken(tokenStr string) (int64, string, error) {
+	claims, err := parsePurposeClaims(tokenStr, PurposeVerifyMail)
+	if err != nil {
+		return 0, "", err
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return 0, "", errors.New("invalid token")
+	}
+	return claimUserID(claims), email, nil
+}
+
+// GenerateSSONonce creates the nonce a client passes to an OpenID provider. It is
+// self-contained (signed, short-lived, bound to the provider) so no state is kept.
+func GenerateSSONonce(provider string) (string, error) {
+	return generatePurposeToken(0, PurposeSSONonce, SSONonceTTL, jwt.MapClaims{"provider": provider})
+}
+
+// ParseSSONonce verifies a nonce issued by GenerateSSONonce for provider
+func ParseSSONonce(nonce, provider string) error {
+	claims, err := parsePurposeClaims(nonce, PurposeSSONonce)
+	if err != nil {
+		return err
+	}
+	if p, _ := claims["provider"].(string); p != provider {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+func generatePurposeToken(userID int64, purpose string, ttl time.Duration, extra jwt.MapClaims) (string, error) {
+	claims := jwt.MapClaims{}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	claims["user_id"] = userID
+	claims["purpose"] = purpose
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	return sign(claims)
+}
+
+func parsePurposeToken(tokenStr, purpose string) (int64, error) {
+	claims, err := parsePurposeClaims(tokenStr, purpose)
 	if err != nil {
 		return 0, err
 	}
+	return claimUserID(claims), nil
+}
+
+func parsePurposeClaims(tokenStr, purpose string) (jwt.MapClaims, error) {
+	claims, err := parse(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if p, _ := claims["purpose"].(string); p != purpose {
+		return nil, errors.New("invalid token purpose")
+	}
+	return claims, nil
+}
+
+func parse(tokenStr string) (jwt.MapClaims, error) {
+	ks, err := currentKeys()
+	if err != nil {
+		return nil, err
+	}
+	t, err := jwt.Parse(tokenStr, ks.keyFunc)
+	if err != nil {
+		return nil, err
+	}
 	if claims, ok := t.Claims.(jwt.MapClaims); ok && t.Valid {
-		if purpose, _ := claims["purpose"].(string); purpose != "reset" {
-			return 0, errors.New("invalid token purpose")
-		}
-		var uid int64
-		switch v := claims["user_id"].(type) {
-		case float64:
-			uid = int64(v)
-		case int64:
-			uid = v
-		}
-		return uid, nil
+		return claims, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+func claimUserID(claims map[string]interface{}) int64 {
+	switch v := claims["user_id"].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
 	}
-	return 0, errors.New("invalid token")
+	return 0
 }
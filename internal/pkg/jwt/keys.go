@@ -0,0 +1,276 @@
+package jwtpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key configuration (see README "JWT signing keys"):
+//
+//	JWT_PRIVATE_KEY_FILE  PEM private key (RSA or Ed25519) used to sign tokens.
+//	                      Only the auth service needs it.
+//	JWT_KEY_ID            kid of the signing key (default: private key file name
+//	                      without extension).
+//	JWT_PUBLIC_KEYS_DIR   directory of PEM public keys accepted for verification;
+//	                      the kid of each key is its file name without extension.
+//	JWT_ACCEPT_HS256      "true" keeps accepting legacy HS256 tokens signed with
+//	                      JWT_SECRET while migrating to asymmetric keys.
+//
+// When neither JWT_PRIVATE_KEY_FILE nor JWT_PUBLIC_KEYS_DIR is set, tokens are
+// signed and verified with HS256 and JWT_SECRET (legacy mode). JWT_SECRET has no
+// default: without it HS256 cannot be used and LoadKeys fails.
+type keyStore struct {
+	method     jwt.SigningMethod
+	signKID    string
+	signKey    interface{}            // *rsa.PrivateKey or ed25519.PrivateKey
+	verify     map[string]interface{} // kid -> *rsa.PublicKey or ed25519.PublicKey
+	acceptHMAC bool
+	// secret is JWT_SECRET, set in legacy mode and with acceptHMAC
+	secret []byte
+}
+
+// ErrNoSecret is returned by LoadKeys when HS256 is in use without JWT_SECRET
+var ErrNoSecret = errors.New("JWT_SECRET is required for HS256 tokens (or configure JWT_PRIVATE_KEY_FILE/JWT_PUBLIC_KEYS_DIR)")
+
+var (
+	keysOnce sync.Once
+	keys     *keyStore
+	keysErr  error
+)
+
+// LoadKeys reads the key configuration from the environment. It is called lazily
+// by the token functions; services call it at startup to fail fast on bad config.
+func LoadKeys() error {
+	keysOnce.Do(func() {
+		keys, keysErr = loadKeysFromEnv()
+	})
+	return keysErr
+}
+
+func currentKeys() (*keyStore, error) {
+	if err := LoadKeys(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (ks *keyStore) asymmetric() bool {
+	return ks.signKey != nil || len(ks.verify) > 0
+}
+
+func loadKeysFromEnv() (*keyStore, error) {
+	ks := &keyStore{verify: map[string]interface{}{}, acceptHMAC: os.Getenv("JWT_ACCEPT_HS256") == "true"}
+
+	if dir := os.Getenv("JWT_PUBLIC_KEYS_DIR"); dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			pub, err := readPublicKey(f)
+			if err != nil {
+				return nil, fmt.Errorf("jwt public key %s: %w", f, err)
+			}
+			ks.verify[kidFromFile(f)] = pub
+		}
+	}
+
+	if f := os.Getenv("JWT_PRIVATE_KEY_FILE"); f != "" {
+		priv, err := readPrivateKey(f)
+		if err != nil {
+			return nil, fmt.Errorf("jwt private key %s: %w", f, err)
+		}
+		kid := os.Getenv("JWT_KEY_ID")
+		if kid == "" {
+			kid = kidFromFile(f)
+		}
+		ks.signKID = kid
+		ks.signKey = priv
+		switch k := priv.(type) {
+		case *rsa.PrivateKey:
+			ks.method = jwt.SigningMethodRS256
+			ks.verify[kid] = &k.PublicKey
+		case ed25519.PrivateKey:
+			ks.method = jwt.SigningMethodEdDSA
+			ks.verify[kid] = k.Public()
+		}
+	}
+
+	if !ks.asymmetric() || ks.acceptHMAC {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			return nil, ErrNoSecret
+		}
+		ks.secret = []byte(secret)
+	}
+	if !ks.asymmetric() {
+		ks.method = jwt.SigningMethodHS256
+	}
+	return ks, nil
+}
+
+func kidFromFile(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		switch k := k.(type) {
+		case *rsa.PrivateKey, ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, errors.New("unsupported private key type (want RSA or Ed25519)")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("unsupported private key encoding")
+}
+
+func readPublicKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		switch k := k.(type) {
+		case *rsa.PublicKey, ed25519.PublicKey:
+			return k, nil
+		}
+		return nil, errors.New("unsupported public key type (want RSA or Ed25519)")
+	}
+	if k, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("unsupported public key encoding")
+}
+
+// sign signs claims with the active key, adding the kid header in asymmetric mode
+func sign(claims jwt.MapClaims) (string, error) {
+	ks, err := currentKeys()
+	if err != nil {
+		return "", err
+	}
+	if !ks.asymmetric() {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.secret)
+	}
+	if ks.signKey == nil {
+		return "", errors.New("no JWT signing key configured")
+	}
+	t := jwt.NewWithClaims(ks.method, claims)
+	t.Header["kid"] = ks.signKID
+	return t.SignedString(ks.signKey)
+}
+
+// keyFunc selects the verification key by kid and checks the algorithm matches its type
+func (ks *keyStore) keyFunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if ks.asymmetric() && !ks.acceptHMAC {
+			return nil, errors.New("unexpected signing method")
+		}
+		return ks.secret, nil
+	}
+	if !ks.asymmetric() {
+		return nil, errors.New("unexpected signing method")
+	}
+	kid, _ := t.Header["kid"].(string)
+	key, ok := ks.verify[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+	case ed25519.PublicKey:
+		if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+	}
+	return key, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP (Ed25519)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns all verification keys. In legacy HS256 mode the set is empty
+// because the shared secret must never be published.
+func JWKS() (JWKSet, error) {
+	ks, err := currentKeys()
+	if err != nil {
+		return JWKSet{}, err
+	}
+	set := JWKSet{Keys: []JWK{}}
+	kids := make([]string, 0, len(ks.verify))
+	for kid := range ks.verify {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		switch k := ks.verify[kid].(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA", Use: "sig", Alg: "RS256", Kid: kid,
+				N: b64(k.N.Bytes()),
+				E: b64(big.NewInt(int64(k.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP", Use: "sig", Alg: "EdDSA", Kid: kid,
+				Crv: "Ed25519", X: b64(k),
+			})
+		}
+	}
+	return set, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,154 @@
+package jwtpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Exit(m.Run())
+}
+
+// useKeys replaces the process key store for the duration of a test
+func useKeys(t *testing.T, ks *keyStore) {
+	t.Helper()
+	LoadKeys()
+	prev := keys
+	keys = ks
+	t.Cleanup(func() { keys = prev })
+}
+
+func TestAsymmetricKeysAndRotation(t *testing.T) {
+	dir := t.TempDir()
+	pubDir := filepath.Join(dir, "public")
+	os.Mkdir(pubDir, 0700)
+
+	// key 2026-01: Ed25519
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edPriv)
+	writePEM(t, filepath.Join(dir, "2026-01.key"), "PRIVATE KEY", der)
+	der, _ = x509.MarshalPKIXPublicKey(edPub)
+	writePEM(t, filepath.Join(pubDir, "2026-01.pem"), "PUBLIC KEY", der)
+
+	// key 2026-07: RSA
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writePEM(t, filepath.Join(dir, "2026-07.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	der, _ = x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	writePEM(t, filepath.Join(pubDir, "2026-07.pem"), "PUBLIC KEY", der)
+
+	t.Setenv("JWT_PUBLIC_KEYS_DIR", pubDir)
+
+	// 1) auth signs with the old key
+	t.Setenv("JWT_PRIVATE_KEY_FILE", filepath.Join(dir, "2026-01.key"))
+	ks, err := loadKeysFromEnv()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	useKeys(t, ks)
+	oldToken, err := GenerateToken(1, "admin")
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if uid, role, err := ParseToken(oldToken); err != nil || uid != 1 || role != "admin" {
+		t.Fatalf("parse: uid=%d role=%q err=%v", uid, role, err)
+	}
+	set, _ := JWKS()
+	if len(set.Keys) != 2 || set.Keys[0].Kid != "2026-01" || set.Keys[0].Kty != "OKP" || set.Keys[1].Kty != "RSA" {
+		t.Fatalf("unexpected jwks: %+v", set)
+	}
+
+	// 2) rotate: auth signs with the new key, old tokens remain valid
+	t.Setenv("JWT_PRIVATE_KEY_FILE", filepath.Join(dir, "2026-07.key"))
+	ks, err = loadKeysFromEnv()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	useKeys(t, ks)
+	newToken, err := GenerateToken(2, "user")
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(newToken, jwt.MapClaims{})
+	if parsed.Header["kid"] != "2026-07" || parsed.Method.Alg() != "RS256" {
+		t.Fatalf("unexpected header: %v", parsed.Header)
+	}
+	if _, _, err := ParseToken(oldToken); err != nil {
+		t.Fatalf("old token should still verify: %v", err)
+	}
+
+	// 3) a verify-only service (public keys, no private key) accepts both but cannot sign
+	os.Unsetenv("JWT_PRIVATE_KEY_FILE")
+	ks, err = loadKeysFromEnv()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	useKeys(t, ks)
+	if _, _, err := ParseToken(newToken); err != nil {
+		t.Fatalf("verify-only parse: %v", err)
+	}
+	if _, err := GenerateToken(3, "user"); err == nil {
+		t.Fatalf("expected signing to fail without private key")
+	}
+
+	// 4) once the old public key is removed, its tokens are rejected
+	os.Remove(filepath.Join(pubDir, "2026-01.pem"))
+	ks, _ = loadKeysFromEnv()
+	useKeys(t, ks)
+	if _, _, err := ParseToken(oldToken); err == nil {
+		t.Fatalf("expected token with retired kid rejected")
+	}
+
+	// 5) HS256 tokens are rejected in asymmetric mode unless explicitly allowed
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 1, "role": "admin"}).SignedString([]byte(os.Getenv("JWT_SECRET")))
+	if _, _, err := ParseToken(legacy); err == nil {
+		t.Fatalf("expected HS256 token rejected")
+	}
+	t.Setenv("JWT_ACCEPT_HS256", "true")
+	ks, err = loadKeysFromEnv()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	useKeys(t, ks)
+	if _, _, err := ParseToken(legacy); err != nil {
+		t.Fatalf("expected HS256 accepted during migration: %v", err)
+	}
+}
+
+func TestLoadKeys_RequiresSecretForHS256(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_PRIVATE_KEY_FILE", "")
+	t.Setenv("JWT_PUBLIC_KEYS_DIR", "")
+	if _, err := loadKeysFromEnv(); err != ErrNoSecret {
+		t.Fatalf("expected legacy mode without JWT_SECRET refused, got %v", err)
+	}
+
+	// accepting HS256 during migration needs the secret too
+	dir := t.TempDir()
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	writePEM(t, filepath.Join(dir, "2026-01.pem"), "PUBLIC KEY", der)
+	t.Setenv("JWT_PUBLIC_KEYS_DIR", dir)
+	if _, err := loadKeysFromEnv(); err != nil {
+		t.Fatalf("expected public keys alone accepted, got %v", err)
+	}
+	t.Setenv("JWT_ACCEPT_HS256", "true")
+	if _, err := loadKeysFromEnv(); err != ErrNoSecret {
+		t.Fatalf("expected JWT_ACCEPT_HS256 without JWT_SECRET refused, got %v", err)
+	}
+}
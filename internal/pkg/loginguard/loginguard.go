@@ -0,0 +1,454 @@
+package loginguard
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/ms-ecommerce/internal/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+// Scopes of failed-attempt tracking
+const (
+	ScopeAccount = "account"
+	ScopeIP      = "ip"
+	// ScopeMFA counts a user's attempts at a second factor (TOTP or recovery code)
+	ScopeMFA = "mfa"
+)
+
+// Config controls delays and lockouts. Failures are counted per account (email)
+// and per client IP within Window.
+type Config struct {
+	Window time.Duration
+	// FreeAttempts failures are allowed before delays start
+	FreeAttempts int64
+	// BaseDelay doubles with every further failure, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxAccountFailures/MaxIPFailures lock the account/IP for LockDuration
+	MaxAccountFailures int64
+	MaxIPFailures      int64
+	LockDuration       time.Duration
+	// MaxMFATokenFailures attempts void an mfa_pending token (the user has to
+	// enter the password again); MaxMFAFailures attempts without a success lock
+	// the user's second factor for LockDuration
+	MaxMFATokenFailures int64
+	MaxMFAFailures      int64
+}
+
+// DefaultConfig is used for settings not given in the environment
+var DefaultConfig = Config{
+	Window:              15 * time.Minute,
+	FreeAttempts:        3,
+	BaseDelay:           500 * time.Millisecond,
+	MaxDelay:            8 * time.Second,
+	MaxAccountFailures:  10,
+	MaxIPFailures:       50,
+	LockDuration:        15 * time.Minute,
+	MaxMFATokenFailures: 5,
+	MaxMFAFailures:      10,
+}
+
+// LockedError is returned by Check while an account or IP is locked out
+type LockedError struct {
+	Scope      string
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// Store keeps counters and locks. Redis shares them between auth replicas.
+type Store interface {
+	// Incr increments key, starting a new window of the given length if it is absent
+	Incr(key string, window time.Duration) (int64, error)
+	Get(key string) (int64, error)
+	// Set creates key with a time to live (used for locks)
+	Set(key string, ttl time.Duration) error
+	// TTL is the remaining lifetime of key, <= 0 if it does not exist
+	TTL(key string) (time.Duration, error)
+	Delete(keys ...string) error
+}
+
+// Guard tracks failed logins. Store errors are logged and never block a login,
+// so a Redis outage degrades protection instead of locking everyone out.
+type Guard struct {
+	store Store
+	cfg   Config
+}
+
+func New(store Store, cfg Config) *Guard {
+	return &Guard{store: store, cfg: cfg}
+}
+
+// NewFromEnv uses Redis (REDIS_HOST/REDIS_PORT) when available, otherwise an
+// in-memory store. Limits can be tuned with LOGIN_FAILURE_WINDOW,
+// LOGIN_FREE_ATTEMPTS, LOGIN_MAX_ACCOUNT_FAILURES, LOGIN_MAX_IP_FAILURES,
+// LOGIN_LOCK_DURATION, MFA_MAX_TOKEN_FAILURES and MFA_MAX_FAILURES.
+func NewFromEnv() *Guard {
+	cfg := DefaultConfig
+	cfg.Window = envDuration("LOGIN_FAILURE_WINDOW", cfg.Window)
+	cfg.FreeAttempts = envInt("LOGIN_FREE_ATTEMPTS", cfg.FreeAttempts)
+	cfg.MaxAccountFailures = envInt("LOGIN_MAX_ACCOUNT_FAILURES", cfg.MaxAccountFailures)
+	cfg.MaxIPFailures = envInt("LOGIN_MAX_IP_FAILURES", cfg.MaxIPFailures)
+	cfg.LockDuration = envDuration("LOGIN_LOCK_DURATION", cfg.LockDuration)
+	cfg.MaxMFATokenFailures = envInt("MFA_MAX_TOKEN_FAILURES", cfg.MaxMFATokenFailures)
+	cfg.MaxMFAFailures = envInt("MFA_MAX_FAILURES", cfg.MaxMFAFailures)
+
+	client, err := db.NewRedis()
+	if err != nil {
+		log.Printf("loginguard: redis unavailable, using in-memory counters: %v", err)
+		return New(NewMemoryStore(), cfg)
+	}
+	return New(NewRedisStore(db.NewRedisCache(client)), cfg)
+}
+
+func failKey(scope, id string) string { return "loginguard:fail:" + scope + ":" + id }
+func lockKey(scope, id string) string { return "loginguard:lock:" + scope + ":" + id }
+
+// normalizeAccount makes "User@Example.com " and "user@example.com" one account
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+// Check returns a *LockedError if the account or the IP is locked out
+func (g *Guard) Check(account, ip string) error {
+	for _, s := range g.subjects(account, ip) {
+		ttl, err := g.store.TTL(lockKey(s.scope, s.id))
+		if err != nil {
+			log.Printf("loginguard: lock lookup failed: %v", err)
+			continue
+		}
+		if ttl > 0 {
+			return &LockedError{Scope: s.scope, RetryAfter: ttl}
+		}
+	}
+	return nil
+}
+
+// Delay is how long to wait before checking the password, growing with the
+// number of recent failures for the account or IP
+func (g *Guard) Delay(account, ip string) time.Duration {
+	var failures int64
+	for _, s := range g.subjects(account, ip) {
+		n, err := g.store.Get(failKey(s.scope, s.id))
+		if err != nil {
+			log.Printf("loginguard: counter lookup failed: %v", err)
+			continue
+		}
+		// IPs get more free attempts: many users may share one address
+		if s.scope == ScopeIP && g.cfg.MaxAccountFailures > 0 {
+			n = n * g.cfg.MaxAccountFailures / max(g.cfg.MaxIPFailures, 1)
+		}
+		failures = max(failures, n)
+	}
+	extra := failures - g.cfg.FreeAttempts
+	if extra <= 0 {
+		return 0
+	}
+	d := g.cfg.BaseDelay
+	for i := int64(1); i < extra && d < g.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, g.cfg.MaxDelay)
+}
+
+// Failure records a failed attempt and returns the scopes that became locked
+func (g *Guard) Failure(account, ip string) []string {
+	var locked []string
+	for _, s := range g.subjects(account, ip) {
+		n, err := g.store.Incr(failKey(s.scope, s.id), g.cfg.Window)
+		if err != nil {
+			log.Printf("loginguard: counter update failed: %v", err)
+			continue
+		}
+		limit := g.cfg.MaxAccountFailures
+		if s.scope == ScopeIP {
+			limit = g.cfg.MaxIPFailures
+		}
+		if limit > 0 && n >= limit {
+			if err := g.store.Set(lockKey(s.scope, s.id), g.cfg.LockDuration); err != nil {
+				log.Printf("loginguard: lock failed: %v", err)
+				continue
+			}
+			// start counting afresh once the lock expires
+			_ = g.store.Delete(failKey(s.scope, s.id))
+			locked = append(locked, s.scope)
+		}
+	}
+	return locked
+}
+
+// Success clears the account's failures. The IP counter is kept so that one valid
+// account cannot be used to reset an attacker's budget.
+func (g *Guard) Success(account string) {
+	if err := g.store.Delete(failKey(ScopeAccount, normalizeAccount(account))); err != nil {
+		log.Printf("loginguard: reset failed: %v", err)
+	}
+}
+
+// Unlock lifts an account lockout and clears its failures (admin action)
+func (g *Guard) Unlock(account string) error {
+	a := normalizeAccount(account)
+	return g.store.Delete(lockKey(ScopeAccount, a), failKey(ScopeAccount, a))
+}
+
+// ErrMFATokenSpent is returned by MFAAttempt for an mfa_pending token that was
+// already used or had too many wrong codes
+var ErrMFATokenSpent = errors.New("invalid or expired mfa token")
+
+func mfaTokenKey(tokenID string) string { return "loginguard:mfa-token:" + tokenID }
+func mfaSpentKey(tokenID string) string { return "loginguard:mfa-spent:" + tokenID }
+
+// MFAAttempt claims an attempt at a second factor with the mfa_pending token
+// tokenID, valid for ttl, before the code is checked. Counting attempts rather
+// than failures keeps concurrent guesses within the limits. It returns
+// ErrMFATokenSpent once the token was used or had MaxMFATokenFailures attempts,
+// and a *LockedError while the user's second factor is locked after
+// MaxMFAFailures attempts without a success. A correct password does not reset
+// these counters; MFASuccess does.
+func (g *Guard) MFAAttempt(userID int64, tokenID string, ttl time.Duration) error {
+	id := strconv.FormatInt(userID, 10)
+	if err := g.mfaLocked(id); err != nil {
+		return err
+	}
+	if ttl, err := g.store.TTL(mfaSpentKey(tokenID)); err != nil {
+		log.Printf("loginguard: lock lookup failed: %v", err)
+	} else if ttl > 0 {
+		return ErrMFATokenSpent
+	}
+
+	if n, err := g.store.Incr(mfaTokenKey(tokenID), ttl); err != nil {
+		log.Printf("loginguard: counter update failed: %v", err)
+	} else if g.cfg.MaxMFATokenFailures > 0 && n > g.cfg.MaxMFATokenFailures {
+		g.spendMFAToken(tokenID, ttl)
+		return ErrMFATokenSpent
+	}
+	return g.countMFAAttempt(id)
+}
+
+// UserMFAAttempt claims an attempt at the second factor of a signed in user
+// (confirming or disabling 2FA) before the code is checked. It shares the
+// per-user limit of MFAAttempt, so a stolen access token cannot be used to
+// guess codes either.
+func (g *Guard) UserMFAAttempt(userID int64) error {
+	id := strconv.FormatInt(userID, 10)
+	if err := g.mfaLocked(id); err != nil {
+		return err
+	}
+	return g.countMFAAttempt(id)
+}
+
+// mfaLocked returns a *LockedError while the user's second factor is locked
+func (g *Guard) mfaLocked(id string) error {
+	if ttl, err := g.store.TTL(lockKey(ScopeMFA, id)); err != nil {
+		log.Printf("loginguard: lock lookup failed: %v", err)
+	} else if ttl > 0 {
+		return &LockedError{Scope: ScopeMFA, RetryAfter: ttl}
+	}
+	return nil
+}
+
+// countMFAAttempt counts an attempt at the user's second factor and locks it
+// after MaxMFAFailures attempts without a success
+func (g *Guard) countMFAAttempt(id string) error {
+	n, err := g.store.Incr(failKey(ScopeMFA, id), g.cfg.Window)
+	if err != nil {
+		log.Printf("loginguard: counter update failed: %v", err)
+		return nil
+	}
+	if g.cfg.MaxMFAFailures > 0 && n > g.cfg.MaxMFAFailures {
+		if err := g.store.Set(lockKey(ScopeMFA, id), g.cfg.LockDuration); err != nil {
+			log.Printf("loginguard: lock failed: %v", err)
+			return nil
+		}
+		_ = g.store.Delete(failKey(ScopeMFA, id))
+		return &LockedError{Scope: ScopeMFA, RetryAfter: g.cfg.LockDuration}
+	}
+	return nil
+}
+
+// MFASuccess spends the mfa_pending token, so it cannot be used again, and
+// clears the user's second factor attempts
+func (g *Guard) MFASuccess(userID int64, tokenID string, ttl time.Duration) {
+	g.spendMFAToken(tokenID, ttl)
+	g.UserMFASuccess(userID)
+}
+
+// UserMFASuccess clears the user's second factor attempts
+func (g *Guard) UserMFASuccess(userID int64) {
+	if err := g.store.Delete(failKey(ScopeMFA, strconv.FormatInt(userID, 10))); err != nil {
+		log.Printf("loginguard: reset failed: %v", err)
+	}
+}
+
+// spendMFAToken voids an mfa_pending token for the rest of its lifetime ttl
+func (g *Guard) spendMFAToken(tokenID string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if err := g.store.Set(mfaSpentKey(tokenID), ttl); err != nil {
+		log.Printf("loginguard: lock failed: %v", err)
+	}
+	_ = g.store.Delete(mfaTokenKey(tokenID))
+}
+
+type subject struct{ scope, id string }
+
+func (g *Guard) subjects(account, ip string) []subject {
+	var out []subject
+	if a := normalizeAccount(account); a != "" {
+		out = append(out, subject{ScopeAccount, a})
+	}
+	if ip != "" {
+		out = append(out, subject{ScopeIP, ip})
+	}
+	return out
+}
+
+func envInt(key string, fallback int64) int64 {
+	if v, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+type redisStore struct {
+	cache *db.RedisCache
+}
+
+func NewRedisStore(cache *db.RedisCache) Store {
+	return &redisStore{cache: cache}
+}
+
+func (s *redisStore) Incr(key string, window time.Duration) (int64, error) {
+	return s.cache.Incr(key, window)
+}
+
+func (s *redisStore) Get(key string) (int64, error) {
+	v, err := s.cache.Get(key)
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (s *redisStore) Set(key string, ttl time.Duration) error {
+	return s.cache.Set(key, "1", ttl)
+}
+
+func (s *redisStore) TTL(key string) (time.Duration, error) {
+	return s.cache.TTL(key)
+}
+
+func (s *redisStore) Delete(keys ...string) error {
+	for _, k := range keys {
+		if err := s.cache.Delete(k); err != nil {
+			return fmt.Errorf("delete %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+type memoryEntry struct {
+	count     int64
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	pruned  time.Time
+}
+
+// NewMemoryStore returns a process-local store (tests, or when Redis is down)
+func NewMemoryStore() Store {
+	return &memoryStore{entries: map[string]memoryEntry{}}
+}
+
+// live returns the entry for key if it has not expired; callers hold s.mu
+func (s *memoryStore) live(key string) (memoryEntry, bool) {
+	e, ok := s.entries[key]
+	if ok && time.Now().After(e.expiresAt) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+func (s *memoryStore) Incr(key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	e, ok := s.live(key)
+	if !ok {
+		e = memoryEntry{expiresAt: time.Now().Add(window)}
+	}
+	e.count++
+	s.entries[key] = e
+	return e.count, nil
+}
+
+// prune drops expired entries at most once a minute; callers hold s.mu
+func (s *memoryStore) prune() {
+	now := time.Now()
+	if now.Sub(s.pruned) < time.Minute {
+		return
+	}
+	s.pruned = now
+	for k, e := range s.entries {
+		if now.After(e.expiresAt) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func (s *memoryStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, _ := s.live(key)
+	return e.count, nil
+}
+
+func (s *memoryStore) Set(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryEntry{count: 1, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) TTL(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.live(key)
+	if !ok {
+		return 0, nil
+	}
+	return time.Until(e.expiresAt), nil
+}
+
+func (s *memoryStore) Delete(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		delete(s.entries, k)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Mailer delivers messages. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// NewFromEnv picks an implementation from MAIL_DRIVER:
+//   - "smtp": SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD, MAIL_FROM
+//   - "memory": keeps messages in memory (tests)
+//   - "file" (default): writes each message to MAIL_OUTBOX_DIR (default ./outbox)
+func NewFromEnv() Mailer {
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     getenv("SMTP_HOST", "localhost"),
+			Port:     getenv("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     getenv("MAIL_FROM", "no-reply@example.com"),
+		}
+	case "memory":
+		return NewMemoryMailer()
+	default:
+		return NewOutboxMailer(getenv("MAIL_OUTBOX_DIR", "outbox"))
+	}
+}
+
+// SMTPMailer sends mail through an SMTP relay using PLAIN auth when credentials are set
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{msg.To}, render(m.From, msg))
+}
+
+// OutboxMailer writes every message as an .eml file into a local directory.
+// Useful for development: open the file to follow verification/reset links.
+type OutboxMailer struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewOutboxMailer(dir string) *OutboxMailer {
+	return &OutboxMailer{dir: dir}
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), sanitize(msg.To))
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, render("outbox@localhost", msg), 0600); err != nil {
+		return err
+	}
+	log.Printf("mail: wrote %q for %s to %s", msg.Subject, msg.To, path)
+	return nil
+}
+
+// MemoryMailer records messages in memory
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now()
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns a copy of all messages sent so far
+func (m *MemoryMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Message, len(m.sent))
+	copy(out, m.sent)
+	return out
+}
+
+// Last returns the most recent message sent to addr
+func (m *MemoryMailer) Last(addr string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == addr {
+			return m.sent[i], true
+		}
+	}
+	return Message{}, false
+}
+
+func render(from string, msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(msg.Body)
+	return []byte(b.String())
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func getenv(k, fallback string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -6,8 +6,15 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/example/ms-ecommerce/internal/pkg/apikey"
+	"github.com/example/ms-ecommerce/internal/pkg/audit"
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	"github.com/example/ms-ecommerce/internal/pkg/introspect"
 	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+	"github.com/example/ms-ecommerce/internal/pkg/oauth"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/time/rate"
 )
@@ -25,8 +32,149 @@ const (
 	ctxUserID ctxKey = "user_id"
 	ctxRole   ctxKey = "role"
 	ctxToken  ctxKey = "token"
+
+	ctxPermissions ctxKey = "permissions"
+	ctxAPIKeyID    ctxKey = "api_key_id"
+	ctxActorID     ctxKey = "actor_id"
+	ctxClientID    ctxKey = "client_id"
 )
 
+// tokenDenylist is consulted by JWTAuth/GinJWTAuth when set (see SetDenylist)
+var tokenDenylist denylist.Denylist
+
+// SetDenylist enables access-token revocation checks. Services share revocations
+// through Redis; see denylist.NewFromEnv.
+func SetDenylist(d denylist.Denylist) {
+	tokenDenylist = d
+}
+
+// checkRevoked returns an error if the token was revoked. Denylist lookup failures
+// are logged and the token is accepted, so a Redis outage does not lock everyone out.
+func checkRevoked(c *jwtpkg.Claims) error {
+	if tokenDenylist == nil {
+		return nil
+	}
+	revoked, err := denylist.IsRevoked(tokenDenylist, c)
+	if err != nil {
+		log.Printf("denylist lookup failed: %v", err)
+		return nil
+	}
+	if revoked {
+		return errors.New("token revoked")
+	}
+	return nil
+}
+
+// introspector is asked about every token when set (see SetIntrospector)
+var introspector introspect.Introspector
+
+// SetIntrospector makes JWTAuth/GinJWTAuth also ask the auth service whether a
+// token is still active, so suspensions and revocations are enforced without
+// sharing the denylist. Use introspect.NewFromEnv; nil disables the check.
+func SetIntrospector(i introspect.Introspector) {
+	introspector = i
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// checkActive asks the introspector about token. When the auth service cannot
+// be reached or fails (5xx) the token is accepted, like on denylist failures.
+// When it refuses to answer (wrong client credentials or scope) the token is
+// rejected: enforcement must not silently turn off on a configuration error.
+func checkActive(ctx context.Context, token string) error {
+	if introspector == nil {
+		return nil
+	}
+	r, err := introspector.Introspect(ctx, token)
+	if introspect.Refused(err) {
+		log.Printf("token introspection refused, check INTROSPECTION_CLIENT_ID/INTROSPECTION_CLIENT_SECRET: %v", err)
+		return errors.New("token introspection refused")
+	}
+	if err != nil {
+		log.Printf("token introspection failed: %v", err)
+		return nil
+	}
+	if !r.Active {
+		return errors.New("token inactive")
+	}
+	return nil
+}
+
+// verifyToken checks the signature and expiry of an access token, then whether
+// it was revoked
+func verifyToken(ctx context.Context, token string) (*jwtpkg.Claims, error) {
+	claims, err := jwtpkg.ParseClaims(token)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if err := checkRevoked(claims); err != nil {
+		return nil, err
+	}
+	if err := checkActive(ctx, token); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// errInsufficientScope rejects OAuth client tokens outside their scopes (RFC 6750)
+var errInsufficientScope = errors.New("insufficient_scope")
+
+// checkScope limits tokens issued to OAuth clients to the routes their scopes
+// cover; other tokens are not limited
+func checkScope(c *jwtpkg.Claims, method, path string) error {
+	if c.ClientID == "" || oauth.Allows(c.Scopes, method, path) {
+		return nil
+	}
+	return errInsufficientScope
+}
+
+// permissionResolver maps the role of a token to its permissions (see
+// SetPermissionResolver). Until set, rbac.Defaults are used.
+var permissionResolver rbac.Resolver = rbac.NewStaticResolver(rbac.Defaults)
+
+// SetPermissionResolver sets where role permissions come from, normally
+// rbac.NewDBResolver so roles can be managed in the role_permissions table.
+func SetPermissionResolver(r rbac.Resolver) {
+	permissionResolver = r
+}
+
+// permissionsFor resolves role; lookup errors grant nothing
+func permissionsFor(role string) rbac.Permissions {
+	if role == "" {
+		return nil
+	}
+	perms, err := permissionResolver.Permissions(role)
+	if err != nil {
+		log.Printf("permission lookup for role %q failed: %v", role, err)
+		return nil
+	}
+	return perms
+}
+
+// apiKeyResolver enables X-API-Key authentication in GinJWTOrAPIKeyAuth
+var apiKeyResolver apikey.Resolver
+
+// SetAPIKeyResolver enables API key authentication, normally with
+// apikey.NewDBResolver
+func SetAPIKeyResolver(r apikey.Resolver) {
+	apiKeyResolver = r
+}
+
+// auditSink records requests made with impersonation tokens (see SetAuditSink)
+var auditSink audit.Sink = audit.NewLogSink()
+
+// SetAuditSink sets where impersonated requests are recorded, normally
+// audit.NewDBSink. Until set they are written to the service log.
+func SetAuditSink(s audit.Sink) {
+	auditSink = s
+}
+
+// RolePermissions resolves the permissions of role with the configured resolver
+// (see SetPermissionResolver)
+func RolePermissions(role string) rbac.Permissions {
+	return permissionsFor(role)
+}
+
 // RateLimit adalah middleware untuk membatasi rate request per IP
 var limiter = rate.NewLimiter(10, 20) // 10 requests/second, burst 20
 
@@ -61,15 +209,22 @@ func JWTAuth(next http.Handler) http.Handler {
 			return
 		}
 
-		userID, role, err := jwtpkg.ParseToken(token)
+		claims, err := verifyToken(r.Context(), token)
 		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := checkScope(claims, r.Method, r.URL.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), ctxUserID, userID)
-		ctx = context.WithValue(ctx, ctxRole, role)
+		ctx := context.WithValue(r.Context(), ctxUserID, claims.UserID)
+		ctx = context.WithValue(ctx, ctxRole, claims.Role)
 		ctx = context.WithValue(ctx, ctxToken, token)
+		if claims.ClientID != "" {
+			ctx = context.WithValue(ctx, ctxClientID, claims.ClientID)
+		}
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -132,6 +287,29 @@ func RequireRole(required string) func(http.Handler) http.Handler {
 	}
 }
 
+// RequirePermission checks that the injected role grants perm
+func RequirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !GetPermissions(r).Has(perm) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GetPermissions resolves the permissions of the role in context. OAuth client
+// tokens have none.
+func GetPermissions(r *http.Request) rbac.Permissions {
+	if r.Context().Value(ctxClientID) != nil {
+		return rbac.Permissions{}
+	}
+	role, _ := GetRole(r)
+	return permissionsFor(role)
+}
+
 // GetUserID extracts user id from context
 func GetUserID(r *http.Request) (int64, bool) {
 	v := r.Context().Value(ctxUserID)
@@ -164,18 +342,103 @@ func GinJWTAuth() gin.HandlerFunc {
 			return
 		}
 
-		userID, role, err := jwtpkg.ParseToken(token)
+		claims, err := verifyToken(c.Request.Context(), token)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			c.Abort()
 			return
 		}
 
-		// Set values in Gin context
-		c.Set(ctxUserID, userID)
-		c.Set(ctxRole, role)
-		c.Set(ctxToken, token)
+		ginAuthenticated(c, claims, token)
+	}
+}
 
+// ginAuthenticated stores the token's identity in the context and runs the rest
+// of the chain. Impersonated requests are written to the audit sink. OAuth client
+// tokens act as the user, limited to their scopes and without the permissions of
+// the user's role.
+func ginAuthenticated(c *gin.Context, claims *jwtpkg.Claims, token string) {
+	if err := checkScope(claims, c.Request.Method, c.Request.URL.Path); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.Set(ctxUserID, claims.UserID)
+	c.Set(ctxRole, claims.Role)
+	c.Set(ctxToken, token)
+	if claims.ClientID != "" {
+		c.Set(ctxClientID, claims.ClientID)
+		c.Set(ctxPermissions, rbac.Permissions{})
+	}
+	if claims.ActorID == 0 {
+		c.Next()
+		return
+	}
+	c.Set(ctxActorID, claims.ActorID)
+	c.Next()
+	e := audit.Entry{
+		ActorID: claims.ActorID,
+		UserID:  claims.UserID,
+		Method:  c.Request.Method,
+		Path:    c.Request.URL.Path,
+		Status:  c.Writer.Status(),
+		IP:      c.ClientIP(),
+		Time:    time.Now(),
+	}
+	if err := auditSink.Record(e); err != nil {
+		// never lose an entry: fall back to the log
+		log.Printf("audit: recording failed: %v", err)
+		_ = audit.NewLogSink().Record(e)
+	}
+}
+
+// GinJWTOrAPIKeyAuth authenticates with an X-API-Key header when one is sent
+// (see SetAPIKeyResolver), otherwise like GinJWTAuth. A key acts as its owner:
+// owner checks pass for the owner's records and its permissions are the key's
+// scopes that the owner's role still grants.
+func GinJWTOrAPIKeyAuth() gin.HandlerFunc {
+	jwtAuth := GinJWTAuth()
+	return func(c *gin.Context) {
+		key := c.GetHeader(apikey.Header)
+		if key == "" {
+			jwtAuth(c)
+			return
+		}
+		if apiKeyResolver == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "api keys are not accepted"})
+			c.Abort()
+			return
+		}
+		p, err := apiKeyResolver.Resolve(key)
+		if err != nil {
+			if errors.Is(err, apikey.ErrInvalidKey) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			} else {
+				log.Printf("api key lookup failed: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "api key lookup failed"})
+			}
+			c.Abort()
+			return
+		}
+		c.Set(ctxUserID, p.UserID)
+		c.Set(ctxRole, p.Role)
+		c.Set(ctxAPIKeyID, p.KeyID)
+		c.Set(ctxPermissions, rbac.NewPermissions(p.Scopes...).Intersect(permissionsFor(p.Role)))
+		c.Next()
+	}
+}
+
+// GinOptionalJWTAuth sets the same context values as GinJWTAuth when a valid,
+// unrevoked token is present, but never rejects the request.
+func GinOptionalJWTAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := extractTokenGin(c)
+		if err == nil {
+			if claims, err := verifyToken(c.Request.Context(), token); err == nil {
+				ginAuthenticated(c, claims, token)
+				return
+			}
+		}
 		c.Next()
 	}
 }
@@ -193,6 +456,44 @@ func GinRequireRole(required string) gin.HandlerFunc {
 	}
 }
 
+// GinBlockImpersonation rejects requests made with an impersonation token, for
+// operations only the account holder may perform (credentials, 2FA, ...)
+func GinBlockImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := GinGetActor(c); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not allowed while impersonating"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GinRequirePermission checks that the role of the authenticated user grants perm
+func GinRequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !GinGetPermissions(c).Has(perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GinGetPermissions resolves the permissions of the authenticated user's role.
+// The result is kept in the context for the rest of the request.
+func GinGetPermissions(c *gin.Context) rbac.Permissions {
+	if v, exists := c.Get(ctxPermissions); exists {
+		perms, _ := v.(rbac.Permissions)
+		return perms
+	}
+	role, _ := GinGetRole(c)
+	perms := permissionsFor(role)
+	c.Set(ctxPermissions, perms)
+	return perms
+}
+
 // extractTokenGin extracts token from Gin context
 func extractTokenGin(c *gin.Context) (string, error) {
 	// 1️⃣ Try Authorization Header
@@ -243,3 +544,44 @@ func GinGetRole(c *gin.Context) (string, bool) {
 	s, ok := v.(string)
 	return s, ok
 }
+
+// GinGetAPIKeyID returns the API key the request authenticated with, if any
+func GinGetAPIKeyID(c *gin.Context) (int64, bool) {
+	v, exists := c.Get(ctxAPIKeyID)
+	if !exists {
+		return 0, false
+	}
+	id, ok := v.(int64)
+	return id, ok
+}
+
+// GinGetActor returns the staff member acting as the authenticated user when the
+// request uses an impersonation token
+func GinGetActor(c *gin.Context) (int64, bool) {
+	v, exists := c.Get(ctxActorID)
+	if !exists {
+		return 0, false
+	}
+	id, ok := v.(int64)
+	return id, ok
+}
+
+// GinGetClientID returns the OAuth client the request's token was issued to
+func GinGetClientID(c *gin.Context) (string, bool) {
+	v, exists := c.Get(ctxClientID)
+	if !exists {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// GinGetToken returns the raw access token of the authenticated request
+func GinGetToken(c *gin.Context) (string, bool) {
+	v, exists := c.Get(ctxToken)
+	if !exists {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/example/ms-ecommerce/internal/pkg/introspect"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Exit(m.Run())
+}
+
+// fakeIntrospector answers from a fixed set of active tokens, or fails
+type fakeIntrospector struct {
+	active map[string]bool
+	err    error
+	calls  int
+}
+
+func (f *fakeIntrospector) Introspect(ctx context.Context, token string) (*introspect.Result, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &introspect.Result{Active: f.active[token]}, nil
+}
+
+func serveWithAuth(t *testing.T, mw gin.HandlerFunc, method, path string, header http.Header) int {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(method, path, mw, func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestGinJWTAuth_AsksIntrospector(t *testing.T) {
+	active, err := jwtpkg.GenerateVersionedToken(5, "user", 1)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	suspended, _ := jwtpkg.GenerateVersionedToken(6, "user", 1)
+	fake := &fakeIntrospector{active: map[string]bool{active: true}}
+	SetIntrospector(fake)
+	defer SetIntrospector(nil)
+
+	if code := serveWithAuth(t, GinJWTAuth(), http.MethodGet, "/api/v1/products", bearer(active)); code != http.StatusOK {
+		t.Fatalf("expected active token accepted, got %d", code)
+	}
+	if code := serveWithAuth(t, GinJWTAuth(), http.MethodGet, "/api/v1/products", bearer(suspended)); code != http.StatusUnauthorized {
+		t.Fatalf("expected inactive token rejected, got %d", code)
+	}
+	if fake.calls != 2 {
+		t.Fatalf("expected every token introspected, got %d calls", fake.calls)
+	}
+
+	// the auth service being down must not lock everyone out
+	fake.err = errors.New("connection refused")
+	if code := serveWithAuth(t, GinJWTAuth(), http.MethodGet, "/api/v1/products", bearer(suspended)); code != http.StatusOK {
+		t.Fatalf("expected token accepted when introspection fails, got %d", code)
+	}
+	fake.err = &introspect.StatusError{Status: http.StatusBadGateway}
+	if code := serveWithAuth(t, GinJWTAuth(), http.MethodGet, "/api/v1/products", bearer(active)); code != http.StatusOK {
+		t.Fatalf("expected token accepted when the auth service fails, got %d", code)
+	}
+	// but wrong client credentials must not turn enforcement off
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		fake.err = &introspect.StatusError{Status: status}
+		if code := serveWithAuth(t, GinJWTAuth(), http.MethodGet, "/api/v1/products", bearer(active)); code != http.StatusUnauthorized {
+			t.Fatalf("expected token rejected when introspection is refused with %d, got %d", status, code)
+		}
+	}
+	fake.err = nil
+
+	// a forged token is rejected before the auth service is asked
+	fake.calls = 0
+	if code := serveWithAuth(t, GinJWTAuth(), http.MethodGet, "/api/v1/products", bearer(active+"x")); code != http.StatusUnauthorized || fake.calls != 0 {
+		t.Fatalf("expected invalid signature rejected locally, got %d after %d calls", code, fake.calls)
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetTrustedProxiesFromEnv decides which peers may report the client address
+// (X-Forwarded-For, X-Real-IP) that c.ClientIP() returns, and with it the key
+// of per-IP login counters and audit entries. TRUSTED_PROXIES is a comma
+// separated list of IPs or CIDRs, e.g. the network of the nginx container; by
+// default no proxy is trusted and the TCP peer address is used, so clients
+// cannot pick their own address. TRUSTED_PLATFORM names a header that the
+// platform in front of the services always overwrites (gin.PlatformCloudflare,
+// gin.PlatformGoogleAppEngine or e.g. X-Real-IP); only set it when the
+// services cannot be reached without going through that platform.
+func SetTrustedProxiesFromEnv(r *gin.Engine) error {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+	r.TrustedPlatform = strings.TrimSpace(os.Getenv("TRUSTED_PLATFORM"))
+	return nil
+}
@@ -3,15 +3,159 @@ package models
 import "time"
 
 type User struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Phone     string    `json:"phone"`
-	Password  string    `json:"-"`
-	Role      string    `json:"role"`
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	Phone           string     `json:"phone"`
+	Password        string     `json:"-"`
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Status          string     `json:"status"`
+	TokenVersion    int64      `json:"-"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// Account statuses (users.status). Only active accounts may sign in; any other
+// status blocks login, token refresh and API keys.
+const (
+	UserStatusActive = "active"
+	// UserStatusSuspended accounts are kept as they are and can be reactivated
+	UserStatusSuspended = "suspended"
+	// UserStatusDeleted accounts are anonymized; their order history is kept
+	UserStatusDeleted = "deleted"
+)
+
+// UserMFA holds a user's TOTP enrollment. Secret is never serialized.
+type UserMFA struct {
+	UserID       int64     `json:"user_id"`
+	Secret       string    `json:"-"`
+	Enabled      bool      `json:"enabled"`
+	LastUsedStep int64     `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// RefreshToken is a stored (hashed) refresh token. Tokens rotated from the same
+// login share a FamilyID, which is also the session ID.
+type RefreshToken struct {
+	ID               int64      `json:"id"`
+	UserID           int64      `json:"user_id"`
+	TokenHash        string     `json:"-"`
+	FamilyID         string     `json:"family_id"`
+	ParentID         *int64     `json:"parent_id,omitempty"`
+	RotatedAt        *time.Time `json:"rotated_at,omitempty"`
+	UserAgent        string     `json:"user_agent"`
+	IPAddress        string     `json:"ip_address"`
+	SessionCreatedAt time.Time  `json:"session_created_at"`
+	// ClientID is the OAuth client holding the token, limited to Scopes; ""
+	// for sessions of our own apps
+	ClientID  string    `json:"client_id,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Session is a login session (a refresh token family) as shown to users
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int64     `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// login_tokens.channel: passwordless logins, and confirmations of a new email
+// address or phone number (the token's Destination is the new value)
+const (
+	LoginChannelEmail  = "email"
+	LoginChannelSMS    = "sms"
+	ChannelEmailChange = "email_change"
+	ChannelPhoneChange = "phone_change"
+)
+
+// LoginToken is a single-use link or code sent to Destination; only its hash
+// is stored
+type LoginToken struct {
+	ID          int64
+	UserID      int64
+	Channel     string
+	Destination string
+	TokenHash   string
+	// Attempts counts wrong codes entered for this token
+	Attempts  int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// OAuth grant types a client can be allowed to use. Refresh tokens are issued
+// with the authorization code grant.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// OAuthClient is a registered partner app. Confidential clients authenticate
+// with a secret, of which only the hash is stored; public clients (mobile and
+// browser apps) rely on PKCE alone.
+type OAuthClient struct {
+	ID         int64  `json:"id"`
+	ClientID   string `json:"client_id"`
+	SecretHash string `json:"-"`
+	Name       string `json:"name"`
+	// OwnerID is the account client_credentials tokens act as
+	OwnerID      int64      `json:"owner_id"`
+	RedirectURIs []string   `json:"redirect_uris"`
+	Scopes       []string   `json:"scopes"`
+	GrantTypes   []string   `json:"grant_types"`
+	Confidential bool       `json:"confidential"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// OAuthCode is a single-use authorization code; only its hash is stored
+type OAuthCode struct {
+	ID            int64
+	CodeHash      string
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	// FamilyID is the refresh token family issued for the code, revoked if the
+	// code is presented again
+	FamilyID  string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// OAuthConsent records the scopes a user granted a client
+type OAuthConsent struct {
+	UserID     int64     `json:"user_id"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// APIKey is an API key as shown to its owner; the key itself is only returned
+// when it is created
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
 type Store struct {
 	ID        int64     `json:"id"`
 	UserID    int64     `json:"user_id"`
@@ -28,7 +172,75 @@ type Product struct {
 	Price       float64   `json:"price"`
 	Stock       int       `json:"stock"`
 	ImageURL    string    `json:"image_url"`
+	Published   bool      `json:"published"`
+	Rating      float64   `json:"rating"` // average out of 5, 0 while unrated
 	CreatedAt   time.Time `json:"created_at"`
+	// Options and Variants are set for products sold in several variants
+	Options  []*ProductOption  `json:"options,omitempty"`
+	Variants []*ProductVariant `json:"variants,omitempty"`
+	// Images in display order; ImageURL is the primary one
+	Images []*ProductImage `json:"images,omitempty"`
+	// Highlights are the name and description with the words matching a search
+	// query in <em>, HTML escaped
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// ProductImage is an image of a product. Exactly one image of a product with
+// images is primary.
+type ProductImage struct {
+	ID        int64     `json:"id"`
+	ProductID int64     `json:"product_id"`
+	URL       string    `json:"url"`
+	AltText   string    `json:"alt_text"`
+	Position  int       `json:"position"`
+	Primary   bool      `json:"is_primary"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ProductFacets are the numbers of products matching a product list's filters
+// per category, store and price range. Each facet ignores its own filter, so it
+// also counts the values not selected.
+type ProductFacets struct {
+	Categories []*FacetCount `json:"categories"`
+	Stores     []*FacetCount `json:"stores"`
+	Prices     []*PriceFacet `json:"prices"`
+}
+
+// FacetCount is the number of products of a category or store. ID is nil for
+// products without a category.
+type FacetCount struct {
+	ID    *int64 `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// PriceFacet is the number of products priced from Min up to (excluding) Max;
+// the last range has no Max
+type PriceFacet struct {
+	Min   float64  `json:"min"`
+	Max   *float64 `json:"max"`
+	Count int      `json:"count"`
+}
+
+// ProductOption is an option of a product (e.g. "size") with the values its
+// variants use, in variant order
+type ProductOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// ProductVariant is a sellable variant of a product with its own SKU and stock.
+// A nil Price means the product's price.
+type ProductVariant struct {
+	ID        int64             `json:"id"`
+	ProductID int64             `json:"product_id"`
+	SKU       string            `json:"sku"`
+	Name      string            `json:"name"`
+	Options   map[string]string `json:"options"`
+	Price     *float64          `json:"price,omitempty"`
+	Stock     int               `json:"stock"`
+	ImageURL  string            `json:"image_url"`
+	CreatedAt time.Time         `json:"created_at"`
 }
 
 type Category struct {
@@ -55,6 +267,11 @@ type ProductLog struct {
 	ProductPrice  float64   `json:"product_price"`
 	Quantity      int       `json:"quantity"`
 	CreatedAt     time.Time `json:"created_at"`
+	// snapshot of the ordered variant, if any
+	VariantID      *int64            `json:"variant_id,omitempty"`
+	VariantSKU     string            `json:"variant_sku,omitempty"`
+	VariantName    string            `json:"variant_name,omitempty"`
+	VariantOptions map[string]string `json:"variant_options,omitempty"`
 }
 
 type Address struct {
@@ -66,3 +283,48 @@ type Address struct {
 	PostalCode string    `json:"postal_code"`
 	CreatedAt  time.Time `json:"created_at"`
 }
+
+// TransactionRecord is a transaction with its items
+type TransactionRecord struct {
+	Transaction
+	Items []*ProductLog `json:"items"`
+}
+
+// UserImportRow is one user of a bulk import (CSV columns or JSON fields)
+type UserImportRow struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role,omitempty"`
+	// StoreName defaults to "<name>'s Store"
+	StoreName string `json:"store_name,omitempty"`
+}
+
+// Bulk import row outcomes (UserImportResult.Status)
+const (
+	ImportCreated = "created"
+	// ImportValid rows passed validation in a dry run
+	ImportValid = "valid"
+	ImportError = "error"
+)
+
+// UserImportResult reports what happened to one row of a bulk import
+type UserImportResult struct {
+	// Row counts data rows from 1 (a CSV header is not counted)
+	Row    int    `json:"row"`
+	Email  string `json:"email"`
+	Status string `json:"status"`
+	UserID int64  `json:"user_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// UserExport is the archive of a user's data returned by GET /api/v1/auth/me/export
+type UserExport struct {
+	ExportedAt   time.Time            `json:"exported_at"`
+	Profile      *User                `json:"profile"`
+	Addresses    []*Address           `json:"addresses"`
+	Store        *Store               `json:"store"`
+	Products     []*Product           `json:"products"`
+	Transactions []*TransactionRecord `json:"transactions"`
+}
@@ -0,0 +1,132 @@
+package oauth
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Scopes partner apps can request. A ":write" scope includes reading the same
+// resource. Tokens issued to partner apps are limited to the routes their
+// scopes cover (see Allows) and never carry staff permissions.
+const (
+	ScopeProfile          = "profile"
+	ScopeStoreRead        = "store:read"
+	ScopeStoreWrite       = "store:write"
+	ScopeProductRead      = "product:read"
+	ScopeProductWrite     = "product:write"
+	ScopeTransactionRead  = "transaction:read"
+	ScopeTransactionWrite = "transaction:write"
+	ScopeAddressRead      = "address:read"
+	ScopeAddressWrite     = "address:write"
+	// ScopeIntrospect lets a confidential client (a service or gateway) call
+	// the token introspection endpoint; it covers no API routes
+	ScopeIntrospect = "introspect"
+)
+
+// Descriptions are shown on the consent screen
+var Descriptions = map[string]string{
+	ScopeProfile:          "Read your name, email and phone number",
+	ScopeStoreRead:        "View your store",
+	ScopeStoreWrite:       "Manage your store",
+	ScopeProductRead:      "View your products",
+	ScopeProductWrite:     "Manage your products and their images",
+	ScopeTransactionRead:  "View your orders",
+	ScopeTransactionWrite: "Create and update orders",
+	ScopeAddressRead:      "View your addresses",
+	ScopeAddressWrite:     "Manage your addresses",
+	ScopeIntrospect:       "Check whether access tokens are still active",
+}
+
+// Valid reports whether scope is a known scope
+func Valid(scope string) bool {
+	_, ok := Descriptions[scope]
+	return ok
+}
+
+// ParseScope splits a space separated scope parameter, dropping duplicates
+func ParseScope(s string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, scope := range strings.Fields(s) {
+		if !seen[scope] {
+			seen[scope] = true
+			out = append(out, scope)
+		}
+	}
+	return out
+}
+
+// JoinScope formats scopes for a scope parameter or claim, sorted
+func JoinScope(scopes []string) string {
+	s := append([]string(nil), scopes...)
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
+// Subset reports whether every scope in scopes is in granted
+func Subset(scopes, granted []string) bool {
+	for _, s := range scopes {
+		if !contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect returns the scopes in both a and b, in a's order
+func Intersect(a, b []string) []string {
+	out := []string{}
+	for _, s := range a {
+		if contains(b, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func contains(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// routes maps path prefixes to the resource whose scopes cover them. Paths not
+// listed here (the auth API, OAuth client and consent management) are never
+// reachable with a partner token.
+var routes = []struct {
+	prefix   string
+	resource string
+}{
+	{"/api/v1/stores", "store"},
+	{"/api/v1/products", "product"},
+	{"/api/v1/categories", "product"},
+	{"/api/v1/files", "product"},
+	{"/api/v1/transactions", "transaction"},
+	{"/api/v1/addresses", "address"},
+}
+
+// UserInfoPath is the OpenID style profile endpoint, covered by ScopeProfile
+const UserInfoPath = "/api/v1/oauth/userinfo"
+
+// Allows reports whether a token with scopes may make a request. Reads need the
+// resource's ":read" or ":write" scope, anything else its ":write" scope.
+func Allows(scopes []string, method, path string) bool {
+	if path == UserInfoPath {
+		return method == http.MethodGet && contains(scopes, ScopeProfile)
+	}
+	for _, r := range routes {
+		if path != r.prefix && !strings.HasPrefix(path, r.prefix+"/") {
+			continue
+		}
+		if contains(scopes, r.resource+":write") {
+			return true
+		}
+		read := method == http.MethodGet || method == http.MethodHead
+		return read && contains(scopes, r.resource+":read")
+	}
+	return false
+}
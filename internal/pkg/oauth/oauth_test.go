@@ -0,0 +1,42 @@
+package oauth
+
+import "testing"
+
+func TestAllows(t *testing.T) {
+	cases := []struct {
+		scopes       []string
+		method, path string
+		want         bool
+	}{
+		{[]string{ScopeProductRead}, "GET", "/api/v1/products/5", true},
+		{[]string{ScopeProductRead}, "PUT", "/api/v1/products/5", false},
+		{[]string{ScopeProductWrite}, "PUT", "/api/v1/products/5", true},
+		{[]string{ScopeProductWrite}, "GET", "/api/v1/categories", true},
+		{[]string{ScopeProductRead}, "GET", "/api/v1/productsx", false},
+		{[]string{ScopeStoreWrite}, "GET", "/api/v1/products", false},
+		{[]string{ScopeTransactionRead}, "GET", "/api/v1/transactions", true},
+		{[]string{ScopeProfile}, "GET", UserInfoPath, true},
+		{[]string{ScopeStoreWrite}, "GET", UserInfoPath, false},
+		// the auth API is never reachable with a partner token
+		{[]string{ScopeProfile, ScopeStoreWrite}, "GET", "/api/v1/auth/users/5", false},
+		{[]string{ScopeProfile}, "GET", "/api/v1/oauth/consents", false},
+	}
+	for _, c := range cases {
+		if got := Allows(c.scopes, c.method, c.path); got != c.want {
+			t.Errorf("Allows(%v, %s %s) = %v, want %v", c.scopes, c.method, c.path, got, c.want)
+		}
+	}
+}
+
+func TestParseAndJoinScope(t *testing.T) {
+	s := ParseScope(" product:read  profile product:read ")
+	if len(s) != 2 || s[0] != ScopeProductRead || s[1] != ScopeProfile {
+		t.Fatalf("unexpected scopes %v", s)
+	}
+	if got := JoinScope(s); got != "product:read profile" {
+		t.Fatalf("unexpected joined scope %q", got)
+	}
+	if !Subset([]string{ScopeProfile}, s) || Subset([]string{ScopeStoreRead}, s) {
+		t.Fatalf("unexpected Subset results")
+	}
+}
@@ -0,0 +1,184 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultKeysTTL is used when the JWKS response has no Cache-Control max-age
+	defaultKeysTTL = time.Hour
+	maxKeysTTL     = 24 * time.Hour
+	// minRefetchInterval limits refetches triggered by unknown kids so that tokens
+	// with made-up kids cannot make us hammer the issuer
+	minRefetchInterval = 30 * time.Second
+)
+
+// keyCache caches an issuer's signing keys by kid. The zero value is ready to use.
+type keyCache struct {
+	mu        sync.Mutex
+	url       string
+	keys      map[string]interface{} // kid -> *rsa.PublicKey or *ecdsa.PublicKey
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// get returns the key for kid, fetching the JWKS when the cache is stale or
+// the kid is unknown (the issuer rotated its keys)
+func (c *keyCache) get(ctx context.Context, p *Provider, kid, alg string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	key, ok := c.keys[kid]
+	stale := now.After(c.expiresAt)
+	if !ok && !stale && now.Sub(c.fetchedAt) < minRefetchInterval {
+		return nil, errors.New("unknown signing key")
+	}
+	if !ok || stale {
+		if err := c.refresh(ctx, p); err != nil {
+			if ok {
+				// keep using the cached key if the issuer is briefly unreachable
+				return checkAlg(key, alg)
+			}
+			return nil, err
+		}
+		if key, ok = c.keys[kid]; !ok {
+			return nil, errors.New("unknown signing key")
+		}
+	}
+	return checkAlg(key, alg)
+}
+
+// refresh downloads the JWKS; callers hold c.mu
+func (c *keyCache) refresh(ctx context.Context, p *Provider) error {
+	if c.url == "" {
+		u, err := p.discoverJWKSURL(ctx)
+		if err != nil {
+			return err
+		}
+		c.url = u
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", c.url, resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			// skip key types we do not support instead of failing every login
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	now := time.Now()
+	c.keys = keys
+	c.fetchedAt = now
+	c.expiresAt = now.Add(cacheTTL(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// checkAlg makes sure the token's algorithm matches the key type
+func checkAlg(key interface{}, alg string) (interface{}, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unexpected signing method")
+}
+
+func cacheTTL(cacheControl string) time.Duration {
+	for _, part := range strings.Split(cacheControl, ",") {
+		part = strings.TrimSpace(part)
+		if v, ok := strings.CutPrefix(part, "max-age="); ok {
+			if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+				if ttl := time.Duration(secs) * time.Second; ttl < maxKeysTTL {
+					return ttl
+				}
+				return maxKeysTTL
+			}
+		}
+	}
+	return defaultKeysTTL
+}
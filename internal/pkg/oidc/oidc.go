@@ -0,0 +1,259 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Leeway is the clock skew tolerated when checking exp/iat/nbf
+const Leeway = time.Minute
+
+// Identity is the verified subject of an ID token
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider verifies ID tokens of one OpenID Connect issuer locally, using the
+// issuer's published signing keys.
+type Provider struct {
+	Name string
+	// Issuer is the expected iss claim. "{tenantid}" matches any single path
+	// segment (multi-tenant Microsoft issuers).
+	Issuer string
+	// ClientIDs are the accepted audiences (our OAuth client IDs at the issuer)
+	ClientIDs []string
+	// JWKSURL overrides the jwks_uri from the issuer's discovery document
+	JWKSURL string
+	// HTTPClient is used for discovery and JWKS requests (default: 10s timeout)
+	HTTPClient *http.Client
+
+	keys keyCache
+}
+
+// Registry holds the configured providers by name
+type Registry struct {
+	providers map[string]*Provider
+}
+
+func NewRegistry(providers ...*Provider) *Registry {
+	r := &Registry{providers: map[string]*Provider{}}
+	for _, p := range providers {
+		r.Register(p)
+	}
+	return r
+}
+
+func (r *Registry) Register(p *Provider) {
+	r.providers[strings.ToLower(p.Name)] = p
+}
+
+func (r *Registry) Get(name string) (*Provider, bool) {
+	p, ok := r.providers[strings.ToLower(name)]
+	return p, ok
+}
+
+// Names lists the configured provider names in alphabetical order
+func (r *Registry) Names() []string {
+	out := make([]string, 0, len(r.providers))
+	for n := range r.providers {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// well-known issuers; anything else needs OIDC_<NAME>_ISSUER
+var knownIssuers = map[string]struct{ issuer, jwks string }{
+	"google":    {"https://accounts.google.com", "https://www.googleapis.com/oauth2/v3/certs"},
+	"microsoft": {"https://login.microsoftonline.com/{tenantid}/v2.0", "https://login.microsoftonline.com/common/discovery/v2.0/keys"},
+}
+
+// NewRegistryFromEnv configures the providers listed in OIDC_PROVIDERS
+// (comma separated, e.g. "google,microsoft,keycloak"). For each NAME:
+//
+//	OIDC_<NAME>_CLIENT_ID  accepted audience(s), comma separated (required)
+//	OIDC_<NAME>_ISSUER     issuer URL (optional for google and microsoft)
+//	OIDC_<NAME>_JWKS_URL   JWKS URL (optional, discovered from the issuer)
+//
+// Providers without a client ID are skipped with an error in the returned slice.
+func NewRegistryFromEnv() (*Registry, []error) {
+	r := NewRegistry()
+	var errs []error
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p := &Provider{
+			Name:    name,
+			Issuer:  os.Getenv(prefix + "ISSUER"),
+			JWKSURL: os.Getenv(prefix + "JWKS_URL"),
+		}
+		for _, id := range strings.Split(os.Getenv(prefix+"CLIENT_ID"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				p.ClientIDs = append(p.ClientIDs, id)
+			}
+		}
+		if known, ok := knownIssuers[name]; ok {
+			if p.Issuer == "" {
+				p.Issuer = known.issuer
+			}
+			if p.JWKSURL == "" {
+				p.JWKSURL = known.jwks
+			}
+		}
+		if p.Issuer == "" || len(p.ClientIDs) == 0 {
+			errs = append(errs, fmt.Errorf("oidc provider %q: %sISSUER and %sCLIENT_ID are required", name, prefix, prefix))
+			continue
+		}
+		r.Register(p)
+	}
+	return r, errs
+}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of an ID token.
+// nonce must equal the nonce claim; pass "" only for flows that do not use one.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	token, err := jwt.Parse(rawIDToken, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.get(ctx, p, kid, t.Method.Alg())
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384"}),
+		jwt.WithLeeway(Leeway),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid id token")
+	}
+	// exp is optional for jwt.Parse but mandatory in ID tokens
+	if exp, _ := claims.GetExpirationTime(); exp == nil {
+		return nil, errors.New("invalid id token: missing exp")
+	}
+
+	iss, _ := claims.GetIssuer()
+	if !p.issuerMatches(iss, claims) {
+		return nil, errors.New("invalid id token: unexpected issuer")
+	}
+	aud, _ := claims.GetAudience()
+	if !p.audienceMatches(aud) {
+		return nil, errors.New("invalid id token: unexpected audience")
+	}
+	// with several audiences the authorized party must be us
+	if azp, ok := claims["azp"].(string); ok && len(aud) > 1 && !contains(p.ClientIDs, azp) {
+		return nil, errors.New("invalid id token: unexpected authorized party")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+
+	id := &Identity{Provider: p.Name}
+	id.Subject, _ = claims.GetSubject()
+	if id.Subject == "" {
+		return nil, errors.New("invalid id token: missing subject")
+	}
+	id.Email, _ = claims["email"].(string)
+	id.Name, _ = claims["name"].(string)
+	// some issuers send email_verified as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+	return id, nil
+}
+
+func (p *Provider) issuerMatches(iss string, claims jwt.MapClaims) bool {
+	if iss == "" {
+		return false
+	}
+	if !strings.Contains(p.Issuer, "{tenantid}") {
+		// Google historically also issues tokens with the scheme-less issuer
+		return iss == p.Issuer || "https://"+iss == p.Issuer
+	}
+	// multi-tenant: the tenant in iss must be the token's tid claim
+	tid, _ := claims["tid"].(string)
+	return tid != "" && iss == strings.ReplaceAll(p.Issuer, "{tenantid}", tid)
+}
+
+func (p *Provider) audienceMatches(aud []string) bool {
+	for _, a := range aud {
+		if contains(p.ClientIDs, a) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverJWKSURL returns the configured JWKS URL or reads jwks_uri from the
+// issuer's discovery document
+func (p *Provider) discoverJWKSURL(ctx context.Context) (string, error) {
+	if p.JWKSURL != "" {
+		return p.JWKSURL, nil
+	}
+	if strings.Contains(p.Issuer, "{tenantid}") {
+		return "", errors.New("JWKS URL required for multi-tenant issuer")
+	}
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, p.client(), u, &doc); err != nil {
+		return "", fmt.Errorf("oidc discovery: %w", err)
+	}
+	if doc.Issuer != p.Issuer || doc.JWKSURI == "" {
+		return "", errors.New("oidc discovery: issuer mismatch or missing jwks_uri")
+	}
+	return doc.JWKSURI, nil
+}
+
+func getJSON(ctx context.Context, c *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
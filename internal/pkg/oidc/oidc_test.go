@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// stubIssuer is a minimal OpenID provider serving discovery and JWKS
+type stubIssuer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	keys       map[string]*rsa.PrivateKey
+	jwksServed int
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	s := &stubIssuer{keys: map[string]*rsa.PrivateKey{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": s.URL, "jwks_uri": s.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.jwksServed++
+		var keys []map[string]string
+		for kid, k := range s.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "use": "sig", "alg": "RS256", "kid": kid,
+				"n": base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	s.addKey(t, "k1")
+	return s
+}
+
+func (s *stubIssuer) addKey(t *testing.T, kid string) {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = k
+	s.mu.Unlock()
+}
+
+func (s *stubIssuer) fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksServed
+}
+
+func (s *stubIssuer) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	s.mu.Lock()
+	k := s.keys[kid]
+	s.mu.Unlock()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = kid
+	raw, err := tok.SignedString(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (s *stubIssuer) claims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            s.URL,
+		"aud":            "our-client",
+		"sub":            "user-123",
+		"email":          "siti@example.com",
+		"email_verified": true,
+		"name":           "Siti",
+		"nonce":          "n-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	iss := newStubIssuer(t)
+	p := &Provider{Name: "stub", Issuer: iss.URL, ClientIDs: []string{"our-client"}}
+	ctx := context.Background()
+
+	id, err := p.Verify(ctx, iss.sign(t, "k1", iss.claims()), "n-1")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id.Subject != "user-123" || id.Email != "siti@example.com" || !id.EmailVerified || id.Provider != "stub" {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+
+	cases := map[string]func(jwt.MapClaims){
+		"audience": func(c jwt.MapClaims) { c["aud"] = "someone-else" },
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"expired":  func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no exp":   func(c jwt.MapClaims) { delete(c, "exp") },
+		"nonce":    func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"subject":  func(c jwt.MapClaims) { delete(c, "sub") },
+	}
+	for name, mutate := range cases {
+		c := iss.claims()
+		mutate(c)
+		if _, err := p.Verify(ctx, iss.sign(t, "k1", c), "n-1"); err == nil {
+			t.Errorf("%s: expected token rejected", name)
+		}
+	}
+
+	// forged signature
+	raw := iss.sign(t, "k1", iss.claims())
+	parts := strings.Split(raw, ".")
+	other := iss.sign(t, "k1", jwt.MapClaims{"sub": "x"})
+	forged := parts[0] + "." + parts[1] + "." + strings.Split(other, ".")[2]
+	if _, err := p.Verify(ctx, forged, "n-1"); err == nil {
+		t.Errorf("expected forged signature rejected")
+	}
+}
+
+func TestVerify_CachesKeysAndFollowsRotation(t *testing.T) {
+	iss := newStubIssuer(t)
+	p := &Provider{Name: "stub", Issuer: iss.URL, ClientIDs: []string{"our-client"}}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Verify(ctx, iss.sign(t, "k1", iss.claims()), "n-1"); err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+	}
+	if iss.fetches() != 1 {
+		t.Fatalf("expected keys fetched once, got %d", iss.fetches())
+	}
+
+	// the issuer rotates to a new key: an unknown kid triggers one refetch
+	iss.addKey(t, "k2")
+	p.keys.fetchedAt = time.Now().Add(-minRefetchInterval) // past the refetch throttle
+	if _, err := p.Verify(ctx, iss.sign(t, "k2", iss.claims()), "n-1"); err != nil {
+		t.Fatalf("verify with rotated key: %v", err)
+	}
+	if iss.fetches() != 2 {
+		t.Fatalf("expected refetch on unknown kid, got %d fetches", iss.fetches())
+	}
+
+	// made-up kids right after a fetch do not hit the issuer again
+	iss.addKey(t, "k3")
+	if _, err := p.Verify(ctx, iss.sign(t, "k3", iss.claims()), "n-1"); err == nil {
+		t.Fatalf("expected unknown kid rejected while throttled")
+	}
+	if iss.fetches() != 2 {
+		t.Fatalf("expected no refetch while throttled, got %d fetches", iss.fetches())
+	}
+}
+
+func TestVerify_TenantIssuer(t *testing.T) {
+	iss := newStubIssuer(t)
+	p := &Provider{Name: "microsoft", Issuer: iss.URL + "/{tenantid}/v2.0", JWKSURL: iss.URL + "/keys", ClientIDs: []string{"our-client"}}
+
+	c := iss.claims()
+	c["tid"] = "tenant-a"
+	c["iss"] = iss.URL + "/tenant-a/v2.0"
+	if _, err := p.Verify(context.Background(), iss.sign(t, "k1", c), "n-1"); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	// the tenant in iss must match the tid claim
+	c["iss"] = iss.URL + "/tenant-b/v2.0"
+	if _, err := p.Verify(context.Background(), iss.sign(t, "k1", c), "n-1"); err == nil {
+		t.Fatalf("expected mismatched tenant rejected")
+	}
+}
+
+func TestNewRegistryFromEnv(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "google, keycloak,broken")
+	t.Setenv("OIDC_GOOGLE_CLIENT_ID", "g-1,g-2")
+	t.Setenv("OIDC_KEYCLOAK_CLIENT_ID", "kc")
+	t.Setenv("OIDC_KEYCLOAK_ISSUER", "https://sso.example.com/realms/shop")
+
+	r, errs := NewRegistryFromEnv()
+	if len(errs) != 1 {
+		t.Fatalf("expected one config error (broken), got %v", errs)
+	}
+	if got := strings.Join(r.Names(), ","); got != "google,keycloak" {
+		t.Fatalf("unexpected providers %q", got)
+	}
+	g, _ := r.Get("Google")
+	if g.Issuer != "https://accounts.google.com" || len(g.ClientIDs) != 2 || g.JWKSURL == "" {
+		t.Fatalf("unexpected google config: %+v", g)
+	}
+}
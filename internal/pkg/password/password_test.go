@@ -0,0 +1,118 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	h, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(h, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Fatalf("unexpected hash format %q", h)
+	}
+	if ok, rehash, err := Verify(h, "correct horse"); !ok || rehash || err != nil {
+		t.Fatalf("expected match without rehash, got %v %v %v", ok, rehash, err)
+	}
+	if ok, _, _ := Verify(h, "wrong horse"); ok {
+		t.Fatalf("expected mismatch")
+	}
+
+	// legacy bcrypt hashes verify and ask for an upgrade
+	b, _ := bcrypt.GenerateFromPassword([]byte("old secret"), bcrypt.MinCost)
+	if ok, rehash, err := Verify(string(b), "old secret"); !ok || !rehash || err != nil {
+		t.Fatalf("expected bcrypt match with rehash, got %v %v %v", ok, rehash, err)
+	}
+	if ok, _, err := Verify(string(b), "nope"); ok || err != nil {
+		t.Fatalf("expected bcrypt mismatch without error, got %v %v", ok, err)
+	}
+
+	// hashes with outdated parameters are upgraded too
+	weak, _ := hashWith("pw", Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	if ok, rehash, _ := Verify(weak, "pw"); !ok || !rehash {
+		t.Fatalf("expected rehash for old parameters")
+	}
+	if _, _, err := Verify("plaintext", "plaintext"); err == nil {
+		t.Fatalf("expected unknown format rejected")
+	}
+	if ok, _, err := Verify(Unusable, Unusable); ok || err != nil {
+		t.Fatalf("expected unusable password to match nothing, got %v %v", ok, err)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	p := DefaultPolicy
+	cases := map[string]bool{
+		"":                    false,
+		"short1":              false,
+		"alllowercaseletters": false,
+		"Tr0ub4dor&3":         true,
+		"siti-Rahma-2024":     false, // contains the name
+		"Xsitir99!!zz":        false, // contains the email's local part
+		"Kopi Tubruk 77":      true,
+	}
+	for pw, ok := range cases {
+		err := p.Validate(pw, "Siti Rahma", "sitir99@example.com")
+		if (err == nil) != ok {
+			t.Errorf("%q: expected ok=%v, got %v", pw, ok, err)
+		}
+		if err != nil && !errors.Is(err, ErrWeak) {
+			t.Errorf("%q: expected ErrWeak, got %v", pw, err)
+		}
+	}
+}
+
+func TestBreachList(t *testing.T) {
+	breached := []string{"password123", "qwerty", "Tr0ub4dor&3", "iloveyou"}
+	ranges := map[string][]string{}
+	add := func(pw []byte, count string) {
+		sum := sha1.Sum(pw)
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		ranges[hash[:5]] = append(ranges[hash[:5]], hash[5:]+":"+count)
+	}
+	for _, pw := range breached {
+		add([]byte(pw), "42")
+	}
+	for i := 0; i < 200; i++ {
+		add([]byte{byte(i), 'x'}, "1")
+	}
+	dir := t.TempDir()
+	for prefix, lines := range ranges {
+		if err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := OpenBreachList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pw := range breached {
+		if ok, err := list.Contains(pw); !ok || err != nil {
+			t.Errorf("expected %q found, got %v %v", pw, ok, err)
+		}
+	}
+	for _, pw := range []string{"Kopi Tubruk 77", "", "zzzzzz"} {
+		if ok, err := list.Contains(pw); ok || err != nil {
+			t.Errorf("expected %q not found, got %v %v", pw, ok, err)
+		}
+	}
+	if _, err := OpenBreachList(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected missing directory refused")
+	}
+	c := &Checker{Policy: DefaultPolicy, Breaches: list}
+	if err := c.Check("Tr0ub4dor&3"); err != ErrBreached {
+		t.Fatalf("expected ErrBreached, got %v", err)
+	}
+	if err := c.Check("Kopi Tubruk 77"); err != nil {
+		t.Fatalf("expected accepted, got %v", err)
+	}
+}
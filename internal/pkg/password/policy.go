@@ -0,0 +1,195 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrWeak wraps every policy violation
+	ErrWeak = errors.New("password does not meet the policy")
+	// ErrBreached is returned for passwords found in the breach list
+	ErrBreached = errors.New("password appears in a known data breach, choose another one")
+)
+
+// Policy describes acceptable passwords
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols a
+	// password must mix
+	MinClasses int
+}
+
+// DefaultPolicy is used for settings not given in the environment
+var DefaultPolicy = Policy{MinLength: 10, MaxLength: 128, MinClasses: 2}
+
+// Validate checks pw against the policy. personal are values the password must
+// not contain, such as the user's name and email.
+func (p Policy) Validate(pw string, personal ...string) error {
+	n := len([]rune(pw))
+	if n < p.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrWeak, p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return fmt.Errorf("%w: use at most %d characters", ErrWeak, p.MaxLength)
+	}
+	if classes(pw) < p.MinClasses {
+		return fmt.Errorf("%w: mix at least %d of lowercase, uppercase, digits and symbols", ErrWeak, p.MinClasses)
+	}
+	lower := strings.ToLower(pw)
+	for _, word := range personalWords(personal) {
+		if strings.Contains(lower, word) {
+			return fmt.Errorf("%w: must not contain your name or email", ErrWeak)
+		}
+	}
+	return nil
+}
+
+func classes(pw string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range pw {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// personalWords splits names and emails into the lowercase parts worth checking
+// ("Siti Rahma", "siti.r@example.com" -> siti, rahma, siti.r). Parts shorter
+// than 3 characters would reject too many passwords.
+func personalWords(values []string) []string {
+	var out []string
+	for _, v := range values {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if at := strings.IndexByte(v, '@'); at >= 0 {
+			v = v[:at]
+		}
+		for _, w := range strings.Fields(v) {
+			if len([]rune(w)) >= 3 {
+				out = append(out, w)
+			}
+		}
+	}
+	return out
+}
+
+// BreachList is an offline copy of known breached passwords in the k-anonymity
+// range format of the Pwned Passwords API: a directory with one file per 5
+// character SHA-1 prefix ("5BAA6.txt"), each listing the remaining 35 characters
+// of the hashes in that range as "SUFFIX:COUNT" lines, as downloaded by
+// haveibeenpwned-downloader without --single. A lookup reads one small range
+// file, never the whole list.
+type BreachList struct {
+	dir string
+}
+
+// breachPrefixLen is the length of the hash prefix naming a range file
+const breachPrefixLen = 5
+
+func OpenBreachList(dir string) (*BreachList, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory of hash ranges", dir)
+	}
+	return &BreachList{dir: dir}, nil
+}
+
+// Contains reports whether pw is in the list. A missing range file means no
+// breached password has a hash in that range.
+func (b *BreachList) Contains(pw string) (bool, error) {
+	sum := sha1.Sum([]byte(pw))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	f, err := os.Open(filepath.Join(b.dir, hash[:breachPrefixLen]+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	suffix := hash[breachPrefixLen:]
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// Checker enforces a policy and, if configured, rejects breached passwords
+type Checker struct {
+	Policy   Policy
+	Breaches *BreachList
+}
+
+// NewCheckerFromEnv reads PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH,
+// PASSWORD_MIN_CLASSES and PASSWORD_BREACH_DIR (directory of a breach list, see
+// BreachList). A configured breach list that cannot be opened is an error.
+func NewCheckerFromEnv() (*Checker, error) {
+	p := DefaultPolicy
+	p.MinLength = envInt("PASSWORD_MIN_LENGTH", p.MinLength)
+	p.MaxLength = envInt("PASSWORD_MAX_LENGTH", p.MaxLength)
+	p.MinClasses = envInt("PASSWORD_MIN_CLASSES", p.MinClasses)
+	c := &Checker{Policy: p}
+	if path := os.Getenv("PASSWORD_BREACH_DIR"); path != "" {
+		b, err := OpenBreachList(path)
+		if err != nil {
+			return nil, fmt.Errorf("password breach list: %w", err)
+		}
+		c.Breaches = b
+	}
+	return c, nil
+}
+
+// Check validates pw against the policy and the breach list. Breach list read
+// errors are logged and the password is accepted.
+func (c *Checker) Check(pw string, personal ...string) error {
+	if err := c.Policy.Validate(pw, personal...); err != nil {
+		return err
+	}
+	if c.Breaches == nil {
+		return nil
+	}
+	breached, err := c.Breaches.Contains(pw)
+	if err != nil {
+		log.Printf("password: breach list lookup failed: %v", err)
+		return nil
+	}
+	if breached {
+		return ErrBreached
+	}
+	return nil
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,178 @@
+package rbac
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Permissions are "resource:action[:scope]" strings. A ":any" scope grants the
+// action on records owned by other users; owners never need a permission for
+// their own records.
+const (
+	ProductReadAny     = "product:read:any"
+	ProductWriteAny    = "product:write:any"
+	StoreReadAny       = "store:read:any"
+	StoreWriteAny      = "store:write:any"
+	AddressReadAny     = "address:read:any"
+	AddressWriteAny    = "address:write:any"
+	TransactionReadAny = "transaction:read:any"
+	CategoryManage     = "category:manage"
+	UserReadAny        = "user:read:any"
+	UserWriteAny       = "user:write:any"
+	UserAssignRole     = "user:role:assign"
+	// UserSessionsAny covers listing/revoking other users' sessions and force logout
+	UserSessionsAny = "user:sessions:any"
+	UserUnlock      = "user:unlock"
+	// UserStatusManage suspends and reactivates accounts
+	UserStatusManage = "user:status:manage"
+	UserDeleteAny    = "user:delete:any"
+	// UserImpersonate issues tokens to act as another user (support)
+	UserImpersonate = "user:impersonate"
+	// OAuthClientManage registers and revokes OAuth clients (partner apps)
+	OAuthClientManage = "oauth:client:manage"
+
+	// All grants every permission, including ones added later
+	All = "*"
+)
+
+// Permissions is the set of permissions granted to a role
+type Permissions map[string]struct{}
+
+func NewPermissions(perms ...string) Permissions {
+	p := Permissions{}
+	for _, perm := range perms {
+		p[perm] = struct{}{}
+	}
+	return p
+}
+
+// Has reports whether perm is granted. A nil set grants nothing.
+func (p Permissions) Has(perm string) bool {
+	if _, ok := p[All]; ok {
+		return true
+	}
+	_, ok := p[perm]
+	return ok
+}
+
+// Intersect returns the permissions granted by both p and other, e.g. an API
+// key's scopes limited to what its owner's role still grants
+func (p Permissions) Intersect(other Permissions) Permissions {
+	out := Permissions{}
+	for perm := range p {
+		if other.Has(perm) {
+			out[perm] = struct{}{}
+		}
+	}
+	if _, ok := other[All]; ok {
+		return out
+	}
+	// other's permissions are covered by a wildcard in p
+	if _, ok := p[All]; ok {
+		for perm := range other {
+			out[perm] = struct{}{}
+		}
+		delete(out, All)
+	}
+	return out
+}
+
+// List returns the permissions in alphabetical order
+func (p Permissions) List() []string {
+	out := make([]string, 0, len(p))
+	for perm := range p {
+		out = append(out, perm)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Defaults mirror the role_permissions seed rows in sql/schema.sql. They are used
+// when the database cannot be read; roles missing here get no permissions.
+var Defaults = map[string][]string{
+	"admin":             {All},
+	"support":           {UserReadAny, UserSessionsAny, UserUnlock, AddressReadAny, TransactionReadAny, StoreReadAny},
+	"catalog_moderator": {ProductReadAny, ProductWriteAny, CategoryManage},
+}
+
+// Resolver maps a role to its permissions
+type Resolver interface {
+	Permissions(role string) (Permissions, error)
+}
+
+type staticResolver map[string]Permissions
+
+// NewStaticResolver resolves roles from a fixed mapping (tests, or no database)
+func NewStaticResolver(roles map[string][]string) Resolver {
+	r := staticResolver{}
+	for role, perms := range roles {
+		r[role] = NewPermissions(perms...)
+	}
+	return r
+}
+
+func (r staticResolver) Permissions(role string) (Permissions, error) {
+	return r[role], nil
+}
+
+// DefaultTTL is how long DBResolver caches the role_permissions table, i.e. how
+// long a permission change takes to reach every service
+const DefaultTTL = time.Minute
+
+// DBResolver reads the role_permissions table and caches it for ttl. When the
+// table cannot be read it keeps the previous mapping, or uses Defaults if it never
+// loaded, so a database hiccup does not revoke every permission.
+type DBResolver struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu        sync.Mutex
+	roles     map[string]Permissions
+	expiresAt time.Time
+}
+
+func NewDBResolver(db *sql.DB, ttl time.Duration) *DBResolver {
+	return &DBResolver{db: db, ttl: ttl}
+}
+
+func (r *DBResolver) Permissions(role string) (Permissions, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.roles == nil || time.Now().After(r.expiresAt) {
+		roles, err := r.load()
+		if err != nil {
+			log.Printf("rbac: loading role permissions failed: %v", err)
+			if r.roles == nil {
+				r.roles = NewStaticResolver(Defaults).(staticResolver)
+			}
+		} else {
+			r.roles = roles
+		}
+		// on error retry after ttl as well instead of querying on every request
+		r.expiresAt = time.Now().Add(r.ttl)
+	}
+	return r.roles[role], nil
+}
+
+func (r *DBResolver) load() (map[string]Permissions, error) {
+	rows, err := r.db.Query("SELECT role, permission FROM role_permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := map[string]Permissions{}
+	for rows.Next() {
+		var role, perm string
+		if err := rows.Scan(&role, &perm); err != nil {
+			return nil, err
+		}
+		if roles[role] == nil {
+			roles[role] = Permissions{}
+		}
+		roles[role][perm] = struct{}{}
+	}
+	return roles, rows.Err()
+}
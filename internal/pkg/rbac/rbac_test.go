@@ -0,0 +1,46 @@
+package rbac
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPermissionsHas(t *testing.T) {
+	r := NewStaticResolver(Defaults)
+
+	admin, _ := r.Permissions("admin")
+	if !admin.Has(ProductWriteAny) || !admin.Has("reports:export") {
+		t.Fatalf("expected admin to have every permission")
+	}
+	mod, _ := r.Permissions("catalog_moderator")
+	if !mod.Has(CategoryManage) || mod.Has(UserReadAny) {
+		t.Fatalf("unexpected catalog_moderator permissions %v", mod.List())
+	}
+	user, _ := r.Permissions("user")
+	if user.Has(ProductReadAny) {
+		t.Fatalf("expected plain users to have no permissions")
+	}
+	var none Permissions
+	if none.Has(ProductReadAny) {
+		t.Fatalf("expected nil set to grant nothing")
+	}
+}
+
+func TestPermissionsIntersect(t *testing.T) {
+	cases := []struct {
+		scopes, role []string
+		want         string
+	}{
+		{[]string{ProductWriteAny, CategoryManage}, []string{ProductWriteAny}, "product:write:any"},
+		{[]string{ProductWriteAny}, []string{All}, "product:write:any"},
+		{[]string{All}, []string{ProductReadAny, ProductWriteAny}, "product:read:any,product:write:any"},
+		{[]string{All}, []string{All}, "*"},
+		{nil, []string{All}, ""},
+	}
+	for _, tc := range cases {
+		got := NewPermissions(tc.scopes...).Intersect(NewPermissions(tc.role...))
+		if s := strings.Join(got.List(), ","); s != tc.want {
+			t.Errorf("%v ∩ %v = %q, want %q", tc.scopes, tc.role, s, tc.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BM25 parameters, and the weight of a name match relative to a description match
+const (
+	bm25K1     = 1.2
+	bm25B      = 0.75
+	nameWeight = 2.0
+)
+
+// Matches with a typo or of a prefix only count for less than exact ones
+const (
+	typoWeight   = 0.5
+	prefixWeight = 0.7
+)
+
+// Memory is an in-process inverted index ranking with BM25. It holds every
+// product in memory and is not shared between processes, so it suits tests and
+// deployments with a single product service.
+type Memory struct {
+	mu       sync.RWMutex
+	docs     map[int64]*memDoc
+	postings map[string]map[int64]struct{}
+	nameLen  int // total terms in names, for the average length
+	descLen  int
+}
+
+type memDoc struct {
+	name, desc       map[string]int // term frequencies
+	nameLen, descLen int
+}
+
+func NewMemory() *Memory {
+	return &Memory{docs: map[int64]*memDoc{}, postings: map[string]map[int64]struct{}{}}
+}
+
+func frequencies(terms []string) map[string]int {
+	tf := map[string]int{}
+	for _, t := range terms {
+		tf[t]++
+	}
+	return tf
+}
+
+// Index adds a document or replaces the one with the same ID
+func (m *Memory) Index(doc Document) error {
+	name, desc := Terms(doc.Name), Terms(doc.Description)
+	d := &memDoc{name: frequencies(name), desc: frequencies(desc), nameLen: len(name), descLen: len(desc)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(doc.ID)
+	m.docs[doc.ID] = d
+	m.nameLen += d.nameLen
+	m.descLen += d.descLen
+	for _, tf := range []map[string]int{d.name, d.desc} {
+		for t := range tf {
+			if m.postings[t] == nil {
+				m.postings[t] = map[int64]struct{}{}
+			}
+			m.postings[t][doc.ID] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Remove(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(id)
+	return nil
+}
+
+// remove drops a document; callers hold m.mu
+func (m *Memory) remove(id int64) {
+	d := m.docs[id]
+	if d == nil {
+		return
+	}
+	delete(m.docs, id)
+	m.nameLen -= d.nameLen
+	m.descLen -= d.descLen
+	for _, tf := range []map[string]int{d.name, d.desc} {
+		for t := range tf {
+			delete(m.postings[t], id)
+			if len(m.postings[t]) == 0 {
+				delete(m.postings, t)
+			}
+		}
+	}
+}
+
+// expand returns the index terms a query term matches with their weight: the
+// term itself, terms within typo distance and, for terms of 3 letters or more,
+// terms it is a prefix of (search as you type)
+func (m *Memory) expand(q string) map[string]float64 {
+	out := map[string]float64{}
+	if _, ok := m.postings[q]; ok {
+		out[q] = 1
+	}
+	for t := range m.postings {
+		if t == q {
+			continue
+		}
+		w := 0.0
+		if len(q) >= 3 && strings.HasPrefix(t, q) {
+			w = prefixWeight
+		}
+		if w < typoWeight && Similar(t, q) {
+			w = typoWeight
+		}
+		if w > 0 {
+			out[t] = w
+		}
+	}
+	return out
+}
+
+// Search ranks the documents matching any query term by BM25 over names and
+// descriptions, best first
+func (m *Memory) Search(query string, limit int) ([]Hit, error) {
+	terms := QueryTerms(query)
+	if len(terms) == 0 {
+		return []Hit{}, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := float64(len(m.docs))
+	if n == 0 {
+		return []Hit{}, nil
+	}
+	avgName := math.Max(float64(m.nameLen)/n, 1)
+	avgDesc := math.Max(float64(m.descLen)/n, 1)
+	bm25 := func(tf, length int, avg float64) float64 {
+		if tf == 0 {
+			return 0
+		}
+		f := float64(tf)
+		return f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(length)/avg))
+	}
+
+	scores := map[int64]float64{}
+	for _, q := range terms {
+		// a document counts once per query term, with its best matching index term
+		best := map[int64]float64{}
+		for t, weight := range m.expand(q) {
+			df := float64(len(m.postings[t]))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			for id := range m.postings[t] {
+				d := m.docs[id]
+				s := weight * idf * (nameWeight*bm25(d.name[t], d.nameLen, avgName) + bm25(d.desc[t], d.descLen, avgDesc))
+				if s > best[id] {
+					best[id] = s
+				}
+			}
+		}
+		for id, s := range best {
+			scores[id] += s
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, s := range scores {
+		hits = append(hits, Hit{ID: id, Score: s, Terms: terms})
+	}
+	// ties go to the newest product
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
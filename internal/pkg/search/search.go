@@ -0,0 +1,333 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Document is the searchable text of a product
+type Document struct {
+	ID          int64
+	Name        string
+	Description string
+}
+
+// Hit is a matching document. Terms are the analyzed query terms, to pass to
+// Highlight.
+type Hit struct {
+	ID    int64
+	Score float64
+	Terms []string
+}
+
+// minStem is the shortest stem affixes are stripped down to; shorter words are
+// kept as they are. Without a dictionary this keeps roots like "merah" or
+// "buku" from being cut to nonsense.
+const minStem = 4
+
+// stopwords are left out of the index and of queries (Indonesian, plus a few
+// English words common in product names)
+var stopwords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`ada adalah agar akan aku anda apa atau bagi bahwa
+		banyak bisa buat dalam dan dari dengan di dia ia ini itu jadi jika juga
+		kami kamu karena ke kita lagi lain lebih mereka nya oleh pada para saja
+		sangat saya se sebagai sudah tapi telah tersebut tidak untuk yang
+		a an and for in of on or the to with`) {
+		stopwords[w] = true
+	}
+}
+
+type token struct {
+	text       string // lowercased
+	start, end int    // byte offsets in the original text
+}
+
+// tokenize splits text into words of letters and digits
+func tokenize(text string) []token {
+	var out []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			out = append(out, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return out
+}
+
+// Terms analyzes text into index terms: stemmed words without stopwords, in
+// text order, repeated as often as they occur
+func Terms(text string) []string {
+	out := []string{}
+	for _, t := range tokenize(text) {
+		if !stopwords[t.text] {
+			out = append(out, Stem(t.text))
+		}
+	}
+	return out
+}
+
+// QueryTerms analyzes a query like Terms, dropping repeated terms
+func QueryTerms(query string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, t := range Terms(query) {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+var (
+	particles   = []string{"lah", "kah", "tah", "pun"}
+	possessives = []string{"nya", "ku", "mu"}
+	derivations = []string{"kan", "an"}
+)
+
+// Stem reduces an Indonesian word to its root, e.g. "menjual" and "jualan" to
+// "jual". It is a dictionary-less variant of the Nazief-Adriani rules: strip a
+// particle, a possessive and a derivational suffix, then up to two prefixes,
+// never leaving fewer than minStem letters. Queries and documents are stemmed
+// alike, so a wrong root only matters when it collides with another word.
+func Stem(word string) string {
+	if len(word) <= minStem {
+		return word
+	}
+	w := stripSuffix(word, particles)
+	w = stripSuffix(w, possessives)
+	derived := stripSuffix(w, derivations)
+	// ke- is only a prefix together with -an ("kebersihan"); on its own it is
+	// usually part of the root ("kemeja")
+	confix := derived != w && strings.HasSuffix(w, "an")
+	w = derived
+	for i := 0; i < 2; i++ {
+		next := stripPrefix(w, confix && i == 0)
+		if next == w {
+			break
+		}
+		w = next
+	}
+	return w
+}
+
+func stripSuffix(w string, suffixes []string) string {
+	for _, s := range suffixes {
+		if strings.HasSuffix(w, s) && len(w)-len(s) >= minStem {
+			return w[:len(w)-len(s)]
+		}
+	}
+	return w
+}
+
+func isVowel(b byte) bool {
+	return strings.IndexByte("aeiou", b) >= 0
+}
+
+// stripPrefix removes one derivational prefix, restoring the first letter of
+// the root where the prefix replaced it (menulis: tulis, memakai: pakai,
+// menyapu: sapu)
+func stripPrefix(w string, allowKe bool) string {
+	rest := func(n int, restore string) string {
+		if len(w)-n+len(restore) < minStem {
+			return w
+		}
+		return restore + w[n:]
+	}
+	at := func(prefix string) (byte, bool) {
+		if !strings.HasPrefix(w, prefix) || len(w) <= len(prefix) {
+			return 0, false
+		}
+		return w[len(prefix)], true
+	}
+	for _, p := range []string{"me", "pe"} {
+		if c, ok := at(p + "ny"); ok && isVowel(c) {
+			return rest(4, "s")
+		}
+		if _, ok := at(p + "ng"); ok {
+			return rest(4, "")
+		}
+		if c, ok := at(p + "m"); ok {
+			if isVowel(c) {
+				return rest(3, "p")
+			}
+			if strings.IndexByte("bfv", c) >= 0 {
+				return rest(3, "")
+			}
+		}
+		if c, ok := at(p + "n"); ok {
+			if isVowel(c) {
+				return rest(3, "t")
+			}
+			if strings.IndexByte("cdjz", c) >= 0 {
+				return rest(3, "")
+			}
+		}
+		if c, ok := at(p); ok && strings.IndexByte("lrwy", c) >= 0 {
+			return rest(2, "")
+		}
+	}
+	for _, p := range []string{"ber", "ter", "per"} {
+		if _, ok := at(p); ok {
+			return rest(3, "")
+		}
+	}
+	if _, ok := at("di"); ok {
+		return rest(2, "")
+	}
+	if _, ok := at("ke"); ok && allowKe {
+		return rest(2, "")
+	}
+	return w
+}
+
+// maxEdits is the number of typos tolerated in a term of n letters
+func maxEdits(n int) int {
+	switch {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Similar reports whether term is within typo distance of query: at most one
+// edit (insertion, deletion, substitution or swap of adjacent letters) for
+// query terms of 4 to 7 letters, two for longer ones, none for shorter ones
+func Similar(term, query string) bool {
+	if term == query {
+		return true
+	}
+	a, b := []rune(term), []rune(query)
+	limit := maxEdits(len(b))
+	if limit == 0 || abs(len(a)-len(b)) > limit {
+		return false
+	}
+	return editDistance(a, b, limit) <= limit
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// editDistance is the optimal string alignment distance of a and b, or a value
+// above limit once it is known to exceed it
+func editDistance(a, b []rune, limit int) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// Highlight returns text, HTML escaped, with the words matching terms (also
+// with a typo) wrapped in <em>. With maxLen > 0 a longer text is cut to about
+// maxLen bytes around the first match. ok is false when nothing matched.
+func Highlight(text string, terms []string, maxLen int) (highlighted string, ok bool) {
+	var matches []token
+	for _, t := range tokenize(text) {
+		if stopwords[t.text] {
+			continue
+		}
+		stem := Stem(t.text)
+		for _, term := range terms {
+			if stem == term || t.text == term || Similar(stem, term) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+
+	start, end := 0, len(text)
+	if maxLen > 0 && len(text) > maxLen {
+		start = matches[0].start - maxLen/4
+		if start < 0 {
+			start = 0
+		}
+		end = start + maxLen
+		if end > len(text) {
+			end, start = len(text), len(text)-maxLen
+		}
+		// do not cut words
+		for start > 0 && !boundary(text, start) {
+			start--
+		}
+		for end < len(text) && !boundary(text, end) {
+			end++
+		}
+	}
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.start < start || m.end > end {
+			continue
+		}
+		sb.WriteString(html.EscapeString(text[pos:m.start]))
+		sb.WriteString("<em>" + html.EscapeString(text[m.start:m.end]) + "</em>")
+		pos = m.end
+	}
+	sb.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		sb.WriteString("…")
+	}
+	return sb.String(), true
+}
+
+// boundary reports whether byte offset i of text starts a rune outside a word
+func boundary(text string, i int) bool {
+	if i <= 0 || i >= len(text) {
+		return true
+	}
+	if !utf8.RuneStart(text[i]) {
+		return false
+	}
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[i:])
+	return !isWord(before) || !isWord(after)
+}
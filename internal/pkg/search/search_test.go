@@ -0,0 +1,129 @@
+package search
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	cases := map[string]string{
+		"menjual":    "jual",
+		"jualan":     "jual",
+		"dijual":     "jual",
+		"menulis":    "tulis",
+		"memakai":    "pakai",
+		"pakaian":    "pakai",
+		"menyapu":    "sapu",
+		"mengambil":  "ambil",
+		"warnanya":   "warna",
+		"kebersihan": "bersih",
+		"bersih":     "bersih",
+		// roots that look like affixed words are kept
+		"kemeja": "kemeja",
+		"merah":  "merah",
+		"buku":   "buku",
+		"sepatu": "sepatu",
+	}
+	for word, want := range cases {
+		if got := Stem(word); got != want {
+			t.Errorf("Stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	got := strings.Join(Terms("Kemeja Batik untuk pria, dijual dengan harga murah!"), " ")
+	if got != "kemeja batik pria jual harga murah" {
+		t.Fatalf("unexpected terms %q", got)
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	cases := []struct {
+		term, query string
+		want        bool
+	}{
+		{"kemeja", "kemja", true},      // deletion
+		{"kemeja", "kemeaj", true},     // swap
+		{"kemeja", "kamaja", false},    // two edits in a short word
+		{"kerudung", "krudunng", true}, // two edits in a long word
+		{"tas", "tad", false},          // short words must match exactly
+	}
+	for _, c := range cases {
+		if got := Similar(c.term, c.query); got != c.want {
+			t.Errorf("Similar(%q, %q) = %v, want %v", c.term, c.query, got, c.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got, ok := Highlight("Kemeja <Batik> pria", QueryTerms("kemja batik"), 0)
+	if !ok || got != "<em>Kemeja</em> &lt;<em>Batik</em>&gt; pria" {
+		t.Fatalf("unexpected highlight %q", got)
+	}
+	if _, ok := Highlight("Sepatu lari", QueryTerms("kemeja"), 0); ok {
+		t.Fatalf("expected no match")
+	}
+
+	long := strings.Repeat("bahan katun lembut ", 20) + "warna merah " + strings.Repeat("nyaman dipakai ", 20)
+	got, ok = Highlight(long, QueryTerms("merah"), 60)
+	if !ok || !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "<em>merah</em>") {
+		t.Fatalf("unexpected snippet %q", got)
+	}
+	if len(got) > 100 {
+		t.Fatalf("snippet too long: %d bytes", len(got))
+	}
+}
+
+func TestMemory_Search(t *testing.T) {
+	m := NewMemory()
+	m.Index(Document{ID: 1, Name: "Kemeja Batik Pria", Description: "Kemeja lengan panjang bahan katun"})
+	m.Index(Document{ID: 2, Name: "Celana Jeans", Description: "Cocok dipadukan dengan kemeja"})
+	m.Index(Document{ID: 3, Name: "Kerudung Segi Empat", Description: "Jilbab voal warna merah"})
+	m.Index(Document{ID: 4, Name: "Sepatu Lari", Description: "Ringan dan nyaman"})
+
+	ids := func(hits []Hit) string {
+		s := []string{}
+		for _, h := range hits {
+			s = append(s, string(rune('0'+h.ID)))
+		}
+		return strings.Join(s, ",")
+	}
+	search := func(q string) string {
+		hits, err := m.Search(q, 10)
+		if err != nil {
+			t.Fatalf("search %q: %v", q, err)
+		}
+		return ids(hits)
+	}
+
+	// name matches rank above description matches
+	if got := search("kemeja"); got != "1,2" {
+		t.Fatalf("kemeja: got %s", got)
+	}
+	// typo tolerance and prefixes
+	if got := search("kemjea"); got != "1,2" {
+		t.Fatalf("kemjea: got %s", got)
+	}
+	if got := search("keru"); got != "3" {
+		t.Fatalf("keru: got %s", got)
+	}
+	// stemming: "menjual" and "jualan" are both "jual"; stopwords match nothing
+	m.Index(Document{ID: 5, Name: "Jualan Kue", Description: ""})
+	if got := search("menjual"); got != "5" {
+		t.Fatalf("menjual: got %s", got)
+	}
+	if got := search("dan yang"); got != "" {
+		t.Fatalf("stopwords: got %s", got)
+	}
+
+	// re-indexing replaces a document, removing drops it
+	m.Index(Document{ID: 1, Name: "Topi", Description: ""})
+	if got := search("kemeja"); got != "2" {
+		t.Fatalf("after update: got %s", got)
+	}
+	m.Remove(2)
+	if got := search("kemeja"); got != "" {
+		t.Fatalf("after remove: got %s", got)
+	}
+}
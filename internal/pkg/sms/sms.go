@@ -0,0 +1,115 @@
+package sms
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a text message to a phone number
+type Message struct {
+	To     string    `json:"to"`
+	Body   string    `json:"body"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// Sender delivers text messages. Implementations must be safe for concurrent
+// use. Production gateways plug in here; the implementations in this package
+// are local stubs.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// NewFromEnv picks an implementation from SMS_DRIVER:
+//   - "memory": keeps messages in memory (tests)
+//   - "outbox" (default): writes each message to SMS_OUTBOX_DIR (default ./outbox)
+func NewFromEnv() Sender {
+	switch os.Getenv("SMS_DRIVER") {
+	case "memory":
+		return NewMemorySender()
+	default:
+		dir := os.Getenv("SMS_OUTBOX_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		return NewOutboxSender(dir)
+	}
+}
+
+// OutboxSender writes every message as a .sms text file into a local directory
+type OutboxSender struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewOutboxSender(dir string) *OutboxSender {
+	return &OutboxSender{dir: dir}
+}
+
+func (s *OutboxSender) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%d_%s.sms", time.Now().UnixNano(), sanitize(msg.To)))
+	if err := os.WriteFile(path, []byte("To: "+msg.To+"\n\n"+msg.Body+"\n"), 0600); err != nil {
+		return err
+	}
+	log.Printf("sms: wrote message for %s to %s", msg.To, path)
+	return nil
+}
+
+// MemorySender records messages in memory
+type MemorySender struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now()
+	}
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+// Sent returns a copy of all messages sent so far
+func (s *MemorySender) Sent() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Message, len(s.sent))
+	copy(out, s.sent)
+	return out
+}
+
+// Last returns the most recent message sent to phone
+func (s *MemorySender) Last(phone string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.sent) - 1; i >= 0; i-- {
+		if s.sent[i].To == phone {
+			return s.sent[i], true
+		}
+	}
+	return Message{}, false
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '+' || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,115 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Dir is where uploads are stored. The file service serves it as /uploads/, so
+// services saving uploads must share it with the file service, and so must the
+// auth service, which removes a deleted account's product images.
+var Dir = "uploads"
+
+// Policy is what an upload may be: its allowed content types (with the
+// extension used when the filename has none) and maximum size
+type Policy struct {
+	Types   map[string]string
+	MaxSize int64
+}
+
+// Files are the uploads accepted by /api/v1/files/upload
+var Files = Policy{
+	Types: map[string]string{
+		"image/jpeg":      ".jpg",
+		"image/png":       ".png",
+		"image/gif":       ".gif",
+		"image/webp":      ".webp",
+		"application/pdf": ".pdf",
+		"text/plain":      ".txt",
+	},
+	MaxSize: 5 << 20,
+}
+
+// Images are the image types of Files, e.g. for product images
+var Images = Policy{
+	Types: map[string]string{
+		"image/jpeg": ".jpg",
+		"image/png":  ".png",
+		"image/gif":  ".gif",
+		"image/webp": ".webp",
+	},
+	MaxSize: Files.MaxSize,
+}
+
+// Validate checks the upload's content type and size
+func (p Policy) Validate(header *multipart.FileHeader) error {
+	contentType := header.Header.Get("Content-Type")
+	if _, ok := p.Types[contentType]; !ok {
+		return fmt.Errorf("file type not allowed: %s", contentType)
+	}
+	if header.Size > p.MaxSize {
+		return fmt.Errorf("file too large: max %dMB", p.MaxSize>>20)
+	}
+	return nil
+}
+
+// Save validates an upload and stores it in Dir under a unique name prefixed
+// with the user ID. It returns the URL the file is served at
+// ("/uploads/<name>").
+func (p Policy) Save(userID int64, file io.Reader, header *multipart.FileHeader) (string, error) {
+	if err := p.Validate(header); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	base := sanitize(strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename)))
+	if ext == "" || sanitize(ext) != ext {
+		ext = p.Types[header.Header.Get("Content-Type")]
+	}
+	filename := fmt.Sprintf("%d_%d_%s%s", userID, time.Now().UnixNano(), base, ext)
+	path := filepath.Join(Dir, filename)
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, file); err != nil {
+		os.Remove(path) // cleanup on error
+		return "", err
+	}
+	return "/uploads/" + filename, nil
+}
+
+// sanitize keeps letters, digits, '.', '-' and '_' of a client filename
+func sanitize(name string) string {
+	name = strings.ReplaceAll(name, "..", "")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// Remove deletes an uploaded file by its URL. URLs outside /uploads/ (e.g.
+// external image URLs) are refused; a file that is already gone is not an error.
+func Remove(url string) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(url, "/"), "uploads/")
+	if name == url || name == "" || strings.ContainsAny(name, `/\`) || name == ".." || name == "." {
+		return errors.New("not an upload: " + url)
+	}
+	if err := os.Remove(filepath.Join(Dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
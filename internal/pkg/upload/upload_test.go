@@ -0,0 +1,59 @@
+package upload
+
+import (
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func header(filename, contentType string, size int64) *multipart.FileHeader {
+	return &multipart.FileHeader{Filename: filename, Header: textproto.MIMEHeader{"Content-Type": {contentType}}, Size: size}
+}
+
+func TestSaveAndRemove(t *testing.T) {
+	Dir = t.TempDir()
+	defer func() { Dir = "uploads" }()
+
+	url, err := Images.Save(7, strings.NewReader("img"), header("../../etc/my photo.PNG", "image/png", 3))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	name := strings.TrimPrefix(url, "/uploads/")
+	if !strings.HasPrefix(name, "7_") || !strings.HasSuffix(name, "_etcmyphoto.png") || strings.Contains(name, "/") {
+		t.Fatalf("unexpected url %q", url)
+	}
+	if b, err := os.ReadFile(filepath.Join(Dir, name)); err != nil || string(b) != "img" {
+		t.Fatalf("unexpected file %q %v", b, err)
+	}
+
+	if err := Remove(url); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(Dir, name)); !os.IsNotExist(err) {
+		t.Fatalf("expected file removed, got %v", err)
+	}
+	// removing twice is fine, paths outside the upload directory are refused
+	if err := Remove(url); err != nil {
+		t.Fatalf("remove again: %v", err)
+	}
+	for _, bad := range []string{"/uploads/../go.mod", "https://cdn.example.com/a.png", "/etc/passwd", "/uploads/"} {
+		if err := Remove(bad); err == nil {
+			t.Fatalf("expected %q refused", bad)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Images.Validate(header("a.pdf", "application/pdf", 10)); err == nil {
+		t.Fatalf("expected PDF refused as an image")
+	}
+	if err := Files.Validate(header("a.pdf", "application/pdf", 10)); err != nil {
+		t.Fatalf("expected PDF accepted as a file: %v", err)
+	}
+	if err := Images.Validate(header("a.png", "image/png", 6<<20)); err == nil || err.Error() != "file too large: max 5MB" {
+		t.Fatalf("expected size error, got %v", err)
+	}
+}
@@ -14,11 +14,11 @@ import (
 func RegisterRoutes(r *gin.Engine, dbConn *sql.DB) {
 	repo := NewRepo(dbConn)
 	uc := NewUsecase(repo)
-	r.POST("/api/v1/addresses", middleware.GinJWTAuth(), makeCreateHandler(uc))
-	r.GET("/api/v1/addresses", middleware.GinJWTAuth(), makeListHandler(uc))
-	r.GET("/api/v1/addresses/:id", middleware.GinJWTAuth(), makeGetHandler(uc))
-	r.PUT("/api/v1/addresses/:id", middleware.GinJWTAuth(), makeUpdateHandler(uc))
-	r.DELETE("/api/v1/addresses/:id", middleware.GinJWTAuth(), makeDeleteHandler(uc))
+	r.POST("/api/v1/addresses", middleware.GinJWTOrAPIKeyAuth(), makeCreateHandler(uc))
+	r.GET("/api/v1/addresses", middleware.GinJWTOrAPIKeyAuth(), makeListHandler(uc))
+	r.GET("/api/v1/addresses/:id", middleware.GinJWTOrAPIKeyAuth(), makeGetHandler(uc))
+	r.PUT("/api/v1/addresses/:id", middleware.GinJWTOrAPIKeyAuth(), makeUpdateHandler(uc))
+	r.DELETE("/api/v1/addresses/:id", middleware.GinJWTOrAPIKeyAuth(), makeDeleteHandler(uc))
 }
 
 func makeCreateHandler(uc Usecase) gin.HandlerFunc {
@@ -95,14 +95,14 @@ func makeGetHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 			return
 		}
-		a, err := uc.GetAddress(uid, id, role)
+		a, err := uc.GetAddress(uid, id, perms)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
@@ -126,7 +126,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
@@ -143,7 +143,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		err = uc.UpdateAddress(uid, id, role, req.Label, req.Address, req.City, req.PostalCode)
+		err = uc.UpdateAddress(uid, id, perms, req.Label, req.Address, req.City, req.PostalCode)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
@@ -165,14 +165,14 @@ func makeDeleteHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 			return
 		}
-		err = uc.DeleteAddress(uid, id, role)
+		err = uc.DeleteAddress(uid, id, perms)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
@@ -4,14 +4,15 @@ import (
 	"errors"
 
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 )
 
 type Usecase interface {
 	CreateAddress(userID int64, a *models.Address) (int64, error)
 	ListAddresses(userID int64, filters map[string]string, page, limit int) ([]*models.Address, int, error)
-	GetAddress(requesterID, id int64, requesterRole string) (*models.Address, error)
-	UpdateAddress(requesterID, id int64, requesterRole, label, address, city, postalCode string) error
-	DeleteAddress(requesterID, id int64, requesterRole string) error
+	GetAddress(requesterID, id int64, perms rbac.Permissions) (*models.Address, error)
+	UpdateAddress(requesterID, id int64, perms rbac.Permissions, label, address, city, postalCode string) error
+	DeleteAddress(requesterID, id int64, perms rbac.Permissions) error
 }
 
 type addressUsecase struct {
@@ -31,7 +32,7 @@ func (u *addressUsecase) ListAddresses(userID int64, filters map[string]string,
 	return u.repo.ListByUser(userID, filters, page, limit)
 }
 
-func (u *addressUsecase) GetAddress(requesterID, id int64, requesterRole string) (*models.Address, error) {
+func (u *addressUsecase) GetAddress(requesterID, id int64, perms rbac.Permissions) (*models.Address, error) {
 	a, err := u.repo.GetByID(id)
 	if err != nil {
 		return nil, err
@@ -39,13 +40,13 @@ func (u *addressUsecase) GetAddress(requesterID, id int64, requesterRole string)
 	if a == nil {
 		return nil, nil
 	}
-	if requesterRole != "admin" && a.UserID != requesterID {
+	if !perms.Has(rbac.AddressReadAny) && a.UserID != requesterID {
 		return nil, errors.New("forbidden")
 	}
 	return a, nil
 }
 
-func (u *addressUsecase) UpdateAddress(requesterID, id int64, requesterRole, label, address, city, postalCode string) error {
+func (u *addressUsecase) UpdateAddress(requesterID, id int64, perms rbac.Permissions, label, address, city, postalCode string) error {
 	// Check ownership
 	a, err := u.repo.GetByID(id)
 	if err != nil {
@@ -54,13 +55,13 @@ func (u *addressUsecase) UpdateAddress(requesterID, id int64, requesterRole, lab
 	if a == nil {
 		return errors.New("not found")
 	}
-	if requesterRole != "admin" && a.UserID != requesterID {
+	if !perms.Has(rbac.AddressWriteAny) && a.UserID != requesterID {
 		return errors.New("forbidden")
 	}
 	return u.repo.Update(id, label, address, city, postalCode)
 }
 
-func (u *addressUsecase) DeleteAddress(requesterID, id int64, requesterRole string) error {
+func (u *addressUsecase) DeleteAddress(requesterID, id int64, perms rbac.Permissions) error {
 	// Check ownership
 	a, err := u.repo.GetByID(id)
 	if err != nil {
@@ -69,7 +70,7 @@ func (u *addressUsecase) DeleteAddress(requesterID, id int64, requesterRole stri
 	if a == nil {
 		return errors.New("not found")
 	}
-	if requesterRole != "admin" && a.UserID != requesterID {
+	if !perms.Has(rbac.AddressWriteAny) && a.UserID != requesterID {
 		return errors.New("forbidden")
 	}
 	return u.repo.Delete(id)
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 )
 
 // mockRepo implements minimal Repository for address tests.
@@ -32,7 +33,7 @@ func TestGetAddress_Authorization(t *testing.T) {
 
 	// 1) Owner gets own address -> allowed
 	repo.address = &models.Address{ID: 1, UserID: 10}
-	a, err := u.GetAddress(10, 1, "user")
+	a, err := u.GetAddress(10, 1, nil)
 	if err != nil {
 		t.Fatalf("expected owner get allowed, got err: %v", err)
 	}
@@ -41,13 +42,13 @@ func TestGetAddress_Authorization(t *testing.T) {
 	}
 
 	// 2) Non-owner non-admin gets another user's address -> forbidden
-	_, err = u.GetAddress(11, 1, "user")
+	_, err = u.GetAddress(11, 1, nil)
 	if err == nil || err.Error() != "forbidden" {
 		t.Fatalf("expected forbidden, got err: %v", err)
 	}
 
 	// 3) Admin gets any address -> allowed
-	a, err = u.GetAddress(1, 1, "admin")
+	a, err = u.GetAddress(1, 1, rbac.NewPermissions(rbac.AddressReadAny))
 	if err != nil {
 		t.Fatalf("expected admin get allowed, got err: %v", err)
 	}
@@ -57,14 +58,14 @@ func TestGetAddress_Authorization(t *testing.T) {
 
 	// 4) Address not found
 	repo.address = nil
-	_, err = u.GetAddress(10, 1, "user")
+	_, err = u.GetAddress(10, 1, nil)
 	if err != nil {
 		t.Fatalf("expected nil for not found, got err: %v", err)
 	}
 
 	// 5) Repo error -> forwarded
 	repo.err = errors.New("db fail")
-	_, err = u.GetAddress(10, 1, "user")
+	_, err = u.GetAddress(10, 1, nil)
 	if err == nil {
 		t.Fatalf("expected repo error forwarded, got nil")
 	}
@@ -76,33 +77,33 @@ func TestUpdateAddress_Authorization(t *testing.T) {
 
 	// 1) Owner updates own address -> allowed
 	repo.address = &models.Address{ID: 1, UserID: 10}
-	err := u.UpdateAddress(10, 1, "user", "home", "addr", "city", "123")
+	err := u.UpdateAddress(10, 1, nil, "home", "addr", "city", "123")
 	if err != nil {
 		t.Fatalf("expected owner update allowed, got err: %v", err)
 	}
 
 	// 2) Non-owner non-admin updates another user's address -> forbidden
-	err = u.UpdateAddress(11, 1, "user", "home", "addr", "city", "123")
+	err = u.UpdateAddress(11, 1, nil, "home", "addr", "city", "123")
 	if err == nil || err.Error() != "forbidden" {
 		t.Fatalf("expected forbidden, got err: %v", err)
 	}
 
 	// 3) Admin updates any address -> allowed
-	err = u.UpdateAddress(1, 1, "admin", "home", "addr", "city", "123")
+	err = u.UpdateAddress(1, 1, rbac.NewPermissions(rbac.AddressWriteAny), "home", "addr", "city", "123")
 	if err != nil {
 		t.Fatalf("expected admin update allowed, got err: %v", err)
 	}
 
 	// 4) Address not found
 	repo.address = nil
-	err = u.UpdateAddress(10, 1, "user", "home", "addr", "city", "123")
+	err = u.UpdateAddress(10, 1, nil, "home", "addr", "city", "123")
 	if err == nil || err.Error() != "not found" {
 		t.Fatalf("expected not found, got err: %v", err)
 	}
 
 	// 5) Repo error -> forwarded
 	repo.err = errors.New("db fail")
-	err = u.UpdateAddress(10, 1, "user", "home", "addr", "city", "123")
+	err = u.UpdateAddress(10, 1, nil, "home", "addr", "city", "123")
 	if err == nil {
 		t.Fatalf("expected repo error forwarded, got nil")
 	}
@@ -114,33 +115,33 @@ func TestDeleteAddress_Authorization(t *testing.T) {
 
 	// 1) Owner deletes own address -> allowed
 	repo.address = &models.Address{ID: 1, UserID: 10}
-	err := u.DeleteAddress(10, 1, "user")
+	err := u.DeleteAddress(10, 1, nil)
 	if err != nil {
 		t.Fatalf("expected owner delete allowed, got err: %v", err)
 	}
 
 	// 2) Non-owner non-admin deletes another user's address -> forbidden
-	err = u.DeleteAddress(11, 1, "user")
+	err = u.DeleteAddress(11, 1, nil)
 	if err == nil || err.Error() != "forbidden" {
 		t.Fatalf("expected forbidden, got err: %v", err)
 	}
 
 	// 3) Admin deletes any address -> allowed
-	err = u.DeleteAddress(1, 1, "admin")
+	err = u.DeleteAddress(1, 1, rbac.NewPermissions(rbac.AddressWriteAny))
 	if err != nil {
 		t.Fatalf("expected admin delete allowed, got err: %v", err)
 	}
 
 	// 4) Address not found
 	repo.address = nil
-	err = u.DeleteAddress(10, 1, "user")
+	err = u.DeleteAddress(10, 1, nil)
 	if err == nil || err.Error() != "not found" {
 		t.Fatalf("expected not found, got err: %v", err)
 	}
 
 	// 5) Repo error -> forwarded
 	repo.err = errors.New("db fail")
-	err = u.DeleteAddress(10, 1, "user")
+	err = u.DeleteAddress(10, 1, nil)
 	if err == nil {
 		t.Fatalf("expected repo error forwarded, got nil")
 	}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/example/ms-ecommerce/internal/pkg/mail"
+)
+
+// appURL builds a link into the frontend (APP_BASE_URL, default http://localhost:8080)
+func appURL(path string, query url.Values) string {
+	base := strings.TrimRight(os.Getenv("APP_BASE_URL"), "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return base + path + "?" + query.Encode()
+}
+
+func verifyEmailMessage(to, name, token string) mail.Message {
+	link := appURL("/verify-email", url.Values{"token": {token}})
+	return mail.Message{
+		To:      to,
+		Subject: "Verify your email address",
+		Body: "Hi " + name + ",\n\n" +
+			"Please confirm your email address by opening the link below:\n\n" +
+			link + "\n\n" +
+			"The link expires in 24 hours. If you did not create an account, ignore this email.\n",
+	}
+}
+
+func resetPasswordMessage(to, name, token string) mail.Message {
+	link := appURL("/reset-password", url.Values{"token": {token}})
+	return mail.Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: "Hi " + name + ",\n\n" +
+			"We received a request to reset your password. Open the link below to choose a new one:\n\n" +
+			link + "\n\n" +
+			"The link expires in 1 hour. If you did not request this, you can ignore this email.\n",
+	}
+}
+
+func magicLinkMessage(to, name, token string) mail.Message {
+	link := appURL("/magic-login", url.Values{"token": {token}})
+	return mail.Message{
+		To:      to,
+		Subject: "Your login link",
+		Body: "Hi " + name + ",\n\n" +
+			"Open the link below to log in. It can be used once:\n\n" +
+			link + "\n\n" +
+			"The link expires in 15 minutes. If you did not ask to log in, ignore this email.\n",
+	}
+}
+
+func confirmEmailChangeMessage(to, name, token string) mail.Message {
+	link := appURL("/confirm-email-change", url.Values{"token": {token}})
+	return mail.Message{
+		To:      to,
+		Subject: "Confirm your new email address",
+		Body: "Hi " + name + ",\n\n" +
+			"Open the link below to use this address for your account:\n\n" +
+			link + "\n\n" +
+			"The link expires in 24 hours. Until then your account keeps its current email address. If you did not ask for this, ignore this email.\n",
+	}
+}
+
+func emailChangeNoticeMessage(to, name, newEmail string) mail.Message {
+	return mail.Message{
+		To:      to,
+		Subject: "Your email address is being changed",
+		Body: "Hi " + name + ",\n\n" +
+			"We received a request to change the email address of your account to " + newEmail + ". " +
+			"Nothing changes until the new address is confirmed.\n\n" +
+			"If you did not make this request, change your password now.\n",
+	}
+}
+
+func inviteMessage(to, name, token string) mail.Message {
+	link := appURL("/reset-password", url.Values{"token": {token}})
+	return mail.Message{
+		To:      to,
+		Subject: "Your account is ready",
+		Body: "Hi " + name + ",\n\n" +
+			"An account with a store has been created for you. Open the link below to choose your password:\n\n" +
+			link + "\n\n" +
+			"The link expires in 1 hour. After that, use \"Forgot password\" on the login page with this email address.\n",
+	}
+}
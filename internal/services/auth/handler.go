@@ -2,47 +2,185 @@ package auth
 
 import (
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"time"
 
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+	"github.com/example/ms-ecommerce/internal/pkg/loginguard"
+	"github.com/example/ms-ecommerce/internal/pkg/mail"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/oauth"
+	"github.com/example/ms-ecommerce/internal/pkg/oidc"
+	"github.com/example/ms-ecommerce/internal/pkg/password"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
+	"github.com/example/ms-ecommerce/internal/pkg/sms"
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, dbConn *sql.DB) {
+func RegisterRoutes(r *gin.Engine, dbConn *sql.DB, mailer mail.Mailer, dl denylist.Denylist, sso *oidc.Registry, guard *loginguard.Guard, pw *password.Checker, smsSender sms.Sender) {
 	repo := NewRepo(dbConn)
-	uc := NewUsecase(repo)
+	uc := NewUsecase(repo, mailer, dl, sso, guard, pw, smsSender)
+	// public verification keys so other services can validate tokens without the signing key
+	r.GET("/.well-known/jwks.json", makeJWKSHandler())
+	log.Printf("registered GET /.well-known/jwks.json")
 	r.POST("/api/v1/auth/register", makeRegisterHandler(uc))
 	log.Printf("registered POST /api/v1/auth/register")
 	r.POST("/api/v1/auth/login", makeLoginHandler(uc))
 	log.Printf("registered POST /api/v1/auth/login")
+	// passwordless login: a single-use link by email or a code by SMS
+	r.POST("/api/v1/auth/magic-link", makeMagicLinkRequestHandler(uc))
+	log.Printf("registered POST /api/v1/auth/magic-link")
+	r.POST("/api/v1/auth/magic-link/verify", makeMagicLinkLoginHandler(uc))
+	log.Printf("registered POST /api/v1/auth/magic-link/verify")
+	r.POST("/api/v1/auth/otp/request", makePhoneOTPRequestHandler(uc))
+	log.Printf("registered POST /api/v1/auth/otp/request")
+	r.POST("/api/v1/auth/otp/verify", makePhoneOTPLoginHandler(uc))
+	log.Printf("registered POST /api/v1/auth/otp/verify")
+	// Requests made with an impersonation token are audited by GinJWTAuth; routes
+	// with GinBlockImpersonation are reserved to the account holder.
+	// two-factor authentication (TOTP)
+	r.POST("/api/v1/auth/2fa/login", makeMFALoginHandler(uc))
+	log.Printf("registered POST /api/v1/auth/2fa/login")
+	r.POST("/api/v1/auth/2fa/enroll", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeMFAEnrollHandler(uc))
+	log.Printf("registered POST /api/v1/auth/2fa/enroll")
+	r.POST("/api/v1/auth/2fa/verify", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeMFAVerifyHandler(uc))
+	log.Printf("registered POST /api/v1/auth/2fa/verify")
+	r.POST("/api/v1/auth/2fa/disable", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeMFADisableHandler(uc))
+	log.Printf("registered POST /api/v1/auth/2fa/disable")
 	r.POST("/api/v1/auth/forgot-password", makeForgotHandler(uc))
 	log.Printf("registered POST /api/v1/auth/forgot-password")
 	r.POST("/api/v1/auth/reset-password", makeResetHandler(uc))
 	log.Printf("registered POST /api/v1/auth/reset-password")
-	r.POST("/api/v1/auth/sso/google", makeSSOHandler(uc))
-	log.Printf("registered POST /api/v1/auth/sso/google")
+	r.POST("/api/v1/auth/change-password", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeChangePasswordHandler(uc))
+	log.Printf("registered POST /api/v1/auth/change-password")
+	r.POST("/api/v1/auth/verify-email/request", middleware.GinJWTAuth(), makeVerifyEmailRequestHandler(uc))
+	log.Printf("registered POST /api/v1/auth/verify-email/request")
+	r.POST("/api/v1/auth/verify-email/confirm", makeVerifyEmailConfirmHandler(uc))
+	log.Printf("registered POST /api/v1/auth/verify-email/confirm")
+	// change email/phone: the new value is confirmed before it replaces the old one
+	r.POST("/api/v1/auth/me/email", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeRequestEmailChangeHandler(uc))
+	log.Printf("registered POST /api/v1/auth/me/email")
+	r.POST("/api/v1/auth/me/email/confirm", makeConfirmEmailChangeHandler(uc))
+	log.Printf("registered POST /api/v1/auth/me/email/confirm")
+	r.POST("/api/v1/auth/me/phone", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeRequestPhoneChangeHandler(uc))
+	log.Printf("registered POST /api/v1/auth/me/phone")
+	r.POST("/api/v1/auth/me/phone/confirm", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeConfirmPhoneChangeHandler(uc))
+	log.Printf("registered POST /api/v1/auth/me/phone/confirm")
+	// OpenID Connect login; providers are configured with OIDC_PROVIDERS
+	r.POST("/api/v1/auth/sso/:provider/nonce", makeSSONonceHandler(uc))
+	log.Printf("registered POST /api/v1/auth/sso/:provider/nonce")
+	r.POST("/api/v1/auth/sso/:provider", makeSSOHandler(uc))
+	log.Printf("registered POST /api/v1/auth/sso/:provider")
 	r.POST("/api/v1/auth/refresh", makeRefreshHandler(uc))
 	log.Printf("registered POST /api/v1/auth/refresh")
-	r.POST("/api/v1/auth/logout", makeRevokeHandler(uc))
+	// RFC 7662 token introspection for services and gateways (form encoded
+	// "token", client credentials with the introspect scope)
+	r.POST("/api/v1/auth/introspect", makeIntrospectHandler(uc))
+	log.Printf("registered POST /api/v1/auth/introspect")
+	// the access token, when sent, is revoked along with the refresh token
+	r.POST("/api/v1/auth/logout", middleware.GinOptionalJWTAuth(), makeRevokeHandler(uc))
 	log.Printf("registered POST /api/v1/auth/logout")
-	// revoke all tokens (self) or admin revoke for a user
+	// revoke all tokens (self) or, with user:sessions:any, for another user
 	r.POST("/api/v1/auth/logout/all", middleware.GinJWTAuth(), makeRevokeAllHandler(uc))
 	log.Printf("registered POST /api/v1/auth/logout/all")
-	// Admin-only list users (register both trailing and non-trailing variants)
-	r.GET("/api/v1/auth/users", middleware.GinJWTAuth(), middleware.GinRequireRole("admin"), makeListUsersHandler(uc))
-	r.GET("/api/v1/auth/users/", middleware.GinJWTAuth(), middleware.GinRequireRole("admin"), makeListUsersHandler(uc))
+	// active sessions (devices); ?user_id= manages another user's sessions (user:sessions:any)
+	r.GET("/api/v1/auth/sessions", middleware.GinJWTAuth(), makeListSessionsHandler(uc))
+	log.Printf("registered GET /api/v1/auth/sessions")
+	r.DELETE("/api/v1/auth/sessions/:id", middleware.GinJWTAuth(), makeRevokeSessionHandler(uc))
+	log.Printf("registered DELETE /api/v1/auth/sessions/:id")
+	// API keys of the caller, for scripts and integrations (X-API-Key header)
+	r.POST("/api/v1/auth/api-keys", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeCreateAPIKeyHandler(uc))
+	log.Printf("registered POST /api/v1/auth/api-keys")
+	r.GET("/api/v1/auth/api-keys", middleware.GinJWTAuth(), makeListAPIKeysHandler(uc))
+	log.Printf("registered GET /api/v1/auth/api-keys")
+	r.PATCH("/api/v1/auth/api-keys/:id", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeUpdateAPIKeyHandler(uc))
+	log.Printf("registered PATCH /api/v1/auth/api-keys/:id")
+	r.DELETE("/api/v1/auth/api-keys/:id", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeDeleteAPIKeyHandler(uc))
+	log.Printf("registered DELETE /api/v1/auth/api-keys/:id")
+	// lift a login lockout
+	r.POST("/api/v1/auth/users/:id/unlock", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserUnlock), makeUnlockUserHandler(uc))
+	log.Printf("registered POST /api/v1/auth/users/:id/unlock")
+	// force logout a user from every device
+	r.POST("/api/v1/auth/users/:id/logout", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserSessionsAny), makeForceLogoutHandler(uc))
+	log.Printf("registered POST /api/v1/auth/users/:id/logout")
+	// act as another user (support); the token expires after 15 minutes
+	r.POST("/api/v1/auth/users/:id/impersonate", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), middleware.GinRequirePermission(rbac.UserImpersonate), makeImpersonateHandler(uc))
+	log.Printf("registered POST /api/v1/auth/users/:id/impersonate")
+	// suspend or reactivate an account
+	r.PUT("/api/v1/auth/users/:id/status", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserStatusManage), makeSetUserStatusHandler(uc))
+	log.Printf("registered PUT /api/v1/auth/users/:id/status")
+	// delete (anonymize) an account: your own, or any with user:delete:any
+	r.DELETE("/api/v1/auth/me", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeDeleteAccountHandler(uc))
+	log.Printf("registered DELETE /api/v1/auth/me")
+	r.DELETE("/api/v1/auth/users/:id", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserDeleteAny), makeDeleteAccountHandler(uc))
+	log.Printf("registered DELETE /api/v1/auth/users/:id")
+	// download everything stored about the caller as JSON
+	r.GET("/api/v1/auth/me/export", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeExportHandler(uc))
+	log.Printf("registered GET /api/v1/auth/me/export")
+	// bulk import (CSV or JSON, ?dry_run=true to only validate) and CSV export
+	r.POST("/api/v1/auth/users/import", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserWriteAny), makeImportUsersHandler(uc))
+	log.Printf("registered POST /api/v1/auth/users/import")
+	r.GET("/api/v1/auth/users/export", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserReadAny), makeExportUsersHandler(uc))
+	log.Printf("registered GET /api/v1/auth/users/export")
+	// list users (register both trailing and non-trailing variants)
+	r.GET("/api/v1/auth/users", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserReadAny), makeListUsersHandler(uc))
+	r.GET("/api/v1/auth/users/", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.UserReadAny), makeListUsersHandler(uc))
 	log.Printf("registered GET /api/v1/auth/users and /api/v1/auth/users/")
-	// Get user by id: requires JWT; allowed if admin or owner
+	// Get user by id: requires JWT; allowed for the owner or with user:read:any
 	r.GET("/api/v1/auth/users/:id", middleware.GinJWTAuth(), makeGetUserHandler(uc))
 	log.Printf("registered GET /api/v1/auth/users/:id")
-	// Update user (owner or admin). Admin may change role.
+	// Update user (owner or user:write:any); changing the role needs user:role:assign
 	r.PUT("/api/v1/auth/users/:id", middleware.GinJWTAuth(), makeUpdateUserHandler(uc))
 	log.Printf("registered PUT /api/v1/auth/users/:id")
+
+	// OAuth 2.0 authorization server for partner apps. Client tokens only reach
+	// the routes their scopes cover (see internal/pkg/oauth).
+	r.POST("/api/v1/oauth/clients", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.OAuthClientManage), makeCreateOAuthClientHandler(uc))
+	log.Printf("registered POST /api/v1/oauth/clients")
+	r.GET("/api/v1/oauth/clients", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.OAuthClientManage), makeListOAuthClientsHandler(uc))
+	log.Printf("registered GET /api/v1/oauth/clients")
+	r.DELETE("/api/v1/oauth/clients/:client_id", middleware.GinJWTAuth(), middleware.GinRequirePermission(rbac.OAuthClientManage), makeRevokeOAuthClientHandler(uc))
+	log.Printf("registered DELETE /api/v1/oauth/clients/:client_id")
+	// the consent screen reads the request with GET and posts the user's decision
+	r.GET("/api/v1/oauth/authorize", middleware.GinJWTAuth(), makeOAuthAuthorizeHandler(uc))
+	log.Printf("registered GET /api/v1/oauth/authorize")
+	r.POST("/api/v1/oauth/authorize", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeOAuthApproveHandler(uc))
+	log.Printf("registered POST /api/v1/oauth/authorize")
+	r.POST("/api/v1/oauth/token", makeOAuthTokenHandler(uc))
+	log.Printf("registered POST /api/v1/oauth/token")
+	r.POST("/api/v1/oauth/revoke", makeOAuthRevokeHandler(uc))
+	log.Printf("registered POST /api/v1/oauth/revoke")
+	r.GET("/api/v1/oauth/userinfo", middleware.GinJWTAuth(), makeOAuthUserInfoHandler(uc))
+	log.Printf("registered GET /api/v1/oauth/userinfo")
+	// apps the caller granted access to
+	r.GET("/api/v1/oauth/consents", middleware.GinJWTAuth(), makeListOAuthConsentsHandler(uc))
+	log.Printf("registered GET /api/v1/oauth/consents")
+	r.DELETE("/api/v1/oauth/consents/:client_id", middleware.GinJWTAuth(), middleware.GinBlockImpersonation(), makeRevokeOAuthConsentHandler(uc))
+	log.Printf("registered DELETE /api/v1/oauth/consents/:client_id")
+}
+
+func makeJWKSHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		set, err := jwtpkg.JWKS()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, set)
+	}
 }
 
 func makeRegisterHandler(uc Usecase) gin.HandlerFunc {
@@ -64,10 +202,14 @@ func makeRegisterHandler(uc Usecase) gin.HandlerFunc {
 		u := &models.User{Name: req.Name, Email: req.Email, Phone: req.Phone, Password: req.Password}
 		token, userID, err := uc.Register(u)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			if errors.Is(err, errEmailTaken) || errors.Is(err, errPhoneTaken) || isPasswordRejected(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		refresh, refreshExp, err := uc.IssueRefreshToken(userID)
+		refresh, refreshExp, err := uc.IssueRefreshToken(userID, clientInfo(c))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -92,13 +234,146 @@ func makeForgotHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		token, err := uc.ForgotPassword(req.Email)
-		if err != nil {
+		if err := uc.ForgotPassword(req.Email); err != nil {
+			log.Printf("forgot password: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send reset email"})
+			return
+		}
+		// same response whether or not the email exists
+		c.JSON(http.StatusAccepted, gin.H{"message": "if the email is registered, a reset link has been sent"})
+	}
+}
+
+func makeVerifyEmailRequestHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if err := uc.SendEmailVerification(uid); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "verification email sent"})
+	}
+}
+
+func makeVerifyEmailConfirmHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.ConfirmEmail(req.Token); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		// In real app send email; for now return token so it can be used in tests/Postman
-		c.JSON(http.StatusOK, map[string]interface{}{"reset_token": token, "expires_in": 3600})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// contactChangeError writes the response for an email or phone change error
+func contactChangeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errEmailTaken), errors.Is(err, errPhoneTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err == errTooManyRequests:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case err.Error() == "user not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err == errInvalidConfirmation, err == errSameContact, err.Error() == "invalid email", err.Error() == "phone is required":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("contact change: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func makeRequestEmailChangeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.RequestEmailChange(uid, req.Email); err != nil {
+			contactChangeError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "a confirmation link has been sent to the new address"})
+	}
+}
+
+func makeConfirmEmailChangeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.ConfirmEmailChange(req.Token); err != nil {
+			contactChangeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeRequestPhoneChangeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Phone string `json:"phone"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.RequestPhoneChange(uid, req.Phone); err != nil {
+			contactChangeError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "a confirmation code has been sent to the new number"})
+	}
+}
+
+func makeConfirmPhoneChangeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Phone string `json:"phone"`
+			Code  string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Phone == "" || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.ConfirmPhoneChange(uid, req.Phone, req.Code); err != nil {
+			contactChangeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
 	}
 }
 
@@ -120,21 +395,108 @@ func makeResetHandler(uc Usecase) gin.HandlerFunc {
 	}
 }
 
+// isPasswordRejected reports policy and breach list rejections
+func isPasswordRejected(err error) bool {
+	return errors.Is(err, password.ErrWeak) || errors.Is(err, password.ErrBreached)
+}
+
+func makeChangePasswordHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+			// RefreshToken keeps the caller's session logged in
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "current_password and new_password are required"})
+			return
+		}
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		token, err := uc.ChangePassword(uid, req.CurrentPassword, req.NewPassword, req.RefreshToken)
+		if err != nil {
+			switch {
+			case errors.Is(err, errWrongPassword):
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			case isPasswordRejected(err):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		expiresAt := time.Now().UTC().Add(jwtpkg.AccessTokenTTL)
+		c.JSON(http.StatusOK, gin.H{
+			"token":      token,
+			"expires_in": int(jwtpkg.AccessTokenTTL.Seconds()),
+			"expires_at": expiresAt.Format(time.RFC3339),
+		})
+	}
+}
+
+func makeIntrospectHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, secret := oauthClientCredentials(c)
+		if err := uc.AuthenticateIntrospection(clientID, secret); err != nil {
+			writeOAuthError(c, err)
+			return
+		}
+		token := c.PostForm("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+			return
+		}
+		res, err := uc.Introspect(token)
+		if err != nil {
+			log.Printf("introspect: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "introspection failed"})
+			return
+		}
+		// answers must not be reused by proxies; clients cache them themselves
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+func makeSSONonceHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nonce, err := uc.SSONonce(c.Param("provider"))
+		if err == errUnknownProvider {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"nonce": nonce, "expires_in": int(jwtpkg.SSONonceTTL.Seconds())})
+	}
+}
+
 func makeSSOHandler(uc Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			IDToken string `json:"id_token"`
+			Nonce   string `json:"nonce"`
 		}
-		if err := c.ShouldBindJSON(&req); err != nil || req.IDToken == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		if err := c.ShouldBindJSON(&req); err != nil || req.IDToken == "" || req.Nonce == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "id_token and nonce are required"})
+			return
+		}
+		token, userID, err := uc.SSOLogin(c.Param("provider"), req.IDToken, req.Nonce)
+		if err == errUnknownProvider {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		token, userID, err := uc.SSOLogin(req.IDToken)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
-		refresh, refreshExp, err := uc.IssueRefreshToken(userID)
+		refresh, refreshExp, err := uc.IssueRefreshToken(userID, clientInfo(c))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -171,13 +533,33 @@ func makeLoginHandler(uc Usecase) gin.HandlerFunc {
 			return
 		}
 
-		token, userID, err := uc.Login(req.Email, req.Password)
+		token, userID, mfaRequired, err := uc.Login(req.Email, req.Password, clientInfo(c))
+		var locked *loginguard.LockedError
+		if errors.As(err, &locked) {
+			c.Header("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		if err == errAccountInactive {
+			// only reported after the password was verified
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 			return
 		}
+		if mfaRequired {
+			// second step: client must call /api/v1/auth/2fa/login with this token
+			c.JSON(http.StatusOK, gin.H{
+				"mfa_required": true,
+				"mfa_token":    token,
+				"expires_in":   int(jwtpkg.MFATokenTTL.Seconds()),
+			})
+			return
+		}
 
-		refreshToken, refreshExp, err := uc.IssueRefreshToken(userID)
+		refreshToken, refreshExp, err := uc.IssueRefreshToken(userID, clientInfo(c))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue refresh token"})
 			return
@@ -198,126 +580,132 @@ func makeLoginHandler(uc Usecase) gin.HandlerFunc {
 	}
 }
 
-func makeListUsersHandler(uc Usecase) gin.HandlerFunc {
+func makeMagicLinkRequestHandler(uc Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// parse pagination
-		page := 1
-		limit := 10
-		// enforce a reasonable max limit
-		const maxLimit = 100
-		if p := c.Query("page"); p != "" {
-			if v, err := strconv.Atoi(p); err == nil && v > 0 {
-				page = v
-			}
-		}
-		if l := c.Query("limit"); l != "" {
-			if v, err := strconv.Atoi(l); err == nil && v > 0 {
-				limit = v
-			}
-		}
-		if limit > maxLimit {
-			limit = maxLimit
+		var req struct {
+			Email string `json:"email"`
 		}
-		search := c.Query("search")
-		users, total, err := uc.ListUsers(page, limit, search)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		resp := map[string]interface{}{
-			"data": users,
-			"pagination": map[string]interface{}{
-				"page":  page,
-				"limit": limit,
-				"total": total,
-			},
+		if err := uc.RequestMagicLink(req.Email); err != nil {
+			log.Printf("magic link: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send login link"})
+			return
 		}
-		c.JSON(http.StatusOK, resp)
+		// same response whether or not the email exists
+		c.JSON(http.StatusAccepted, gin.H{"message": "if the email is registered, a login link has been sent"})
 	}
 }
 
-func makeGetUserHandler(uc Usecase) gin.HandlerFunc {
+func makeMagicLinkLoginHandler(uc Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		idStr := c.Param("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-			return
+		var req struct {
+			Token string `json:"token"`
 		}
-		// permission: admin or owner
-		reqUID, ok := middleware.GinGetUserID(c)
-		role, _ := middleware.GinGetRole(c)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		if role != "admin" && reqUID != id {
-			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-			return
+		token, userID, mfaRequired, err := uc.MagicLinkLogin(req.Token)
+		respondPasswordlessLogin(c, uc, token, userID, mfaRequired, err)
+	}
+}
+
+func makePhoneOTPRequestHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Phone string `json:"phone"`
 		}
-		u, err := uc.GetUserByID(id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := c.ShouldBindJSON(&req); err != nil || req.Phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		if u == nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		if err := uc.RequestPhoneOTP(req.Phone); err != nil {
+			log.Printf("sms login code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send login code"})
 			return
 		}
-		c.JSON(http.StatusOK, u)
+		c.JSON(http.StatusAccepted, gin.H{"message": "if the phone number is registered, a login code has been sent"})
 	}
 }
 
-func makeUpdateUserHandler(uc Usecase) gin.HandlerFunc {
+func makePhoneOTPLoginHandler(uc Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		idStr := c.Param("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-			return
-		}
-		reqUID, ok := middleware.GinGetUserID(c)
-		role, _ := middleware.GinGetRole(c)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			return
-		}
-		var body struct {
-			Name  *string `json:"name"`
-			Phone *string `json:"phone"`
-			Role  *string `json:"role"`
+		var req struct {
+			Phone string `json:"phone"`
+			Code  string `json:"code"`
 		}
-		if err := c.ShouldBindJSON(&body); err != nil {
+		if err := c.ShouldBindJSON(&req); err != nil || req.Phone == "" || req.Code == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		// enforce authorization in usecase
-		if err := uc.UpdateUser(reqUID, id, role, body.Name, body.Phone, body.Role); err != nil {
-			if err.Error() == "forbidden" {
-				c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		c.Status(http.StatusNoContent)
+		token, userID, mfaRequired, err := uc.PhoneOTPLogin(req.Phone, req.Code)
+		respondPasswordlessLogin(c, uc, token, userID, mfaRequired, err)
 	}
 }
 
-func makeRefreshHandler(uc Usecase) gin.HandlerFunc {
+// respondPasswordlessLogin writes the same responses as the password login
+func respondPasswordlessLogin(c *gin.Context, uc Usecase, token string, userID int64, mfaRequired bool, err error) {
+	if err == errAccountInactive {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err == errInvalidLoginToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if mfaRequired {
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    token,
+			"expires_in":   int(jwtpkg.MFATokenTTL.Seconds()),
+		})
+		return
+	}
+	refresh, refreshExp, err := uc.IssueRefreshToken(userID, clientInfo(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue refresh token"})
+		return
+	}
+	expiresAt := time.Now().UTC().Add(jwtpkg.AccessTokenTTL)
+	c.JSON(http.StatusOK, gin.H{
+		"token":              token,
+		"expires_in":         int(jwtpkg.AccessTokenTTL.Seconds()),
+		"expires_at":         expiresAt.Format(time.RFC3339),
+		"refresh_token":      refresh,
+		"refresh_expires_at": refreshExp.UTC().Format(time.RFC3339),
+	})
+}
+
+func makeMFALoginHandler(uc Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			RefreshToken string `json:"refresh_token"`
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
 		}
-		if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		if err := c.ShouldBindJSON(&req); err != nil || req.MFAToken == "" || req.Code == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		token, refresh, refreshExp, err := uc.Refresh(req.RefreshToken)
+		token, userID, err := uc.VerifyMFALogin(req.MFAToken, req.Code)
+		if writeMFALocked(c, err) {
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
+		refresh, refreshExp, err := uc.IssueRefreshToken(userID, clientInfo(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue refresh token"})
+			return
+		}
 		expiresAt := time.Now().UTC().Add(1 * time.Hour)
 		c.JSON(http.StatusOK, map[string]interface{}{
 			"token":              token,
@@ -329,8 +717,354 @@ func makeRefreshHandler(uc Usecase) gin.HandlerFunc {
 	}
 }
 
-func makeRevokeHandler(uc Usecase) gin.HandlerFunc {
-	return func(c *gin.Context) {
+// writeMFALocked answers 429 with Retry-After if err is a second factor lockout
+func writeMFALocked(c *gin.Context, err error) bool {
+	var locked *loginguard.LockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	return true
+}
+
+func makeMFAEnrollHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		secret, otpauthURL, err := uc.EnrollMFA(uid)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_url": otpauthURL})
+	}
+}
+
+func makeMFAVerifyHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		codes, err := uc.ConfirmMFA(uid, req.Code)
+		if writeMFALocked(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// recovery codes are only ever shown here
+		c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+	}
+}
+
+func makeMFADisableHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		err := uc.DisableMFA(uid, req.Code)
+		if writeMFALocked(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// maxImportBytes bounds the body of a bulk import
+const maxImportBytes = 5 << 20
+
+func makeImportUsersHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+		var rows []models.UserImportRow
+		var err error
+		switch c.ContentType() {
+		case "text/csv", "application/csv":
+			rows, err = parseImportCSV(c.Request.Body)
+		case "application/json":
+			err = json.NewDecoder(c.Request.Body).Decode(&rows)
+		default:
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "send text/csv or application/json"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+		results, err := uc.ImportUsers(middleware.GinGetPermissions(c), rows, dryRun)
+		if err == errTooManyRows {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		failed := 0
+		for _, r := range results {
+			if r.Status == models.ImportError {
+				failed++
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"dry_run":   dryRun,
+			"succeeded": len(results) - failed,
+			"failed":    failed,
+			"results":   results,
+		})
+	}
+}
+
+// importColumns maps CSV header names to row fields
+var importColumns = map[string]func(*models.UserImportRow, string){
+	"name":       func(r *models.UserImportRow, v string) { r.Name = v },
+	"email":      func(r *models.UserImportRow, v string) { r.Email = v },
+	"phone":      func(r *models.UserImportRow, v string) { r.Phone = v },
+	"password":   func(r *models.UserImportRow, v string) { r.Password = v },
+	"role":       func(r *models.UserImportRow, v string) { r.Role = v },
+	"store_name": func(r *models.UserImportRow, v string) { r.StoreName = v },
+}
+
+// parseImportCSV reads rows of a CSV with a header line naming its columns
+func parseImportCSV(r io.Reader) ([]models.UserImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %w", err)
+	}
+	setters := make([]func(*models.UserImportRow, string), len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if setters[i] = importColumns[name]; setters[i] == nil {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+	var rows []models.UserImportRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var row models.UserImportRow
+		for i, v := range rec {
+			setters[i](&row, v)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func makeExportUsersHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="users.csv"`)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"id", "name", "email", "phone", "role", "status", "email_verified_at", "created_at"})
+		n := 0
+		err := uc.ExportUsers(c.Query("search"), func(u *models.User) error {
+			verified := ""
+			if u.EmailVerifiedAt != nil {
+				verified = u.EmailVerifiedAt.UTC().Format(time.RFC3339)
+			}
+			w.Write([]string{strconv.FormatInt(u.ID, 10), csvSafe(u.Name), csvSafe(u.Email), csvSafe(u.Phone), u.Role, u.Status, verified, u.CreatedAt.UTC().Format(time.RFC3339)})
+			// stream instead of buffering every user in memory
+			if n++; n%100 == 0 {
+				w.Flush()
+				c.Writer.Flush()
+			}
+			return w.Error()
+		})
+		w.Flush()
+		if err != nil {
+			// the status line is gone; a truncated file is all we can signal
+			log.Printf("export users: %v", err)
+		}
+	}
+}
+
+// csvSafe keeps spreadsheets from evaluating user-entered values as formulas.
+// Phone numbers such as +62 811 stay as they are.
+func csvSafe(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+	if strings.Trim(s, "+-0123456789 ()") == "" {
+		return s
+	}
+	return "'" + s
+}
+
+func makeListUsersHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// parse pagination
+		page := 1
+		limit := 10
+		// enforce a reasonable max limit
+		const maxLimit = 100
+		if p := c.Query("page"); p != "" {
+			if v, err := strconv.Atoi(p); err == nil && v > 0 {
+				page = v
+			}
+		}
+		if l := c.Query("limit"); l != "" {
+			if v, err := strconv.Atoi(l); err == nil && v > 0 {
+				limit = v
+			}
+		}
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+		search := c.Query("search")
+		users, total, err := uc.ListUsers(page, limit, search)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp := map[string]interface{}{
+			"data": users,
+			"pagination": map[string]interface{}{
+				"page":  page,
+				"limit": limit,
+				"total": total,
+			},
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func makeGetUserHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		// permission: owner or user:read:any
+		reqUID, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if !middleware.GinGetPermissions(c).Has(rbac.UserReadAny) && reqUID != id {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		u, err := uc.GetUserByID(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if u == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, u)
+	}
+}
+
+func makeUpdateUserHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		reqUID, ok := middleware.GinGetUserID(c)
+		perms := middleware.GinGetPermissions(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var body struct {
+			Name  *string `json:"name"`
+			Phone *string `json:"phone"`
+			Role  *string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		// enforce authorization in usecase
+		if err := uc.UpdateUser(reqUID, id, perms, body.Name, body.Phone, body.Role); err != nil {
+			if err.Error() == "forbidden" {
+				c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+				return
+			}
+			if err == errPhoneNeedsConfirm {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, errPhoneTaken) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeRefreshHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		token, refresh, refreshExp, err := uc.Refresh(req.RefreshToken, clientInfo(c))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		expiresAt := time.Now().UTC().Add(1 * time.Hour)
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"token":              token,
+			"expires_in":         3600,
+			"expires_at":         expiresAt.Format(time.RFC3339),
+			"refresh_token":      refresh,
+			"refresh_expires_at": refreshExp.Format(time.RFC3339),
+		})
+	}
+}
+
+func makeRevokeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		var req struct {
 			RefreshToken string `json:"refresh_token"`
 		}
@@ -342,7 +1076,170 @@ func makeRevokeHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.Status(http.StatusNoContent)
+		if token, ok := middleware.GinGetToken(c); ok {
+			if err := uc.RevokeAccessToken(token); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeUnlockUserHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if err := uc.UnlockUser(id); err != nil {
+			if err.Error() == "user not found" {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeForceLogoutHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if err := uc.RevokeAllRefreshTokens(id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeImpersonateHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		actorID, _ := middleware.GinGetUserID(c)
+		token, expiresAt, err := uc.Impersonate(actorID, middleware.GinGetPermissions(c), id, req.Reason)
+		if err != nil {
+			switch {
+			case errors.Is(err, errImpersonation):
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			case errors.Is(err, errAccountInactive):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err.Error() == "user not found":
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case err.Error() == "reason is required (max 255 characters)":
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"token":      token,
+			"expires_in": int(time.Until(expiresAt).Seconds()),
+			"expires_at": expiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+func makeSetUserStatusHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var req struct {
+			Status string `json:"status"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		requesterID, _ := middleware.GinGetUserID(c)
+		if err := uc.SetUserStatus(requesterID, id, req.Status); err != nil {
+			switch {
+			case errors.Is(err, errInvalidStatus), errors.Is(err, errOwnStatus):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, errAccountGone):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err.Error() == "user not found":
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// makeDeleteAccountHandler deletes the account in the :id parameter, or the
+// caller's own account on /me
+func makeDeleteAccountHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if p := c.Param("id"); p != "" {
+			var err error
+			if id, err = strconv.ParseInt(p, 10, 64); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+				return
+			}
+		}
+		if err := uc.DeleteAccount(id); err != nil {
+			switch {
+			case errors.Is(err, errAccountGone):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err.Error() == "user not found":
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeExportHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		export, err := uc.ExportUserData(id)
+		if err != nil {
+			if err.Error() == "user not found" {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.json"`, id))
+		c.IndentedJSON(http.StatusOK, export)
 	}
 }
 
@@ -361,12 +1258,10 @@ func makeRevokeAllHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
-
 		var target int64
 		if req.UserID != nil {
-			// admin may revoke for any user
-			if role != "admin" {
+			// revoking for another user needs user:sessions:any
+			if !middleware.GinGetPermissions(c).Has(rbac.UserSessionsAny) {
 				c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 				return
 			}
@@ -382,3 +1277,450 @@ func makeRevokeAllHandler(uc Usecase) gin.HandlerFunc {
 		c.Status(http.StatusNoContent)
 	}
 }
+
+// clientInfo captures the device details stored with a session
+func clientInfo(c *gin.Context) ClientInfo {
+	return ClientInfo{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
+}
+
+// sessionTarget returns the user whose sessions are addressed: the requester, or
+// the user given by ?user_id= (authorization is enforced in the usecase)
+func sessionTarget(c *gin.Context, requesterID int64) (int64, bool) {
+	v := c.Query("user_id")
+	if v == "" {
+		return requesterID, true
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	return id, err == nil
+}
+
+func makeListSessionsHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requesterID, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		target, ok := sessionTarget(c, requesterID)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return
+		}
+		sessions, err := uc.ListSessions(requesterID, perms, target)
+		if err != nil {
+			if err.Error() == "forbidden" {
+				c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": sessions})
+	}
+}
+
+func makeRevokeSessionHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requesterID, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		target, ok := sessionTarget(c, requesterID)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return
+		}
+		if err := uc.RevokeSession(requesterID, perms, target, c.Param("id")); err != nil {
+			switch err.Error() {
+			case "forbidden":
+				c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			case "session not found":
+				c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// apiKeyError maps API key usecase errors to responses
+func apiKeyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errScopeNotGranted):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errAPIKeyName), errors.Is(err, errAPIKeyExpiry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func makeCreateAPIKeyHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Name      string     `json:"name"`
+			Scopes    []string   `json:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		key, k, err := uc.CreateAPIKey(uid, middleware.GinGetPermissions(c), req.Name, req.Scopes, req.ExpiresAt)
+		if err != nil {
+			apiKeyError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"key": key, "api_key": k})
+	}
+}
+
+func makeListAPIKeysHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		keys, err := uc.ListAPIKeys(uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": keys})
+	}
+}
+
+func makeUpdateAPIKeyHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var req struct {
+			Name   *string  `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		k, err := uc.UpdateAPIKey(uid, middleware.GinGetPermissions(c), id, req.Name, req.Scopes)
+		if err != nil {
+			apiKeyError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, k)
+	}
+}
+
+func makeDeleteAPIKeyHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if err := uc.DeleteAPIKey(uid, id); err != nil {
+			apiKeyError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// writeOAuthError answers with an RFC 6749 error body; other errors are server errors
+func writeOAuthError(c *gin.Context, err error) {
+	var oe *OAuthError
+	if !errors.As(err, &oe) {
+		log.Printf("oauth: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	status := http.StatusBadRequest
+	if oe.Code == "invalid_client" {
+		status = http.StatusUnauthorized
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.JSON(status, gin.H{"error": oe.Code, "error_description": oe.Description})
+}
+
+// oauthClientCredentials reads client credentials from HTTP Basic auth
+// (form-urlencoded, RFC 6749 section 2.3.1) or the request body
+func oauthClientCredentials(c *gin.Context) (string, string) {
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		return id, secret
+	}
+	return c.PostForm("client_id"), c.PostForm("client_secret")
+}
+
+func makeCreateOAuthClientHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			Name         string   `json:"name"`
+			OwnerID      int64    `json:"owner_id"`
+			RedirectURIs []string `json:"redirect_uris"`
+			Scopes       []string `json:"scopes"`
+			GrantTypes   []string `json:"grant_types"`
+			Confidential *bool    `json:"confidential"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		client := &models.OAuthClient{
+			Name:         req.Name,
+			OwnerID:      req.OwnerID,
+			RedirectURIs: req.RedirectURIs,
+			Scopes:       req.Scopes,
+			GrantTypes:   req.GrantTypes,
+			Confidential: req.Confidential == nil || *req.Confidential,
+		}
+		// the partner's account, or whoever registers the client
+		if client.OwnerID == 0 {
+			client.OwnerID = uid
+		}
+		secret, err := uc.CreateOAuthClient(client)
+		if errors.Is(err, errInvalidOAuthClient) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp := gin.H{"client": client}
+		if secret != "" {
+			resp["client_secret"] = secret
+		}
+		c.JSON(http.StatusCreated, resp)
+	}
+}
+
+func makeListOAuthClientsHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clients, err := uc.ListOAuthClients()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": clients})
+	}
+}
+
+func makeRevokeOAuthClientHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := uc.RevokeOAuthClient(c.Param("client_id"))
+		if errors.Is(err, errOAuthClientNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+type oauthAuthorizeParams struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+}
+
+func (p oauthAuthorizeParams) request() OAuthAuthorizeRequest {
+	return OAuthAuthorizeRequest(p)
+}
+
+func makeOAuthAuthorizeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var p oauthAuthorizeParams
+		if err := c.ShouldBindQuery(&p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		a, err := uc.AuthorizeOAuth(uid, p.request())
+		if err != nil {
+			writeOAuthError(c, err)
+			return
+		}
+		scopes := make([]gin.H, 0, len(a.Scopes))
+		for _, s := range a.Scopes {
+			scopes = append(scopes, gin.H{"scope": s, "description": oauth.Descriptions[s]})
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"client":       gin.H{"client_id": a.Client.ClientID, "name": a.Client.Name},
+			"redirect_uri": a.RedirectURI,
+			"scopes":       scopes,
+			"consented":    a.Consented,
+		})
+	}
+}
+
+func makeOAuthApproveHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		var req struct {
+			oauthAuthorizeParams
+			Approve bool `json:"approve"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		redirect, err := uc.ApproveOAuth(uid, req.request(), req.Approve)
+		if err != nil {
+			writeOAuthError(c, err)
+			return
+		}
+		// the consent screen sends the browser there
+		c.JSON(http.StatusOK, gin.H{"redirect_to": redirect})
+	}
+}
+
+func makeOAuthTokenHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, secret := oauthClientCredentials(c)
+		req := OAuthTokenRequest{
+			GrantType:    c.PostForm("grant_type"),
+			ClientID:     clientID,
+			ClientSecret: secret,
+			Code:         c.PostForm("code"),
+			RedirectURI:  c.PostForm("redirect_uri"),
+			CodeVerifier: c.PostForm("code_verifier"),
+			RefreshToken: c.PostForm("refresh_token"),
+			Scope:        c.PostForm("scope"),
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		token, err := uc.OAuthToken(req, clientInfo(c))
+		if err != nil {
+			writeOAuthError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, token)
+	}
+}
+
+// makeOAuthRevokeHandler answers 200 for unknown tokens too (RFC 7009)
+func makeOAuthRevokeHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, secret := oauthClientCredentials(c)
+		token := c.PostForm("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "token is required"})
+			return
+		}
+		if err := uc.RevokeOAuthToken(clientID, secret, token); err != nil {
+			writeOAuthError(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+func makeOAuthUserInfoHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		user, err := uc.GetUserByID(uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"sub":            strconv.FormatInt(user.ID, 10),
+			"name":           user.Name,
+			"email":          user.Email,
+			"email_verified": user.EmailVerifiedAt != nil,
+			"phone_number":   user.Phone,
+		})
+	}
+}
+
+func makeListOAuthConsentsHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		consents, err := uc.ListOAuthConsents(uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": consents})
+	}
+}
+
+func makeRevokeOAuthConsentHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		err := uc.RevokeOAuthConsent(uid, c.Param("client_id"))
+		if errors.Is(err, errOAuthConsentMissing) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
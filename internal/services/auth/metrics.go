@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// loginAttempts counts password logins by result: success, failure or locked
+	loginAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_login_attempts_total",
+			Help: "Total number of password login attempts by result",
+		},
+		[]string{"result"},
+	)
+
+	// loginLockouts counts temporary lockouts by scope: account or ip
+	loginLockouts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_login_lockouts_total",
+			Help: "Total number of temporary login lockouts",
+		},
+		[]string{"scope"},
+	)
+)
@@ -2,13 +2,24 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
 	"strings"
 	"time"
 
+	"github.com/example/ms-ecommerce/internal/pkg/apikey"
+	"github.com/example/ms-ecommerce/internal/pkg/db"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/oauth"
 )
 
 type Repository interface {
+	// WithTx runs fn with a Repository bound to one database transaction, committed
+	// if fn returns nil and rolled back otherwise. Nested calls join the outer
+	// transaction.
+	WithTx(fn func(tx Repository) error) error
+
+	// CreateUser returns errEmailTaken or errPhoneTaken when the unique
+	// constraint on email or phone is violated
 	CreateUser(user *models.User) (int64, error)
 	CreateStore(userID int64, name string) error
 	GetUserByEmail(email string) (*models.User, error)
@@ -16,29 +27,176 @@ type Repository interface {
 	UpdatePassword(userID int64, hashed string) error
 	UpdateUser(id int64, name, phone, role *string) error
 	GetUserByID(id int64) (*models.User, error)
+	MarkEmailVerified(userID int64) error
+	// UpdateEmail sets a confirmed new email address (verified). Returns
+	// errEmailTaken when the address belongs to another user.
+	UpdateEmail(userID int64, email string) error
 	// ListUsers returns a page of users and the total count. If search is non-empty,
 	// it filters by name or email containing the search term.
 	ListUsers(page, limit int, search string) ([]*models.User, int, error)
+	// SetUserStatus changes the account status and bumps the token version
+	SetUserStatus(id int64, status string) error
+	// DeleteUserData anonymizes a user and removes their personal data. Records that
+	// orders reference (addresses, the store) are scrubbed instead of deleted so the
+	// order history stays intact. Run it inside WithTx. It returns the URLs of the
+	// deleted products' images, whose files the caller removes after commit.
+	DeleteUserData(userID int64) (imageURLs []string, err error)
+	// GetUserExport collects a user's addresses, store, products and transactions
+	GetUserExport(userID int64) (*models.UserExport, error)
 
+	// External identities (SSO). GetUserByIdentity returns nil if none is linked.
+	GetUserByIdentity(provider, subject string) (*models.User, error)
+	CreateIdentity(userID int64, provider, subject, email string) error
 	// Refresh token operations
-	CreateRefreshToken(userID int64, tokenHash string, expiresAt time.Time) error
-	GetRefreshToken(tokenHash string) (userID int64, expiresAt time.Time, found bool, err error)
+	CreateRefreshToken(t *models.RefreshToken) (int64, error)
+	// GetRefreshToken returns nil if no token has the given hash
+	GetRefreshToken(tokenHash string) (*models.RefreshToken, error)
+	// MarkRefreshTokenRotated sets rotated_at; false means it was already rotated
+	MarkRefreshTokenRotated(id int64) (bool, error)
 	DeleteRefreshToken(tokenHash string) error
+	DeleteRefreshTokenFamily(familyID string) error
 	DeleteRefreshTokensByUser(userID int64) error
+	// DeleteOtherRefreshTokens deletes every session of userID except keepFamily
+	// ("" deletes all)
+	DeleteOtherRefreshTokens(userID int64, keepFamily string) error
+	// Sessions are refresh token families; the family ID is the session ID
+	ListSessions(userID int64) ([]*models.Session, error)
+	// DeleteSession revokes one session of userID; false if it does not exist
+	DeleteSession(userID int64, sessionID string) (bool, error)
+	RecordSecurityEvent(userID int64, eventType, detail string) error
+
+	// Passwordless login tokens (magic links, SMS codes)
+	CreateLoginToken(t *models.LoginToken) (int64, error)
+	// CountLoginTokens counts the tokens sent to destination since a point in time
+	CountLoginTokens(channel, destination string, since time.Time) (int, error)
+	// LatestLoginToken returns the newest unused, unexpired token of a
+	// destination, or nil
+	LatestLoginToken(channel, destination string) (*models.LoginToken, error)
+	// GetLoginTokenByHash returns an unused, unexpired token, or nil
+	GetLoginTokenByHash(channel, tokenHash string) (*models.LoginToken, error)
+	// ClaimLoginTokenAttempt atomically counts one attempt against an unused
+	// token; false once max attempts are spent or the token was used
+	ClaimLoginTokenAttempt(id int64, max int) (bool, error)
+	// UseLoginToken marks a token used; false if it was already used (replay)
+	UseLoginToken(id int64) (bool, error)
+	// InvalidateLoginTokens marks all unused tokens of userID on channel used
+	InvalidateLoginTokens(userID int64, channel string) error
+
+	// OAuth clients, authorization codes and consents
+	CreateOAuthClient(c *models.OAuthClient) (int64, error)
+	// GetOAuthClient returns nil if no client has clientID; revoked clients are returned
+	GetOAuthClient(clientID string) (*models.OAuthClient, error)
+	ListOAuthClients() ([]*models.OAuthClient, error)
+	// RevokeOAuthClient sets revoked_at; false if the client is unknown or already revoked
+	RevokeOAuthClient(clientID string) (bool, error)
+	// DeleteOAuthRefreshTokens deletes the refresh tokens a client holds for
+	// userID (0 deletes them for every user)
+	DeleteOAuthRefreshTokens(clientID string, userID int64) error
+	CreateOAuthCode(c *models.OAuthCode) (int64, error)
+	// GetOAuthCode returns the code with the given hash, used or not, or nil
+	GetOAuthCode(codeHash string) (*models.OAuthCode, error)
+	// UseOAuthCode marks a code used and records the refresh token family issued
+	// for it; false if it was already used (replay)
+	UseOAuthCode(id int64, familyID string) (bool, error)
+	// GetOAuthConsent returns nil if userID never consented to the client
+	GetOAuthConsent(userID int64, clientID string) (*models.OAuthConsent, error)
+	// SaveOAuthConsent creates or replaces the scopes userID granted a client
+	SaveOAuthConsent(userID int64, clientID string, scopes []string) error
+	ListOAuthConsents(userID int64) ([]*models.OAuthConsent, error)
+	// DeleteOAuthConsent returns false if userID has no consent for the client
+	DeleteOAuthConsent(userID int64, clientID string) (bool, error)
+
+	// API keys
+	CreateAPIKey(k *models.APIKey) (int64, error)
+	ListAPIKeys(userID int64) ([]*models.APIKey, error)
+	// GetAPIKey returns nil if userID has no key with that id
+	GetAPIKey(userID, id int64) (*models.APIKey, error)
+	UpdateAPIKey(k *models.APIKey) error
+	// DeleteAPIKey returns false if userID has no key with that id
+	DeleteAPIKey(userID, id int64) (bool, error)
+
+	// Two-factor authentication
+	// UpsertMFASecret stores a new (not yet enabled) TOTP secret for the user,
+	// replacing any previous enrollment.
+	UpsertMFASecret(userID int64, secret string) error
+	GetMFA(userID int64) (*models.UserMFA, error)
+	EnableMFA(userID int64, step int64) error
+	// MarkMFAStepUsed records step as the last accepted TOTP step. It returns false
+	// if a code for the same or a later step was already used (replay).
+	MarkMFAStepUsed(userID int64, step int64) (bool, error)
+	DeleteMFA(userID int64) error
+	ReplaceRecoveryCodes(userID int64, codeHashes []string) error
+	// ConsumeRecoveryCode marks an unused recovery code as used and reports whether it matched.
+	ConsumeRecoveryCode(userID int64, codeHash string) (bool, error)
+}
+
+// dbtx is implemented by *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type mysqlRepo struct {
-	db *sql.DB
+	db dbtx
+	// conn starts transactions; nil for a repository bound to a transaction
+	conn *sql.DB
 }
 
 func NewRepo(db *sql.DB) Repository {
-	return &mysqlRepo{db: db}
+	return &mysqlRepo{db: db, conn: db}
+}
+
+func (r *mysqlRepo) WithTx(fn func(tx Repository) error) (err error) {
+	if r.conn == nil {
+		return fn(r)
+	}
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(&mysqlRepo{db: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var (
+	errEmailTaken = errors.New("email already registered")
+	errPhoneTaken = errors.New("phone number already registered")
+)
+
+// uniqueError maps violations of the users' unique constraints to friendly errors
+func uniqueError(err error) error {
+	switch key, _ := db.DuplicateKey(err); key {
+	case "email":
+		return errEmailTaken
+	case "phone":
+		return errPhoneTaken
+	}
+	return err
+}
+
+// nullIfEmpty stores optional values such as the phone of SSO users as NULL,
+// which unlike an empty string does not collide in a UNIQUE index
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
 }
 
 func (r *mysqlRepo) CreateUser(user *models.User) (int64, error) {
-	res, err := r.db.Exec("INSERT INTO users (name,email,phone,password,role) VALUES (?,?,?,?,?)", user.Name, user.Email, user.Phone, user.Password, user.Role)
+	res, err := r.db.Exec("INSERT INTO users (name,email,phone,password,role) VALUES (?,?,?,?,?)", user.Name, user.Email, nullIfEmpty(user.Phone), user.Password, user.Role)
 	if err != nil {
-		return 0, err
+		return 0, uniqueError(err)
 	}
 	id, _ := res.LastInsertId()
 	return id, nil
@@ -49,10 +207,28 @@ func (r *mysqlRepo) CreateStore(userID int64, name string) error {
 	return err
 }
 
-func (r *mysqlRepo) GetUserByEmail(email string) (*models.User, error) {
+// userColumns is the column list read by scanUser
+const userColumns = "id,name,email,COALESCE(phone,''),password,role,email_verified_at,status,token_version,created_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (*models.User, error) {
 	u := &models.User{}
-	row := r.db.QueryRow("SELECT id,name,email,phone,password,role,created_at FROM users WHERE email = ?", email)
-	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Phone, &u.Password, &u.Role, &u.CreatedAt)
+	var verifiedAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Phone, &u.Password, &u.Role, &verifiedAt, &u.Status, &u.TokenVersion, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	if verifiedAt.Valid {
+		t := verifiedAt.Time
+		u.EmailVerifiedAt = &t
+	}
+	return u, nil
+}
+
+func (r *mysqlRepo) GetUserByEmail(email string) (*models.User, error) {
+	u, err := scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ?", email))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -63,9 +239,7 @@ func (r *mysqlRepo) GetUserByEmail(email string) (*models.User, error) {
 }
 
 func (r *mysqlRepo) GetUserByPhone(phone string) (*models.User, error) {
-	u := &models.User{}
-	row := r.db.QueryRow("SELECT id,name,email,phone,password,role,created_at FROM users WHERE phone = ?", phone)
-	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Phone, &u.Password, &u.Role, &u.CreatedAt)
+	u, err := scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE phone = ?", phone))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -81,9 +255,8 @@ func (r *mysqlRepo) UpdatePassword(userID int64, hashed string) error {
 }
 
 func (r *mysqlRepo) GetUserByID(id int64) (*models.User, error) {
-	u := &models.User{}
-	row := r.db.QueryRow("SELECT id,name,email,phone,role,created_at FROM users WHERE id = ?", id)
-	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Phone, &u.Role, &u.CreatedAt); err != nil {
+	u, err := scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -92,6 +265,16 @@ func (r *mysqlRepo) GetUserByID(id int64) (*models.User, error) {
 	return u, nil
 }
 
+func (r *mysqlRepo) MarkEmailVerified(userID int64) error {
+	_, err := r.db.Exec("UPDATE users SET email_verified_at = NOW() WHERE id = ? AND email_verified_at IS NULL", userID)
+	return err
+}
+
+func (r *mysqlRepo) UpdateEmail(userID int64, email string) error {
+	_, err := r.db.Exec("UPDATE users SET email = ?, email_verified_at = NOW() WHERE id = ?", email, userID)
+	return uniqueError(err)
+}
+
 func (r *mysqlRepo) UpdateUser(id int64, name, phone, role *string) error {
 	// Build dynamic update
 	sets := []string{}
@@ -102,11 +285,13 @@ func (r *mysqlRepo) UpdateUser(id int64, name, phone, role *string) error {
 	}
 	if phone != nil {
 		sets = append(sets, "phone = ?")
-		args = append(args, *phone)
+		args = append(args, nullIfEmpty(*phone))
 	}
 	if role != nil {
-		sets = append(sets, "role = ?")
-		args = append(args, *role)
+		// bump the token version on a role change so outdated tokens can be told apart;
+		// it must be evaluated before role is assigned
+		sets = append(sets, "token_version = token_version + (role <> ?)", "role = ?")
+		args = append(args, *role, *role)
 	}
 	if len(sets) == 0 {
 		return nil
@@ -114,7 +299,7 @@ func (r *mysqlRepo) UpdateUser(id int64, name, phone, role *string) error {
 	args = append(args, id)
 	q := "UPDATE users SET " + strings.Join(sets, ", ") + " WHERE id = ?"
 	_, err := r.db.Exec(q, args...)
-	return err
+	return uniqueError(err)
 }
 
 func (r *mysqlRepo) ListUsers(page, limit int, search string) ([]*models.User, int, error) {
@@ -142,10 +327,10 @@ func (r *mysqlRepo) ListUsers(page, limit int, search string) ([]*models.User, i
 	var rows *sql.Rows
 	var err error
 	if search == "" {
-		rows, err = r.db.Query("SELECT id,name,email,phone,role,created_at FROM users ORDER BY id ASC LIMIT ? OFFSET ?", limit, offset)
+		rows, err = r.db.Query("SELECT "+userColumns+" FROM users ORDER BY id ASC LIMIT ? OFFSET ?", limit, offset)
 	} else {
 		like := "%" + search + "%"
-		rows, err = r.db.Query("SELECT id,name,email,phone,role,created_at FROM users WHERE name LIKE ? OR email LIKE ? ORDER BY id ASC LIMIT ? OFFSET ?", like, like, limit, offset)
+		rows, err = r.db.Query("SELECT "+userColumns+" FROM users WHERE name LIKE ? OR email LIKE ? ORDER BY id ASC LIMIT ? OFFSET ?", like, like, limit, offset)
 	}
 	if err != nil {
 		return nil, 0, err
@@ -153,8 +338,8 @@ func (r *mysqlRepo) ListUsers(page, limit int, search string) ([]*models.User, i
 	defer rows.Close()
 	out := []*models.User{}
 	for rows.Next() {
-		u := &models.User{}
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Phone, &u.Role, &u.CreatedAt); err != nil {
+		u, err := scanUser(rows)
+		if err != nil {
 			return nil, 0, err
 		}
 		out = append(out, u)
@@ -162,22 +347,50 @@ func (r *mysqlRepo) ListUsers(page, limit int, search string) ([]*models.User, i
 	return out, total, nil
 }
 
-func (r *mysqlRepo) CreateRefreshToken(userID int64, tokenHash string, expiresAt time.Time) error {
-	_, err := r.db.Exec("INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?,?,?)", userID, tokenHash, expiresAt)
-	return err
+func (r *mysqlRepo) CreateRefreshToken(t *models.RefreshToken) (int64, error) {
+	// every new row is the result of a login or a refresh, i.e. a use of the session
+	res, err := r.db.Exec("INSERT INTO refresh_tokens (user_id, token_hash, family_id, parent_id, user_agent, ip_address, session_created_at, last_used_at, client_id, scope, expires_at) VALUES (?,?,?,?,?,?,?,NOW(),?,?,?)",
+		t.UserID, t.TokenHash, t.FamilyID, t.ParentID, t.UserAgent, t.IPAddress, t.SessionCreatedAt, nullIfEmpty(t.ClientID), oauth.JoinScope(t.Scopes), t.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	return id, nil
 }
 
-func (r *mysqlRepo) GetRefreshToken(tokenHash string) (int64, time.Time, bool, error) {
-	var userID int64
-	var expiresAt time.Time
-	row := r.db.QueryRow("SELECT user_id, expires_at FROM refresh_tokens WHERE token_hash = ?", tokenHash)
-	if err := row.Scan(&userID, &expiresAt); err != nil {
+func (r *mysqlRepo) GetRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	t := &models.RefreshToken{}
+	var parentID sql.NullInt64
+	var rotatedAt sql.NullTime
+	var clientID sql.NullString
+	var scope string
+	row := r.db.QueryRow("SELECT id, user_id, token_hash, family_id, parent_id, rotated_at, user_agent, ip_address, COALESCE(session_created_at, created_at), client_id, scope, expires_at, created_at FROM refresh_tokens WHERE token_hash = ?", tokenHash)
+	if err := row.Scan(&t.ID, &t.UserID, &t.TokenHash, &t.FamilyID, &parentID, &rotatedAt, &t.UserAgent, &t.IPAddress, &t.SessionCreatedAt, &clientID, &scope, &t.ExpiresAt, &t.CreatedAt); err != nil {
 		if err == sql.ErrNoRows {
-			return 0, time.Time{}, false, nil
+			return nil, nil
 		}
-		return 0, time.Time{}, false, err
+		return nil, err
 	}
-	return userID, expiresAt, true, nil
+	if parentID.Valid {
+		v := parentID.Int64
+		t.ParentID = &v
+	}
+	if rotatedAt.Valid {
+		v := rotatedAt.Time
+		t.RotatedAt = &v
+	}
+	t.ClientID = clientID.String
+	t.Scopes = oauth.ParseScope(scope)
+	return t, nil
+}
+
+func (r *mysqlRepo) MarkRefreshTokenRotated(id int64) (bool, error) {
+	res, err := r.db.Exec("UPDATE refresh_tokens SET rotated_at = NOW() WHERE id = ? AND rotated_at IS NULL", id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
 }
 
 func (r *mysqlRepo) DeleteRefreshToken(tokenHash string) error {
@@ -185,7 +398,595 @@ func (r *mysqlRepo) DeleteRefreshToken(tokenHash string) error {
 	return err
 }
 
+func (r *mysqlRepo) DeleteRefreshTokenFamily(familyID string) error {
+	_, err := r.db.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", familyID)
+	return err
+}
+
+// ListSessions returns the active sessions of a user: the current (not yet rotated)
+// token of every unexpired family. Tokens held by OAuth clients are listed as
+// consents instead.
+func (r *mysqlRepo) ListSessions(userID int64) ([]*models.Session, error) {
+	rows, err := r.db.Query(`SELECT family_id, user_id, user_agent, ip_address, COALESCE(session_created_at, created_at), COALESCE(last_used_at, created_at), expires_at
+		FROM refresh_tokens WHERE user_id = ? AND client_id IS NULL AND rotated_at IS NULL AND expires_at > NOW()
+		ORDER BY COALESCE(last_used_at, created_at) DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.Session{}
+	for rows.Next() {
+		s := &models.Session{}
+		if err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func (r *mysqlRepo) DeleteSession(userID int64, sessionID string) (bool, error) {
+	res, err := r.db.Exec("DELETE FROM refresh_tokens WHERE user_id = ? AND family_id = ?", userID, sessionID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
 func (r *mysqlRepo) DeleteRefreshTokensByUser(userID int64) error {
 	_, err := r.db.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", userID)
 	return err
 }
+
+func (r *mysqlRepo) DeleteOtherRefreshTokens(userID int64, keepFamily string) error {
+	if keepFamily == "" {
+		return r.DeleteRefreshTokensByUser(userID)
+	}
+	_, err := r.db.Exec("DELETE FROM refresh_tokens WHERE user_id = ? AND family_id <> ?", userID, keepFamily)
+	return err
+}
+
+func (r *mysqlRepo) RecordSecurityEvent(userID int64, eventType, detail string) error {
+	_, err := r.db.Exec("INSERT INTO security_events (user_id, event_type, detail) VALUES (?,?,?)", userID, eventType, detail)
+	return err
+}
+
+func (r *mysqlRepo) CreateLoginToken(t *models.LoginToken) (int64, error) {
+	res, err := r.db.Exec("INSERT INTO login_tokens (user_id, channel, destination, token_hash, expires_at) VALUES (?,?,?,?,?)",
+		t.UserID, t.Channel, t.Destination, t.TokenHash, t.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *mysqlRepo) CountLoginTokens(channel, destination string, since time.Time) (int, error) {
+	var n int
+	err := r.db.QueryRow("SELECT COUNT(1) FROM login_tokens WHERE channel = ? AND destination = ? AND created_at >= ?", channel, destination, since).Scan(&n)
+	return n, err
+}
+
+const loginTokenColumns = "id, user_id, channel, destination, token_hash, attempts, expires_at, used_at, created_at"
+
+func scanLoginToken(row rowScanner) (*models.LoginToken, error) {
+	t := &models.LoginToken{}
+	var usedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.Channel, &t.Destination, &t.TokenHash, &t.Attempts, &t.ExpiresAt, &usedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		t.UsedAt = &usedAt.Time
+	}
+	return t, nil
+}
+
+func (r *mysqlRepo) LatestLoginToken(channel, destination string) (*models.LoginToken, error) {
+	return scanLoginToken(r.db.QueryRow("SELECT "+loginTokenColumns+` FROM login_tokens
+		WHERE channel = ? AND destination = ? AND used_at IS NULL AND expires_at > NOW()
+		ORDER BY id DESC LIMIT 1`, channel, destination))
+}
+
+func (r *mysqlRepo) GetLoginTokenByHash(channel, tokenHash string) (*models.LoginToken, error) {
+	return scanLoginToken(r.db.QueryRow("SELECT "+loginTokenColumns+` FROM login_tokens
+		WHERE channel = ? AND token_hash = ? AND used_at IS NULL AND expires_at > NOW()`, channel, tokenHash))
+}
+
+func (r *mysqlRepo) ClaimLoginTokenAttempt(id int64, max int) (bool, error) {
+	res, err := r.db.Exec("UPDATE login_tokens SET attempts = attempts + 1 WHERE id = ? AND attempts < ? AND used_at IS NULL", id, max)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *mysqlRepo) UseLoginToken(id int64) (bool, error) {
+	res, err := r.db.Exec("UPDATE login_tokens SET used_at = NOW() WHERE id = ? AND used_at IS NULL", id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *mysqlRepo) InvalidateLoginTokens(userID int64, channel string) error {
+	_, err := r.db.Exec("UPDATE login_tokens SET used_at = NOW() WHERE user_id = ? AND channel = ? AND used_at IS NULL", userID, channel)
+	return err
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*models.APIKey, error) {
+	k := &models.APIKey{}
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &scopes, &expiresAt, &lastUsedAt, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+	k.Scopes = apikey.SplitScopes(scopes)
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	return k, nil
+}
+
+func (r *mysqlRepo) CreateAPIKey(k *models.APIKey) (int64, error) {
+	res, err := r.db.Exec("INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at) VALUES (?,?,?,?,?,?)",
+		k.UserID, k.Name, k.Prefix, k.KeyHash, apikey.JoinScopes(k.Scopes), k.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *mysqlRepo) ListAPIKeys(userID int64) ([]*models.APIKey, error) {
+	rows, err := r.db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+func (r *mysqlRepo) GetAPIKey(userID, id int64) (*models.APIKey, error) {
+	k, err := scanAPIKey(r.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? AND id = ?", userID, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+func (r *mysqlRepo) UpdateAPIKey(k *models.APIKey) error {
+	_, err := r.db.Exec("UPDATE api_keys SET name = ?, scopes = ? WHERE user_id = ? AND id = ?", k.Name, apikey.JoinScopes(k.Scopes), k.UserID, k.ID)
+	return err
+}
+
+func (r *mysqlRepo) DeleteAPIKey(userID, id int64) (bool, error) {
+	res, err := r.db.Exec("DELETE FROM api_keys WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+const oauthClientColumns = "id, client_id, secret_hash, name, owner_id, redirect_uris, scopes, grant_types, created_at, revoked_at"
+
+func scanOAuthClient(row rowScanner) (*models.OAuthClient, error) {
+	c := &models.OAuthClient{}
+	var secretHash sql.NullString
+	var redirectURIs, scopes, grantTypes string
+	var revokedAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.ClientID, &secretHash, &c.Name, &c.OwnerID, &redirectURIs, &scopes, &grantTypes, &c.CreatedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	c.SecretHash = secretHash.String
+	c.Confidential = secretHash.Valid
+	c.RedirectURIs = strings.Fields(redirectURIs)
+	c.Scopes = oauth.ParseScope(scopes)
+	c.GrantTypes = strings.Fields(grantTypes)
+	if revokedAt.Valid {
+		c.RevokedAt = &revokedAt.Time
+	}
+	return c, nil
+}
+
+func (r *mysqlRepo) CreateOAuthClient(c *models.OAuthClient) (int64, error) {
+	res, err := r.db.Exec("INSERT INTO oauth_clients (client_id, secret_hash, name, owner_id, redirect_uris, scopes, grant_types) VALUES (?,?,?,?,?,?,?)",
+		c.ClientID, nullIfEmpty(c.SecretHash), c.Name, c.OwnerID, strings.Join(c.RedirectURIs, " "), oauth.JoinScope(c.Scopes), strings.Join(c.GrantTypes, " "))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *mysqlRepo) GetOAuthClient(clientID string) (*models.OAuthClient, error) {
+	c, err := scanOAuthClient(r.db.QueryRow("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE client_id = ?", clientID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (r *mysqlRepo) ListOAuthClients() ([]*models.OAuthClient, error) {
+	rows, err := r.db.Query("SELECT " + oauthClientColumns + " FROM oauth_clients ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.OAuthClient{}
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (r *mysqlRepo) RevokeOAuthClient(clientID string) (bool, error) {
+	res, err := r.db.Exec("UPDATE oauth_clients SET revoked_at = NOW() WHERE client_id = ? AND revoked_at IS NULL", clientID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *mysqlRepo) DeleteOAuthRefreshTokens(clientID string, userID int64) error {
+	if userID == 0 {
+		_, err := r.db.Exec("DELETE FROM refresh_tokens WHERE client_id = ?", clientID)
+		return err
+	}
+	_, err := r.db.Exec("DELETE FROM refresh_tokens WHERE client_id = ? AND user_id = ?", clientID, userID)
+	return err
+}
+
+func (r *mysqlRepo) CreateOAuthCode(c *models.OAuthCode) (int64, error) {
+	res, err := r.db.Exec("INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at) VALUES (?,?,?,?,?,?,?)",
+		c.CodeHash, c.ClientID, c.UserID, c.RedirectURI, oauth.JoinScope(c.Scopes), c.CodeChallenge, c.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *mysqlRepo) GetOAuthCode(codeHash string) (*models.OAuthCode, error) {
+	c := &models.OAuthCode{}
+	var scopes string
+	var familyID sql.NullString
+	var usedAt sql.NullTime
+	err := r.db.QueryRow(`SELECT id, code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, family_id, expires_at, used_at, created_at
+		FROM oauth_authorization_codes WHERE code_hash = ?`, codeHash).
+		Scan(&c.ID, &c.CodeHash, &c.ClientID, &c.UserID, &c.RedirectURI, &scopes, &c.CodeChallenge, &familyID, &c.ExpiresAt, &usedAt, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Scopes = oauth.ParseScope(scopes)
+	c.FamilyID = familyID.String
+	if usedAt.Valid {
+		c.UsedAt = &usedAt.Time
+	}
+	return c, nil
+}
+
+func (r *mysqlRepo) UseOAuthCode(id int64, familyID string) (bool, error) {
+	res, err := r.db.Exec("UPDATE oauth_authorization_codes SET used_at = NOW(), family_id = ? WHERE id = ? AND used_at IS NULL", familyID, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+const oauthConsentQuery = `SELECT oc.user_id, oc.client_id, COALESCE(c.name, ''), oc.scopes, oc.created_at, oc.updated_at
+	FROM oauth_consents oc LEFT JOIN oauth_clients c ON c.client_id = oc.client_id`
+
+func scanOAuthConsent(row rowScanner) (*models.OAuthConsent, error) {
+	c := &models.OAuthConsent{}
+	var scopes string
+	if err := row.Scan(&c.UserID, &c.ClientID, &c.ClientName, &scopes, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	c.Scopes = oauth.ParseScope(scopes)
+	return c, nil
+}
+
+func (r *mysqlRepo) GetOAuthConsent(userID int64, clientID string) (*models.OAuthConsent, error) {
+	c, err := scanOAuthConsent(r.db.QueryRow(oauthConsentQuery+" WHERE oc.user_id = ? AND oc.client_id = ?", userID, clientID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (r *mysqlRepo) SaveOAuthConsent(userID int64, clientID string, scopes []string) error {
+	_, err := r.db.Exec("INSERT INTO oauth_consents (user_id, client_id, scopes) VALUES (?,?,?) ON DUPLICATE KEY UPDATE scopes = VALUES(scopes)",
+		userID, clientID, oauth.JoinScope(scopes))
+	return err
+}
+
+// ListOAuthConsents lists the consents of a user to clients that were not revoked
+func (r *mysqlRepo) ListOAuthConsents(userID int64) ([]*models.OAuthConsent, error) {
+	rows, err := r.db.Query(oauthConsentQuery+" WHERE oc.user_id = ? AND c.revoked_at IS NULL ORDER BY oc.created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.OAuthConsent{}
+	for rows.Next() {
+		c, err := scanOAuthConsent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (r *mysqlRepo) DeleteOAuthConsent(userID int64, clientID string) (bool, error) {
+	res, err := r.db.Exec("DELETE FROM oauth_consents WHERE user_id = ? AND client_id = ?", userID, clientID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *mysqlRepo) UpsertMFASecret(userID int64, secret string) error {
+	_, err := r.db.Exec("INSERT INTO user_mfa (user_id, secret, enabled, last_used_step) VALUES (?,?,0,0) ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled = 0, last_used_step = 0", userID, secret)
+	return err
+}
+
+func (r *mysqlRepo) GetMFA(userID int64) (*models.UserMFA, error) {
+	m := &models.UserMFA{}
+	row := r.db.QueryRow("SELECT user_id, secret, enabled, last_used_step, created_at FROM user_mfa WHERE user_id = ?", userID)
+	if err := row.Scan(&m.UserID, &m.Secret, &m.Enabled, &m.LastUsedStep, &m.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *mysqlRepo) EnableMFA(userID int64, step int64) error {
+	_, err := r.db.Exec("UPDATE user_mfa SET enabled = 1, last_used_step = ? WHERE user_id = ?", step, userID)
+	return err
+}
+
+func (r *mysqlRepo) MarkMFAStepUsed(userID int64, step int64) (bool, error) {
+	res, err := r.db.Exec("UPDATE user_mfa SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *mysqlRepo) DeleteMFA(userID int64) error {
+	if _, err := r.db.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("DELETE FROM user_mfa WHERE user_id = ?", userID)
+	return err
+}
+
+func (r *mysqlRepo) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+	return r.WithTx(func(tx Repository) error {
+		q := tx.(*mysqlRepo).db
+		if _, err := q.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		for _, h := range codeHashes {
+			if _, err := q.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?,?)", userID, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *mysqlRepo) ConsumeRecoveryCode(userID int64, codeHash string) (bool, error) {
+	res, err := r.db.Exec("UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (r *mysqlRepo) GetUserByIdentity(provider, subject string) (*models.User, error) {
+	u, err := scanUser(r.db.QueryRow("SELECT u."+strings.ReplaceAll(userColumns, ",", ",u.")+" FROM users u JOIN user_identities i ON i.user_id = u.id WHERE i.provider = ? AND i.subject = ?", provider, subject))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *mysqlRepo) CreateIdentity(userID int64, provider, subject, email string) error {
+	_, err := r.db.Exec("INSERT INTO user_identities (user_id, provider, subject, email) VALUES (?,?,?,?)", userID, provider, subject, email)
+	return err
+}
+
+func (r *mysqlRepo) SetUserStatus(id int64, status string) error {
+	_, err := r.db.Exec("UPDATE users SET status = ?, token_version = token_version + 1 WHERE id = ?", status, id)
+	return err
+}
+
+func (r *mysqlRepo) DeleteUserData(userID int64) ([]string, error) {
+	// the image rows go with the products, their files are left to the caller
+	rows, err := r.db.Query(`SELECT i.url FROM product_images i JOIN products p ON p.id = i.product_id
+		JOIN stores s ON s.id = p.store_id WHERE s.user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imageURLs := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		imageURLs = append(imageURLs, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stmts := []string{
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+		"DELETE FROM user_mfa WHERE user_id = ?",
+		"DELETE FROM mfa_recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM api_keys WHERE user_id = ?",
+		"DELETE FROM login_tokens WHERE user_id = ?",
+		"DELETE FROM oauth_consents WHERE user_id = ?",
+		"DELETE FROM oauth_authorization_codes WHERE user_id = ?",
+		"UPDATE oauth_clients SET revoked_at = NOW() WHERE owner_id = ? AND revoked_at IS NULL",
+		// addresses of past orders keep only the city, for order statistics
+		`UPDATE addresses SET label = '', address = '', postal_code = ''
+			WHERE user_id = ? AND id IN (SELECT address_id FROM transactions)`,
+		"DELETE FROM addresses WHERE user_id = ? AND id NOT IN (SELECT address_id FROM transactions)",
+		"DELETE p FROM products p JOIN stores s ON s.id = p.store_id WHERE s.user_id = ?",
+		// a store that sold something stays as the seller of those orders
+		"UPDATE stores SET name = 'Closed store' WHERE user_id = ? AND id IN (SELECT store_id FROM transactions)",
+		"DELETE FROM stores WHERE user_id = ? AND id NOT IN (SELECT store_id FROM transactions)",
+		`UPDATE users SET name = 'Deleted user', email = CONCAT('deleted-', id, '@deleted.invalid'), phone = NULL,
+			password = '', email_verified_at = NULL, status = 'deleted', token_version = token_version + 1
+			WHERE id = ?`,
+	}
+	for _, q := range stmts {
+		if _, err := r.db.Exec(q, userID); err != nil {
+			return nil, err
+		}
+	}
+	return imageURLs, nil
+}
+
+func (r *mysqlRepo) GetUserExport(userID int64) (*models.UserExport, error) {
+	out := &models.UserExport{Addresses: []*models.Address{}, Products: []*models.Product{}, Transactions: []*models.TransactionRecord{}}
+
+	rows, err := r.db.Query(`SELECT id,user_id,COALESCE(label,''),address,COALESCE(city,''),COALESCE(postal_code,''),created_at
+		FROM addresses WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := &models.Address{}
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Label, &a.Address, &a.City, &a.PostalCode, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		out.Addresses = append(out.Addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	st := &models.Store{}
+	err = r.db.QueryRow("SELECT id, user_id, name, created_at FROM stores WHERE user_id = ?", userID).Scan(&st.ID, &st.UserID, &st.Name, &st.CreatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		out.Store = st
+		if out.Products, err = r.storeProducts(st.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if out.Transactions, err = r.userTransactions(userID); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *mysqlRepo) storeProducts(storeID int64) ([]*models.Product, error) {
+	rows, err := r.db.Query(`SELECT id,store_id,category_id,name,COALESCE(description,''),price,stock,COALESCE(image_url,''),created_at
+		FROM products WHERE store_id = ? ORDER BY id`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.Product{}
+	for rows.Next() {
+		p := &models.Product{}
+		var cat sql.NullInt64
+		if err := rows.Scan(&p.ID, &p.StoreID, &cat, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		if cat.Valid {
+			v := cat.Int64
+			p.CategoryID = &v
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// userTransactions returns the user's purchases with their items
+func (r *mysqlRepo) userTransactions(userID int64) ([]*models.TransactionRecord, error) {
+	rows, err := r.db.Query("SELECT id,user_id,store_id,address_id,total,status,created_at FROM transactions WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.TransactionRecord{}
+	byID := map[int64]*models.TransactionRecord{}
+	for rows.Next() {
+		t := &models.TransactionRecord{Items: []*models.ProductLog{}}
+		if err := rows.Scan(&t.ID, &t.UserID, &t.StoreID, &t.AddressID, &t.Total, &t.Status, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+		byID[t.ID] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return out, nil
+	}
+
+	items, err := r.db.Query(`SELECT l.id,l.transaction_id,l.product_id,l.product_name,l.product_price,l.quantity,l.created_at
+		FROM product_logs l JOIN transactions t ON t.id = l.transaction_id WHERE t.user_id = ? ORDER BY l.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+	for items.Next() {
+		l := &models.ProductLog{}
+		if err := items.Scan(&l.ID, &l.TransactionID, &l.ProductID, &l.ProductName, &l.ProductPrice, &l.Quantity, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		if t := byID[l.TransactionID]; t != nil {
+			t.Items = append(t.Items, l)
+		}
+	}
+	return out, items.Err()
+}
@@ -1,72 +1,215 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"net/http"
+	"fmt"
+	"log"
+	"math/big"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/example/ms-ecommerce/internal/pkg/apikey"
+	"github.com/example/ms-ecommerce/internal/pkg/denylist"
+	"github.com/example/ms-ecommerce/internal/pkg/introspect"
 	jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+	"github.com/example/ms-ecommerce/internal/pkg/loginguard"
+	"github.com/example/ms-ecommerce/internal/pkg/mail"
+	"github.com/example/ms-ecommerce/internal/pkg/middleware"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/example/ms-ecommerce/internal/pkg/oauth"
+	"github.com/example/ms-ecommerce/internal/pkg/oidc"
+	"github.com/example/ms-ecommerce/internal/pkg/password"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
+	"github.com/example/ms-ecommerce/internal/pkg/sms"
+	"github.com/example/ms-ecommerce/internal/pkg/totp"
+	"github.com/example/ms-ecommerce/internal/pkg/upload"
 )
 
 type Usecase interface {
 	Register(user *models.User) (string, int64, error)
-	Login(email, password string) (string, int64, error)
-	ForgotPassword(email string) (string, error)
+	// Login checks credentials. When the account has 2FA enabled the returned
+	// token is a short-lived mfa_pending token and mfaRequired is true.
+	// Failed attempts are tracked per account and client IP; a locked out login
+	// returns a *loginguard.LockedError.
+	Login(email, password string, client ClientInfo) (token string, userID int64, mfaRequired bool, err error)
+	VerifyMFALogin(mfaToken, code string) (string, int64, error)
+	EnrollMFA(userID int64) (secret string, otpauthURL string, err error)
+	ConfirmMFA(userID int64, code string) ([]string, error)
+	DisableMFA(userID int64, code string) error
+	// ForgotPassword mails a reset link. Unknown emails are not reported to avoid
+	// leaking which addresses are registered.
+	ForgotPassword(email string) error
 	ResetPassword(token, newPassword string) error
-	SSOLogin(idToken string) (string, int64, error)
+	// ChangePassword replaces the password after checking the current one. Every
+	// other session is logged out; the session of keepRefreshToken, if given,
+	// stays. It returns a fresh access token for the caller.
+	ChangePassword(userID int64, current, newPassword, keepRefreshToken string) (string, error)
+	SendEmailVerification(userID int64) error
+	ConfirmEmail(token string) error
+	// RequestMagicLink mails a single-use login link; RequestPhoneOTP texts a
+	// login code. Neither reports whether the destination is registered, and
+	// requests over the per-destination limit are dropped silently.
+	RequestMagicLink(email string) error
+	RequestPhoneOTP(phone string) error
+	// MagicLinkLogin and PhoneOTPLogin complete a passwordless login like Login
+	// (mfaRequired when the account has 2FA enabled)
+	MagicLinkLogin(token string) (string, int64, bool, error)
+	PhoneOTPLogin(phone, code string) (string, int64, bool, error)
+	// SSONonce issues the nonce for an SSO login; SSOLogin requires it back
+	SSONonce(provider string) (string, error)
+	SSOLogin(provider, idToken, nonce string) (string, int64, error)
 	GetUserByID(id int64) (*models.User, error)
-	UpdateUser(requesterID, id int64, requesterRole string, name, phone, role *string) error
+	UpdateUser(requesterID, id int64, perms rbac.Permissions, name, phone, role *string) error
+	// RequestEmailChange mails a confirmation link to newEmail and a notice to the
+	// current address. The email only changes once ConfirmEmailChange is called
+	// with the link's token.
+	RequestEmailChange(userID int64, newEmail string) error
+	ConfirmEmailChange(token string) error
+	// RequestPhoneChange texts a code to newPhone (and a notice to the current
+	// number); ConfirmPhoneChange sets the number once the code is entered
+	RequestPhoneChange(userID int64, newPhone string) error
+	ConfirmPhoneChange(userID int64, newPhone, code string) error
 	ListUsers(page, limit int, search string) ([]*models.User, int, error)
-	IssueRefreshToken(userID int64) (string, time.Time, error)
-	Refresh(refreshToken string) (string, string, time.Time, error)
+	// ImportUsers validates rows and creates the valid ones with their stores.
+	// With dryRun nothing is created. Invalid rows are reported, not returned
+	// as an error.
+	ImportUsers(perms rbac.Permissions, rows []models.UserImportRow, dryRun bool) ([]models.UserImportResult, error)
+	// ExportUsers calls fn for every user ListUsers would return for search, in
+	// id order, one page at a time
+	ExportUsers(search string, fn func(*models.User) error) error
+	// IssueRefreshToken starts a new session for the client
+	IssueRefreshToken(userID int64, client ClientInfo) (string, time.Time, error)
+	Refresh(refreshToken string, client ClientInfo) (string, string, time.Time, error)
 	RevokeRefreshToken(refreshToken string) error
+	// ListSessions lists the active sessions of userID (own sessions, or any user with user:sessions:any)
+	ListSessions(requesterID int64, perms rbac.Permissions, userID int64) ([]*models.Session, error)
+	// RevokeSession logs out a single session of userID
+	RevokeSession(requesterID int64, perms rbac.Permissions, userID int64, sessionID string) error
+	// RevokeAllRefreshTokens logs a user out everywhere: refresh tokens are deleted
+	// and every access token issued so far is denied.
 	RevokeAllRefreshTokens(userID int64) error
+	// RevokeAccessToken denies a single access token until it expires
+	RevokeAccessToken(accessToken string) error
+	// AuthenticateIntrospection checks the client credentials of a caller of
+	// the introspection endpoint
+	AuthenticateIntrospection(clientID, secret string) error
+	// Introspect reports whether an access or refresh token is active (RFC 7662)
+	Introspect(token string) (*introspect.Result, error)
+	// UnlockUser lifts a login lockout of a user (admin)
+	UnlockUser(userID int64) error
+	// SetUserStatus suspends or reactivates another user's account; the user is
+	// logged out everywhere
+	SetUserStatus(requesterID, userID int64, status string) error
+	// DeleteAccount anonymizes an account (see Repository.DeleteUserData) and logs
+	// it out everywhere. It cannot be undone.
+	DeleteAccount(userID int64) error
+	// ExportUserData assembles everything stored about a user
+	ExportUserData(userID int64) (*models.UserExport, error)
+	// Impersonate issues a short-lived access token for userID on behalf of
+	// actorID, who must hold every permission the user has. No refresh token is
+	// issued.
+	Impersonate(actorID int64, actorPerms rbac.Permissions, userID int64, reason string) (string, time.Time, error)
+
+	// CreateAPIKey returns the new key, which is not stored and cannot be shown
+	// again. scopes must be permissions the owner holds (perms).
+	CreateAPIKey(userID int64, perms rbac.Permissions, name string, scopes []string, expiresAt *time.Time) (string, *models.APIKey, error)
+	ListAPIKeys(userID int64) ([]*models.APIKey, error)
+	// UpdateAPIKey renames a key and/or replaces its scopes (nil leaves them unchanged)
+	UpdateAPIKey(userID int64, perms rbac.Permissions, id int64, name *string, scopes []string) (*models.APIKey, error)
+	DeleteAPIKey(userID, id int64) error
+
+	// OAuth 2.0 authorization server for partner apps. Errors meant for the
+	// client are *OAuthError.
+	// CreateOAuthClient registers c and returns its secret (confidential
+	// clients), which is not stored and cannot be shown again
+	CreateOAuthClient(c *models.OAuthClient) (string, error)
+	ListOAuthClients() ([]*models.OAuthClient, error)
+	RevokeOAuthClient(clientID string) error
+	// AuthorizeOAuth validates an authorization request for the consent screen
+	AuthorizeOAuth(userID int64, req OAuthAuthorizeRequest) (*OAuthAuthorization, error)
+	// ApproveOAuth records the user's decision and returns the client redirect
+	ApproveOAuth(userID int64, req OAuthAuthorizeRequest, approve bool) (string, error)
+	OAuthToken(req OAuthTokenRequest, client ClientInfo) (*OAuthToken, error)
+	RevokeOAuthToken(clientID, secret, token string) error
+	ListOAuthConsents(userID int64) ([]*models.OAuthConsent, error)
+	RevokeOAuthConsent(userID int64, clientID string) error
+}
+
+// ClientInfo describes the device a session was created or last used from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
 }
 
 type authUsecase struct {
-	repo Repository
+	repo     Repository
+	mailer   mail.Mailer
+	sms      sms.Sender
+	denylist denylist.Denylist
+	sso      *oidc.Registry
+	guard    *loginguard.Guard
+	// passwords enforces the password policy; nil applies password.DefaultPolicy
+	passwords *password.Checker
+	sleep     func(time.Duration) // progressive login delay; replaced in tests
+	// rolePerms resolves the permissions of a role (impersonation checks)
+	rolePerms func(role string) rbac.Permissions
 }
 
-func NewUsecase(r Repository) Usecase {
-	return &authUsecase{repo: r}
+func NewUsecase(r Repository, m mail.Mailer, d denylist.Denylist, sso *oidc.Registry, g *loginguard.Guard, pw *password.Checker, s sms.Sender) Usecase {
+	return &authUsecase{repo: r, mailer: m, sms: s, denylist: d, sso: sso, guard: g, passwords: pw, sleep: time.Sleep, rolePerms: middleware.RolePermissions}
 }
 
-func (u *authUsecase) Register(user *models.User) (string, int64, error) {
-	// uniqueness checks
-	existing, _ := u.repo.GetUserByEmail(user.Email)
-	if existing != nil {
-		return "", 0, errors.New("email already registered")
+// send delivers a message if a mailer is configured
+func (u *authUsecase) send(msg mail.Message) error {
+	if u.mailer == nil {
+		return errors.New("mailer not configured")
 	}
-	existing, _ = u.repo.GetUserByPhone(user.Phone)
-	if existing != nil {
-		return "", 0, errors.New("phone number already registered")
+	return u.mailer.Send(msg)
+}
+
+// checkPassword applies the password policy and breach list; personal are the
+// user's name and email, which the password must not contain
+func (u *authUsecase) checkPassword(pw string, personal ...string) error {
+	c := u.passwords
+	if c == nil {
+		c = &password.Checker{Policy: password.DefaultPolicy}
 	}
-	// hash password
-	h, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
+	return c.Check(pw, personal...)
+}
+
+func (u *authUsecase) Register(user *models.User) (string, int64, error) {
+	if err := u.checkPassword(user.Password, user.Name, user.Email); err != nil {
 		return "", 0, err
 	}
-	user.Password = string(h)
-	id, err := u.repo.CreateUser(user)
+	h, err := password.Hash(user.Password)
 	if err != nil {
 		return "", 0, err
 	}
-	// create store automatically
-	storeName := user.Name + "'s Store"
-	err = u.repo.CreateStore(id, storeName)
+	user.Password = h
+	// email/phone uniqueness is enforced by the database (errEmailTaken, errPhoneTaken)
+	var id int64
+	err = u.repo.WithTx(func(tx Repository) error {
+		var err error
+		if id, err = tx.CreateUser(user); err != nil {
+			return err
+		}
+		return createDefaultRecords(tx, id, user)
+	})
 	if err != nil {
-		// If store creation fails, we should ideally delete the user, but for simplicity, log error
-		// In production, use transactions
-		return "", 0, errors.New("user created but failed to create store: " + err.Error())
+		return "", 0, err
+	}
+	// the account works right away; verification is tracked via email_verified_at
+	if err := u.sendVerification(id, user.Name, user.Email); err != nil {
+		log.Printf("send verification email to user %d: %v", id, err)
 	}
 	token, err := jwtpkg.GenerateToken(id, user.Role)
 	if err != nil {
@@ -75,215 +218,2279 @@ func (u *authUsecase) Register(user *models.User) (string, int64, error) {
 	return token, id, nil
 }
 
-func (u *authUsecase) Login(email, password string) (string, int64, error) {
-	user, err := u.repo.GetUserByEmail(email)
-	if err != nil || user == nil {
-		return "", 0, errors.New("invalid credentials")
+func (u *authUsecase) sendVerification(userID int64, name, email string) error {
+	token, err := jwtpkg.GenerateEmailVerifyToken(userID, email)
+	if err != nil {
+		return err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return "", 0, errors.New("invalid credentials")
+	return u.send(verifyEmailMessage(email, name, token))
+}
+
+// SendEmailVerification (re)sends the verification link to the user's current email
+func (u *authUsecase) SendEmailVerification(userID int64) error {
+	user, err := u.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("user not found")
+	}
+	if user.EmailVerifiedAt != nil {
+		return errors.New("email already verified")
 	}
-	token, err := jwtpkg.GenerateToken(user.ID, user.Role)
+	return u.sendVerification(user.ID, user.Name, user.Email)
+}
+
+// ConfirmEmail marks the email embedded in a verification token as verified
+func (u *authUsecase) ConfirmEmail(token string) error {
+	uid, email, err := jwtpkg.ParseEmailVerifyToken(token)
 	if err != nil {
-		return "", 0, err
+		return errors.New("invalid or expired token")
 	}
-	return token, user.ID, nil
+	user, err := u.repo.GetUserByID(uid)
+	if err != nil {
+		return err
+	}
+	if user == nil || !strings.EqualFold(user.Email, email) {
+		return errors.New("invalid or expired token")
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	return u.repo.MarkEmailVerified(uid)
 }
 
-func (u *authUsecase) ForgotPassword(email string) (string, error) {
+func (u *authUsecase) Login(email, pw string, client ClientInfo) (string, int64, bool, error) {
+	if u.guard != nil {
+		if err := u.guard.Check(email, client.IP); err != nil {
+			loginAttempts.WithLabelValues("locked").Inc()
+			return "", 0, false, err
+		}
+		if d := u.guard.Delay(email, client.IP); d > 0 && u.sleep != nil {
+			u.sleep(d)
+		}
+	}
 	user, err := u.repo.GetUserByEmail(email)
 	if err != nil || user == nil {
-		return "", errors.New("user not found")
+		u.loginFailed(nil, email, client.IP)
+		return "", 0, false, errors.New("invalid credentials")
 	}
-	// generate short-lived reset token
-	token, err := jwtpkg.GenerateResetToken(user.ID)
+	ok, rehash, err := password.Verify(user.Password, pw)
+	if err != nil || !ok {
+		u.loginFailed(user, email, client.IP)
+		return "", 0, false, errors.New("invalid credentials")
+	}
+	loginAttempts.WithLabelValues("success").Inc()
+	if rehash {
+		// upgrade bcrypt (or outdated argon2id) hashes while the password is at hand
+		if h, err := password.Hash(pw); err == nil {
+			if err := u.repo.UpdatePassword(user.ID, h); err != nil {
+				log.Printf("rehash password of user %d: %v", user.ID, err)
+			}
+		}
+	}
+	if u.guard != nil {
+		u.guard.Success(email)
+	}
+	return u.completeLogin(user)
+}
+
+// completeLogin finishes a login whose first factor (password, magic link, SMS
+// code) was verified: it returns an access token, or an mfa_pending token when
+// the account has 2FA enabled
+func (u *authUsecase) completeLogin(user *models.User) (string, int64, bool, error) {
+	if user.Status != models.UserStatusActive {
+		return "", 0, false, errAccountInactive
+	}
+	mfa, err := u.repo.GetMFA(user.ID)
 	if err != nil {
-		return "", err
+		return "", 0, false, err
+	}
+	if mfa != nil && mfa.Enabled {
+		// the first factor is correct but a second one is still required
+		token, err := jwtpkg.GenerateMFAToken(user.ID)
+		if err != nil {
+			return "", 0, false, err
+		}
+		return token, user.ID, true, nil
+	}
+	token, err := accessTokenFor(user)
+	if err != nil {
+		return "", 0, false, err
 	}
-	// In production you'd email this token; for now return it in response
-	return token, nil
+	return token, user.ID, false, nil
 }
 
-func (u *authUsecase) ResetPassword(token, newPassword string) error {
-	uid, err := jwtpkg.ParseResetToken(token)
+// loginFailed counts a failed password check. Unknown emails are counted too, so
+// lockouts do not reveal which addresses are registered.
+func (u *authUsecase) loginFailed(user *models.User, email, ip string) {
+	loginAttempts.WithLabelValues("failure").Inc()
+	if u.guard == nil {
+		return
+	}
+	for _, scope := range u.guard.Failure(email, ip) {
+		loginLockouts.WithLabelValues(scope).Inc()
+		log.Printf("security: login locked out (%s) for email %q from %s", scope, email, ip)
+		if user != nil {
+			if err := u.repo.RecordSecurityEvent(user.ID, "login_lockout", "scope="+scope+" ip="+ip); err != nil {
+				log.Printf("security: failed to record event: %v", err)
+			}
+		}
+	}
+}
+
+func (u *authUsecase) UnlockUser(userID int64) error {
+	user, err := u.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("user not found")
+	}
+	if u.guard == nil {
+		return nil
+	}
+	return u.guard.Unlock(user.Email)
+}
+
+// errAccountInactive is returned for accounts whose status is not active
+var errAccountInactive = errors.New("account is deactivated")
+
+var (
+	errInvalidStatus = errors.New("status must be active or suspended")
+	errOwnStatus     = errors.New("cannot change the status of your own account")
+	errAccountGone   = errors.New("account is deleted")
+)
+
+func (u *authUsecase) SetUserStatus(requesterID, userID int64, status string) error {
+	if status != models.UserStatusActive && status != models.UserStatusSuspended {
+		return errInvalidStatus
+	}
+	// an admin suspending themselves would lock out the last admin just as easily
+	if requesterID == userID {
+		return errOwnStatus
+	}
+	user, err := u.repo.GetUserByID(userID)
 	if err != nil {
 		return err
 	}
-	// hash password
-	h, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	if user.Status == models.UserStatusDeleted {
+		return errAccountGone
+	}
+	if user.Status == status {
+		return nil
+	}
+	if err := u.repo.SetUserStatus(userID, status); err != nil {
+		return err
+	}
+	if err := u.repo.RecordSecurityEvent(userID, "account_"+status, fmt.Sprintf("by=%d", requesterID)); err != nil {
+		log.Printf("security: failed to record event: %v", err)
+	}
+	if status == models.UserStatusActive {
+		return nil
+	}
+	// refresh already refuses suspended accounts; this also ends access tokens
+	return u.RevokeAllRefreshTokens(userID)
+}
+
+func (u *authUsecase) DeleteAccount(userID int64) error {
+	user, err := u.repo.GetUserByID(userID)
 	if err != nil {
 		return err
 	}
-	return u.repo.UpdatePassword(uid, string(h))
+	if user == nil {
+		return errors.New("user not found")
+	}
+	if user.Status == models.UserStatusDeleted {
+		return errAccountGone
+	}
+	var imageURLs []string
+	if err := u.repo.WithTx(func(tx Repository) (err error) {
+		imageURLs, err = tx.DeleteUserData(userID)
+		return err
+	}); err != nil {
+		return err
+	}
+	// the product images are public files; remove them once the rows are gone
+	for _, url := range imageURLs {
+		if err := upload.Remove(url); err != nil {
+			log.Printf("delete account: removing image %s: %v", url, err)
+		}
+	}
+	if err := u.repo.RecordSecurityEvent(userID, "account_deleted", ""); err != nil {
+		log.Printf("security: failed to record event: %v", err)
+	}
+	if u.denylist == nil {
+		return nil
+	}
+	return u.denylist.RevokeUserTokens(userID, time.Now())
 }
 
-// SSOLogin accepts a Google ID token, validates it via Google's tokeninfo endpoint,
-// and logs the user in (creating an account automatically if needed).
-func (u *authUsecase) SSOLogin(idToken string) (string, int64, error) {
-	if idToken == "" {
-		return "", 0, errors.New("missing id token")
+var errImpersonation = errors.New("cannot impersonate this user")
+
+func (u *authUsecase) Impersonate(actorID int64, actorPerms rbac.Permissions, userID int64, reason string) (string, time.Time, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" || len(reason) > 255 {
+		return "", time.Time{}, errors.New("reason is required (max 255 characters)")
 	}
-	// Verify token with Google tokeninfo endpoint
-	endpoint := "https://oauth2.googleapis.com/tokeninfo?id_token=" + url.QueryEscape(idToken)
-	resp, err := http.Get(endpoint)
+	if actorID == userID {
+		return "", time.Time{}, errImpersonation
+	}
+	user, err := u.repo.GetUserByID(userID)
 	if err != nil {
-		return "", 0, err
+		return "", time.Time{}, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", 0, errors.New("invalid id token")
+	if user == nil {
+		return "", time.Time{}, errors.New("user not found")
 	}
-	var info struct {
-		Email         string `json:"email"`
-		EmailVerified string `json:"email_verified"`
-		Name          string `json:"name"`
-		Picture       string `json:"picture"`
-		Aud           string `json:"aud"`
+	// acting as a more privileged user would be an escalation
+	if u.rolePerms == nil {
+		return "", time.Time{}, errImpersonation
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		return "", 0, err
+	for perm := range u.rolePerms(user.Role) {
+		if !actorPerms.Has(perm) {
+			return "", time.Time{}, errImpersonation
+		}
+	}
+	if user.Status != models.UserStatusActive {
+		return "", time.Time{}, errAccountInactive
+	}
+	token, err := jwtpkg.GenerateImpersonationToken(user.ID, user.Role, user.TokenVersion, actorID)
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	if info.Email == "" {
-		return "", 0, errors.New("invalid token payload")
+	log.Printf("security: user %d impersonating user %d: %s", actorID, userID, reason)
+	detail := fmt.Sprintf("by=%d reason=%s", actorID, reason)
+	if err := u.repo.RecordSecurityEvent(userID, "impersonation_started", detail); err != nil {
+		log.Printf("security: failed to record event: %v", err)
 	}
+	return token, time.Now().Add(jwtpkg.ImpersonationTokenTTL), nil
+}
 
-	// Try to find existing user
-	user, err := u.repo.GetUserByEmail(info.Email)
+func (u *authUsecase) ExportUserData(userID int64) (*models.UserExport, error) {
+	user, err := u.repo.GetUserByID(userID)
 	if err != nil {
-		return "", 0, err
+		return nil, err
 	}
-	if user != nil {
-		// return token for existing user
-		tk, err := jwtpkg.GenerateToken(user.ID, user.Role)
-		if err != nil {
-			return "", 0, err
-		}
-		return tk, user.ID, nil
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	out, err := u.repo.GetUserExport(userID)
+	if err != nil {
+		return nil, err
 	}
+	out.ExportedAt = time.Now().UTC()
+	out.Profile = user
+	return out, nil
+}
 
-	// Create a new user. Generate a random password (hashed) since login uses JWT.
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return "", 0, err
+// accessTokenFor issues an access token reflecting the user's current role and
+// token version. Inactive accounts get no token.
+func accessTokenFor(user *models.User) (string, error) {
+	if user.Status != models.UserStatusActive {
+		return "", errAccountInactive
+	}
+	return jwtpkg.GenerateVersionedToken(user.ID, user.Role, user.TokenVersion)
+}
+
+// VerifyMFALogin completes a login started with Login by checking a TOTP or recovery code
+func (u *authUsecase) VerifyMFALogin(mfaToken, code string) (string, int64, error) {
+	uid, tokenID, err := jwtpkg.ParseMFAToken(mfaToken)
+	if err != nil {
+		return "", 0, errors.New("invalid or expired mfa token")
 	}
-	rawPwd := hex.EncodeToString(b)
-	h, err := bcrypt.GenerateFromPassword([]byte(rawPwd), bcrypt.DefaultCost)
+	mfa, err := u.repo.GetMFA(uid)
 	if err != nil {
 		return "", 0, err
 	}
-	newUser := &models.User{
-		Name:     info.Name,
-		Email:    info.Email,
-		Password: string(h),
-		Role:     "user",
+	if mfa == nil || !mfa.Enabled {
+		return "", 0, errors.New("two-factor authentication is not enabled")
+	}
+	// the attempt is counted before the code is checked, so that concurrent
+	// guesses cannot get past the limits
+	if u.guard != nil {
+		if err := u.guard.MFAAttempt(uid, tokenID, jwtpkg.MFATokenTTL); err != nil {
+			return "", 0, err
+		}
 	}
-	id, err := u.repo.CreateUser(newUser)
+	if err := u.verifySecondFactor(mfa, code); err != nil {
+		return "", 0, err
+	}
+	if u.guard != nil {
+		u.guard.MFASuccess(uid, tokenID, jwtpkg.MFATokenTTL)
+	}
+	user, err := u.repo.GetUserByID(uid)
 	if err != nil {
 		return "", 0, err
 	}
-	token, err := jwtpkg.GenerateToken(id, newUser.Role)
+	if user == nil {
+		return "", 0, errors.New("invalid credentials")
+	}
+	token, err := accessTokenFor(user)
 	if err != nil {
 		return "", 0, err
 	}
-	return token, id, nil
+	return token, user.ID, nil
 }
 
-func (u *authUsecase) GetUserByID(id int64) (*models.User, error) {
-	return u.repo.GetUserByID(id)
+// EnrollMFA generates a fresh TOTP secret for the user. 2FA is not enforced until
+// the secret is confirmed with ConfirmMFA.
+func (u *authUsecase) EnrollMFA(userID int64) (string, string, error) {
+	user, err := u.repo.GetUserByID(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if user == nil {
+		return "", "", errors.New("user not found")
+	}
+	existing, err := u.repo.GetMFA(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if existing != nil && existing.Enabled {
+		return "", "", errors.New("two-factor authentication already enabled")
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := u.repo.UpsertMFASecret(userID, secret); err != nil {
+		return "", "", err
+	}
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Evermos"
+	}
+	return secret, totp.URL(issuer, user.Email, secret), nil
 }
 
-func (u *authUsecase) UpdateUser(requesterID, id int64, requesterRole string, name, phone, role *string) error {
-	// Only owner or admin can update. Only admin can change role.
-	if requesterRole != "admin" && requesterID != id {
-		return errors.New("forbidden")
+// ConfirmMFA enables 2FA once the user proves their authenticator produces valid
+// codes, and returns a fresh set of plaintext recovery codes (shown only once).
+// Attempts count against the user's second factor limit like VerifyMFALogin.
+func (u *authUsecase) ConfirmMFA(userID int64, code string) ([]string, error) {
+	mfa, err := u.repo.GetMFA(userID)
+	if err != nil {
+		return nil, err
 	}
-	if role != nil && requesterRole != "admin" {
-		return errors.New("forbidden")
+	if mfa == nil {
+		return nil, errors.New("two-factor enrollment not started")
+	}
+	if mfa.Enabled {
+		return nil, errors.New("two-factor authentication already enabled")
+	}
+	if u.guard != nil {
+		if err := u.guard.UserMFAAttempt(userID); err != nil {
+			return nil, err
+		}
+	}
+	step, ok := totp.Validate(mfa.Secret, code, time.Now())
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+	if u.guard != nil {
+		u.guard.UserMFASuccess(userID)
+	}
+	codes, hashes, err := generateRecoveryCodes(10)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
 	}
-	return u.repo.UpdateUser(id, name, phone, role)
+	if err := u.repo.EnableMFA(userID, step); err != nil {
+		return nil, err
+	}
+	return codes, nil
 }
 
-func (u *authUsecase) ListUsers(page, limit int, search string) ([]*models.User, int, error) {
-	return u.repo.ListUsers(page, limit, search)
+// DisableMFA turns off 2FA; a valid TOTP or recovery code is required. Attempts
+// count against the user's second factor limit like VerifyMFALogin.
+func (u *authUsecase) DisableMFA(userID int64, code string) error {
+	mfa, err := u.repo.GetMFA(userID)
+	if err != nil {
+		return err
+	}
+	if mfa == nil || !mfa.Enabled {
+		return errors.New("two-factor authentication is not enabled")
+	}
+	if u.guard != nil {
+		if err := u.guard.UserMFAAttempt(userID); err != nil {
+			return err
+		}
+	}
+	if err := u.verifySecondFactor(mfa, code); err != nil {
+		return err
+	}
+	if u.guard != nil {
+		u.guard.UserMFASuccess(userID)
+	}
+	return u.repo.DeleteMFA(userID)
 }
 
-// helper to get refresh token expiry from env, default 30 days
-func getRefreshExpirySeconds() int64 {
-	s := os.Getenv("REFRESH_TOKEN_EXP_SECONDS")
-	if s == "" {
-		return 60 * 60 * 24 * 30 // 30 days
+// verifySecondFactor accepts either a current TOTP code (each step only once) or
+// an unused recovery code.
+func (u *authUsecase) verifySecondFactor(mfa *models.UserMFA, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errors.New("missing code")
 	}
-	v, err := strconv.ParseInt(s, 10, 64)
-	if err != nil || v <= 0 {
-		return 60 * 60 * 24 * 30
+	if step, ok := totp.Validate(mfa.Secret, code, time.Now()); ok {
+		fresh, err := u.repo.MarkMFAStepUsed(mfa.UserID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return errors.New("code already used")
+		}
+		return nil
 	}
-	return v
+	used, err := u.repo.ConsumeRecoveryCode(mfa.UserID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errors.New("invalid code")
+	}
+	return nil
 }
 
-// IssueRefreshToken creates and stores a new refresh token for a user and returns the plaintext token and expiry
-func (u *authUsecase) IssueRefreshToken(userID int64) (string, time.Time, error) {
-	// generate random 32-byte token
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
-		return "", time.Time{}, err
+// generateRecoveryCodes returns n plaintext codes formatted as xxxxx-xxxxx and their hashes
+func generateRecoveryCodes(n int) ([]string, []string, error) {
+	codes := make([]string, 0, n)
+	hashes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := hex.EncodeToString(b)
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashes = append(hashes, hashToken(raw))
 	}
-	token := hex.EncodeToString(b)
-	// hash for storage
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// hashToken returns the hex sha256 of a high-entropy secret for storage
+func hashToken(token string) string {
 	h := sha256.Sum256([]byte(token))
-	hashHex := hex.EncodeToString(h[:])
-	expiresAt := time.Now().Add(time.Duration(getRefreshExpirySeconds()) * time.Second)
-	if err := u.repo.CreateRefreshToken(userID, hashHex, expiresAt); err != nil {
-		return "", time.Time{}, err
+	return hex.EncodeToString(h[:])
+}
+
+func (u *authUsecase) ForgotPassword(email string) error {
+	user, err := u.repo.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+	// generate short-lived reset token
+	token, err := jwtpkg.GenerateResetToken(user.ID)
+	if err != nil {
+		return err
 	}
-	return token, expiresAt, nil
+	return u.send(resetPasswordMessage(user.Email, user.Name, token))
 }
 
-// Refresh rotates a refresh token: validates provided token, issues new access and refresh tokens
-func (u *authUsecase) Refresh(refreshToken string) (string, string, time.Time, error) {
-	if refreshToken == "" {
-		return "", "", time.Time{}, errors.New("missing refresh token")
+func (u *authUsecase) ResetPassword(token, newPassword string) error {
+	uid, err := jwtpkg.ParseResetToken(token)
+	if err != nil {
+		return err
 	}
-	h := sha256.Sum256([]byte(refreshToken))
-	hashHex := hex.EncodeToString(h[:])
-	userID, expiresAt, found, err := u.repo.GetRefreshToken(hashHex)
+	user, err := u.repo.GetUserByID(uid)
 	if err != nil {
-		return "", "", time.Time{}, err
+		return err
 	}
-	if !found {
-		return "", "", time.Time{}, errors.New("invalid refresh token")
+	if user == nil {
+		return errors.New("invalid or expired token")
 	}
-	if time.Now().After(expiresAt) {
-		// delete expired token
-		_ = u.repo.DeleteRefreshToken(hashHex)
-		return "", "", time.Time{}, errors.New("refresh token expired")
+	if err := u.checkPassword(newPassword, user.Name, user.Email); err != nil {
+		return err
 	}
-	// issue new access token
-	accessToken, err := jwtpkg.GenerateToken(userID, "user")
+	h, err := password.Hash(newPassword)
 	if err != nil {
-		return "", "", time.Time{}, err
+		return err
 	}
-	// rotate refresh token: delete old and create new
-	if err := u.repo.DeleteRefreshToken(hashHex); err != nil {
-		return "", "", time.Time{}, err
+	return u.repo.UpdatePassword(uid, h)
+}
+
+var errWrongPassword = errors.New("current password is incorrect")
+
+func (u *authUsecase) ChangePassword(userID int64, current, newPassword, keepRefreshToken string) (string, error) {
+	user, err := u.repo.GetUserByID(userID)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", errors.New("user not found")
+	}
+	if ok, _, err := password.Verify(user.Password, current); err != nil || !ok {
+		return "", errWrongPassword
+	}
+	if newPassword == current {
+		return "", fmt.Errorf("%w: choose a different password", password.ErrWeak)
+	}
+	if err := u.checkPassword(newPassword, user.Name, user.Email); err != nil {
+		return "", err
 	}
-	newRefresh, newExpiresAt, err := u.IssueRefreshToken(userID)
+	h, err := password.Hash(newPassword)
 	if err != nil {
-		return "", "", time.Time{}, err
+		return "", err
+	}
+	if err := u.repo.UpdatePassword(userID, h); err != nil {
+		return "", err
+	}
+	if err := u.endOtherSessions(user, keepRefreshToken); err != nil {
+		return "", err
 	}
-	return accessToken, newRefresh, newExpiresAt, nil
+	return accessTokenFor(user)
 }
 
-// RevokeRefreshToken deletes a refresh token (logout)
-func (u *authUsecase) RevokeRefreshToken(refreshToken string) error {
-	if refreshToken == "" {
-		return errors.New("missing refresh token")
+// endOtherSessions logs out every session of user except the one of
+// keepRefreshToken and denies their access tokens
+func (u *authUsecase) endOtherSessions(user *models.User, keepRefreshToken string) error {
+	keepFamily := ""
+	if keepRefreshToken != "" {
+		rt, err := u.repo.GetRefreshToken(hashToken(keepRefreshToken))
+		if err != nil {
+			return err
+		}
+		if rt != nil && rt.UserID == user.ID && rt.RotatedAt == nil {
+			keepFamily = rt.FamilyID
+		}
+	}
+	if err := u.repo.DeleteOtherRefreshTokens(user.ID, keepFamily); err != nil {
+		return err
+	}
+	if err := u.repo.RecordSecurityEvent(user.ID, "password_changed", ""); err != nil {
+		log.Printf("security: failed to record event: %v", err)
 	}
-	h := sha256.Sum256([]byte(refreshToken))
-	hashHex := hex.EncodeToString(h[:])
-	return u.repo.DeleteRefreshToken(hashHex)
+	if u.denylist == nil {
+		return nil
+	}
+	// the caller's new access token is issued after the cutoff and stays valid
+	return u.denylist.RevokeUserTokens(user.ID, time.Now())
 }
 
-// RevokeAllRefreshTokens deletes all refresh tokens for a user (admin or self)
-func (u *authUsecase) RevokeAllRefreshTokens(userID int64) error {
-	return u.repo.DeleteRefreshTokensByUser(userID)
+// Lifetimes and limits of the links and codes in login_tokens
+const (
+	MagicLinkTTL = 15 * time.Minute
+	PhoneOTPTTL  = 5 * time.Minute
+	// EmailChangeTTL is how long the link confirming a new email address works
+	EmailChangeTTL = 24 * time.Hour
+	// at most passwordlessMaxSends links or codes per destination per
+	// passwordlessWindow, and one per passwordlessCooldown
+	passwordlessMaxSends = 5
+	passwordlessWindow   = time.Hour
+	passwordlessCooldown = time.Minute
+	// a code is invalidated after this many wrong guesses
+	phoneOTPMaxAttempts = 5
+)
+
+var errInvalidLoginToken = errors.New("invalid or expired login token")
+
+// passwordlessAllowed applies the per-destination send limits
+func (u *authUsecase) passwordlessAllowed(channel, destination string) (bool, error) {
+	now := time.Now()
+	recent, err := u.repo.CountLoginTokens(channel, destination, now.Add(-passwordlessCooldown))
+	if err != nil || recent > 0 {
+		return false, err
+	}
+	n, err := u.repo.CountLoginTokens(channel, destination, now.Add(-passwordlessWindow))
+	if err != nil {
+		return false, err
+	}
+	return n < passwordlessMaxSends, nil
+}
+
+func (u *authUsecase) RequestMagicLink(email string) error {
+	email = strings.TrimSpace(email)
+	user, err := u.repo.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Status != models.UserStatusActive {
+		return nil
+	}
+	ok, err := u.passwordlessAllowed(models.LoginChannelEmail, user.Email)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Printf("security: magic link for user %d dropped (rate limit)", user.ID)
+		return nil
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	t := &models.LoginToken{UserID: user.ID, Channel: models.LoginChannelEmail, Destination: user.Email, TokenHash: hashToken(token), ExpiresAt: time.Now().Add(MagicLinkTTL)}
+	if _, err := u.repo.CreateLoginToken(t); err != nil {
+		return err
+	}
+	return u.send(magicLinkMessage(user.Email, user.Name, token))
+}
+
+func (u *authUsecase) MagicLinkLogin(token string) (string, int64, bool, error) {
+	if token == "" {
+		return "", 0, false, errInvalidLoginToken
+	}
+	t, err := u.repo.GetLoginTokenByHash(models.LoginChannelEmail, hashToken(token))
+	if err != nil {
+		return "", 0, false, err
+	}
+	if t == nil {
+		return "", 0, false, errInvalidLoginToken
+	}
+	// marking it used first makes a concurrent second use fail
+	used, err := u.repo.UseLoginToken(t.ID)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if !used {
+		return "", 0, false, errInvalidLoginToken
+	}
+	user, err := u.repo.GetUserByID(t.UserID)
+	if err != nil {
+		return "", 0, false, err
+	}
+	// the link is only valid for the address it was sent to
+	if user == nil || !strings.EqualFold(user.Email, t.Destination) {
+		return "", 0, false, errInvalidLoginToken
+	}
+	// opening the link proves control of the address
+	if user.EmailVerifiedAt == nil {
+		if err := u.repo.MarkEmailVerified(user.ID); err != nil {
+			log.Printf("mark email verified for user %d: %v", user.ID, err)
+		}
+	}
+	return u.completeLogin(user)
+}
+
+func (u *authUsecase) RequestPhoneOTP(phone string) error {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return errors.New("phone is required")
+	}
+	if u.sms == nil {
+		return errors.New("sms sender not configured")
+	}
+	user, err := u.repo.GetUserByPhone(phone)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Status != models.UserStatusActive {
+		return nil
+	}
+	ok, err := u.passwordlessAllowed(models.LoginChannelSMS, phone)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Printf("security: sms code for user %d dropped (rate limit)", user.ID)
+		return nil
+	}
+	code, err := randomDigits(6)
+	if err != nil {
+		return err
+	}
+	// only the newest code is valid
+	if err := u.repo.InvalidateLoginTokens(user.ID, models.LoginChannelSMS); err != nil {
+		return err
+	}
+	t := &models.LoginToken{UserID: user.ID, Channel: models.LoginChannelSMS, Destination: phone, TokenHash: phoneOTPHash(user.ID, code), ExpiresAt: time.Now().Add(PhoneOTPTTL)}
+	if _, err := u.repo.CreateLoginToken(t); err != nil {
+		return err
+	}
+	return u.sms.Send(sms.Message{To: phone, Body: fmt.Sprintf("%s is your login code. It expires in %d minutes. Never share it.", code, int(PhoneOTPTTL.Minutes()))})
+}
+
+func (u *authUsecase) PhoneOTPLogin(phone, code string) (string, int64, bool, error) {
+	phone, code = strings.TrimSpace(phone), strings.TrimSpace(code)
+	t, err := u.repo.LatestLoginToken(models.LoginChannelSMS, phone)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if t == nil {
+		return "", 0, false, errInvalidLoginToken
+	}
+	// claim the attempt before comparing so concurrent guesses cannot all
+	// pass a stale attempts count
+	claimed, err := u.repo.ClaimLoginTokenAttempt(t.ID, phoneOTPMaxAttempts)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if !claimed || subtle.ConstantTimeCompare([]byte(phoneOTPHash(t.UserID, code)), []byte(t.TokenHash)) != 1 {
+		return "", 0, false, errInvalidLoginToken
+	}
+	used, err := u.repo.UseLoginToken(t.ID)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if !used {
+		return "", 0, false, errInvalidLoginToken
+	}
+	user, err := u.repo.GetUserByID(t.UserID)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if user == nil || user.Phone != t.Destination {
+		return "", 0, false, errInvalidLoginToken
+	}
+	return u.completeLogin(user)
+}
+
+// phoneOTPHash binds a code to its user, so equal codes of different users do
+// not collide in the unique token_hash index
+func phoneOTPHash(userID int64, code string) string {
+	return hashToken(strconv.FormatInt(userID, 10) + ":" + code)
+}
+
+// randomDigits returns n uniformly random decimal digits
+func randomDigits(n int) (string, error) {
+	b := make([]byte, n)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
+
+var (
+	errInvalidConfirmation = errors.New("invalid or expired confirmation")
+	errSameContact         = errors.New("new value equals the current one")
+	errTooManyRequests     = errors.New("too many requests, try again later")
+	errPhoneNeedsConfirm   = errors.New("phone changes must be confirmed, use /api/v1/auth/me/phone")
+)
+
+func (u *authUsecase) RequestEmailChange(userID int64, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if !strings.Contains(newEmail, "@") {
+		return errors.New("invalid email")
+	}
+	user, err := u.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("user not found")
+	}
+	if strings.EqualFold(user.Email, newEmail) {
+		return errSameContact
+	}
+	// checked again by the unique index when the change is confirmed
+	existing, err := u.repo.GetUserByEmail(newEmail)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return errEmailTaken
+	}
+	ok, err := u.passwordlessAllowed(models.ChannelEmailChange, newEmail)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errTooManyRequests
+	}
+	// only the latest request can be confirmed
+	if err := u.repo.InvalidateLoginTokens(user.ID, models.ChannelEmailChange); err != nil {
+		return err
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	t := &models.LoginToken{UserID: user.ID, Channel: models.ChannelEmailChange, Destination: newEmail, TokenHash: hashToken(token), ExpiresAt: time.Now().Add(EmailChangeTTL)}
+	if _, err := u.repo.CreateLoginToken(t); err != nil {
+		return err
+	}
+	if err := u.send(confirmEmailChangeMessage(newEmail, user.Name, token)); err != nil {
+		return err
+	}
+	// tell the owner of the current address, in case the request is not theirs
+	if err := u.send(emailChangeNoticeMessage(user.Email, user.Name, newEmail)); err != nil {
+		log.Printf("email change notice for user %d: %v", user.ID, err)
+	}
+	return nil
+}
+
+func (u *authUsecase) ConfirmEmailChange(token string) error {
+	if token == "" {
+		return errInvalidConfirmation
+	}
+	t, err := u.repo.GetLoginTokenByHash(models.ChannelEmailChange, hashToken(token))
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errInvalidConfirmation
+	}
+	user, err := u.repo.GetUserByID(t.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Status != models.UserStatusActive {
+		return errInvalidConfirmation
+	}
+	used, err := u.repo.UseLoginToken(t.ID)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errInvalidConfirmation
+	}
+	if err := u.repo.UpdateEmail(user.ID, t.Destination); err != nil {
+		return err
+	}
+	if err := u.repo.RecordSecurityEvent(user.ID, "email_changed", "from="+user.Email+" to="+t.Destination); err != nil {
+		log.Printf("security: failed to record event: %v", err)
+	}
+	return nil
+}
+
+func (u *authUsecase) RequestPhoneChange(userID int64, newPhone string) error {
+	newPhone = strings.TrimSpace(newPhone)
+	if newPhone == "" {
+		return errors.New("phone is required")
+	}
+	if u.sms == nil {
+		return errors.New("sms sender not configured")
+	}
+	user, err := u.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("user not found")
+	}
+	if user.Phone == newPhone {
+		return errSameContact
+	}
+	existing, err := u.repo.GetUserByPhone(newPhone)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return errPhoneTaken
+	}
+	ok, err := u.passwordlessAllowed(models.ChannelPhoneChange, newPhone)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errTooManyRequests
+	}
+	if err := u.repo.InvalidateLoginTokens(user.ID, models.ChannelPhoneChange); err != nil {
+		return err
+	}
+	code, err := randomDigits(6)
+	if err != nil {
+		return err
+	}
+	t := &models.LoginToken{UserID: user.ID, Channel: models.ChannelPhoneChange, Destination: newPhone, TokenHash: phoneOTPHash(user.ID, code), ExpiresAt: time.Now().Add(PhoneOTPTTL)}
+	if _, err := u.repo.CreateLoginToken(t); err != nil {
+		return err
+	}
+	if err := u.sms.Send(sms.Message{To: newPhone, Body: fmt.Sprintf("%s is your code to confirm this number for your account. It expires in %d minutes.", code, int(PhoneOTPTTL.Minutes()))}); err != nil {
+		return err
+	}
+	if user.Phone != "" {
+		if err := u.sms.Send(sms.Message{To: user.Phone, Body: "A request was made to move your account to another phone number. If this was not you, change your password."}); err != nil {
+			log.Printf("phone change notice for user %d: %v", user.ID, err)
+		}
+	}
+	return nil
+}
+
+func (u *authUsecase) ConfirmPhoneChange(userID int64, newPhone, code string) error {
+	newPhone, code = strings.TrimSpace(newPhone), strings.TrimSpace(code)
+	t, err := u.repo.LatestLoginToken(models.ChannelPhoneChange, newPhone)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.UserID != userID {
+		return errInvalidConfirmation
+	}
+	claimed, err := u.repo.ClaimLoginTokenAttempt(t.ID, phoneOTPMaxAttempts)
+	if err != nil {
+		return err
+	}
+	if !claimed || subtle.ConstantTimeCompare([]byte(phoneOTPHash(userID, code)), []byte(t.TokenHash)) != 1 {
+		return errInvalidConfirmation
+	}
+	used, err := u.repo.UseLoginToken(t.ID)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errInvalidConfirmation
+	}
+	if err := u.repo.UpdateUser(userID, nil, &newPhone, nil); err != nil {
+		return err
+	}
+	if err := u.repo.RecordSecurityEvent(userID, "phone_changed", "to="+newPhone); err != nil {
+		log.Printf("security: failed to record event: %v", err)
+	}
+	return nil
+}
+
+// SSONonce returns a nonce for an SSO login with provider. The client passes it to
+// the provider's authorization request and back to SSOLogin with the ID token.
+func (u *authUsecase) SSONonce(provider string) (string, error) {
+	p, err := u.ssoProvider(provider)
+	if err != nil {
+		return "", err
+	}
+	return jwtpkg.GenerateSSONonce(p.Name)
+}
+
+func (u *authUsecase) ssoProvider(name string) (*oidc.Provider, error) {
+	if u.sso == nil {
+		return nil, errUnknownProvider
+	}
+	p, ok := u.sso.Get(name)
+	if !ok {
+		return nil, errUnknownProvider
+	}
+	return p, nil
+}
+
+var errUnknownProvider = errors.New("unknown sso provider")
+
+// SSOLogin verifies an OpenID Connect ID token locally (signature against the
+// provider's JWKS, issuer, audience, expiry and nonce) and logs the user in. The
+// first login with an identity links it to the account with the same verified
+// email, or creates a new account.
+func (u *authUsecase) SSOLogin(provider, idToken, nonce string) (string, int64, error) {
+	if idToken == "" {
+		return "", 0, errors.New("missing id token")
+	}
+	p, err := u.ssoProvider(provider)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := jwtpkg.ParseSSONonce(nonce, p.Name); err != nil {
+		return "", 0, errors.New("invalid or expired nonce")
+	}
+	id, err := p.Verify(context.Background(), idToken, nonce)
+	if err != nil {
+		return "", 0, err
+	}
+
+	user, err := u.repo.GetUserByIdentity(p.Name, id.Subject)
+	if err != nil {
+		return "", 0, err
+	}
+	if user == nil {
+		// only a verified email may be used to match or create an account
+		if id.Email == "" || !id.EmailVerified {
+			return "", 0, errors.New("sso account has no verified email")
+		}
+		if user, err = u.repo.GetUserByEmail(id.Email); err != nil {
+			return "", 0, err
+		}
+		if user == nil {
+			// creates the identity link along with the account
+			user, err = u.createSSOUser(id)
+			if errors.Is(err, errEmailTaken) {
+				// a concurrent sign-up with the same email won the race: link to it
+				if user, err = u.repo.GetUserByEmail(id.Email); err == nil && user == nil {
+					err = errEmailTaken
+				}
+				if err == nil {
+					err = u.repo.CreateIdentity(user.ID, p.Name, id.Subject, id.Email)
+				}
+			}
+			if err != nil {
+				return "", 0, err
+			}
+		} else if err := u.repo.CreateIdentity(user.ID, p.Name, id.Subject, id.Email); err != nil {
+			return "", 0, err
+		}
+	}
+	token, err := accessTokenFor(user)
+	if err != nil {
+		return "", 0, err
+	}
+	return token, user.ID, nil
+}
+
+// createSSOUser creates an account for a first-time SSO user, linked to the
+// identity. It gets a random password (login goes through the provider), a
+// verified email and no phone.
+func (u *authUsecase) createSSOUser(id *oidc.Identity) (*models.User, error) {
+	rawPwd, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	h, err := password.Hash(rawPwd)
+	if err != nil {
+		return nil, err
+	}
+	name := id.Name
+	if name == "" {
+		name = id.Email
+	}
+	newUser := &models.User{
+		Name:     name,
+		Email:    id.Email,
+		Password: h,
+		Role:     "user",
+		Status:   models.UserStatusActive,
+	}
+	err = u.repo.WithTx(func(tx Repository) error {
+		var err error
+		if newUser.ID, err = tx.CreateUser(newUser); err != nil {
+			return err
+		}
+		if err := tx.MarkEmailVerified(newUser.ID); err != nil {
+			return err
+		}
+		if err := tx.CreateIdentity(newUser.ID, id.Provider, id.Subject, id.Email); err != nil {
+			return err
+		}
+		return createDefaultRecords(tx, newUser.ID, newUser)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newUser, nil
+}
+
+// createDefaultRecords creates what every new account starts with (its store).
+// It runs in the transaction that creates the user.
+func createDefaultRecords(tx Repository, userID int64, user *models.User) error {
+	return tx.CreateStore(userID, user.Name+"'s Store")
+}
+
+func (u *authUsecase) GetUserByID(id int64) (*models.User, error) {
+	return u.repo.GetUserByID(id)
+}
+
+func (u *authUsecase) UpdateUser(requesterID, id int64, perms rbac.Permissions, name, phone, role *string) error {
+	// Owners may update themselves; others need user:write:any. Changing a role
+	// needs user:role:assign.
+	if !perms.Has(rbac.UserWriteAny) && requesterID != id {
+		return errors.New("forbidden")
+	}
+	if role != nil && !perms.Has(rbac.UserAssignRole) {
+		return errors.New("forbidden")
+	}
+	if phone != nil {
+		// users prove they own a new number (RequestPhoneChange); staff with
+		// user:write:any may still set it directly
+		if !perms.Has(rbac.UserWriteAny) {
+			return errPhoneNeedsConfirm
+		}
+		if *phone != "" {
+			existing, err := u.repo.GetUserByPhone(*phone)
+			if err != nil {
+				return err
+			}
+			if existing != nil && existing.ID != id {
+				return errPhoneTaken
+			}
+		}
+	}
+	roleChanged := false
+	if role != nil {
+		current, err := u.repo.GetUserByID(id)
+		if err != nil {
+			return err
+		}
+		roleChanged = current == nil || current.Role != *role
+	}
+	if err := u.repo.UpdateUser(id, name, phone, role); err != nil {
+		return err
+	}
+	if roleChanged && u.denylist != nil {
+		// outstanding access tokens carry the old role; deny them so clients refresh
+		// (refresh re-reads the role) instead of acting with stale rights for a day
+		return u.denylist.RevokeUserTokens(id, time.Now())
+	}
+	return nil
+}
+
+func (u *authUsecase) ListUsers(page, limit int, search string) ([]*models.User, int, error) {
+	return u.repo.ListUsers(page, limit, search)
+}
+
+// Bulk import limits
+const (
+	MaxImportRows   = 1000
+	importBatchSize = 100
+	exportPageSize  = 500
+)
+
+var errTooManyRows = fmt.Errorf("at most %d users can be imported at once", MaxImportRows)
+
+// importItem is a validated import row ready to be created
+type importItem struct {
+	user      *models.User
+	storeName string
+	// password is hashed when the user is created, not during validation
+	password string
+	// invite rows came without a password and get a link to choose one
+	invite bool
+	result *models.UserImportResult
+}
+
+func (u *authUsecase) ImportUsers(perms rbac.Permissions, rows []models.UserImportRow, dryRun bool) ([]models.UserImportResult, error) {
+	if len(rows) > MaxImportRows {
+		return nil, errTooManyRows
+	}
+	results := make([]models.UserImportResult, len(rows))
+	var items []*importItem
+	emails, phones := map[string]bool{}, map[string]bool{}
+	for i, row := range rows {
+		res := &results[i]
+		*res = models.UserImportResult{Row: i + 1, Email: strings.TrimSpace(row.Email)}
+		item, err := u.validateImportRow(perms, row, emails, phones)
+		if err != nil {
+			res.Status, res.Error = models.ImportError, err.Error()
+			continue
+		}
+		item.result = res
+		res.Status = models.ImportValid
+		items = append(items, item)
+	}
+	if dryRun {
+		return results, nil
+	}
+	for start := 0; start < len(items); start += importBatchSize {
+		batch := items[start:min(start+importBatchSize, len(items))]
+		err := u.repo.WithTx(func(tx Repository) error {
+			for _, it := range batch {
+				if err := createImportedUser(tx, it); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// a row failed, e.g. an email registered since validation: retry
+			// the batch row by row so only the failing rows are reported
+			for _, it := range batch {
+				if err := u.repo.WithTx(func(tx Repository) error { return createImportedUser(tx, it) }); err != nil {
+					it.result.Status, it.result.Error, it.result.UserID = models.ImportError, err.Error(), 0
+				}
+			}
+		}
+		for _, it := range batch {
+			if it.result.Status == models.ImportError {
+				continue
+			}
+			it.result.Status = models.ImportCreated
+			u.welcomeImportedUser(it)
+		}
+	}
+	return results, nil
+}
+
+// validateImportRow checks a row like Register would, plus uniqueness against
+// the database and the rows before it. emails and phones collect the values seen.
+func (u *authUsecase) validateImportRow(perms rbac.Permissions, row models.UserImportRow, emails, phones map[string]bool) (*importItem, error) {
+	user := &models.User{
+		Name:  strings.TrimSpace(row.Name),
+		Email: strings.TrimSpace(row.Email),
+		Phone: strings.TrimSpace(row.Phone),
+		Role:  strings.TrimSpace(row.Role),
+	}
+	if user.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if !strings.Contains(user.Email, "@") {
+		return nil, errors.New("invalid email")
+	}
+	if user.Role == "" {
+		user.Role = "user"
+	}
+	if user.Role != "user" && !perms.Has(rbac.UserAssignRole) {
+		return nil, errors.New("assigning roles requires " + rbac.UserAssignRole)
+	}
+	email := strings.ToLower(user.Email)
+	if emails[email] {
+		return nil, errors.New("duplicate email in import")
+	}
+	emails[email] = true
+	if user.Phone != "" {
+		if phones[user.Phone] {
+			return nil, errors.New("duplicate phone in import")
+		}
+		phones[user.Phone] = true
+	}
+	if existing, err := u.repo.GetUserByEmail(user.Email); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, errEmailTaken
+	}
+	if user.Phone != "" {
+		if existing, err := u.repo.GetUserByPhone(user.Phone); err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, errPhoneTaken
+		}
+	}
+	item := &importItem{user: user, storeName: strings.TrimSpace(row.StoreName), password: row.Password}
+	if row.Password == "" {
+		// no password can log in; the user sets their own from the invitation
+		user.Password, item.invite = password.Unusable, true
+	} else if err := u.checkPassword(row.Password, user.Name, user.Email); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func createImportedUser(tx Repository, it *importItem) error {
+	// hashed once, also when the batch is retried row by row
+	if it.password != "" {
+		h, err := password.Hash(it.password)
+		if err != nil {
+			return err
+		}
+		it.user.Password, it.password = h, ""
+	}
+	id, err := tx.CreateUser(it.user)
+	if err != nil {
+		return err
+	}
+	it.result.UserID = id
+	if it.storeName != "" {
+		return tx.CreateStore(id, it.storeName)
+	}
+	return createDefaultRecords(tx, id, it.user)
+}
+
+// welcomeImportedUser mails an invitation to choose a password, or the email
+// verification link Register sends. Failures are logged: the account exists.
+func (u *authUsecase) welcomeImportedUser(it *importItem) {
+	id, user := it.result.UserID, it.user
+	var err error
+	if it.invite {
+		var token string
+		if token, err = jwtpkg.GenerateResetToken(id); err == nil {
+			err = u.send(inviteMessage(user.Email, user.Name, token))
+		}
+	} else {
+		err = u.sendVerification(id, user.Name, user.Email)
+	}
+	if err != nil {
+		log.Printf("import: welcome email to user %d: %v", id, err)
+	}
+}
+
+func (u *authUsecase) ExportUsers(search string, fn func(*models.User) error) error {
+	for page := 1; ; page++ {
+		users, _, err := u.repo.ListUsers(page, exportPageSize, search)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+// helper to get refresh token expiry from env, default 30 days
+func getRefreshExpirySeconds() int64 {
+	s := os.Getenv("REFRESH_TOKEN_EXP_SECONDS")
+	if s == "" {
+		return 60 * 60 * 24 * 30 // 30 days
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return 60 * 60 * 24 * 30
+	}
+	return v
+}
+
+// errRefreshTokenReused is returned when a rotated refresh token is presented again
+var errRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// IssueRefreshToken creates and stores a new refresh token for a user and returns the plaintext token and expiry.
+// Each call starts a new token family (one per login).
+func (u *authUsecase) IssueRefreshToken(userID int64, client ClientInfo) (string, time.Time, error) {
+	familyID, err := randomHex(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return u.issueRefreshToken(&models.RefreshToken{UserID: userID, FamilyID: familyID, SessionCreatedAt: time.Now()}, client)
+}
+
+// issueRefreshToken stores a new token for the session described by rt (user, family,
+// parent and session start) and returns the plaintext token
+func (u *authUsecase) issueRefreshToken(rt *models.RefreshToken, client ClientInfo) (string, time.Time, error) {
+	// generate random 32-byte token, only its hash is stored
+	token, err := randomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	rt.TokenHash = hashToken(token)
+	rt.UserAgent = truncate(client.UserAgent, 255)
+	rt.IPAddress = truncate(client.IP, 64)
+	rt.ExpiresAt = time.Now().Add(time.Duration(getRefreshExpirySeconds()) * time.Second)
+	if _, err := u.repo.CreateRefreshToken(rt); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, rt.ExpiresAt, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Refresh rotates a refresh token: validates provided token, issues new access and refresh tokens.
+// The old token is kept (marked rotated) so that presenting it again is detected as
+// reuse, in which case the whole family is revoked.
+func (u *authUsecase) Refresh(refreshToken string, client ClientInfo) (string, string, time.Time, error) {
+	r, err := u.rotateRefreshToken(refreshToken, "", client)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	accessToken, err := accessTokenFor(r.user)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return accessToken, r.token, r.expiresAt, nil
+}
+
+var (
+	errMissingRefreshToken = errors.New("missing refresh token")
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+)
+
+// rotatedRefreshToken is the result of rotateRefreshToken
+type rotatedRefreshToken struct {
+	// user is the token's user, as currently on record
+	user *models.User
+	// scopes of the session, for tokens held by OAuth clients
+	scopes    []string
+	token     string
+	expiresAt time.Time
+}
+
+// rotateRefreshToken replaces a refresh token held by clientID ("" for our own
+// apps) with the next token of its family. Tokens of other clients are rejected
+// without touching them.
+func (u *authUsecase) rotateRefreshToken(refreshToken, clientID string, client ClientInfo) (*rotatedRefreshToken, error) {
+	if refreshToken == "" {
+		return nil, errMissingRefreshToken
+	}
+	rt, err := u.repo.GetRefreshToken(hashToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+	if rt == nil || rt.ClientID != clientID {
+		return nil, errInvalidRefreshToken
+	}
+	if rt.RotatedAt != nil {
+		return nil, u.revokeReusedFamily(rt)
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		// delete expired token
+		_ = u.repo.DeleteRefreshToken(rt.TokenHash)
+		return nil, errRefreshTokenExpired
+	}
+	// mark rotated before issuing, so two concurrent uses cannot both succeed
+	ok, err := u.repo.MarkRefreshTokenRotated(rt.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, u.revokeReusedFamily(rt)
+	}
+	// the new access token gets the role and token version currently on record
+	user, err := u.repo.GetUserByID(rt.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Status != models.UserStatusActive {
+		// the account is gone or deactivated: end the session
+		_ = u.repo.DeleteRefreshTokenFamily(rt.FamilyID)
+		if user == nil {
+			return nil, errInvalidRefreshToken
+		}
+		return nil, errAccountInactive
+	}
+	familyID := rt.FamilyID
+	if familyID == "" {
+		// token issued before families existed
+		if familyID, err = randomHex(16); err != nil {
+			return nil, err
+		}
+	}
+	parentID := rt.ID
+	next := &models.RefreshToken{UserID: rt.UserID, FamilyID: familyID, ParentID: &parentID, SessionCreatedAt: rt.SessionCreatedAt, ClientID: rt.ClientID, Scopes: rt.Scopes}
+	token, expiresAt, err := u.issueRefreshToken(next, client)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatedRefreshToken{user: user, scopes: rt.Scopes, token: token, expiresAt: expiresAt}, nil
+}
+
+// revokeReusedFamily handles a replayed refresh token: one of the two parties holding
+// it is not the legitimate client, so every token of the family is revoked.
+func (u *authUsecase) revokeReusedFamily(rt *models.RefreshToken) error {
+	var err error
+	if rt.FamilyID == "" {
+		err = u.repo.DeleteRefreshToken(rt.TokenHash)
+	} else {
+		err = u.repo.DeleteRefreshTokenFamily(rt.FamilyID)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("security: refresh token reuse for user %d (family %s), family revoked", rt.UserID, rt.FamilyID)
+	detail := fmt.Sprintf("family=%s token_id=%d", rt.FamilyID, rt.ID)
+	if err := u.repo.RecordSecurityEvent(rt.UserID, "refresh_token_reuse", detail); err != nil {
+		log.Printf("security: failed to record event: %v", err)
+	}
+	return errRefreshTokenReused
+}
+
+// RevokeRefreshToken revokes the token family of a refresh token (logout)
+func (u *authUsecase) RevokeRefreshToken(refreshToken string) error {
+	if refreshToken == "" {
+		return errors.New("missing refresh token")
+	}
+	rt, err := u.repo.GetRefreshToken(hashToken(refreshToken))
+	if err != nil || rt == nil {
+		return err
+	}
+	if rt.FamilyID == "" {
+		return u.repo.DeleteRefreshToken(rt.TokenHash)
+	}
+	return u.repo.DeleteRefreshTokenFamily(rt.FamilyID)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func (u *authUsecase) ListSessions(requesterID int64, perms rbac.Permissions, userID int64) ([]*models.Session, error) {
+	if requesterID != userID && !perms.Has(rbac.UserSessionsAny) {
+		return nil, errors.New("forbidden")
+	}
+	return u.repo.ListSessions(userID)
+}
+
+func (u *authUsecase) RevokeSession(requesterID int64, perms rbac.Permissions, userID int64, sessionID string) error {
+	if requesterID != userID && !perms.Has(rbac.UserSessionsAny) {
+		return errors.New("forbidden")
+	}
+	found, err := u.repo.DeleteSession(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// RevokeAllRefreshTokens deletes all refresh tokens for a user (admin or self) and
+// denies their outstanding access tokens
+func (u *authUsecase) RevokeAllRefreshTokens(userID int64) error {
+	if err := u.repo.DeleteRefreshTokensByUser(userID); err != nil {
+		return err
+	}
+	if u.denylist == nil {
+		return nil
+	}
+	return u.denylist.RevokeUserTokens(userID, time.Now())
+}
+
+func (u *authUsecase) RevokeAccessToken(accessToken string) error {
+	claims, err := jwtpkg.ParseClaims(accessToken)
+	if err != nil {
+		return err
+	}
+	if u.denylist == nil || claims.ID == "" {
+		return nil
+	}
+	return u.denylist.RevokeToken(claims.ID, claims.ExpiresAt)
+}
+
+var (
+	errAPIKeyNotFound  = errors.New("api key not found")
+	errScopeNotGranted = errors.New("scope exceeds your permissions")
+	errAPIKeyName      = errors.New("name is required (max 100 characters)")
+	errAPIKeyExpiry    = errors.New("expires_at must be in the future")
+)
+
+// validateAPIKey checks a key's name and that its scopes are permissions the
+// owner holds, so a key can never do more than its owner
+func validateAPIKey(name string, scopes []string, perms rbac.Permissions) error {
+	if name == "" || len(name) > 100 {
+		return errAPIKeyName
+	}
+	for _, s := range scopes {
+		if !perms.Has(s) {
+			return fmt.Errorf("%w: %s", errScopeNotGranted, s)
+		}
+	}
+	return nil
+}
+
+func (u *authUsecase) CreateAPIKey(userID int64, perms rbac.Permissions, name string, scopes []string, expiresAt *time.Time) (string, *models.APIKey, error) {
+	name = strings.TrimSpace(name)
+	if err := validateAPIKey(name, scopes, perms); err != nil {
+		return "", nil, err
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", nil, errAPIKeyExpiry
+	}
+	key, prefix, hash, err := apikey.Generate()
+	if err != nil {
+		return "", nil, err
+	}
+	k := &models.APIKey{UserID: userID, Name: name, Prefix: prefix, KeyHash: hash, Scopes: scopes, ExpiresAt: expiresAt, CreatedAt: time.Now()}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	if k.ID, err = u.repo.CreateAPIKey(k); err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+func (u *authUsecase) ListAPIKeys(userID int64) ([]*models.APIKey, error) {
+	return u.repo.ListAPIKeys(userID)
+}
+
+func (u *authUsecase) UpdateAPIKey(userID int64, perms rbac.Permissions, id int64, name *string, scopes []string) (*models.APIKey, error) {
+	k, err := u.repo.GetAPIKey(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, errAPIKeyNotFound
+	}
+	if name != nil {
+		k.Name = strings.TrimSpace(*name)
+	}
+	if scopes != nil {
+		k.Scopes = scopes
+	}
+	// only changed scopes are checked: a key keeps scopes its owner has since lost,
+	// they are simply not effective (see middleware.GinJWTOrAPIKeyAuth)
+	if err := validateAPIKey(k.Name, scopes, perms); err != nil {
+		return nil, err
+	}
+	if err := u.repo.UpdateAPIKey(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (u *authUsecase) DeleteAPIKey(userID, id int64) error {
+	found, err := u.repo.DeleteAPIKey(userID, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// AuthenticateIntrospection only admits confidential clients holding
+// oauth.ScopeIntrospect: answers reveal who a token belongs to, so callers must
+// authenticate (RFC 7662 section 2.1)
+func (u *authUsecase) AuthenticateIntrospection(clientID, secret string) error {
+	c, err := u.authenticateOAuthClient(clientID, secret)
+	if err != nil {
+		return err
+	}
+	if !c.Confidential || !oauth.Subset([]string{oauth.ScopeIntrospect}, c.Scopes) {
+		return oauthError("invalid_client", "client may not introspect tokens")
+	}
+	return nil
+}
+
+// Introspect checks a token like the services accepting it would, and also
+// against the current state of the account: tokens of suspended or deleted
+// users, and tokens issued before the user's token version changed, are
+// inactive. Only errors reading that state are returned.
+func (u *authUsecase) Introspect(token string) (*introspect.Result, error) {
+	inactive := &introspect.Result{}
+	// access tokens are JWTs, refresh tokens opaque hex strings
+	if strings.Count(token, ".") != 2 {
+		return u.introspectRefreshToken(token)
+	}
+	claims, err := jwtpkg.ParseClaims(token)
+	if err != nil {
+		return inactive, nil
+	}
+	if u.denylist != nil {
+		revoked, err := denylist.IsRevoked(u.denylist, claims)
+		if err != nil {
+			log.Printf("introspect: denylist lookup failed: %v", err)
+		} else if revoked {
+			return inactive, nil
+		}
+	}
+	user, err := u.repo.GetUserByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Status != models.UserStatusActive || user.TokenVersion != claims.TokenVersion {
+		return inactive, nil
+	}
+	if claims.ActorID != 0 {
+		// impersonation ends when the staff member loses their account
+		actor, err := u.repo.GetUserByID(claims.ActorID)
+		if err != nil {
+			return nil, err
+		}
+		if actor == nil || actor.Status != models.UserStatusActive {
+			return inactive, nil
+		}
+	}
+	if claims.ClientID != "" {
+		// partner tokens end with their client or the user's consent
+		if ok, err := u.oauthGrantActive(claims.ClientID, user.ID); err != nil || !ok {
+			return inactive, err
+		}
+	}
+	return &introspect.Result{
+		Active:       true,
+		TokenType:    introspect.TypeAccessToken,
+		Subject:      strconv.FormatInt(user.ID, 10),
+		UserID:       user.ID,
+		Role:         claims.Role,
+		Status:       user.Status,
+		TokenVersion: claims.TokenVersion,
+		ActorID:      claims.ActorID,
+		ClientID:     claims.ClientID,
+		Scope:        oauth.JoinScope(claims.Scopes),
+		JTI:          claims.ID,
+		IssuedAt:     claims.IssuedAt.Unix(),
+		ExpiresAt:    claims.ExpiresAt.Unix(),
+	}, nil
+}
+
+func (u *authUsecase) introspectRefreshToken(token string) (*introspect.Result, error) {
+	inactive := &introspect.Result{}
+	if token == "" {
+		return inactive, nil
+	}
+	rt, err := u.repo.GetRefreshToken(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if rt == nil || rt.RotatedAt != nil || time.Now().After(rt.ExpiresAt) {
+		return inactive, nil
+	}
+	user, err := u.repo.GetUserByID(rt.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Status != models.UserStatusActive {
+		return inactive, nil
+	}
+	if rt.ClientID != "" {
+		if ok, err := u.oauthGrantActive(rt.ClientID, user.ID); err != nil || !ok {
+			return inactive, err
+		}
+	}
+	return &introspect.Result{
+		Active:    true,
+		TokenType: introspect.TypeRefreshToken,
+		Subject:   strconv.FormatInt(user.ID, 10),
+		UserID:    user.ID,
+		Role:      user.Role,
+		Status:    user.Status,
+		ClientID:  rt.ClientID,
+		Scope:     oauth.JoinScope(rt.Scopes),
+		IssuedAt:  rt.CreatedAt.Unix(),
+		ExpiresAt: rt.ExpiresAt.Unix(),
+	}, nil
+}
+
+// OAuth 2.0 authorization server lifetimes
+const (
+	// OAuthCodeTTL is how long a client has to exchange an authorization code
+	OAuthCodeTTL = 10 * time.Minute
+	// pkceMethod is the only PKCE challenge method accepted (RFC 7636)
+	pkceMethod = "S256"
+)
+
+// OAuthError is an OAuth 2.0 error response (RFC 6749 section 5.2); Code is one
+// of the registered error codes
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) error {
+	return &OAuthError{Code: code, Description: description}
+}
+
+var (
+	errOAuthClientNotFound = errors.New("oauth client not found")
+	errOAuthConsentMissing = errors.New("consent not found")
+	errInvalidOAuthClient  = errors.New("invalid oauth client")
+)
+
+// OAuthAuthorizeRequest holds the parameters of an authorization request
+type OAuthAuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// OAuthAuthorization is a validated authorization request, as shown on the
+// consent screen
+type OAuthAuthorization struct {
+	Client      *models.OAuthClient
+	RedirectURI string
+	Scopes      []string
+	// Consented is true when the user already granted every requested scope
+	Consented bool
+}
+
+// OAuthTokenRequest holds the parameters of a token request. The client
+// authenticates with ClientSecret, unless it is a public client.
+type OAuthTokenRequest struct {
+	GrantType    string
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+}
+
+// OAuthToken is a successful token response (RFC 6749 section 5.1)
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// CreateOAuthClient registers a partner app owned by c.OwnerID and returns its
+// secret (confidential clients only), which is not stored and cannot be shown again
+func (u *authUsecase) CreateOAuthClient(c *models.OAuthClient) (string, error) {
+	if err := validateOAuthClient(c); err != nil {
+		return "", err
+	}
+	owner, err := u.repo.GetUserByID(c.OwnerID)
+	if err != nil {
+		return "", err
+	}
+	if owner == nil || owner.Status != models.UserStatusActive {
+		return "", fmt.Errorf("%w: owner must be an active user", errInvalidOAuthClient)
+	}
+	id, err := randomHex(12)
+	if err != nil {
+		return "", err
+	}
+	c.ClientID = "cl_" + id
+	var secret string
+	if c.Confidential {
+		if secret, err = randomHex(32); err != nil {
+			return "", err
+		}
+		secret = "cs_" + secret
+		c.SecretHash = hashToken(secret)
+	}
+	c.CreatedAt = time.Now()
+	if c.ID, err = u.repo.CreateOAuthClient(c); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// validateOAuthClient checks a client's registration. Redirect URIs must be
+// absolute https URLs (http only for localhost) without a fragment.
+func validateOAuthClient(c *models.OAuthClient) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" || len(c.Name) > 100 {
+		return fmt.Errorf("%w: name is required (max 100 characters)", errInvalidOAuthClient)
+	}
+	if len(c.Scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", errInvalidOAuthClient)
+	}
+	for _, s := range c.Scopes {
+		if !oauth.Valid(s) {
+			return fmt.Errorf("%w: unknown scope %s", errInvalidOAuthClient, s)
+		}
+		if s == oauth.ScopeIntrospect && !c.Confidential {
+			return fmt.Errorf("%w: public clients cannot introspect tokens", errInvalidOAuthClient)
+		}
+	}
+	if len(c.GrantTypes) == 0 {
+		return fmt.Errorf("%w: at least one grant type is required", errInvalidOAuthClient)
+	}
+	for _, g := range c.GrantTypes {
+		switch g {
+		case models.GrantAuthorizationCode:
+			if len(c.RedirectURIs) == 0 {
+				return fmt.Errorf("%w: redirect_uris are required for the authorization code grant", errInvalidOAuthClient)
+			}
+		case models.GrantClientCredentials:
+			if !c.Confidential {
+				return fmt.Errorf("%w: public clients cannot use client credentials", errInvalidOAuthClient)
+			}
+		default:
+			return fmt.Errorf("%w: unsupported grant type %s", errInvalidOAuthClient, g)
+		}
+	}
+	for _, raw := range c.RedirectURIs {
+		ru, err := url.Parse(raw)
+		if err != nil || !ru.IsAbs() || ru.Fragment != "" || ru.Host == "" {
+			return fmt.Errorf("%w: invalid redirect uri %s", errInvalidOAuthClient, raw)
+		}
+		local := ru.Hostname() == "localhost" || ru.Hostname() == "127.0.0.1"
+		if ru.Scheme != "https" && !(ru.Scheme == "http" && local) {
+			return fmt.Errorf("%w: redirect uri must use https: %s", errInvalidOAuthClient, raw)
+		}
+	}
+	return nil
+}
+
+func (u *authUsecase) ListOAuthClients() ([]*models.OAuthClient, error) {
+	return u.repo.ListOAuthClients()
+}
+
+// RevokeOAuthClient disables a client for good and deletes its refresh tokens.
+// Its access tokens stay valid until they expire, except with services using
+// introspection.
+func (u *authUsecase) RevokeOAuthClient(clientID string) error {
+	return u.repo.WithTx(func(tx Repository) error {
+		ok, err := tx.RevokeOAuthClient(clientID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errOAuthClientNotFound
+		}
+		return tx.DeleteOAuthRefreshTokens(clientID, 0)
+	})
+}
+
+// activeOAuthClient returns the client with clientID, or nil if it is unknown
+// or revoked
+func (u *authUsecase) activeOAuthClient(clientID string) (*models.OAuthClient, error) {
+	if clientID == "" {
+		return nil, nil
+	}
+	c, err := u.repo.GetOAuthClient(clientID)
+	if err != nil || c == nil || c.RevokedAt != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func hasGrant(c *models.OAuthClient, grant string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedScopes parses a scope parameter; no scope means every scope of the client
+func requestedScopes(c *models.OAuthClient, scope string) ([]string, error) {
+	scopes := oauth.ParseScope(scope)
+	if len(scopes) == 0 {
+		return c.Scopes, nil
+	}
+	if !oauth.Subset(scopes, c.Scopes) {
+		return nil, oauthError("invalid_scope", "scope not allowed for this client")
+	}
+	return scopes, nil
+}
+
+// AuthorizeOAuth validates an authorization request of userID. Errors about the
+// client or redirect URI must be shown to the user, never redirected.
+func (u *authUsecase) AuthorizeOAuth(userID int64, req OAuthAuthorizeRequest) (*OAuthAuthorization, error) {
+	c, err := u.activeOAuthClient(req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, oauthError("invalid_client", "unknown client")
+	}
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(c.RedirectURIs) == 1 {
+		redirectURI = c.RedirectURIs[0]
+	}
+	registered := false
+	for _, ru := range c.RedirectURIs {
+		if ru == redirectURI {
+			registered = true
+		}
+	}
+	if !registered {
+		return nil, oauthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+	if req.ResponseType != "code" {
+		return nil, oauthError("unsupported_response_type", "response_type must be code")
+	}
+	if !hasGrant(c, models.GrantAuthorizationCode) {
+		return nil, oauthError("unauthorized_client", "client may not use the authorization code grant")
+	}
+	// PKCE is required for every client (OAuth 2.1)
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != pkceMethod {
+		return nil, oauthError("invalid_request", "code_challenge with code_challenge_method S256 is required")
+	}
+	scopes, err := requestedScopes(c, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	consent, err := u.repo.GetOAuthConsent(userID, c.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &OAuthAuthorization{
+		Client:      c,
+		RedirectURI: redirectURI,
+		Scopes:      scopes,
+		Consented:   consent != nil && oauth.Subset(scopes, consent.Scopes),
+	}, nil
+}
+
+// ApproveOAuth completes an authorization request of userID and returns where
+// to redirect the user: with a code when approved (the consent is recorded),
+// otherwise with error=access_denied
+func (u *authUsecase) ApproveOAuth(userID int64, req OAuthAuthorizeRequest, approve bool) (string, error) {
+	a, err := u.AuthorizeOAuth(userID, req)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if !approve {
+		params.Set("error", "access_denied")
+		return withQuery(a.RedirectURI, params), nil
+	}
+	code, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	consent, err := u.repo.GetOAuthConsent(userID, a.Client.ClientID)
+	if err != nil {
+		return "", err
+	}
+	// consents accumulate; a narrower request keeps the earlier grants
+	granted := append([]string(nil), a.Scopes...)
+	if consent != nil {
+		granted = oauth.ParseScope(oauth.JoinScope(append(granted, consent.Scopes...)))
+	}
+	err = u.repo.WithTx(func(tx Repository) error {
+		if err := tx.SaveOAuthConsent(userID, a.Client.ClientID, granted); err != nil {
+			return err
+		}
+		_, err := tx.CreateOAuthCode(&models.OAuthCode{
+			CodeHash:      hashToken(code),
+			ClientID:      a.Client.ClientID,
+			UserID:        userID,
+			RedirectURI:   a.RedirectURI,
+			Scopes:        a.Scopes,
+			CodeChallenge: req.CodeChallenge,
+			ExpiresAt:     time.Now().Add(OAuthCodeTTL),
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	params.Set("code", code)
+	return withQuery(a.RedirectURI, params), nil
+}
+
+// withQuery adds params to the query of a registered redirect URI
+func withQuery(rawURL string, params url.Values) string {
+	ru, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := ru.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	ru.RawQuery = q.Encode()
+	return ru.String()
+}
+
+// authenticateOAuthClient checks a client's credentials. Public clients have no
+// secret and must not send one.
+func (u *authUsecase) authenticateOAuthClient(clientID, secret string) (*models.OAuthClient, error) {
+	c, err := u.activeOAuthClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	if c.Confidential {
+		if secret == "" || subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) != 1 {
+			return nil, oauthError("invalid_client", "client authentication failed")
+		}
+	} else if secret != "" {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	return c, nil
+}
+
+// OAuthToken is the token endpoint: it exchanges an authorization code, a
+// refresh token or the client's own credentials for an access token
+func (u *authUsecase) OAuthToken(req OAuthTokenRequest, client ClientInfo) (*OAuthToken, error) {
+	c, err := u.authenticateOAuthClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	switch req.GrantType {
+	case models.GrantAuthorizationCode:
+		if !hasGrant(c, models.GrantAuthorizationCode) {
+			return nil, oauthError("unauthorized_client", "client may not use this grant type")
+		}
+		return u.exchangeOAuthCode(c, req, client)
+	case models.GrantRefreshToken:
+		if !hasGrant(c, models.GrantAuthorizationCode) {
+			return nil, oauthError("unauthorized_client", "client may not use this grant type")
+		}
+		return u.refreshOAuthToken(c, req, client)
+	case models.GrantClientCredentials:
+		if !hasGrant(c, models.GrantClientCredentials) {
+			return nil, oauthError("unauthorized_client", "client may not use this grant type")
+		}
+		return u.clientCredentialsToken(c, req)
+	case "":
+		return nil, oauthError("invalid_request", "grant_type is required")
+	}
+	return nil, oauthError("unsupported_grant_type", "unsupported grant type")
+}
+
+// verifyPKCE checks a code_verifier against its S256 code_challenge
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	h := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(h[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func (u *authUsecase) exchangeOAuthCode(c *models.OAuthClient, req OAuthTokenRequest, client ClientInfo) (*OAuthToken, error) {
+	invalidGrant := oauthError("invalid_grant", "invalid authorization code")
+	if req.Code == "" {
+		return nil, invalidGrant
+	}
+	code, err := u.repo.GetOAuthCode(hashToken(req.Code))
+	if err != nil {
+		return nil, err
+	}
+	if code == nil || code.ClientID != c.ClientID {
+		return nil, invalidGrant
+	}
+	if code.UsedAt != nil {
+		// a replayed code may have been stolen: revoke what it was exchanged for
+		return nil, u.revokeReusedCode(code)
+	}
+	if time.Now().After(code.ExpiresAt) || req.RedirectURI != code.RedirectURI {
+		return nil, invalidGrant
+	}
+	if !verifyPKCE(req.CodeVerifier, code.CodeChallenge) {
+		return nil, oauthError("invalid_grant", "code_verifier does not match the code challenge")
+	}
+	familyID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := u.repo.UseOAuthCode(code.ID, familyID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, u.revokeReusedCode(code)
+	}
+	user, err := u.repo.GetUserByID(code.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Status != models.UserStatusActive {
+		return nil, invalidGrant
+	}
+	scopes := oauth.Intersect(code.Scopes, c.Scopes)
+	access, err := jwtpkg.GenerateClientToken(user.ID, user.Role, user.TokenVersion, c.ClientID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	rt := &models.RefreshToken{UserID: user.ID, FamilyID: familyID, SessionCreatedAt: time.Now(), ClientID: c.ClientID, Scopes: scopes}
+	refresh, _, err := u.issueRefreshToken(rt, client)
+	if err != nil {
+		return nil, err
+	}
+	return newOAuthToken(access, refresh, scopes), nil
+}
+
+// revokeReusedCode revokes the refresh tokens issued for an authorization code
+// that was presented again (RFC 6749 section 4.1.2)
+func (u *authUsecase) revokeReusedCode(code *models.OAuthCode) error {
+	if code.FamilyID != "" {
+		if err := u.repo.DeleteRefreshTokenFamily(code.FamilyID); err != nil {
+			return err
+		}
+	}
+	log.Printf("security: authorization code reuse for user %d (client %s), tokens revoked", code.UserID, code.ClientID)
+	detail := fmt.Sprintf("client=%s family=%s", code.ClientID, code.FamilyID)
+	if err := u.repo.RecordSecurityEvent(code.UserID, "oauth_code_reuse", detail); err != nil {
+		log.Printf("security: failed to record event: %v", err)
+	}
+	return oauthError("invalid_grant", "invalid authorization code")
+}
+
+// refreshOAuthToken rotates a client's refresh token like Refresh does for our
+// own apps. A narrower scope may be requested for the new access token.
+func (u *authUsecase) refreshOAuthToken(c *models.OAuthClient, req OAuthTokenRequest, client ClientInfo) (*OAuthToken, error) {
+	r, err := u.rotateRefreshToken(req.RefreshToken, c.ClientID, client)
+	switch {
+	case errors.Is(err, errRefreshTokenReused), errors.Is(err, errInvalidRefreshToken),
+		errors.Is(err, errRefreshTokenExpired), errors.Is(err, errAccountInactive):
+		return nil, oauthError("invalid_grant", err.Error())
+	case errors.Is(err, errMissingRefreshToken):
+		return nil, oauthError("invalid_request", err.Error())
+	case err != nil:
+		return nil, err
+	}
+	// scopes the client is no longer registered for are dropped
+	scopes := oauth.Intersect(r.scopes, c.Scopes)
+	if requested := oauth.ParseScope(req.Scope); len(requested) > 0 {
+		if !oauth.Subset(requested, scopes) {
+			return nil, oauthError("invalid_scope", "scope exceeds the original grant")
+		}
+		scopes = requested
+	}
+	access, err := jwtpkg.GenerateClientToken(r.user.ID, r.user.Role, r.user.TokenVersion, c.ClientID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	return newOAuthToken(access, r.token, scopes), nil
+}
+
+// clientCredentialsToken issues a token acting as the client's owner. No
+// refresh token is issued: the client can always ask again.
+func (u *authUsecase) clientCredentialsToken(c *models.OAuthClient, req OAuthTokenRequest) (*OAuthToken, error) {
+	scopes, err := requestedScopes(c, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := u.repo.GetUserByID(c.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if owner == nil || owner.Status != models.UserStatusActive {
+		return nil, oauthError("invalid_client", "client owner is not active")
+	}
+	access, err := jwtpkg.GenerateClientToken(owner.ID, owner.Role, owner.TokenVersion, c.ClientID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	return newOAuthToken(access, "", scopes), nil
+}
+
+func newOAuthToken(access, refresh string, scopes []string) *OAuthToken {
+	return &OAuthToken{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(jwtpkg.OAuthAccessTokenTTL.Seconds()),
+		RefreshToken: refresh,
+		Scope:        oauth.JoinScope(scopes),
+	}
+}
+
+// RevokeOAuthToken revokes an access or refresh token of the authenticated
+// client (RFC 7009). Unknown tokens and tokens of other clients are ignored.
+func (u *authUsecase) RevokeOAuthToken(clientID, secret, token string) error {
+	c, err := u.authenticateOAuthClient(clientID, secret)
+	if err != nil {
+		return err
+	}
+	if strings.Count(token, ".") == 2 {
+		claims, err := jwtpkg.ParseClaims(token)
+		if err != nil || claims.ClientID != c.ClientID || u.denylist == nil || claims.ID == "" {
+			return nil
+		}
+		return u.denylist.RevokeToken(claims.ID, claims.ExpiresAt)
+	}
+	rt, err := u.repo.GetRefreshToken(hashToken(token))
+	if err != nil || rt == nil || rt.ClientID != c.ClientID {
+		return err
+	}
+	return u.repo.DeleteRefreshTokenFamily(rt.FamilyID)
+}
+
+func (u *authUsecase) ListOAuthConsents(userID int64) ([]*models.OAuthConsent, error) {
+	return u.repo.ListOAuthConsents(userID)
+}
+
+// RevokeOAuthConsent withdraws a consent and deletes the client's refresh tokens
+// for the user
+func (u *authUsecase) RevokeOAuthConsent(userID int64, clientID string) error {
+	return u.repo.WithTx(func(tx Repository) error {
+		ok, err := tx.DeleteOAuthConsent(userID, clientID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errOAuthConsentMissing
+		}
+		return tx.DeleteOAuthRefreshTokens(clientID, userID)
+	})
+}
+
+// oauthGrantActive reports whether a client token of userID is still backed by
+// an active client and, unless it acts as the client's owner, a consent
+func (u *authUsecase) oauthGrantActive(clientID string, userID int64) (bool, error) {
+	c, err := u.activeOAuthClient(clientID)
+	if err != nil || c == nil {
+		return false, err
+	}
+	if c.OwnerID == userID && hasGrant(c, models.GrantClientCredentials) {
+		return true, nil
+	}
+	consent, err := u.repo.GetOAuthConsent(userID, clientID)
+	return consent != nil, err
 }
@@ -1,13 +1,49 @@
 package auth
 
 import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
     "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
     "testing"
     "time"
 
+    "github.com/example/ms-ecommerce/internal/pkg/apikey"
+    "github.com/example/ms-ecommerce/internal/pkg/denylist"
+    "github.com/example/ms-ecommerce/internal/pkg/introspect"
+    jwtpkg "github.com/example/ms-ecommerce/internal/pkg/jwt"
+    "github.com/example/ms-ecommerce/internal/pkg/loginguard"
+    "github.com/example/ms-ecommerce/internal/pkg/mail"
+    "github.com/example/ms-ecommerce/internal/pkg/middleware"
     "github.com/example/ms-ecommerce/internal/pkg/models"
+    "github.com/example/ms-ecommerce/internal/pkg/oauth"
+    "github.com/example/ms-ecommerce/internal/pkg/oidc"
+    "github.com/example/ms-ecommerce/internal/pkg/password"
+    "github.com/example/ms-ecommerce/internal/pkg/rbac"
+    "github.com/example/ms-ecommerce/internal/pkg/sms"
+    "github.com/example/ms-ecommerce/internal/pkg/totp"
+    "github.com/example/ms-ecommerce/internal/pkg/upload"
+    "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt/v5"
+    "golang.org/x/crypto/bcrypt"
 )
 
+// tokens are signed with HS256, which needs a secret
+func TestMain(m *testing.M) {
+    os.Setenv("JWT_SECRET", "test-secret")
+    os.Exit(m.Run())
+}
+
 // mockRepo implements minimal Repository for UpdateUser tests.
 type mockRepo struct {
     lastID   int64
@@ -15,19 +51,427 @@ type mockRepo struct {
     lastPhone *string
     lastRole *string
     err      error
+
+    // state used by login / 2FA tests
+    user          *models.User
+    mfa           *models.UserMFA
+    recoveryCodes map[string]bool // hash -> used
+
+    // state used by refresh token tests
+    refreshTokens  map[string]*models.RefreshToken // hash -> token
+    securityEvents []string
+    identities     map[string]int64 // provider|subject -> user id
+    apiKeys        []*models.APIKey
+    loginTokens    []*models.LoginToken
+
+    // state used by OAuth tests
+    oauthClients  map[string]*models.OAuthClient
+    oauthCodes    map[string]*models.OAuthCode // hash -> code
+    oauthConsents map[string]*models.OAuthConsent // user id|client id -> consent
+
+    // state used by registration tests
+    stores   []string
+    // image URLs of the user's products, used by account deletion tests
+    productImages []string
+    storeErr error
 }
 
-func (m *mockRepo) CreateUser(user *models.User) (int64, error) { return 0, nil }
-func (m *mockRepo) CreateStore(userID int64, name string) error { return nil }
-func (m *mockRepo) GetUserByEmail(email string) (*models.User, error) { return nil, nil }
-func (m *mockRepo) GetUserByPhone(phone string) (*models.User, error) { return nil, nil }
-func (m *mockRepo) UpdatePassword(userID int64, hashed string) error { return nil }
-func (m *mockRepo) GetUserByID(id int64) (*models.User, error) { return nil, nil }
+// WithTx rolls back the user, identity and store state when fn fails
+func (m *mockRepo) WithTx(fn func(tx Repository) error) error {
+    user, stores := m.user, m.stores
+    identities := map[string]int64{}
+    for k, v := range m.identities {
+        identities[k] = v
+    }
+    if err := fn(m); err != nil {
+        m.user, m.stores, m.identities = user, stores, identities
+        return err
+    }
+    return nil
+}
+func (m *mockRepo) CreateUser(user *models.User) (int64, error) {
+    // the mock holds a single user; its email is the unique constraint
+    if m.user != nil && strings.EqualFold(m.user.Email, user.Email) {
+        return 0, errEmailTaken
+    }
+    user.ID = 99
+    user.Status = models.UserStatusActive // column default
+    m.user = user
+    return user.ID, nil
+}
+func (m *mockRepo) CreateStore(userID int64, name string) error {
+    if m.storeErr != nil {
+        return m.storeErr
+    }
+    m.stores = append(m.stores, name)
+    return nil
+}
+func (m *mockRepo) GetUserByEmail(email string) (*models.User, error) {
+    // MySQL's default collation compares emails case-insensitively
+    if m.user != nil && strings.EqualFold(m.user.Email, email) {
+        return m.user, nil
+    }
+    return nil, nil
+}
+func (m *mockRepo) GetUserByPhone(phone string) (*models.User, error) {
+    if m.user != nil && phone != "" && m.user.Phone == phone {
+        return m.user, nil
+    }
+    return nil, nil
+}
+func (m *mockRepo) UpdatePassword(userID int64, hashed string) error {
+    if m.user != nil && m.user.ID == userID {
+        m.user.Password = hashed
+    }
+    return nil
+}
+func (m *mockRepo) MarkEmailVerified(userID int64) error {
+    now := time.Now()
+    m.user.EmailVerifiedAt = &now
+    return nil
+}
+func (m *mockRepo) UpdateEmail(userID int64, email string) error {
+    if m.err != nil {
+        return m.err
+    }
+    now := time.Now()
+    m.user.Email, m.user.EmailVerifiedAt = email, &now
+    return nil
+}
+func (m *mockRepo) GetUserByID(id int64) (*models.User, error) {
+    if m.user != nil && m.user.ID == id {
+        return m.user, nil
+    }
+    return nil, nil
+}
 func (m *mockRepo) ListUsers(page, limit int, search string) ([]*models.User, int, error) { return nil, 0, nil }
-func (m *mockRepo) CreateRefreshToken(userID int64, tokenHash string, expiresAt time.Time) error { return nil }
-func (m *mockRepo) GetRefreshToken(tokenHash string) (int64, time.Time, bool, error) { return 0, time.Time{}, false, nil }
-func (m *mockRepo) DeleteRefreshToken(tokenHash string) error { return nil }
+func (m *mockRepo) SetUserStatus(id int64, status string) error {
+    m.user.Status = status
+    m.user.TokenVersion++
+    return nil
+}
+func (m *mockRepo) DeleteUserData(userID int64) ([]string, error) {
+    m.user.Name, m.user.Email, m.user.Phone, m.user.Password = "Deleted user", "deleted@deleted.invalid", "", ""
+    m.user.Status = models.UserStatusDeleted
+    m.stores = nil
+    m.refreshTokens = nil
+    urls := m.productImages
+    m.productImages = nil
+    return urls, nil
+}
+func (m *mockRepo) GetUserExport(userID int64) (*models.UserExport, error) {
+    out := &models.UserExport{}
+    for _, name := range m.stores {
+        out.Store = &models.Store{UserID: userID, Name: name}
+    }
+    return out, nil
+}
+func (m *mockRepo) CreateRefreshToken(t *models.RefreshToken) (int64, error) {
+    if m.refreshTokens == nil {
+        m.refreshTokens = map[string]*models.RefreshToken{}
+    }
+    t.ID = int64(len(m.refreshTokens) + 1)
+    m.refreshTokens[t.TokenHash] = t
+    return t.ID, nil
+}
+func (m *mockRepo) GetRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+    return m.refreshTokens[tokenHash], nil
+}
+func (m *mockRepo) MarkRefreshTokenRotated(id int64) (bool, error) {
+    for _, t := range m.refreshTokens {
+        if t.ID == id && t.RotatedAt == nil {
+            now := time.Now()
+            t.RotatedAt = &now
+            return true, nil
+        }
+    }
+    return false, nil
+}
+func (m *mockRepo) DeleteRefreshToken(tokenHash string) error {
+    delete(m.refreshTokens, tokenHash)
+    return nil
+}
+func (m *mockRepo) DeleteRefreshTokenFamily(familyID string) error {
+    for h, t := range m.refreshTokens {
+        if t.FamilyID == familyID {
+            delete(m.refreshTokens, h)
+        }
+    }
+    return nil
+}
 func (m *mockRepo) DeleteRefreshTokensByUser(userID int64) error { return nil }
+func (m *mockRepo) DeleteOtherRefreshTokens(userID int64, keepFamily string) error {
+    for h, t := range m.refreshTokens {
+        if t.UserID == userID && (keepFamily == "" || t.FamilyID != keepFamily) {
+            delete(m.refreshTokens, h)
+        }
+    }
+    return nil
+}
+func (m *mockRepo) ListSessions(userID int64) ([]*models.Session, error) {
+    out := []*models.Session{}
+    for _, t := range m.refreshTokens {
+        if t.UserID == userID && t.RotatedAt == nil {
+            out = append(out, &models.Session{ID: t.FamilyID, UserID: t.UserID, UserAgent: t.UserAgent, IPAddress: t.IPAddress, CreatedAt: t.SessionCreatedAt, ExpiresAt: t.ExpiresAt})
+        }
+    }
+    return out, nil
+}
+func (m *mockRepo) DeleteSession(userID int64, sessionID string) (bool, error) {
+    found := false
+    for h, t := range m.refreshTokens {
+        if t.UserID == userID && t.FamilyID == sessionID {
+            delete(m.refreshTokens, h)
+            found = true
+        }
+    }
+    return found, nil
+}
+func (m *mockRepo) RecordSecurityEvent(userID int64, eventType, detail string) error {
+    m.securityEvents = append(m.securityEvents, eventType)
+    return nil
+}
+
+func (m *mockRepo) CreateAPIKey(k *models.APIKey) (int64, error) {
+    k.ID = int64(len(m.apiKeys) + 1)
+    m.apiKeys = append(m.apiKeys, k)
+    return k.ID, nil
+}
+func (m *mockRepo) ListAPIKeys(userID int64) ([]*models.APIKey, error) {
+    out := []*models.APIKey{}
+    for _, k := range m.apiKeys {
+        if k.UserID == userID {
+            out = append(out, k)
+        }
+    }
+    return out, nil
+}
+func (m *mockRepo) GetAPIKey(userID, id int64) (*models.APIKey, error) {
+    for _, k := range m.apiKeys {
+        if k.UserID == userID && k.ID == id {
+            c := *k
+            return &c, nil
+        }
+    }
+    return nil, nil
+}
+func (m *mockRepo) UpdateAPIKey(k *models.APIKey) error {
+    for i, old := range m.apiKeys {
+        if old.ID == k.ID {
+            m.apiKeys[i] = k
+        }
+    }
+    return nil
+}
+func (m *mockRepo) DeleteAPIKey(userID, id int64) (bool, error) {
+    for i, k := range m.apiKeys {
+        if k.UserID == userID && k.ID == id {
+            m.apiKeys = append(m.apiKeys[:i], m.apiKeys[i+1:]...)
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (m *mockRepo) CreateLoginToken(t *models.LoginToken) (int64, error) {
+    t.ID = int64(len(m.loginTokens) + 1)
+    t.CreatedAt = time.Now()
+    m.loginTokens = append(m.loginTokens, t)
+    return t.ID, nil
+}
+func (m *mockRepo) CountLoginTokens(channel, destination string, since time.Time) (int, error) {
+    n := 0
+    for _, t := range m.loginTokens {
+        if t.Channel == channel && t.Destination == destination && !t.CreatedAt.Before(since) {
+            n++
+        }
+    }
+    return n, nil
+}
+func (m *mockRepo) LatestLoginToken(channel, destination string) (*models.LoginToken, error) {
+    for i := len(m.loginTokens) - 1; i >= 0; i-- {
+        t := m.loginTokens[i]
+        if t.Channel == channel && t.Destination == destination && t.UsedAt == nil && t.ExpiresAt.After(time.Now()) {
+            return t, nil
+        }
+    }
+    return nil, nil
+}
+func (m *mockRepo) GetLoginTokenByHash(channel, tokenHash string) (*models.LoginToken, error) {
+    for _, t := range m.loginTokens {
+        if t.Channel == channel && t.TokenHash == tokenHash && t.UsedAt == nil && t.ExpiresAt.After(time.Now()) {
+            return t, nil
+        }
+    }
+    return nil, nil
+}
+func (m *mockRepo) ClaimLoginTokenAttempt(id int64, max int) (bool, error) {
+    t := m.loginTokens[id-1]
+    if t.UsedAt != nil || t.Attempts >= max {
+        return false, nil
+    }
+    t.Attempts++
+    return true, nil
+}
+func (m *mockRepo) UseLoginToken(id int64) (bool, error) {
+    t := m.loginTokens[id-1]
+    if t.UsedAt != nil {
+        return false, nil
+    }
+    now := time.Now()
+    t.UsedAt = &now
+    return true, nil
+}
+func (m *mockRepo) InvalidateLoginTokens(userID int64, channel string) error {
+    for _, t := range m.loginTokens {
+        if t.UserID == userID && t.Channel == channel && t.UsedAt == nil {
+            now := time.Now()
+            t.UsedAt = &now
+        }
+    }
+    return nil
+}
+
+func (m *mockRepo) CreateOAuthClient(c *models.OAuthClient) (int64, error) {
+    if m.oauthClients == nil {
+        m.oauthClients = map[string]*models.OAuthClient{}
+    }
+    c.ID = int64(len(m.oauthClients) + 1)
+    m.oauthClients[c.ClientID] = c
+    return c.ID, nil
+}
+func (m *mockRepo) GetOAuthClient(clientID string) (*models.OAuthClient, error) {
+    return m.oauthClients[clientID], nil
+}
+func (m *mockRepo) ListOAuthClients() ([]*models.OAuthClient, error) {
+    out := []*models.OAuthClient{}
+    for _, c := range m.oauthClients {
+        out = append(out, c)
+    }
+    return out, nil
+}
+func (m *mockRepo) RevokeOAuthClient(clientID string) (bool, error) {
+    c := m.oauthClients[clientID]
+    if c == nil || c.RevokedAt != nil {
+        return false, nil
+    }
+    now := time.Now()
+    c.RevokedAt = &now
+    return true, nil
+}
+func (m *mockRepo) DeleteOAuthRefreshTokens(clientID string, userID int64) error {
+    for h, t := range m.refreshTokens {
+        if t.ClientID == clientID && (userID == 0 || t.UserID == userID) {
+            delete(m.refreshTokens, h)
+        }
+    }
+    return nil
+}
+func (m *mockRepo) CreateOAuthCode(c *models.OAuthCode) (int64, error) {
+    if m.oauthCodes == nil {
+        m.oauthCodes = map[string]*models.OAuthCode{}
+    }
+    c.ID = int64(len(m.oauthCodes) + 1)
+    m.oauthCodes[c.CodeHash] = c
+    return c.ID, nil
+}
+func (m *mockRepo) GetOAuthCode(codeHash string) (*models.OAuthCode, error) {
+    return m.oauthCodes[codeHash], nil
+}
+func (m *mockRepo) UseOAuthCode(id int64, familyID string) (bool, error) {
+    for _, c := range m.oauthCodes {
+        if c.ID == id && c.UsedAt == nil {
+            now := time.Now()
+            c.UsedAt, c.FamilyID = &now, familyID
+            return true, nil
+        }
+    }
+    return false, nil
+}
+func consentKey(userID int64, clientID string) string {
+    return fmt.Sprintf("%d|%s", userID, clientID)
+}
+func (m *mockRepo) GetOAuthConsent(userID int64, clientID string) (*models.OAuthConsent, error) {
+    return m.oauthConsents[consentKey(userID, clientID)], nil
+}
+func (m *mockRepo) SaveOAuthConsent(userID int64, clientID string, scopes []string) error {
+    if m.oauthConsents == nil {
+        m.oauthConsents = map[string]*models.OAuthConsent{}
+    }
+    m.oauthConsents[consentKey(userID, clientID)] = &models.OAuthConsent{UserID: userID, ClientID: clientID, Scopes: scopes}
+    return nil
+}
+func (m *mockRepo) ListOAuthConsents(userID int64) ([]*models.OAuthConsent, error) {
+    out := []*models.OAuthConsent{}
+    for _, c := range m.oauthConsents {
+        if c.UserID == userID {
+            out = append(out, c)
+        }
+    }
+    return out, nil
+}
+func (m *mockRepo) DeleteOAuthConsent(userID int64, clientID string) (bool, error) {
+    k := consentKey(userID, clientID)
+    _, ok := m.oauthConsents[k]
+    delete(m.oauthConsents, k)
+    return ok, nil
+}
+func (m *mockRepo) GetUserByIdentity(provider, subject string) (*models.User, error) {
+    if uid, ok := m.identities[provider+"|"+subject]; ok && m.user != nil && m.user.ID == uid {
+        return m.user, nil
+    }
+    return nil, nil
+}
+func (m *mockRepo) CreateIdentity(userID int64, provider, subject, email string) error {
+    if m.identities == nil {
+        m.identities = map[string]int64{}
+    }
+    m.identities[provider+"|"+subject] = userID
+    return nil
+}
+
+func (m *mockRepo) UpsertMFASecret(userID int64, secret string) error {
+    m.mfa = &models.UserMFA{UserID: userID, Secret: secret}
+    return nil
+}
+func (m *mockRepo) GetMFA(userID int64) (*models.UserMFA, error) {
+    if m.mfa != nil && m.mfa.UserID == userID {
+        return m.mfa, nil
+    }
+    return nil, nil
+}
+func (m *mockRepo) EnableMFA(userID int64, step int64) error {
+    m.mfa.Enabled = true
+    m.mfa.LastUsedStep = step
+    return nil
+}
+func (m *mockRepo) MarkMFAStepUsed(userID int64, step int64) (bool, error) {
+    if m.mfa.LastUsedStep >= step {
+        return false, nil
+    }
+    m.mfa.LastUsedStep = step
+    return true, nil
+}
+func (m *mockRepo) DeleteMFA(userID int64) error {
+    m.mfa = nil
+    m.recoveryCodes = nil
+    return nil
+}
+func (m *mockRepo) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+    m.recoveryCodes = map[string]bool{}
+    for _, h := range codeHashes {
+        m.recoveryCodes[h] = false
+    }
+    return nil
+}
+func (m *mockRepo) ConsumeRecoveryCode(userID int64, codeHash string) (bool, error) {
+    used, ok := m.recoveryCodes[codeHash]
+    if !ok || used {
+        return false, nil
+    }
+    m.recoveryCodes[codeHash] = true
+    return true, nil
+}
 
 func (m *mockRepo) UpdateUser(id int64, name, phone, role *string) error {
     if m.err != nil {
@@ -37,6 +481,9 @@ func (m *mockRepo) UpdateUser(id int64, name, phone, role *string) error {
     m.lastName = name
     m.lastPhone = phone
     m.lastRole = role
+    if phone != nil && m.user != nil && m.user.ID == id {
+        m.user.Phone = *phone
+    }
     return nil
 }
 
@@ -46,7 +493,7 @@ func TestUpdateUser_Authorization(t *testing.T) {
 
     // 1) Owner updates own name -> allowed
     name := "Owner New"
-    if err := u.UpdateUser(10, 10, "user", &name, nil, nil); err != nil {
+    if err := u.UpdateUser(10, 10, nil, &name, nil, nil); err != nil {
         t.Fatalf("expected owner update allowed, got err: %v", err)
     }
     if repo.lastID != 10 || repo.lastName == nil || *repo.lastName != name {
@@ -54,27 +501,1514 @@ func TestUpdateUser_Authorization(t *testing.T) {
     }
 
     // 2) Non-owner non-admin updating another user -> forbidden
-    if err := u.UpdateUser(11, 12, "user", &name, nil, nil); err == nil {
+    if err := u.UpdateUser(11, 12, nil, &name, nil, nil); err == nil {
         t.Fatalf("expected forbidden, got nil")
     }
 
     // 3) Non-admin attempting to change role -> forbidden
     role := "admin"
-    if err := u.UpdateUser(10, 10, "user", nil, nil, &role); err == nil {
+    if err := u.UpdateUser(10, 10, nil, nil, nil, &role); err == nil {
         t.Fatalf("expected forbidden for role change by non-admin, got nil")
     }
 
-    // 4) Admin changing role of another user -> allowed
-    if err := u.UpdateUser(1, 20, "admin", nil, nil, &role); err != nil {
+    // 4) user:write:any edits other users but cannot change roles
+    support := rbac.NewPermissions(rbac.UserWriteAny)
+    if err := u.UpdateUser(11, 12, support, &name, nil, nil); err != nil {
+        t.Fatalf("expected update with user:write:any allowed, got err: %v", err)
+    }
+    if err := u.UpdateUser(11, 12, support, nil, nil, &role); err == nil {
+        t.Fatalf("expected role change without user:role:assign forbidden, got nil")
+    }
+
+    // 5) Admin changing role of another user -> allowed
+    if err := u.UpdateUser(1, 20, rbac.NewPermissions(rbac.All), nil, nil, &role); err != nil {
         t.Fatalf("expected admin role change allowed, got err: %v", err)
     }
     if repo.lastID != 20 || repo.lastRole == nil || *repo.lastRole != role {
         t.Fatalf("unexpected repo update values for role change: %#v", repo)
     }
 
-    // 5) Repo returns error -> forwarded
+    // 6) Repo returns error -> forwarded
     repo.err = errors.New("db fail")
-    if err := u.UpdateUser(1, 20, "admin", nil, nil, &role); err == nil {
+    if err := u.UpdateUser(1, 20, rbac.NewPermissions(rbac.All), nil, nil, &role); err == nil {
         t.Fatalf("expected repo error forwarded, got nil")
     }
 }
+
+func newLoginRepo(t *testing.T) *mockRepo {
+    h, err := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &mockRepo{user: &models.User{ID: 7, Email: "a@example.com", Password: string(h), Role: "admin", Status: models.UserStatusActive}}
+}
+
+func TestLogin_TwoFactor(t *testing.T) {
+    repo := newLoginRepo(t)
+    u := &authUsecase{repo: repo, guard: loginguard.New(loginguard.NewMemoryStore(), loginguard.DefaultConfig), sleep: func(time.Duration) {}}
+    newPending := func() string {
+        tok, _, ok, err := u.Login("a@example.com", "secret123", ClientInfo{})
+        if err != nil || !ok {
+            t.Fatalf("expected mfa pending, got pending=%v err=%v", ok, err)
+        }
+        return tok
+    }
+
+    // 1) Without 2FA login returns an access token directly
+    _, uid, pending, err := u.Login("a@example.com", "secret123", ClientInfo{})
+    if err != nil || pending || uid != 7 {
+        t.Fatalf("expected plain login, got uid=%d pending=%v err=%v", uid, pending, err)
+    }
+
+    // 2) Enroll and confirm with a valid TOTP code
+    secret, otpURL, err := u.EnrollMFA(7)
+    if err != nil {
+        t.Fatalf("enroll: %v", err)
+    }
+    if !strings.HasPrefix(otpURL, "otpauth://totp/") {
+        t.Fatalf("unexpected otpauth url: %s", otpURL)
+    }
+    // a wrong code must not enable 2FA
+    if _, err := u.ConfirmMFA(7, "000000x"); err == nil {
+        t.Fatalf("expected invalid code error")
+    }
+    // use the previous step so the login below (current step) is not a replay
+    code, _ := totp.Code(secret, time.Now().Add(-totp.Period*time.Second))
+    recovery, err := u.ConfirmMFA(7, code)
+    if err != nil {
+        t.Fatalf("confirm: %v", err)
+    }
+    if len(recovery) != 10 {
+        t.Fatalf("expected 10 recovery codes, got %d", len(recovery))
+    }
+
+    // 3) Login now returns an mfa_pending token instead of an access token
+    mfaToken, _, pending, err := u.Login("a@example.com", "secret123", ClientInfo{})
+    if err != nil || !pending {
+        t.Fatalf("expected mfa pending, got pending=%v err=%v", pending, err)
+    }
+    if _, _, err := u.VerifyMFALogin(mfaToken, "123"); err == nil {
+        t.Fatalf("expected bad code rejected")
+    }
+    code, _ = totp.Code(secret, time.Now())
+    if _, uid, err := u.VerifyMFALogin(mfaToken, code); err != nil || uid != 7 {
+        t.Fatalf("expected mfa login ok, got uid=%d err=%v", uid, err)
+    }
+    // the mfa_pending token is spent, and the same TOTP code cannot be replayed
+    if _, _, err := u.VerifyMFALogin(mfaToken, code); err != loginguard.ErrMFATokenSpent {
+        t.Fatalf("expected used mfa token rejected, got %v", err)
+    }
+    if _, _, err := u.VerifyMFALogin(newPending(), code); err == nil {
+        t.Fatalf("expected replayed code rejected")
+    }
+
+    // 4) Recovery codes work exactly once
+    if _, _, err := u.VerifyMFALogin(newPending(), strings.ToUpper(recovery[0])); err != nil {
+        t.Fatalf("expected recovery code accepted, got %v", err)
+    }
+    if _, _, err := u.VerifyMFALogin(newPending(), recovery[0]); err == nil {
+        t.Fatalf("expected used recovery code rejected")
+    }
+
+    // 5) The mfa_pending token is not usable as an access token, and vice versa
+    if _, _, err := jwtpkg.ParseToken(mfaToken); err == nil {
+        t.Fatalf("expected mfa_pending token rejected as access token")
+    }
+    access, _ := jwtpkg.GenerateToken(7, "admin")
+    if _, _, err := u.VerifyMFALogin(access, code); err == nil {
+        t.Fatalf("expected access token rejected as mfa token")
+    }
+
+    // 6) Disable requires a valid factor
+    if err := u.DisableMFA(7, "bogus"); err == nil {
+        t.Fatalf("expected disable with bad code rejected")
+    }
+    if err := u.DisableMFA(7, recovery[1]); err != nil {
+        t.Fatalf("disable: %v", err)
+    }
+    if _, _, pending, _ := u.Login("a@example.com", "secret123", ClientInfo{}); pending {
+        t.Fatalf("expected plain login after disabling 2FA")
+    }
+}
+
+func TestVerifyMFALogin_AttemptLimits(t *testing.T) {
+    repo := newLoginRepo(t)
+    cfg := loginguard.DefaultConfig
+    cfg.MaxMFATokenFailures = 3
+    cfg.MaxMFAFailures = 5
+    u := &authUsecase{repo: repo, guard: loginguard.New(loginguard.NewMemoryStore(), cfg), sleep: func(time.Duration) {}}
+    secret, _, err := u.EnrollMFA(7)
+    if err != nil {
+        t.Fatalf("enroll: %v", err)
+    }
+    code, _ := totp.Code(secret, time.Now().Add(-totp.Period*time.Second))
+    if _, err := u.ConfirmMFA(7, code); err != nil {
+        t.Fatalf("confirm: %v", err)
+    }
+    newPending := func() string {
+        tok, _, _, err := u.Login("a@example.com", "secret123", ClientInfo{})
+        if err != nil {
+            t.Fatalf("login: %v", err)
+        }
+        return tok
+    }
+    code, _ = totp.Code(secret, time.Now())
+
+    // a token is void after 3 attempts, even for the right code
+    tok := newPending()
+    for i := 0; i < 3; i++ {
+        if _, _, err := u.VerifyMFALogin(tok, "000000"); err == nil || err == loginguard.ErrMFATokenSpent {
+            t.Fatalf("attempt %d: expected wrong code, got %v", i, err)
+        }
+    }
+    if _, _, err := u.VerifyMFALogin(tok, code); err != loginguard.ErrMFATokenSpent {
+        t.Fatalf("expected spent token, got %v", err)
+    }
+
+    // a new password login does not reset the user's budget: after 5 attempts
+    // the second factor is locked
+    tok = newPending()
+    for i := 0; i < 2; i++ {
+        if _, _, err := u.VerifyMFALogin(tok, "000000"); err == nil {
+            t.Fatalf("expected wrong code rejected")
+        }
+    }
+    var locked *loginguard.LockedError
+    if _, _, err := u.VerifyMFALogin(tok, code); !errors.As(err, &locked) || locked.Scope != loginguard.ScopeMFA {
+        t.Fatalf("expected second factor locked, got %v", err)
+    }
+}
+
+func TestConfirmAndDisableMFA_AttemptLimits(t *testing.T) {
+    repo := newLoginRepo(t)
+    cfg := loginguard.DefaultConfig
+    cfg.MaxMFAFailures = 3
+    u := &authUsecase{repo: repo, guard: loginguard.New(loginguard.NewMemoryStore(), cfg), sleep: func(time.Duration) {}}
+    secret, _, err := u.EnrollMFA(7)
+    if err != nil {
+        t.Fatalf("enroll: %v", err)
+    }
+    code, _ := totp.Code(secret, time.Now().Add(-totp.Period*time.Second))
+
+    // guessing the confirmation code locks the second factor
+    var locked *loginguard.LockedError
+    for i := 0; i < 3; i++ {
+        if _, err := u.ConfirmMFA(7, "000000"); err == nil || errors.As(err, &locked) {
+            t.Fatalf("attempt %d: expected wrong code, got %v", i, err)
+        }
+    }
+    if _, err := u.ConfirmMFA(7, code); !errors.As(err, &locked) || locked.Scope != loginguard.ScopeMFA {
+        t.Fatalf("expected confirmation locked, got %v", err)
+    }
+
+    // and so does guessing codes to turn 2FA off with a stolen access token
+    u.guard = loginguard.New(loginguard.NewMemoryStore(), cfg)
+    if _, err := u.ConfirmMFA(7, code); err != nil {
+        t.Fatalf("confirm: %v", err)
+    }
+    for i := 0; i < 3; i++ {
+        if err := u.DisableMFA(7, "000000"); err == nil || errors.As(err, &locked) {
+            t.Fatalf("attempt %d: expected wrong code, got %v", i, err)
+        }
+    }
+    code, _ = totp.Code(secret, time.Now())
+    if err := u.DisableMFA(7, code); !errors.As(err, &locked) {
+        t.Fatalf("expected disable locked, got %v", err)
+    }
+    if repo.mfa == nil || !repo.mfa.Enabled {
+        t.Fatalf("expected 2FA still enabled")
+    }
+}
+
+// linkToken extracts the token query parameter from the link in a mail body
+func linkToken(t *testing.T, body string) string {
+    for _, line := range strings.Split(body, "\n") {
+        if strings.HasPrefix(line, "http") {
+            u, err := url.Parse(strings.TrimSpace(line))
+            if err != nil {
+                t.Fatalf("bad link %q: %v", line, err)
+            }
+            return u.Query().Get("token")
+        }
+    }
+    t.Fatalf("no link in mail body: %q", body)
+    return ""
+}
+
+func TestForgotPassword_SendsMail(t *testing.T) {
+    repo := newLoginRepo(t)
+    mailer := mail.NewMemoryMailer()
+    u := &authUsecase{repo: repo, mailer: mailer}
+
+    // unknown email: no error (no account enumeration) and nothing sent
+    if err := u.ForgotPassword("nobody@example.com"); err != nil {
+        t.Fatalf("expected nil for unknown email, got %v", err)
+    }
+    if len(mailer.Sent()) != 0 {
+        t.Fatalf("expected no mail for unknown email")
+    }
+
+    if err := u.ForgotPassword("a@example.com"); err != nil {
+        t.Fatalf("forgot password: %v", err)
+    }
+    msg, ok := mailer.Last("a@example.com")
+    if !ok {
+        t.Fatalf("expected reset mail")
+    }
+    token := linkToken(t, msg.Body)
+    if err := u.ResetPassword(token, "Newpass-4567"); err != nil {
+        t.Fatalf("reset with mailed token: %v", err)
+    }
+    if _, _, _, err := u.Login("a@example.com", "Newpass-4567", ClientInfo{}); err != nil {
+        t.Fatalf("expected login with new password, got %v", err)
+    }
+}
+
+func TestEmailVerification(t *testing.T) {
+    repo := &mockRepo{}
+    mailer := mail.NewMemoryMailer()
+    u := &authUsecase{repo: repo, mailer: mailer}
+
+    _, id, err := u.Register(&models.User{Name: "Budi", Email: "budi@example.com", Phone: "0811", Password: "Kopi-Tubruk-77", Role: "user"})
+    if err != nil {
+        t.Fatalf("register: %v", err)
+    }
+    msg, ok := mailer.Last("budi@example.com")
+    if !ok {
+        t.Fatalf("expected verification mail on register")
+    }
+    token := linkToken(t, msg.Body)
+
+    // other purpose tokens are rejected
+    reset, _ := jwtpkg.GenerateResetToken(id)
+    if err := u.ConfirmEmail(reset); err == nil {
+        t.Fatalf("expected reset token rejected")
+    }
+
+    if err := u.ConfirmEmail(token); err != nil {
+        t.Fatalf("confirm: %v", err)
+    }
+    if repo.user.EmailVerifiedAt == nil {
+        t.Fatalf("expected email marked verified")
+    }
+    if err := u.SendEmailVerification(id); err == nil {
+        t.Fatalf("expected resend refused for verified email")
+    }
+
+    // a link issued for a previous address stops working after an email change
+    repo.user.EmailVerifiedAt = nil
+    repo.user.Email = "budi.new@example.com"
+    if err := u.ConfirmEmail(token); err == nil {
+        t.Fatalf("expected token for old email rejected")
+    }
+}
+
+func TestLogout_RevokesAccessTokens(t *testing.T) {
+    dl := denylist.NewMemory()
+    u := &authUsecase{repo: &mockRepo{}, denylist: dl}
+
+    isRevoked := func(token string) bool {
+        c, err := jwtpkg.ParseClaims(token)
+        if err != nil {
+            t.Fatalf("parse: %v", err)
+        }
+        revoked, err := denylist.IsRevoked(dl, c)
+        if err != nil {
+            t.Fatalf("denylist: %v", err)
+        }
+        return revoked
+    }
+
+    // 1) single logout revokes only the presented token
+    a, _ := jwtpkg.GenerateToken(5, "user")
+    b, _ := jwtpkg.GenerateToken(5, "user")
+    if err := u.RevokeAccessToken(a); err != nil {
+        t.Fatalf("revoke: %v", err)
+    }
+    if !isRevoked(a) || isRevoked(b) {
+        t.Fatalf("expected only the presented token revoked")
+    }
+
+    // 2) logout everywhere revokes every token issued so far for that user only
+    other, _ := jwtpkg.GenerateToken(6, "user")
+    if err := u.RevokeAllRefreshTokens(5); err != nil {
+        t.Fatalf("revoke all: %v", err)
+    }
+    if !isRevoked(b) {
+        t.Fatalf("expected outstanding token revoked after logout everywhere")
+    }
+    if isRevoked(other) {
+        t.Fatalf("expected other users unaffected")
+    }
+
+    // 3) tokens issued after the cutoff are valid again
+    fresh, _ := jwtpkg.GenerateToken(5, "user")
+    if isRevoked(fresh) {
+        t.Fatalf("expected token issued after logout to be valid")
+    }
+}
+
+func TestRefresh_ReuseRevokesFamily(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "user", Status: models.UserStatusActive}}
+    u := &authUsecase{repo: repo}
+
+    first, _, err := u.IssueRefreshToken(5, ClientInfo{})
+    if err != nil {
+        t.Fatalf("issue: %v", err)
+    }
+    other, _, _ := u.IssueRefreshToken(5, ClientInfo{}) // second device, separate family
+
+    // normal rotation
+    _, second, _, err := u.Refresh(first, ClientInfo{})
+    if err != nil {
+        t.Fatalf("refresh: %v", err)
+    }
+    rt := repo.refreshTokens[hashToken(second)]
+    parent := repo.refreshTokens[hashToken(first)]
+    if rt.FamilyID != parent.FamilyID || rt.ParentID == nil || *rt.ParentID != parent.ID {
+        t.Fatalf("rotated token should stay in family: %+v parent %+v", rt, parent)
+    }
+
+    // replaying the rotated token revokes the family, including the current token
+    if _, _, _, err := u.Refresh(first, ClientInfo{}); err != errRefreshTokenReused {
+        t.Fatalf("expected reuse error, got %v", err)
+    }
+    if _, _, _, err := u.Refresh(second, ClientInfo{}); err == nil {
+        t.Fatalf("expected current token of revoked family rejected")
+    }
+    if len(repo.securityEvents) != 1 || repo.securityEvents[0] != "refresh_token_reuse" {
+        t.Fatalf("expected security event, got %v", repo.securityEvents)
+    }
+
+    // other sessions are unaffected
+    if _, _, _, err := u.Refresh(other, ClientInfo{}); err != nil {
+        t.Fatalf("other family should still work: %v", err)
+    }
+}
+
+func TestSessions_ListAndRevoke(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "user", Status: models.UserStatusActive}}
+    u := &authUsecase{repo: repo}
+
+    phone, _, _ := u.IssueRefreshToken(5, ClientInfo{UserAgent: "okhttp/4.12", IP: "10.0.0.1"})
+    laptop, _, _ := u.IssueRefreshToken(5, ClientInfo{UserAgent: "Firefox", IP: "10.0.0.2"})
+    // a refresh keeps the session and records the latest device details
+    if _, _, _, err := u.Refresh(phone, ClientInfo{UserAgent: "okhttp/4.12", IP: "10.0.0.9"}); err != nil {
+        t.Fatalf("refresh: %v", err)
+    }
+
+    sessions, err := u.ListSessions(5, nil, 5)
+    if err != nil || len(sessions) != 2 {
+        t.Fatalf("expected 2 sessions, got %d (err %v)", len(sessions), err)
+    }
+    var phoneSession *models.Session
+    for _, s := range sessions {
+        if s.UserAgent == "okhttp/4.12" {
+            phoneSession = s
+        }
+    }
+    if phoneSession == nil || phoneSession.IPAddress != "10.0.0.9" {
+        t.Fatalf("expected refreshed phone session with latest ip, got %+v", phoneSession)
+    }
+
+    // other users may not see or revoke them, admins may
+    if _, err := u.ListSessions(6, nil, 5); err == nil || err.Error() != "forbidden" {
+        t.Fatalf("expected forbidden, got %v", err)
+    }
+    if err := u.RevokeSession(6, nil, 5, phoneSession.ID); err == nil || err.Error() != "forbidden" {
+        t.Fatalf("expected forbidden, got %v", err)
+    }
+    if _, err := u.ListSessions(1, rbac.NewPermissions(rbac.UserSessionsAny), 5); err != nil {
+        t.Fatalf("admin list: %v", err)
+    }
+
+    // revoking one session leaves the other usable
+    if err := u.RevokeSession(5, nil, 5, phoneSession.ID); err != nil {
+        t.Fatalf("revoke: %v", err)
+    }
+    if err := u.RevokeSession(5, nil, 5, phoneSession.ID); err == nil || err.Error() != "session not found" {
+        t.Fatalf("expected not found, got %v", err)
+    }
+    if _, _, _, err := u.Refresh(laptop, ClientInfo{}); err != nil {
+        t.Fatalf("laptop session should survive: %v", err)
+    }
+    if sessions, _ := u.ListSessions(5, nil, 5); len(sessions) != 1 {
+        t.Fatalf("expected 1 session left, got %d", len(sessions))
+    }
+}
+
+func TestRefresh_UsesCurrentRole(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "admin", Status: models.UserStatusActive}}
+    dl := denylist.NewMemory()
+    u := &authUsecase{repo: repo, denylist: dl}
+
+    // an admin keeps admin rights across refreshes
+    refresh, _, err := u.IssueRefreshToken(5, ClientInfo{})
+    if err != nil {
+        t.Fatalf("issue: %v", err)
+    }
+    access, refresh, _, err := u.Refresh(refresh, ClientInfo{})
+    if err != nil {
+        t.Fatalf("refresh: %v", err)
+    }
+    if c, _ := jwtpkg.ParseClaims(access); c.Role != "admin" {
+        t.Fatalf("expected admin role after refresh, got %q", c.Role)
+    }
+
+    // a role change denies outstanding tokens; the next refresh carries the new role
+    demoted := "user"
+    if err := u.UpdateUser(1, 5, rbac.NewPermissions(rbac.All), nil, nil, &demoted); err != nil {
+        t.Fatalf("update: %v", err)
+    }
+    c, _ := jwtpkg.ParseClaims(access)
+    if revoked, _ := denylist.IsRevoked(dl, c); !revoked {
+        t.Fatalf("expected token with old role revoked")
+    }
+    // mockRepo.UpdateUser only records its arguments; apply what MySQL would
+    repo.user.Role = *repo.lastRole
+    repo.user.TokenVersion++
+    access, refresh, _, err = u.Refresh(refresh, ClientInfo{})
+    if err != nil {
+        t.Fatalf("refresh after role change: %v", err)
+    }
+    c, _ = jwtpkg.ParseClaims(access)
+    if c.Role != "user" || c.TokenVersion != 1 {
+        t.Fatalf("expected role user, tv 1; got %q, %d", c.Role, c.TokenVersion)
+    }
+    if revoked, _ := denylist.IsRevoked(dl, c); revoked {
+        t.Fatalf("token issued after the role change should be valid")
+    }
+
+    // deactivated accounts cannot refresh, and the session is ended
+    repo.user.Status = "inactive"
+    if _, _, _, err := u.Refresh(refresh, ClientInfo{}); err != errAccountInactive {
+        t.Fatalf("expected deactivated error, got %v", err)
+    }
+    if len(repo.refreshTokens) != 0 {
+        t.Fatalf("expected session revoked, %d tokens left", len(repo.refreshTokens))
+    }
+}
+
+// newStubOIDC serves the JWKS of a single RSA key, like an OpenID provider
+func newStubOIDC(t *testing.T) (*oidc.Provider, func(claims jwt.MapClaims) string) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+            "kty": "RSA", "kid": "k1", "use": "sig",
+            "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }}})
+    }))
+    t.Cleanup(srv.Close)
+    p := &oidc.Provider{Name: "acme", Issuer: "https://id.acme.test", JWKSURL: srv.URL, ClientIDs: []string{"shop"}}
+    sign := func(claims jwt.MapClaims) string {
+        tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+        tok.Header["kid"] = "k1"
+        raw, err := tok.SignedString(key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return raw
+    }
+    return p, sign
+}
+
+func TestSSOLogin_LinksIdentity(t *testing.T) {
+    provider, sign := newStubOIDC(t)
+    repo := newLoginRepo(t) // existing password account a@example.com (id 7)
+    u := &authUsecase{repo: repo, sso: oidc.NewRegistry(provider)}
+
+    if _, err := u.SSONonce("unknown"); err != errUnknownProvider {
+        t.Fatalf("expected unknown provider, got %v", err)
+    }
+    nonce, err := u.SSONonce("acme")
+    if err != nil {
+        t.Fatalf("nonce: %v", err)
+    }
+    idToken := func(sub string, verified bool, nonce string) string {
+        return sign(jwt.MapClaims{
+            "iss": "https://id.acme.test", "aud": "shop", "sub": sub, "nonce": nonce,
+            "email": "a@example.com", "email_verified": verified,
+            "iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+        })
+    }
+
+    // the nonce must be one we issued, and match the token's nonce claim
+    if _, _, err := u.SSOLogin("acme", idToken("sub-1", true, "made-up"), "made-up"); err == nil {
+        t.Fatalf("expected foreign nonce rejected")
+    }
+    if _, _, err := u.SSOLogin("acme", idToken("sub-1", true, "other"), nonce); err == nil {
+        t.Fatalf("expected nonce mismatch rejected")
+    }
+    // an unverified email is never used to match an account
+    if _, _, err := u.SSOLogin("acme", idToken("sub-1", false, nonce), nonce); err == nil {
+        t.Fatalf("expected unverified email rejected")
+    }
+
+    // first login links the identity to the account with that email
+    token, uid, err := u.SSOLogin("acme", idToken("sub-1", true, nonce), nonce)
+    if err != nil || uid != 7 {
+        t.Fatalf("sso login: uid=%d err=%v", uid, err)
+    }
+    if c, _ := jwtpkg.ParseClaims(token); c.Role != "admin" {
+        t.Fatalf("expected the linked account's role, got %q", c.Role)
+    }
+    if repo.identities["acme|sub-1"] != 7 {
+        t.Fatalf("expected identity linked, got %v", repo.identities)
+    }
+    // later logins resolve the identity, even if the provider no longer says verified
+    if _, uid, err := u.SSOLogin("acme", idToken("sub-1", false, nonce), nonce); err != nil || uid != 7 {
+        t.Fatalf("linked login: uid=%d err=%v", uid, err)
+    }
+}
+
+func TestLogin_LockoutAndUnlock(t *testing.T) {
+    repo := newLoginRepo(t)
+    cfg := loginguard.DefaultConfig
+    cfg.FreeAttempts, cfg.MaxAccountFailures, cfg.MaxIPFailures = 2, 5, 100
+    var delays []time.Duration
+    u := &authUsecase{repo: repo, guard: loginguard.New(loginguard.NewMemoryStore(), cfg), sleep: func(d time.Duration) { delays = append(delays, d) }}
+    client := ClientInfo{IP: "203.0.113.7"}
+
+    for i := 0; i < 5; i++ {
+        if _, _, _, err := u.Login("A@example.com", "wrong", client); err == nil || err.Error() != "invalid credentials" {
+            t.Fatalf("attempt %d: expected invalid credentials, got %v", i, err)
+        }
+    }
+    // delays start after the free attempts and grow
+    if len(delays) != 2 || delays[0] != cfg.BaseDelay || delays[1] != 2*cfg.BaseDelay {
+        t.Fatalf("unexpected delays %v", delays)
+    }
+    if len(repo.securityEvents) != 1 || repo.securityEvents[0] != "login_lockout" {
+        t.Fatalf("expected lockout event, got %v", repo.securityEvents)
+    }
+
+    // locked: even the right password is refused
+    _, _, _, err := u.Login("a@example.com", "secret123", client)
+    var locked *loginguard.LockedError
+    if !errors.As(err, &locked) || locked.Scope != loginguard.ScopeAccount || locked.RetryAfter <= 0 {
+        t.Fatalf("expected account lockout, got %v", err)
+    }
+
+    // an admin unlock restores access
+    if err := u.UnlockUser(7); err != nil {
+        t.Fatalf("unlock: %v", err)
+    }
+    if _, uid, _, err := u.Login("a@example.com", "secret123", client); err != nil || uid != 7 {
+        t.Fatalf("expected login after unlock, uid=%d err=%v", uid, err)
+    }
+    if err := u.UnlockUser(404); err == nil || err.Error() != "user not found" {
+        t.Fatalf("expected user not found, got %v", err)
+    }
+}
+
+func TestLogin_IPLockoutCoversUnknownEmails(t *testing.T) {
+    repo := newLoginRepo(t)
+    cfg := loginguard.DefaultConfig
+    cfg.MaxIPFailures = 3
+    u := &authUsecase{repo: repo, guard: loginguard.New(loginguard.NewMemoryStore(), cfg), sleep: func(time.Duration) {}}
+    client := ClientInfo{IP: "198.51.100.1"}
+
+    // credential stuffing: one IP trying many accounts
+    for _, email := range []string{"x@example.com", "y@example.com", "z@example.com"} {
+        u.Login(email, "123456", client)
+    }
+    var locked *loginguard.LockedError
+    if _, _, _, err := u.Login("a@example.com", "secret123", client); !errors.As(err, &locked) || locked.Scope != loginguard.ScopeIP {
+        t.Fatalf("expected ip lockout, got %v", err)
+    }
+    // the account itself is not locked from other addresses
+    if _, _, _, err := u.Login("a@example.com", "secret123", ClientInfo{IP: "192.0.2.10"}); err != nil {
+        t.Fatalf("expected login from another ip, got %v", err)
+    }
+}
+
+func TestLogin_SpoofedForwardedForKeepsIPCounter(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    cfg := loginguard.DefaultConfig
+    cfg.MaxIPFailures = 3
+    newServer := func(trusted string) *gin.Engine {
+        t.Setenv("TRUSTED_PROXIES", trusted)
+        r := gin.New()
+        if err := middleware.SetTrustedProxiesFromEnv(r); err != nil {
+            t.Fatalf("trusted proxies: %v", err)
+        }
+        u := &authUsecase{repo: newLoginRepo(t), guard: loginguard.New(loginguard.NewMemoryStore(), cfg), sleep: func(time.Duration) {}}
+        r.POST("/login", makeLoginHandler(u))
+        return r
+    }
+    login := func(r *gin.Engine, email, pw, xff string) int {
+        req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(fmt.Sprintf(`{"email":%q,"password":%q}`, email, pw)))
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("X-Forwarded-For", xff)
+        req.RemoteAddr = "198.51.100.1:4321"
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Code
+    }
+
+    // by default X-Forwarded-For is ignored: a new value per request still
+    // counts against the peer address
+    r := newServer("")
+    for i, email := range []string{"x@example.com", "y@example.com", "z@example.com"} {
+        login(r, email, "123456", fmt.Sprintf("203.0.113.%d", i+1))
+    }
+    if code := login(r, "a@example.com", "secret123", "203.0.113.99"); code != http.StatusTooManyRequests {
+        t.Fatalf("expected ip lockout despite spoofed X-Forwarded-For, got %d", code)
+    }
+
+    // behind a trusted proxy the forwarded address is the client
+    r = newServer("198.51.100.1")
+    for i, email := range []string{"x@example.com", "y@example.com", "z@example.com"} {
+        login(r, email, "123456", fmt.Sprintf("203.0.113.%d", i+1))
+    }
+    if code := login(r, "a@example.com", "secret123", "203.0.113.99"); code != http.StatusOK {
+        t.Fatalf("expected login from another forwarded client, got %d", code)
+    }
+}
+
+func TestAPIKeys_ScopesLimitedToOwner(t *testing.T) {
+    repo := &mockRepo{}
+    u := &authUsecase{repo: repo}
+    owner := rbac.NewPermissions(rbac.ProductWriteAny, rbac.TransactionReadAny)
+
+    if _, _, err := u.CreateAPIKey(5, owner, "erp", []string{rbac.CategoryManage}, nil); !errors.Is(err, errScopeNotGranted) {
+        t.Fatalf("expected scope the owner lacks rejected, got %v", err)
+    }
+    past := time.Now().Add(-time.Hour)
+    if _, _, err := u.CreateAPIKey(5, owner, "erp", nil, &past); !errors.Is(err, errAPIKeyExpiry) {
+        t.Fatalf("expected past expiry rejected, got %v", err)
+    }
+
+    key, k, err := u.CreateAPIKey(5, owner, " erp ", []string{rbac.TransactionReadAny}, nil)
+    if err != nil {
+        t.Fatalf("create: %v", err)
+    }
+    if !strings.HasPrefix(key, k.Prefix+"_") || k.KeyHash != apikey.Hash(key) || k.Name != "erp" {
+        t.Fatalf("unexpected key %q for %+v", key, k)
+    }
+    if keys, _ := u.ListAPIKeys(5); len(keys) != 1 {
+        t.Fatalf("expected one key, got %d", len(keys))
+    }
+
+    // scopes can be replaced within the owner's permissions
+    updated, err := u.UpdateAPIKey(5, owner, k.ID, nil, []string{rbac.ProductWriteAny})
+    if err != nil || len(updated.Scopes) != 1 || updated.Scopes[0] != rbac.ProductWriteAny {
+        t.Fatalf("update: %+v %v", updated, err)
+    }
+    if _, err := u.UpdateAPIKey(5, owner, k.ID, nil, []string{rbac.UserAssignRole}); !errors.Is(err, errScopeNotGranted) {
+        t.Fatalf("expected escalation rejected, got %v", err)
+    }
+
+    // other users cannot see or delete the key
+    if err := u.DeleteAPIKey(6, k.ID); !errors.Is(err, errAPIKeyNotFound) {
+        t.Fatalf("expected not found for other user, got %v", err)
+    }
+    if err := u.DeleteAPIKey(5, k.ID); err != nil {
+        t.Fatalf("delete: %v", err)
+    }
+}
+
+func TestRegister_CreatesUserAndStoreAtomically(t *testing.T) {
+    repo := &mockRepo{storeErr: errors.New("stores table locked")}
+    mailer := mail.NewMemoryMailer()
+    u := &authUsecase{repo: repo, mailer: mailer}
+
+    // a failing store insert rolls the user back and sends no mail
+    if _, _, err := u.Register(&models.User{Name: "Budi", Email: "budi@example.com", Phone: "0811", Password: "Kopi-Tubruk-77", Role: "user"}); err == nil {
+        t.Fatalf("expected store failure reported")
+    }
+    if repo.user != nil {
+        t.Fatalf("expected user rolled back, got %+v", repo.user)
+    }
+    if _, ok := mailer.Last("budi@example.com"); ok {
+        t.Fatalf("expected no verification mail for a failed registration")
+    }
+
+    repo.storeErr = nil
+    if _, _, err := u.Register(&models.User{Name: "Budi", Email: "budi@example.com", Phone: "0811", Password: "Kopi-Tubruk-77", Role: "user"}); err != nil {
+        t.Fatalf("register: %v", err)
+    }
+    if len(repo.stores) != 1 || repo.stores[0] != "Budi's Store" {
+        t.Fatalf("expected store created, got %v", repo.stores)
+    }
+    // the unique constraint surfaces as a friendly error
+    if _, _, err := u.Register(&models.User{Name: "Budi 2", Email: "BUDI@example.com", Phone: "0812", Password: "Kopi-Tubruk-77", Role: "user"}); err != errEmailTaken {
+        t.Fatalf("expected errEmailTaken, got %v", err)
+    }
+}
+
+func TestSSOLogin_SignUpCreatesStore(t *testing.T) {
+    provider, sign := newStubOIDC(t)
+    repo := &mockRepo{}
+    u := &authUsecase{repo: repo, sso: oidc.NewRegistry(provider)}
+    nonce, _ := u.SSONonce("acme")
+    idToken := sign(jwt.MapClaims{
+        "iss": "https://id.acme.test", "aud": "shop", "sub": "sub-9", "nonce": nonce,
+        "email": "new@example.com", "email_verified": true, "name": "Nina",
+        "iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+    })
+
+    repo.storeErr = errors.New("boom")
+    if _, _, err := u.SSOLogin("acme", idToken, nonce); err == nil {
+        t.Fatalf("expected sign-up failure reported")
+    }
+    if repo.user != nil || len(repo.identities) != 0 {
+        t.Fatalf("expected sign-up rolled back, got user %+v identities %v", repo.user, repo.identities)
+    }
+
+    repo.storeErr = nil
+    _, uid, err := u.SSOLogin("acme", idToken, nonce)
+    if err != nil {
+        t.Fatalf("sso sign-up: %v", err)
+    }
+    if repo.user.Phone != "" || repo.user.EmailVerifiedAt == nil || repo.identities["acme|sub-9"] != uid {
+        t.Fatalf("unexpected sso user %+v identities %v", repo.user, repo.identities)
+    }
+    if len(repo.stores) != 1 || repo.stores[0] != "Nina's Store" {
+        t.Fatalf("expected store created for sso user, got %v", repo.stores)
+    }
+}
+
+func TestSetUserStatus_SuspendBlocksLoginAndRefresh(t *testing.T) {
+    hashed, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+    repo := &mockRepo{user: &models.User{ID: 5, Email: "a@example.com", Password: string(hashed), Role: "user", Status: models.UserStatusActive}}
+    dl := denylist.NewMemory()
+    u := &authUsecase{repo: repo, denylist: dl}
+
+    refresh, _, _ := u.IssueRefreshToken(5, ClientInfo{})
+    access, _, _, _ := u.Login("a@example.com", "pw", ClientInfo{})
+
+    if err := u.SetUserStatus(5, 5, models.UserStatusSuspended); err != errOwnStatus {
+        t.Fatalf("expected own status change refused, got %v", err)
+    }
+    if err := u.SetUserStatus(1, 5, models.UserStatusDeleted); err != errInvalidStatus {
+        t.Fatalf("expected deleted status refused, got %v", err)
+    }
+    if err := u.SetUserStatus(1, 5, models.UserStatusSuspended); err != nil {
+        t.Fatalf("suspend: %v", err)
+    }
+    c, _ := jwtpkg.ParseClaims(access)
+    if revoked, _ := denylist.IsRevoked(dl, c); !revoked {
+        t.Fatalf("expected outstanding access token revoked")
+    }
+    if _, _, _, err := u.Login("a@example.com", "pw", ClientInfo{}); err != errAccountInactive {
+        t.Fatalf("expected suspended login refused, got %v", err)
+    }
+    if _, _, _, err := u.Refresh(refresh, ClientInfo{}); err == nil {
+        t.Fatalf("expected suspended refresh refused")
+    }
+
+    if err := u.SetUserStatus(1, 5, models.UserStatusActive); err != nil {
+        t.Fatalf("reactivate: %v", err)
+    }
+    if _, _, _, err := u.Login("a@example.com", "pw", ClientInfo{}); err != nil {
+        t.Fatalf("expected login after reactivation, got %v", err)
+    }
+}
+
+func TestDeleteAccount_AnonymizesAndExport(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Budi", Email: "budi@example.com", Role: "user", Status: models.UserStatusActive}, stores: []string{"Budi's Store"}}
+    u := &authUsecase{repo: repo, denylist: denylist.NewMemory()}
+    dir := upload.Dir
+    upload.Dir = t.TempDir()
+    defer func() { upload.Dir = dir }()
+    image := filepath.Join(upload.Dir, "5_1_batik.jpg")
+    if err := os.WriteFile(image, []byte("jpeg"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    repo.productImages = []string{"/uploads/5_1_batik.jpg"}
+
+    export, err := u.ExportUserData(5)
+    if err != nil {
+        t.Fatalf("export: %v", err)
+    }
+    if export.Profile.Email != "budi@example.com" || export.Store == nil || export.ExportedAt.IsZero() {
+        t.Fatalf("unexpected export %+v", export)
+    }
+    if b, _ := json.Marshal(export); strings.Contains(string(b), "password") {
+        t.Fatalf("export must not contain the password hash: %s", b)
+    }
+
+    if err := u.DeleteAccount(5); err != nil {
+        t.Fatalf("delete: %v", err)
+    }
+    if repo.user.Status != models.UserStatusDeleted || strings.Contains(repo.user.Email, "budi") {
+        t.Fatalf("expected anonymized user, got %+v", repo.user)
+    }
+    if _, err := os.Stat(image); !os.IsNotExist(err) {
+        t.Fatalf("expected product image file removed, got %v", err)
+    }
+    if len(repo.securityEvents) == 0 || repo.securityEvents[len(repo.securityEvents)-1] != "account_deleted" {
+        t.Fatalf("expected account_deleted event, got %v", repo.securityEvents)
+    }
+    if err := u.DeleteAccount(5); err != errAccountGone {
+        t.Fatalf("expected second delete refused, got %v", err)
+    }
+    if err := u.SetUserStatus(1, 5, models.UserStatusActive); err != errAccountGone {
+        t.Fatalf("expected deleted account not reactivated, got %v", err)
+    }
+}
+
+func TestImpersonate(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "user", Status: models.UserStatusActive, TokenVersion: 2}}
+    roles := rbac.NewStaticResolver(map[string][]string{"admin": {rbac.All}, "support": {rbac.UserImpersonate, rbac.UserReadAny}})
+    u := &authUsecase{repo: repo, rolePerms: func(role string) rbac.Permissions { p, _ := roles.Permissions(role); return p }}
+    support, _ := roles.Permissions("support")
+
+    if _, _, err := u.Impersonate(1, support, 5, ""); err == nil {
+        t.Fatalf("expected a reason to be required")
+    }
+    if _, _, err := u.Impersonate(5, support, 5, "ticket 42"); err != errImpersonation {
+        t.Fatalf("expected self impersonation refused, got %v", err)
+    }
+    token, exp, err := u.Impersonate(1, support, 5, "ticket 42")
+    if err != nil {
+        t.Fatalf("impersonate: %v", err)
+    }
+    c, err := jwtpkg.ParseClaims(token)
+    if err != nil {
+        t.Fatalf("parse: %v", err)
+    }
+    if c.UserID != 5 || c.ActorID != 1 || c.Role != "user" || c.TokenVersion != 2 {
+        t.Fatalf("unexpected claims %+v", c)
+    }
+    if d := time.Until(c.ExpiresAt); d <= 0 || d > jwtpkg.ImpersonationTokenTTL || exp.Sub(c.ExpiresAt) > time.Second {
+        t.Fatalf("expected a short-lived token, expires %v", exp)
+    }
+    if repo.securityEvents[len(repo.securityEvents)-1] != "impersonation_started" {
+        t.Fatalf("expected impersonation recorded, got %v", repo.securityEvents)
+    }
+
+    // support cannot act as an admin: that would grant permissions it lacks
+    repo.user.Role = "admin"
+    if _, _, err := u.Impersonate(1, support, 5, "ticket 42"); err != errImpersonation {
+        t.Fatalf("expected escalation refused, got %v", err)
+    }
+    repo.user.Role = "user"
+    repo.user.Status = models.UserStatusSuspended
+    if _, _, err := u.Impersonate(1, support, 5, "ticket 42"); err != errAccountInactive {
+        t.Fatalf("expected inactive account refused, got %v", err)
+    }
+}
+
+func TestPasswords_PolicyRehashAndChange(t *testing.T) {
+    // weak passwords are refused at registration
+    u := &authUsecase{repo: &mockRepo{}}
+    if _, _, err := u.Register(&models.User{Name: "Budi", Email: "budi@example.com", Phone: "0811", Password: "", Role: "user"}); !errors.Is(err, password.ErrWeak) {
+        t.Fatalf("expected empty password refused, got %v", err)
+    }
+    if _, _, err := u.Register(&models.User{Name: "Budi", Email: "budi@example.com", Phone: "0811", Password: "budi-is-me-123", Role: "user"}); !errors.Is(err, password.ErrWeak) {
+        t.Fatalf("expected password containing the name refused, got %v", err)
+    }
+
+    // a bcrypt hash is upgraded to argon2id on login
+    legacy, _ := bcrypt.GenerateFromPassword([]byte("Old-secret-1"), bcrypt.MinCost)
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Ani", Email: "ani@example.com", Password: string(legacy), Role: "user", Status: models.UserStatusActive}}
+    dl := denylist.NewMemory()
+    u = &authUsecase{repo: repo, denylist: dl}
+    if _, _, _, err := u.Login("ani@example.com", "Old-secret-1", ClientInfo{}); err != nil {
+        t.Fatalf("login: %v", err)
+    }
+    if !strings.HasPrefix(repo.user.Password, "$argon2id$") {
+        t.Fatalf("expected hash upgraded, got %q", repo.user.Password)
+    }
+    if _, _, _, err := u.Login("ani@example.com", "Old-secret-1", ClientInfo{}); err != nil {
+        t.Fatalf("login with upgraded hash: %v", err)
+    }
+
+    // changing the password keeps the caller's session and ends the others
+    mine, _, _ := u.IssueRefreshToken(5, ClientInfo{UserAgent: "mine"})
+    other, _, _ := u.IssueRefreshToken(5, ClientInfo{UserAgent: "other"})
+    otherAccess, _ := jwtpkg.GenerateToken(5, "user")
+    if _, err := u.ChangePassword(5, "wrong", "New-secret-22", mine); err != errWrongPassword {
+        t.Fatalf("expected wrong current password refused, got %v", err)
+    }
+    access, err := u.ChangePassword(5, "Old-secret-1", "New-secret-22", mine)
+    if err != nil {
+        t.Fatalf("change password: %v", err)
+    }
+    if _, _, _, err := u.Refresh(other, ClientInfo{}); err == nil {
+        t.Fatalf("expected other session logged out")
+    }
+    if _, _, _, err := u.Refresh(mine, ClientInfo{}); err != nil {
+        t.Fatalf("expected own session kept, got %v", err)
+    }
+    c, _ := jwtpkg.ParseClaims(otherAccess)
+    if revoked, _ := denylist.IsRevoked(dl, c); !revoked {
+        t.Fatalf("expected other access tokens revoked")
+    }
+    c, _ = jwtpkg.ParseClaims(access)
+    if revoked, _ := denylist.IsRevoked(dl, c); revoked {
+        t.Fatalf("expected the new access token to stay valid")
+    }
+    if _, _, _, err := u.Login("ani@example.com", "New-secret-22", ClientInfo{}); err != nil {
+        t.Fatalf("login with new password: %v", err)
+    }
+}
+
+func TestMagicLinkLogin_SingleUseAndRateLimited(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Ani", Email: "ani@example.com", Role: "user", Status: models.UserStatusActive}}
+    mailer := mail.NewMemoryMailer()
+    u := &authUsecase{repo: repo, mailer: mailer}
+
+    // unknown addresses get the same silent success
+    if err := u.RequestMagicLink("nobody@example.com"); err != nil {
+        t.Fatalf("request for unknown email: %v", err)
+    }
+    if len(mailer.Sent()) != 0 {
+        t.Fatalf("expected no mail for unknown email")
+    }
+    if err := u.RequestMagicLink("ani@example.com"); err != nil {
+        t.Fatalf("request: %v", err)
+    }
+    msg, ok := mailer.Last("ani@example.com")
+    if !ok {
+        t.Fatalf("expected login link mailed")
+    }
+    link := linkToken(t, msg.Body)
+    if repo.loginTokens[0].TokenHash == link {
+        t.Fatalf("expected only the token hash stored")
+    }
+    token, uid, pending, err := u.MagicLinkLogin(link)
+    if err != nil || pending || uid != 5 {
+        t.Fatalf("magic link login: uid=%d pending=%v err=%v", uid, pending, err)
+    }
+    if c, err := jwtpkg.ParseClaims(token); err != nil || c.UserID != 5 {
+        t.Fatalf("unexpected access token: %v", err)
+    }
+    if repo.user.EmailVerifiedAt == nil {
+        t.Fatalf("expected email marked verified")
+    }
+    if _, _, _, err := u.MagicLinkLogin(link); err != errInvalidLoginToken {
+        t.Fatalf("expected replayed link refused, got %v", err)
+    }
+
+    // a second request within the cooldown is dropped without telling the caller
+    if err := u.RequestMagicLink("ani@example.com"); err != nil {
+        t.Fatalf("rate limited request: %v", err)
+    }
+    if len(mailer.Sent()) != 1 {
+        t.Fatalf("expected rate limited request dropped, %d mails sent", len(mailer.Sent()))
+    }
+
+    // expired links are refused
+    repo.loginTokens = []*models.LoginToken{{ID: 1, UserID: 5, Channel: models.LoginChannelEmail, Destination: "ani@example.com", TokenHash: hashToken("old"), ExpiresAt: time.Now().Add(-time.Second)}}
+    if _, _, _, err := u.MagicLinkLogin("old"); err != errInvalidLoginToken {
+        t.Fatalf("expected expired link refused, got %v", err)
+    }
+}
+
+// staleTokenRepo hands out login tokens as they were before any attempt,
+// like reads racing each other
+type staleTokenRepo struct {
+    *mockRepo
+}
+
+func (s *staleTokenRepo) LatestLoginToken(channel, destination string) (*models.LoginToken, error) {
+    t, err := s.mockRepo.LatestLoginToken(channel, destination)
+    if t == nil || err != nil {
+        return t, err
+    }
+    c := *t
+    c.Attempts = 0
+    return &c, nil
+}
+
+func TestPhoneOTPLogin_AttemptsAndMFA(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Ani", Email: "ani@example.com", Phone: "+628111", Role: "user", Status: models.UserStatusActive}}
+    sender := sms.NewMemorySender()
+    u := &authUsecase{repo: repo, sms: sender}
+
+    if err := u.RequestPhoneOTP("+628111"); err != nil {
+        t.Fatalf("request: %v", err)
+    }
+    msg, ok := sender.Last("+628111")
+    if !ok {
+        t.Fatalf("expected code sent by sms")
+    }
+    code := strings.Fields(msg.Body)[0]
+    if len(code) != 6 {
+        t.Fatalf("expected a 6 digit code, got %q", msg.Body)
+    }
+    wrong := "000000"
+    if code == wrong {
+        wrong = "111111"
+    }
+    for i := 0; i < phoneOTPMaxAttempts; i++ {
+        if _, _, _, err := u.PhoneOTPLogin("+628111", wrong); err != errInvalidLoginToken {
+            t.Fatalf("expected wrong code refused, got %v", err)
+        }
+    }
+    // too many guesses burn the code, even the right one
+    if _, _, _, err := u.PhoneOTPLogin("+628111", code); err != errInvalidLoginToken {
+        t.Fatalf("expected code invalidated after %d attempts, got %v", phoneOTPMaxAttempts, err)
+    }
+
+    // concurrent guesses all read the token before any attempt is counted;
+    // the claim must still cap them
+    repo.loginTokens = nil
+    stale := &staleTokenRepo{mockRepo: repo}
+    su := &authUsecase{repo: stale, sms: sender}
+    if err := su.RequestPhoneOTP("+628111"); err != nil {
+        t.Fatalf("request: %v", err)
+    }
+    msg, _ = sender.Last("+628111")
+    code = strings.Fields(msg.Body)[0]
+    wrong = "000000"
+    if code == wrong {
+        wrong = "111111"
+    }
+    for i := 0; i < phoneOTPMaxAttempts; i++ {
+        if _, _, _, err := su.PhoneOTPLogin("+628111", wrong); err != errInvalidLoginToken {
+            t.Fatalf("expected wrong code refused, got %v", err)
+        }
+    }
+    if _, _, _, err := su.PhoneOTPLogin("+628111", code); err != errInvalidLoginToken {
+        t.Fatalf("expected stale reads not to bypass the attempt limit, got %v", err)
+    }
+
+    // with 2FA enabled the code is only the first factor
+    repo.loginTokens = nil
+    repo.mfa = &models.UserMFA{UserID: 5, Secret: "JBSWY3DPEHPK3PXP", Enabled: true}
+    if err := u.RequestPhoneOTP("+628111"); err != nil {
+        t.Fatalf("request: %v", err)
+    }
+    msg, _ = sender.Last("+628111")
+    code = strings.Fields(msg.Body)[0]
+    if _, _, pending, err := u.PhoneOTPLogin("+628111", code); err != nil || !pending {
+        t.Fatalf("expected mfa pending, got pending=%v err=%v", pending, err)
+    }
+    if _, _, _, err := u.PhoneOTPLogin("+628111", code); err != errInvalidLoginToken {
+        t.Fatalf("expected used code refused, got %v", err)
+    }
+}
+
+func TestIntrospect(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Email: "a@example.com", Role: "user", Status: models.UserStatusActive}}
+    // no denylist: the account state alone must make tokens inactive
+    u := &authUsecase{repo: repo}
+
+    access, _ := accessTokenFor(repo.user)
+    refresh, _, _ := u.IssueRefreshToken(5, ClientInfo{})
+    r, err := u.Introspect(access)
+    if err != nil || !r.Active || r.TokenType != introspect.TypeAccessToken || r.Subject != "5" || r.Role != "user" || r.Status != models.UserStatusActive || r.ExpiresAt == 0 {
+        t.Fatalf("unexpected access token result %+v %v", r, err)
+    }
+    r, err = u.Introspect(refresh)
+    if err != nil || !r.Active || r.TokenType != introspect.TypeRefreshToken || r.UserID != 5 {
+        t.Fatalf("unexpected refresh token result %+v %v", r, err)
+    }
+    for _, bad := range []string{"not-a-token", "a.b.c", access + "x"} {
+        if r, err := u.Introspect(bad); err != nil || r.Active {
+            t.Fatalf("expected %q inactive, got %+v %v", bad, r, err)
+        }
+    }
+
+    // suspending bumps the token version: earlier tokens are no longer active
+    repo.SetUserStatus(5, models.UserStatusSuspended)
+    if r, _ := u.Introspect(access); r.Active {
+        t.Fatalf("expected suspended user's access token inactive")
+    }
+    if r, _ := u.Introspect(refresh); r.Active {
+        t.Fatalf("expected suspended user's refresh token inactive")
+    }
+    repo.SetUserStatus(5, models.UserStatusActive)
+    if r, _ := u.Introspect(access); r.Active {
+        t.Fatalf("expected token from before the suspension to stay inactive")
+    }
+    fresh, _ := accessTokenFor(repo.user)
+    if r, _ := u.Introspect(fresh); !r.Active || r.TokenVersion != 2 {
+        t.Fatalf("expected new token active, got %+v", r)
+    }
+}
+
+func TestAuthenticateIntrospection(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "admin", Status: models.UserStatusActive}}
+    u := &authUsecase{repo: repo}
+    gateway := &models.OAuthClient{Name: "Gateway", OwnerID: 5, Confidential: true,
+        Scopes: []string{oauth.ScopeIntrospect}, GrantTypes: []string{models.GrantClientCredentials}}
+    secret, err := u.CreateOAuthClient(gateway)
+    if err != nil {
+        t.Fatalf("create client: %v", err)
+    }
+    partner := &models.OAuthClient{Name: "Partner", OwnerID: 5, Confidential: true,
+        Scopes: []string{oauth.ScopeProductRead}, GrantTypes: []string{models.GrantClientCredentials}}
+    partnerSecret, err := u.CreateOAuthClient(partner)
+    if err != nil {
+        t.Fatalf("create client: %v", err)
+    }
+    public := &models.OAuthClient{Name: "App", OwnerID: 5, Scopes: []string{oauth.ScopeIntrospect},
+        RedirectURIs: []string{"https://app.example.com/cb"}, GrantTypes: []string{models.GrantAuthorizationCode}}
+    if _, err := u.CreateOAuthClient(public); !errors.Is(err, errInvalidOAuthClient) {
+        t.Fatalf("expected public client with introspect scope rejected, got %v", err)
+    }
+
+    if err := u.AuthenticateIntrospection(gateway.ClientID, secret); err != nil {
+        t.Fatalf("expected gateway admitted, got %v", err)
+    }
+    for _, c := range []struct{ id, secret string }{
+        {"", ""},
+        {gateway.ClientID, ""},
+        {gateway.ClientID, partnerSecret},
+        {partner.ClientID, partnerSecret},
+    } {
+        if err := u.AuthenticateIntrospection(c.id, c.secret); oauthErrorCode(err) != "invalid_client" {
+            t.Fatalf("expected %q refused, got %v", c.id, err)
+        }
+    }
+}
+
+func TestContactChange_ConfirmsNewValue(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Ani", Email: "ani@example.com", Phone: "+628111", Role: "user", Status: models.UserStatusActive}}
+    mailer := mail.NewMemoryMailer()
+    sender := sms.NewMemorySender()
+    u := &authUsecase{repo: repo, mailer: mailer, sms: sender}
+
+    if err := u.RequestEmailChange(5, "ANI@example.com"); err != errSameContact {
+        t.Fatalf("expected same address refused, got %v", err)
+    }
+    if err := u.RequestEmailChange(5, "ani.new@example.com"); err != nil {
+        t.Fatalf("request email change: %v", err)
+    }
+    // the old value stays until confirmed; its owner is told about the request
+    if repo.user.Email != "ani@example.com" {
+        t.Fatalf("expected email unchanged before confirmation, got %q", repo.user.Email)
+    }
+    if notice, ok := mailer.Last("ani@example.com"); !ok || !strings.Contains(notice.Body, "ani.new@example.com") {
+        t.Fatalf("expected notice to the old address")
+    }
+    if err := u.RequestEmailChange(5, "ani.new@example.com"); err != errTooManyRequests {
+        t.Fatalf("expected repeated request rate limited, got %v", err)
+    }
+    msg, ok := mailer.Last("ani.new@example.com")
+    if !ok {
+        t.Fatalf("expected confirmation mailed to the new address")
+    }
+    token := linkToken(t, msg.Body)
+    if err := u.ConfirmEmailChange(token); err != nil {
+        t.Fatalf("confirm email change: %v", err)
+    }
+    if repo.user.Email != "ani.new@example.com" || repo.user.EmailVerifiedAt == nil {
+        t.Fatalf("expected new verified email, got %+v", repo.user)
+    }
+    if err := u.ConfirmEmailChange(token); err != errInvalidConfirmation {
+        t.Fatalf("expected used link refused, got %v", err)
+    }
+
+    // a user cannot set their phone directly; staff can, but not to a taken number
+    phone := "+628222"
+    if err := u.UpdateUser(5, 5, nil, nil, &phone, nil); err != errPhoneNeedsConfirm {
+        t.Fatalf("expected direct phone change refused, got %v", err)
+    }
+    taken := "+628111"
+    if err := u.UpdateUser(1, 9, rbac.NewPermissions(rbac.All), nil, &taken, nil); err != errPhoneTaken {
+        t.Fatalf("expected taken phone refused, got %v", err)
+    }
+
+    if err := u.RequestPhoneChange(5, phone); err != nil {
+        t.Fatalf("request phone change: %v", err)
+    }
+    if _, ok := sender.Last("+628111"); !ok {
+        t.Fatalf("expected notice to the old number")
+    }
+    msg2, _ := sender.Last(phone)
+    code := strings.Fields(msg2.Body)[0]
+    if err := u.ConfirmPhoneChange(6, phone, code); err != errInvalidConfirmation {
+        t.Fatalf("expected another user's code refused, got %v", err)
+    }
+    if repo.user.Phone != "+628111" {
+        t.Fatalf("expected phone unchanged before confirmation")
+    }
+    if err := u.ConfirmPhoneChange(5, phone, code); err != nil {
+        t.Fatalf("confirm phone change: %v", err)
+    }
+    if repo.user.Phone != phone {
+        t.Fatalf("expected new phone, got %q", repo.user.Phone)
+    }
+}
+
+func TestConfirmPhoneChange_AttemptLimit(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Ani", Email: "ani@example.com", Phone: "+628111", Role: "user", Status: models.UserStatusActive}}
+    sender := sms.NewMemorySender()
+    // every guess reads the token before any attempt is counted
+    u := &authUsecase{repo: &staleTokenRepo{mockRepo: repo}, sms: sender}
+
+    phone := "+628222"
+    if err := u.RequestPhoneChange(5, phone); err != nil {
+        t.Fatalf("request phone change: %v", err)
+    }
+    msg, _ := sender.Last(phone)
+    code := strings.Fields(msg.Body)[0]
+    wrong := "000000"
+    if code == wrong {
+        wrong = "111111"
+    }
+    for i := 0; i < phoneOTPMaxAttempts; i++ {
+        if err := u.ConfirmPhoneChange(5, phone, wrong); err != errInvalidConfirmation {
+            t.Fatalf("expected wrong code refused, got %v", err)
+        }
+    }
+    if err := u.ConfirmPhoneChange(5, phone, code); err != errInvalidConfirmation {
+        t.Fatalf("expected code invalidated after %d attempts, got %v", phoneOTPMaxAttempts, err)
+    }
+    if repo.user.Phone != "+628111" {
+        t.Fatalf("expected phone unchanged, got %q", repo.user.Phone)
+    }
+}
+
+func TestImportUsers_ReportsEachRow(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Name: "Ani", Email: "ani@example.com", Phone: "+628111", Role: "user", Status: models.UserStatusActive}}
+    mailer := mail.NewMemoryMailer()
+    u := &authUsecase{repo: repo, mailer: mailer}
+    admin := rbac.NewPermissions(rbac.UserWriteAny)
+
+    rows, err := parseImportCSV(strings.NewReader("Name,Email,Phone,Password,store_name\n" +
+        "Budi,budi@example.com,+628222,Kopi-Tubruk-77,Toko Budi\n" +
+        "Citra,citra@example.com,,,\n" +
+        "Dewi,not-an-email,,,\n" +
+        "Eko,ani@example.com,,,\n" +
+        "Fajar,BUDI@example.com,,,\n" +
+        "Gita,gita@example.com,,short,\n"))
+    if err != nil {
+        t.Fatalf("parse csv: %v", err)
+    }
+    rows = append(rows, models.UserImportRow{Name: "Hadi", Email: "hadi@example.com", Role: "admin"})
+
+    results, err := u.ImportUsers(admin, rows, true)
+    if err != nil {
+        t.Fatalf("dry run: %v", err)
+    }
+    if len(repo.stores) != 0 || len(mailer.Sent()) != 0 {
+        t.Fatalf("expected a dry run to create nothing")
+    }
+    want := []string{models.ImportValid, models.ImportValid, models.ImportError, models.ImportError, models.ImportError, models.ImportError, models.ImportError}
+    for i, r := range results {
+        if r.Row != i+1 || r.Status != want[i] {
+            t.Fatalf("row %d: expected %s, got %+v", i+1, want[i], r)
+        }
+    }
+    if results[3].Error != errEmailTaken.Error() || results[4].Error != "duplicate email in import" {
+        t.Fatalf("unexpected errors %+v", results)
+    }
+
+    results, err = u.ImportUsers(admin, rows, false)
+    if err != nil {
+        t.Fatalf("import: %v", err)
+    }
+    if results[0].Status != models.ImportCreated || results[1].Status != models.ImportCreated || results[0].UserID == 0 {
+        t.Fatalf("expected valid rows created, got %+v", results[:2])
+    }
+    if len(repo.stores) != 2 || repo.stores[0] != "Toko Budi" || repo.stores[1] != "Citra's Store" {
+        t.Fatalf("expected stores created, got %v", repo.stores)
+    }
+    // the invited user (created last) has no usable password until they pick one
+    if repo.user.Email != "citra@example.com" || repo.user.Password != password.Unusable {
+        t.Fatalf("expected invited user without a password, got %+v", repo.user)
+    }
+    // a row without a password is invited to choose one
+    if msg, ok := mailer.Last("citra@example.com"); !ok || !strings.Contains(msg.Body, "/reset-password?token=") {
+        t.Fatalf("expected invitation for citra")
+    }
+    if msg, ok := mailer.Last("budi@example.com"); !ok || !strings.Contains(msg.Body, "/verify-email?token=") {
+        t.Fatalf("expected verification mail for budi")
+    }
+
+    if _, err := u.ImportUsers(admin, make([]models.UserImportRow, MaxImportRows+1), true); err != errTooManyRows {
+        t.Fatalf("expected too many rows refused, got %v", err)
+    }
+    if _, err := parseImportCSV(strings.NewReader("name,email,age\n")); err == nil {
+        t.Fatalf("expected unknown column refused")
+    }
+    if csvSafe("=HYPERLINK(\"x\")") != "'=HYPERLINK(\"x\")" || csvSafe("+62 811 (0)") != "+62 811 (0)" {
+        t.Fatalf("unexpected csv escaping")
+    }
+}
+
+// pkcePair returns a code verifier and its S256 challenge
+func pkcePair() (string, string) {
+    verifier := strings.Repeat("v", 50)
+    h := sha256.Sum256([]byte(verifier))
+    return verifier, base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func oauthErrorCode(err error) string {
+    var oe *OAuthError
+    if errors.As(err, &oe) {
+        return oe.Code
+    }
+    return ""
+}
+
+func TestOAuth_AuthorizationCodeWithPKCE(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "user", Status: models.UserStatusActive}}
+    u := &authUsecase{repo: repo}
+    client := &models.OAuthClient{
+        Name: "Logistics", OwnerID: 5, Confidential: true,
+        RedirectURIs: []string{"https://partner.example.com/callback"},
+        Scopes:       []string{oauth.ScopeProductRead, oauth.ScopeTransactionRead},
+        GrantTypes:   []string{models.GrantAuthorizationCode},
+    }
+    secret, err := u.CreateOAuthClient(client)
+    if err != nil || secret == "" || client.SecretHash != hashToken(secret) {
+        t.Fatalf("create client: %q %v", secret, err)
+    }
+    verifier, challenge := pkcePair()
+    req := OAuthAuthorizeRequest{ResponseType: "code", ClientID: client.ClientID, RedirectURI: client.RedirectURIs[0],
+        Scope: oauth.ScopeProductRead, State: "xyz", CodeChallenge: challenge, CodeChallengeMethod: "S256"}
+
+    bad := req
+    bad.RedirectURI = "https://evil.example.com/callback"
+    if _, err := u.AuthorizeOAuth(5, bad); oauthErrorCode(err) != "invalid_request" {
+        t.Fatalf("expected unregistered redirect rejected, got %v", err)
+    }
+    bad = req
+    bad.CodeChallenge = ""
+    if _, err := u.AuthorizeOAuth(5, bad); oauthErrorCode(err) != "invalid_request" {
+        t.Fatalf("expected PKCE required, got %v", err)
+    }
+    bad = req
+    bad.Scope = oauth.ScopeStoreWrite
+    if _, err := u.AuthorizeOAuth(5, bad); oauthErrorCode(err) != "invalid_scope" {
+        t.Fatalf("expected scope outside the client rejected, got %v", err)
+    }
+    if a, err := u.AuthorizeOAuth(5, req); err != nil || a.Consented {
+        t.Fatalf("expected consent pending, got %+v %v", a, err)
+    }
+
+    denied, err := u.ApproveOAuth(5, req, false)
+    if err != nil || !strings.Contains(denied, "error=access_denied") || !strings.Contains(denied, "state=xyz") {
+        t.Fatalf("unexpected denial redirect %q %v", denied, err)
+    }
+    redirect, err := u.ApproveOAuth(5, req, true)
+    if err != nil {
+        t.Fatalf("approve: %v", err)
+    }
+    ru, _ := url.Parse(redirect)
+    code := ru.Query().Get("code")
+    if code == "" || ru.Query().Get("state") != "xyz" {
+        t.Fatalf("unexpected redirect %q", redirect)
+    }
+    if a, _ := u.AuthorizeOAuth(5, req); !a.Consented {
+        t.Fatalf("expected consent recorded")
+    }
+
+    exchange := OAuthTokenRequest{GrantType: models.GrantAuthorizationCode, ClientID: client.ClientID, ClientSecret: secret,
+        Code: code, RedirectURI: req.RedirectURI, CodeVerifier: strings.Repeat("x", 50)}
+    if _, err := u.OAuthToken(exchange, ClientInfo{}); oauthErrorCode(err) != "invalid_grant" {
+        t.Fatalf("expected wrong verifier rejected, got %v", err)
+    }
+    wrongSecret := exchange
+    wrongSecret.ClientSecret = "cs_wrong"
+    if _, err := u.OAuthToken(wrongSecret, ClientInfo{}); oauthErrorCode(err) != "invalid_client" {
+        t.Fatalf("expected wrong secret rejected, got %v", err)
+    }
+    exchange.CodeVerifier = verifier
+    tok, err := u.OAuthToken(exchange, ClientInfo{})
+    if err != nil || tok.RefreshToken == "" || tok.Scope != oauth.ScopeProductRead {
+        t.Fatalf("exchange: %+v %v", tok, err)
+    }
+    claims, err := jwtpkg.ParseClaims(tok.AccessToken)
+    if err != nil || claims.UserID != 5 || claims.ClientID != client.ClientID || len(claims.Scopes) != 1 {
+        t.Fatalf("unexpected claims %+v %v", claims, err)
+    }
+
+    // refresh tokens rotate like first-party ones, but only for their client
+    if _, _, _, err := u.Refresh(tok.RefreshToken, ClientInfo{}); err == nil {
+        t.Fatalf("expected client refresh token rejected by first-party refresh")
+    }
+    refreshed, err := u.OAuthToken(OAuthTokenRequest{GrantType: models.GrantRefreshToken, ClientID: client.ClientID, ClientSecret: secret, RefreshToken: tok.RefreshToken}, ClientInfo{})
+    if err != nil || refreshed.RefreshToken == "" || refreshed.RefreshToken == tok.RefreshToken {
+        t.Fatalf("refresh: %+v %v", refreshed, err)
+    }
+
+    // replaying the code revokes the tokens issued for it
+    if _, err := u.OAuthToken(exchange, ClientInfo{}); oauthErrorCode(err) != "invalid_grant" {
+        t.Fatalf("expected replayed code rejected, got %v", err)
+    }
+    if repo.refreshTokens[hashToken(refreshed.RefreshToken)] != nil {
+        t.Fatalf("expected refresh tokens of a replayed code revoked")
+    }
+    if len(repo.securityEvents) != 1 || repo.securityEvents[0] != "oauth_code_reuse" {
+        t.Fatalf("expected security event, got %v", repo.securityEvents)
+    }
+
+    // withdrawing consent deletes the client's refresh tokens
+    redirect, _ = u.ApproveOAuth(5, req, true)
+    ru, _ = url.Parse(redirect)
+    exchange.Code = ru.Query().Get("code")
+    tok, err = u.OAuthToken(exchange, ClientInfo{})
+    if err != nil {
+        t.Fatalf("second exchange: %v", err)
+    }
+    if err := u.RevokeOAuthConsent(5, client.ClientID); err != nil {
+        t.Fatalf("revoke consent: %v", err)
+    }
+    if r, _ := u.Introspect(tok.AccessToken); r.Active {
+        t.Fatalf("expected access token inactive without consent")
+    }
+    if _, err := u.OAuthToken(OAuthTokenRequest{GrantType: models.GrantRefreshToken, ClientID: client.ClientID, ClientSecret: secret, RefreshToken: tok.RefreshToken}, ClientInfo{}); oauthErrorCode(err) != "invalid_grant" {
+        t.Fatalf("expected refresh after consent revocation rejected, got %v", err)
+    }
+}
+
+func TestOAuth_ClientCredentialsAndRevocation(t *testing.T) {
+    repo := &mockRepo{user: &models.User{ID: 5, Role: "seller", Status: models.UserStatusActive}}
+    dl := denylist.NewMemory()
+    u := &authUsecase{repo: repo, denylist: dl}
+    public := &models.OAuthClient{Name: "App", OwnerID: 5, Scopes: []string{oauth.ScopeProfile},
+        GrantTypes: []string{models.GrantClientCredentials}}
+    if _, err := u.CreateOAuthClient(public); !errors.Is(err, errInvalidOAuthClient) {
+        t.Fatalf("expected public client credentials client rejected, got %v", err)
+    }
+    client := &models.OAuthClient{Name: "Marketing", OwnerID: 5, Confidential: true,
+        Scopes: []string{oauth.ScopeProductRead, oauth.ScopeStoreRead}, GrantTypes: []string{models.GrantClientCredentials}}
+    secret, err := u.CreateOAuthClient(client)
+    if err != nil {
+        t.Fatalf("create client: %v", err)
+    }
+    req := OAuthTokenRequest{GrantType: models.GrantClientCredentials, ClientID: client.ClientID, ClientSecret: secret, Scope: oauth.ScopeStoreRead}
+    tok, err := u.OAuthToken(req, ClientInfo{})
+    if err != nil || tok.RefreshToken != "" || tok.Scope != oauth.ScopeStoreRead {
+        t.Fatalf("client credentials: %+v %v", tok, err)
+    }
+    r, err := u.Introspect(tok.AccessToken)
+    if err != nil || !r.Active || r.UserID != 5 || r.ClientID != client.ClientID || r.Scope != oauth.ScopeStoreRead {
+        t.Fatalf("unexpected introspection %+v %v", r, err)
+    }
+    req.Scope = oauth.ScopeAddressWrite
+    if _, err := u.OAuthToken(req, ClientInfo{}); oauthErrorCode(err) != "invalid_scope" {
+        t.Fatalf("expected unregistered scope rejected, got %v", err)
+    }
+    req.GrantType = models.GrantAuthorizationCode
+    if _, err := u.OAuthToken(req, ClientInfo{}); oauthErrorCode(err) != "unauthorized_client" {
+        t.Fatalf("expected grant not registered rejected, got %v", err)
+    }
+
+    // RFC 7009: only the client's own tokens are revoked, unknown ones ignored
+    if err := u.RevokeOAuthToken(client.ClientID, secret, "unknown"); err != nil {
+        t.Fatalf("revoke unknown: %v", err)
+    }
+    if err := u.RevokeOAuthToken(client.ClientID, secret, tok.AccessToken); err != nil {
+        t.Fatalf("revoke: %v", err)
+    }
+    claims, _ := jwtpkg.ParseClaims(tok.AccessToken)
+    if revoked, _ := denylist.IsRevoked(dl, claims); !revoked {
+        t.Fatalf("expected access token denied")
+    }
+
+    // a revoked client gets no more tokens and its tokens turn inactive
+    fresh, _ := u.OAuthToken(OAuthTokenRequest{GrantType: models.GrantClientCredentials, ClientID: client.ClientID, ClientSecret: secret}, ClientInfo{})
+    if err := u.RevokeOAuthClient(client.ClientID); err != nil {
+        t.Fatalf("revoke client: %v", err)
+    }
+    if r, _ := u.Introspect(fresh.AccessToken); r.Active {
+        t.Fatalf("expected token of revoked client inactive")
+    }
+    if _, err := u.OAuthToken(OAuthTokenRequest{GrantType: models.GrantClientCredentials, ClientID: client.ClientID, ClientSecret: secret}, ClientInfo{}); oauthErrorCode(err) != "invalid_client" {
+        t.Fatalf("expected revoked client rejected, got %v", err)
+    }
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 	"github.com/gin-gonic/gin"
 )
 
@@ -17,10 +18,10 @@ func RegisterRoutes(r *gin.Engine, dbConn *sql.DB) {
 	r.GET("/api/v1/categories", makeListHandler(uc))
 	r.GET("/api/v1/categories/:id", makeGetHandler(uc))
 
-	// Admin-only management
-	r.POST("/api/v1/categories", middleware.GinJWTAuth(), middleware.GinRequireRole("admin"), makeCreateHandler(uc))
-	r.PUT("/api/v1/categories/:id", middleware.GinJWTAuth(), middleware.GinRequireRole("admin"), makeUpdateHandler(uc))
-	r.DELETE("/api/v1/categories/:id", middleware.GinJWTAuth(), middleware.GinRequireRole("admin"), makeDeleteHandler(uc))
+	// Management requires category:manage
+	r.POST("/api/v1/categories", middleware.GinJWTOrAPIKeyAuth(), middleware.GinRequirePermission(rbac.CategoryManage), makeCreateHandler(uc))
+	r.PUT("/api/v1/categories/:id", middleware.GinJWTOrAPIKeyAuth(), middleware.GinRequirePermission(rbac.CategoryManage), makeUpdateHandler(uc))
+	r.DELETE("/api/v1/categories/:id", middleware.GinJWTOrAPIKeyAuth(), middleware.GinRequirePermission(rbac.CategoryManage), makeDeleteHandler(uc))
 }
 
 func makeCreateHandler(uc Usecase) gin.HandlerFunc {
@@ -6,6 +6,7 @@ import (
 	"database/sql"
 
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
+	"github.com/example/ms-ecommerce/internal/pkg/upload"
 	"github.com/gin-gonic/gin"
 )
 
@@ -14,7 +15,7 @@ func RegisterRoutes(r *gin.Engine, dbConn *sql.DB) {
 	uc := NewUsecase(repo)
 	r.POST("/api/v1/files/upload", middleware.GinJWTAuth(), makeUploadHandler(uc))
 	// Serve uploaded files
-	r.StaticFS("/uploads", http.Dir("uploads"))
+	r.StaticFS("/uploads", http.Dir(upload.Dir))
 }
 
 func makeUploadHandler(uc Usecase) gin.HandlerFunc {
@@ -1,30 +1,52 @@
 package product
 
 import (
-	"fmt"
-	"io"
+	"errors"
+	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"database/sql"
 
 	"github.com/example/ms-ecommerce/internal/pkg/cache"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/upload"
 	"github.com/gin-gonic/gin"
 )
 
 func RegisterRoutes(r *gin.Engine, dbConn *sql.DB, productCache *cache.ProductCache) {
-	repo := NewRepo(dbConn, productCache)
+	idx := NewSearchIndex(dbConn)
+	if idx != nil {
+		if err := syncSearchIndex(dbConn, idx); err != nil {
+			log.Printf("search: indexing products failed: %v", err)
+		}
+	}
+	repo := NewRepo(dbConn, productCache, idx)
 	uc := NewUsecase(repo)
 	// create product requires authentication
-	r.POST("/api/v1/products", middleware.GinJWTAuth(), makeCreateHandler(uc))
-	r.GET("/api/v1/products", middleware.GinJWTAuth(), makeListHandler(uc))
-	r.GET("/api/v1/products/:id", middleware.GinJWTAuth(), makeGetHandler(uc))
-	r.PUT("/api/v1/products/:id", middleware.GinJWTAuth(), makeUpdateHandler(uc))
-	r.DELETE("/api/v1/products/:id", middleware.GinJWTAuth(), makeDeleteHandler(uc))
+	r.POST("/api/v1/products", middleware.GinJWTOrAPIKeyAuth(), makeCreateHandler(uc))
+	r.GET("/api/v1/products", middleware.GinJWTOrAPIKeyAuth(), makeListHandler(uc))
+	r.GET("/api/v1/products/:id", middleware.GinJWTOrAPIKeyAuth(), makeGetHandler(uc))
+	r.PUT("/api/v1/products/:id", middleware.GinJWTOrAPIKeyAuth(), makeUpdateHandler(uc))
+	r.DELETE("/api/v1/products/:id", middleware.GinJWTOrAPIKeyAuth(), makeDeleteHandler(uc))
+	// variants (sizes, colors) are embedded in product responses
+	r.POST("/api/v1/products/:id/variants", middleware.GinJWTOrAPIKeyAuth(), makeCreateVariantHandler(uc))
+	r.PUT("/api/v1/products/:id/variants/:variant_id", middleware.GinJWTOrAPIKeyAuth(), makeUpdateVariantHandler(uc))
+	r.DELETE("/api/v1/products/:id/variants/:variant_id", middleware.GinJWTOrAPIKeyAuth(), makeDeleteVariantHandler(uc))
+	// images, in display order; the primary image is also the product's image_url
+	r.POST("/api/v1/products/:id/images", middleware.GinJWTOrAPIKeyAuth(), makeAddImageHandler(uc))
+	r.PUT("/api/v1/products/:id/images", middleware.GinJWTOrAPIKeyAuth(), makeReorderImagesHandler(uc))
+	r.PATCH("/api/v1/products/:id/images/:image_id", middleware.GinJWTOrAPIKeyAuth(), makeUpdateImageHandler(uc))
+	r.DELETE("/api/v1/products/:id/images/:image_id", middleware.GinJWTOrAPIKeyAuth(), makeDeleteImageHandler(uc))
+
+	// public storefront catalog: published products in stock, no authentication
+	r.GET("/api/v1/catalog/products", makeCatalogListHandler(uc, ""))
+	r.GET("/api/v1/catalog/products/:id", makeCatalogGetHandler(uc))
+	r.GET("/api/v1/catalog/stores/:store_id/products", makeCatalogListHandler(uc, "store_id"))
+	r.GET("/api/v1/catalog/categories/:category_id/products", makeCatalogListHandler(uc, "category_id"))
 }
 
 func makeCreateHandler(uc Usecase) gin.HandlerFunc {
@@ -35,7 +57,7 @@ func makeCreateHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 
 		if err := c.Request.ParseMultipartForm(10 << 20); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid form"})
@@ -52,36 +74,41 @@ func makeCreateHandler(uc Usecase) gin.HandlerFunc {
 		}
 		price, _ := strconv.ParseFloat(priceStr, 64)
 		stock, _ := strconv.Atoi(stockStr)
+		// products are published unless created as drafts with published=false
+		published := true
+		if v := c.Request.FormValue("published"); v != "" {
+			published, _ = strconv.ParseBool(v)
+		}
 		var cat *int64
 		if catStr != "" {
 			v, _ := strconv.ParseInt(catStr, 10, 64)
 			cat = &v
 		}
 
+		// the image is stored like /api/v1/files/upload stores files
 		var imageURL string
 		file, fh, err := c.Request.FormFile("image")
 		if err == nil {
 			defer file.Close()
-			os.MkdirAll("uploads", 0755)
-			filename := fmt.Sprintf("%d_%s", (int64)(uid), fh.Filename)
-			dst := filepath.Join("uploads", filename)
-			out, err := os.Create(dst)
-			if err == nil {
-				defer out.Close()
-				io.Copy(out, file)
-				imageURL = dst
+			imageURL, err = upload.Images.Save(uid, file, fh)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
 			}
 		}
 
-		p := &models.Product{Name: name, Description: desc, Price: price, Stock: stock, CategoryID: cat, ImageURL: imageURL}
-		id, err := uc.CreateProduct(uid, role, p)
+		p := &models.Product{Name: name, Description: desc, Price: price, Stock: stock, CategoryID: cat, ImageURL: imageURL, Published: published}
+		id, err := uc.CreateProduct(uid, perms, p)
 		if err != nil {
+			if imageURL != "" {
+				removeUpload(imageURL)
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
 		// Fetch the created product to return complete data
-		createdProduct, err := uc.GetProduct(uid, role, id)
+		createdProduct, err := uc.GetProduct(uid, perms, id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "product created but failed to retrieve"})
 			return
@@ -95,6 +122,7 @@ func makeCreateHandler(uc Usecase) gin.HandlerFunc {
 			"stock":       createdProduct.Stock,
 			"category_id": createdProduct.CategoryID,
 			"image":       createdProduct.ImageURL,
+			"published":   createdProduct.Published,
 			"created_at":  createdProduct.CreatedAt,
 		})
 	}
@@ -108,20 +136,12 @@ func makeListHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 
-		filters := map[string]string{}
-		if v := c.Query("search"); v != "" {
-			filters["search"] = v
-		}
-		if v := c.Query("category_id"); v != "" {
-			filters["category_id"] = v
-		}
-		if v := c.Query("min_price"); v != "" {
-			filters["min_price"] = v
-		}
-		if v := c.Query("max_price"); v != "" {
-			filters["max_price"] = v
+		filters, err := listFilters(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		page := 1
@@ -137,19 +157,92 @@ func makeListHandler(uc Usecase) gin.HandlerFunc {
 			}
 		}
 
-		data, total, err := uc.ListProducts(uid, role, filters, page, limit)
+		data, total, facets, err := uc.ListProducts(uid, perms, filters, page, limit)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeListError(c, err)
 			return
 		}
 		resp := map[string]interface{}{
 			"data":       data,
-			"pagination": map[string]interface{}{"page": page, "limit": limit, "total": total},
+			"facets":     facets,
+			"pagination": listPagination(uc, filters, page, limit, total),
 		}
 		c.JSON(http.StatusOK, resp)
 	}
 }
 
+// listPagination describes a page of a product list. A search only considers
+// its best uc.SearchLimit() matches, so the total counts at most those and
+// max_total tells clients that later matches are not listed.
+func listPagination(uc Usecase, filters map[string]string, page, limit, total int) map[string]interface{} {
+	p := map[string]interface{}{"page": page, "limit": limit, "total": total}
+	if n := uc.SearchLimit(); n > 0 && filters["search"] != "" {
+		p["max_total"] = n
+	}
+	return p
+}
+
+// listFilters reads the filters and sort order of a product list. category_id
+// and store_id take several values, repeated or comma separated.
+func listFilters(c *gin.Context) (map[string]string, error) {
+	filters := map[string]string{}
+	for _, f := range []string{"search", "min_price", "max_price", "sort"} {
+		if v := c.Query(f); v != "" {
+			filters[f] = v
+		}
+	}
+	for _, f := range []string{"category_id", "store_id"} {
+		ids, err := idList(c.QueryArray(f))
+		if err != nil {
+			return nil, errors.New("invalid " + f)
+		}
+		if ids != "" {
+			filters[f] = ids
+		}
+	}
+	return filters, nil
+}
+
+// idList joins IDs from query values sorted and without duplicates, so that the
+// same selection always gives the same cache key
+func idList(values []string) (string, error) {
+	seen := map[int64]bool{}
+	ids := []int64{}
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return "", err
+			}
+			if id <= 0 {
+				return "", strconv.ErrRange
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(out, ","), nil
+}
+
+func writeListError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "invalid sort":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func makeGetHandler(uc Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// user id from context (set by middleware)
@@ -158,11 +251,11 @@ func makeGetHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 
 		idStr := c.Param("id")
 		id, _ := strconv.ParseInt(idStr, 10, 64)
-		p, err := uc.GetProduct(uid, role, id)
+		p, err := uc.GetProduct(uid, perms, id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -183,7 +276,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 
 		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
 
@@ -193,6 +286,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			Price       float64 `json:"price"`
 			Stock       int     `json:"stock"`
 			CategoryID  *int64  `json:"category_id"`
+			Published   *bool   `json:"published"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
@@ -203,7 +297,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			return
 		}
 
-		err := uc.UpdateProduct(uid, role, id, req.Name, req.Description, req.Price, req.Stock, req.CategoryID)
+		err := uc.UpdateProduct(uid, perms, id, req.Name, req.Description, req.Price, req.Stock, req.CategoryID, req.Published)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
@@ -226,11 +320,11 @@ func makeDeleteHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 
 		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
 
-		err := uc.DeleteProduct(uid, role, id)
+		err := uc.DeleteProduct(uid, perms, id)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
@@ -244,3 +338,267 @@ func makeDeleteHandler(uc Usecase) gin.HandlerFunc {
 		c.Status(http.StatusNoContent)
 	}
 }
+
+type variantRequest struct {
+	SKU      string            `json:"sku"`
+	Name     string            `json:"name"`
+	Options  map[string]string `json:"options"`
+	Price    *float64          `json:"price"`
+	Stock    int               `json:"stock"`
+	ImageURL string            `json:"image_url"`
+}
+
+func (req variantRequest) variant() *models.ProductVariant {
+	return &models.ProductVariant{SKU: req.SKU, Name: req.Name, Options: req.Options, Price: req.Price, Stock: req.Stock, ImageURL: req.ImageURL}
+}
+
+func writeProductError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "forbidden":
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case "not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errSKUExists.Error():
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case "sku required", "sku too long", "invalid stock", "invalid price", "invalid options", "invalid image_url",
+		errTooManyImages.Error(), "invalid image order":
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func makeCreateVariantHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		var req variantRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		id, err := uc.CreateVariant(uid, perms, productID, req.variant())
+		if err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"id": id})
+	}
+}
+
+func makeUpdateVariantHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		variantID, _ := strconv.ParseInt(c.Param("variant_id"), 10, 64)
+
+		var req variantRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		v := req.variant()
+		v.ID = variantID
+		if err := uc.UpdateVariant(uid, perms, productID, v); err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeDeleteVariantHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		variantID, _ := strconv.ParseInt(c.Param("variant_id"), 10, 64)
+
+		if err := uc.DeleteVariant(uid, perms, productID, variantID); err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeAddImageHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		if err := c.Request.ParseMultipartForm(10 << 20); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid form"})
+			return
+		}
+		file, fh, err := c.Request.FormFile("image")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "image required"})
+			return
+		}
+		defer file.Close()
+		if err := upload.Images.Validate(fh); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		primary, _ := strconv.ParseBool(c.Request.FormValue("primary"))
+
+		img, err := uc.AddImage(uid, perms, productID, file, fh, c.Request.FormValue("alt_text"), primary)
+		if err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, img)
+	}
+}
+
+func makeReorderImagesHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		var req struct {
+			ImageIDs []int64 `json:"image_ids"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.ReorderImages(uid, perms, productID, req.ImageIDs); err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeUpdateImageHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		imageID, _ := strconv.ParseInt(c.Param("image_id"), 10, 64)
+
+		var req struct {
+			AltText *string `json:"alt_text"`
+			Primary bool    `json:"is_primary"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := uc.UpdateImage(uid, perms, productID, imageID, req.AltText, req.Primary); err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func makeDeleteImageHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := middleware.GinGetUserID(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		perms := middleware.GinGetPermissions(c)
+		productID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		imageID, _ := strconv.ParseInt(c.Param("image_id"), 10, 64)
+
+		if err := uc.DeleteImage(uid, perms, productID, imageID); err != nil {
+			writeProductError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// makeCatalogListHandler lists the public catalog, limited to the store or
+// category in the path parameter param when set
+func makeCatalogListHandler(uc Usecase, param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filters, err := listFilters(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if param != "" {
+			id, err := strconv.ParseInt(c.Param(param), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+				return
+			}
+			filters[param] = strconv.FormatInt(id, 10)
+		}
+
+		page := 1
+		limit := 10
+		if v := c.Query("page"); v != "" {
+			if pi, err := strconv.Atoi(v); err == nil && pi > 0 {
+				page = pi
+			}
+		}
+		if v := c.Query("limit"); v != "" {
+			if li, err := strconv.Atoi(v); err == nil && li > 0 && li <= 100 {
+				limit = li
+			}
+		}
+
+		data, total, facets, err := uc.ListCatalog(filters, page, limit)
+		if err != nil {
+			writeListError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"data":       data,
+			"facets":     facets,
+			"pagination": listPagination(uc, filters, page, limit, total),
+		})
+	}
+}
+
+func makeCatalogGetHandler(uc Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		p, err := uc.GetCatalogProduct(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if p == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	}
+}
@@ -2,29 +2,76 @@ package product
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/example/ms-ecommerce/internal/pkg/cache"
+	"github.com/example/ms-ecommerce/internal/pkg/db"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/search"
 )
 
 type Repository interface {
 	Create(p *models.Product) (int64, error)
 	List(filters map[string]string, page, limit int) ([]*models.Product, int, error)
+	// Facets counts the products matching filters by category, store and price range
+	Facets(filters map[string]string) (*models.ProductFacets, error)
 	GetByID(id int64) (*models.Product, error)
-	Update(id int64, name, description string, price float64, stock int, categoryID *int64) error
+	// Update changes a product; a nil published keeps the current value
+	Update(id int64, name, description string, price float64, stock int, categoryID *int64, published *bool) error
 	Delete(id int64) error
+	// ListVariants returns the variants of the given products by product ID
+	ListVariants(productIDs []int64) (map[int64][]*models.ProductVariant, error)
+	GetVariant(id int64) (*models.ProductVariant, error)
+	CreateVariant(storeID int64, v *models.ProductVariant) (int64, error)
+	UpdateVariant(v *models.ProductVariant) error
+	DeleteVariant(id int64) error
+	// ListImages returns the images of the given products in display order
+	ListImages(productIDs []int64) (map[int64][]*models.ProductImage, error)
+	GetImage(id int64) (*models.ProductImage, error)
+	// AddImage appends an image; the first image of a product becomes primary
+	AddImage(img *models.ProductImage) (int64, error)
+	UpdateImage(img *models.ProductImage) error
+	// ReorderImages sets the positions of a product's images to the order of ids
+	ReorderImages(productID int64, ids []int64) error
+	DeleteImage(img *models.ProductImage) error
 }
 
+var (
+	errSKUExists     = errors.New("sku already exists")
+	errTooManyImages = errors.New("too many images")
+)
+
+// maxProductImages is how many images a product can have
+const maxProductImages = 10
+
 type mysqlRepo struct {
 	db    *sql.DB
 	cache *cache.ProductCache
+	// search is nil when searching matches substrings of name and description
+	search SearchIndex
 }
 
-func NewRepo(db *sql.DB, cache *cache.ProductCache) Repository {
-	return &mysqlRepo{db: db, cache: cache}
+func NewRepo(db *sql.DB, cache *cache.ProductCache, search SearchIndex) Repository {
+	return &mysqlRepo{db: db, cache: cache, search: search}
+}
+
+// index updates the search index after a product was written. A failure is
+// logged: the product is saved and the index catches up on the next write or
+// restart.
+func (r *mysqlRepo) index(id int64, name, description string) {
+	if r.search == nil {
+		return
+	}
+	if err := r.search.Index(search.Document{ID: id, Name: name, Description: description}); err != nil {
+		log.Printf("search: indexing product %d: %v", id, err)
+	}
 }
 
 func (r *mysqlRepo) Create(p *models.Product) (int64, error) {
@@ -39,20 +86,35 @@ func (r *mysqlRepo) Create(p *models.Product) (int64, error) {
 			return 0, err
 		}
 	}
-	res, err := r.db.Exec("INSERT INTO products (store_id,category_id,name,description,price,stock,image_url) VALUES (?,?,?,?,?,?,?)",
-		p.StoreID, p.CategoryID, p.Name, p.Description, p.Price, p.Stock, p.ImageURL)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO products (store_id,category_id,name,description,price,stock,image_url,published) VALUES (?,?,?,?,?,?,?,?)",
+		p.StoreID, p.CategoryID, p.Name, p.Description, p.Price, p.Stock, p.ImageURL, p.Published)
 	if err != nil {
 		return 0, err
 	}
 	id, _ := res.LastInsertId()
+	// the uploaded image is the product's first, primary image
+	if p.ImageURL != "" {
+		if _, err := tx.Exec("INSERT INTO product_images (product_id,url,position,is_primary) VALUES (?,?,0,1)", id, p.ImageURL); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	r.index(id, p.Name, p.Description)
 	return id, nil
 }
 
 func (r *mysqlRepo) GetByID(id int64) (*models.Product, error) {
 	p := &models.Product{}
-	row := r.db.QueryRow("SELECT id,store_id,category_id,name,description,price,stock,image_url,created_at FROM products WHERE id = ?", id)
+	row := r.db.QueryRow("SELECT id,store_id,category_id,name,description,price,stock,image_url,published,rating,created_at FROM products WHERE id = ?", id)
 	var cat sql.NullInt64
-	err := row.Scan(&p.ID, &p.StoreID, &cat, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.CreatedAt)
+	err := row.Scan(&p.ID, &p.StoreID, &cat, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.Published, &p.Rating, &p.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -63,10 +125,13 @@ func (r *mysqlRepo) GetByID(id int64) (*models.Product, error) {
 		v := cat.Int64
 		p.CategoryID = &v
 	}
+	if err := r.embedRelations([]*models.Product{p}); err != nil {
+		return nil, err
+	}
 	return p, nil
 }
 
-func (r *mysqlRepo) Update(id int64, name, description string, price float64, stock int, categoryID *int64) error {
+func (r *mysqlRepo) Update(id int64, name, description string, price float64, stock int, categoryID *int64, published *bool) error {
 	// if a category id is provided, ensure it exists to avoid FK errors
 	if categoryID != nil {
 		var exists int
@@ -78,14 +143,133 @@ func (r *mysqlRepo) Update(id int64, name, description string, price float64, st
 			return err
 		}
 	}
-	_, err := r.db.Exec("UPDATE products SET category_id=?, name=?, description=?, price=?, stock=? WHERE id=?",
-		categoryID, name, description, price, stock, id)
-	return err
+	_, err := r.db.Exec("UPDATE products SET category_id=?, name=?, description=?, price=?, stock=?, published=COALESCE(?, published) WHERE id=?",
+		categoryID, name, description, price, stock, published, id)
+	if err != nil {
+		return err
+	}
+	r.index(id, name, description)
+	return nil
 }
 
 func (r *mysqlRepo) Delete(id int64) error {
 	_, err := r.db.Exec("DELETE FROM products WHERE id=?", id)
-	return err
+	if err != nil {
+		return err
+	}
+	if r.search != nil {
+		if err := r.search.Remove(id); err != nil {
+			log.Printf("search: removing product %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Sort orders of product lists. Relevance is the default when searching,
+// newest otherwise.
+const (
+	SortRelevance   = "relevance"
+	SortNewest      = "newest"
+	SortPriceAsc    = "price_asc"
+	SortPriceDesc   = "price_desc"
+	SortBestSelling = "best_selling"
+	SortRating      = "rating"
+)
+
+// sortOrders are the ORDER BY clauses of the sort orders besides relevance
+var sortOrders = map[string]string{
+	SortNewest:    "products.created_at DESC, products.id DESC",
+	SortPriceAsc:  "products.price ASC, products.id DESC",
+	SortPriceDesc: "products.price DESC, products.id DESC",
+	// units ordered, over all orders
+	SortBestSelling: "(SELECT COALESCE(SUM(l.quantity), 0) FROM product_logs l WHERE l.product_id = products.id) DESC, products.created_at DESC",
+	// unrated products (rating 0) last
+	SortRating: "products.rating DESC, products.id DESC",
+}
+
+// ownerStoreFilter restricts a product list to the caller's own store. Unlike
+// the user-chosen store_id filter it applies to every facet too.
+const ownerStoreFilter = "owner_store_id"
+
+// priceBuckets are the upper bounds of the price facet's ranges
+var priceBuckets = []float64{50000, 100000, 250000, 500000, 1000000}
+
+// searchHits runs the "search" filter against the search index. ok is false
+// when there is nothing to search or no index (substring matching).
+func (r *mysqlRepo) searchHits(filters map[string]string) (hits []search.Hit, ok bool, err error) {
+	if filters["search"] == "" || r.search == nil {
+		return nil, false, nil
+	}
+	hits, err = r.search.Search(filters["search"], maxSearchHits)
+	return hits, err == nil, err
+}
+
+// splitIDs parses a comma separated list of IDs (multi-value filters), skipping
+// invalid ones
+func splitIDs(v string) []interface{} {
+	out := []interface{}{}
+	for _, s := range strings.Split(v, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// listWhere builds the WHERE clause of a product list. hits restrict it to the
+// search results; skip leaves out one filter, for facets counting the other
+// values of that filter.
+func listWhere(filters map[string]string, hits []search.Hit, searching bool, skip string) (string, []interface{}) {
+	where := []string{"1=1"}
+	args := []interface{}{}
+	if v := filters["search"]; v != "" {
+		if searching {
+			// the index ranks the matches; the other filters apply on top
+			where = append(where, "products.id IN ("+placeholders(len(hits))+")")
+			for _, h := range hits {
+				args = append(args, h.ID)
+			}
+		} else {
+			where = append(where, "(products.name LIKE ? OR products.description LIKE ?)")
+			like := "%" + v + "%"
+			args = append(args, like, like)
+		}
+	}
+	if v := filters[ownerStoreFilter]; v != "" {
+		where = append(where, "products.store_id = ?")
+		args = append(args, v)
+	}
+	// category_id and store_id take several comma separated values
+	for _, f := range []string{"category_id", "store_id"} {
+		if v := filters[f]; v != "" && f != skip {
+			ids := splitIDs(v)
+			if len(ids) == 0 {
+				where = append(where, "1=0")
+				continue
+			}
+			where = append(where, "products."+f+" IN ("+placeholders(len(ids))+")")
+			args = append(args, ids...)
+		}
+	}
+	// price filters
+	if skip != "price" {
+		if v := filters["min_price"]; v != "" {
+			where = append(where, "products.price >= ?")
+			args = append(args, v)
+		}
+		if v := filters["max_price"]; v != "" {
+			where = append(where, "products.price <= ?")
+			args = append(args, v)
+		}
+	}
+	// catalog filters
+	if filters["published"] == "1" {
+		where = append(where, "products.published = 1")
+	}
+	if filters["in_stock"] == "1" {
+		where = append(where, inStockCondition)
+	}
+	return strings.Join(where, " AND "), args
 }
 
 func (r *mysqlRepo) List(filters map[string]string, page, limit int) ([]*models.Product, int, error) {
@@ -98,32 +282,33 @@ func (r *mysqlRepo) List(filters map[string]string, page, limit int) ([]*models.
 		// If cache miss, continue with database query
 	}
 
-	where := []string{"1=1"}
-	args := []interface{}{}
-	if v, ok := filters["search"]; ok && v != "" {
-		where = append(where, "(name LIKE ? OR description LIKE ?)")
-		like := "%" + v + "%"
-		args = append(args, like, like)
-	}
-	if v, ok := filters["category_id"]; ok && v != "" {
-		where = append(where, "category_id = ?")
-		args = append(args, v)
+	hits, searching, err := r.searchHits(filters)
+	if err != nil {
+		return nil, 0, err
 	}
-	if v, ok := filters["store_id"]; ok && v != "" {
-		where = append(where, "store_id = ?")
-		args = append(args, v)
+	if searching && len(hits) == 0 {
+		return []*models.Product{}, 0, nil
 	}
-	// price filters
-	if v, ok := filters["min_price"]; ok && v != "" {
-		where = append(where, "price >= ?")
-		args = append(args, v)
+	where, args := listWhere(filters, hits, searching, "")
+
+	order, ok := sortOrders[filters["sort"]]
+	orderArgs := []interface{}{}
+	if !ok {
+		order = sortOrders[SortNewest]
+		if searching {
+			order = "FIELD(products.id," + placeholders(len(hits)) + ")"
+			for _, h := range hits {
+				orderArgs = append(orderArgs, h.ID)
+			}
+		}
 	}
-	if v, ok := filters["max_price"]; ok && v != "" {
-		where = append(where, "price <= ?")
-		args = append(args, v)
+	// matched query terms by product, for highlighting
+	matched := map[int64][]string{}
+	for _, h := range hits {
+		matched[h.ID] = h.Terms
 	}
 
-	countQuery := fmt.Sprintf("SELECT COUNT(1) FROM products WHERE %s", strings.Join(where, " AND "))
+	countQuery := fmt.Sprintf("SELECT COUNT(1) FROM products WHERE %s", where)
 	var total int
 	if err := r.db.QueryRow(countQuery, args...).Scan(&total); err != nil {
 		return nil, 0, err
@@ -137,7 +322,8 @@ func (r *mysqlRepo) List(filters map[string]string, page, limit int) ([]*models.
 	}
 	offset := (page - 1) * limit
 
-	q := fmt.Sprintf("SELECT id,store_id,category_id,name,description,price,stock,image_url,created_at FROM products WHERE %s ORDER BY created_at DESC LIMIT ? OFFSET ?", strings.Join(where, " AND "))
+	q := fmt.Sprintf("SELECT id,store_id,category_id,name,description,price,stock,image_url,published,rating,created_at FROM products WHERE %s ORDER BY %s LIMIT ? OFFSET ?", where, order)
+	args = append(args, orderArgs...)
 	args = append(args, limit, offset)
 	rows, err := r.db.Query(q, args...)
 	if err != nil {
@@ -148,15 +334,24 @@ func (r *mysqlRepo) List(filters map[string]string, page, limit int) ([]*models.
 	for rows.Next() {
 		p := &models.Product{}
 		var cat sql.NullInt64
-		if err := rows.Scan(&p.ID, &p.StoreID, &cat, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.CreatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.StoreID, &cat, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.Published, &p.Rating, &p.CreatedAt); err != nil {
 			return nil, 0, err
 		}
 		if cat.Valid {
 			v := cat.Int64
 			p.CategoryID = &v
 		}
+		if terms, ok := matched[p.ID]; ok {
+			p.Highlights = highlights(p, terms)
+		}
 		out = append(out, p)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if err := r.embedRelations(out); err != nil {
+		return nil, 0, err
+	}
 
 	// Cache the result for 5 minutes
 	if r.cache != nil {
@@ -166,3 +361,414 @@ func (r *mysqlRepo) List(filters map[string]string, page, limit int) ([]*models.
 
 	return out, total, nil
 }
+
+func (r *mysqlRepo) Facets(filters map[string]string) (*models.ProductFacets, error) {
+	if r.cache != nil {
+		if f, err := r.cache.GetFacets(r.cache.GetFacetsCacheKey(filters)); err == nil {
+			return f, nil
+		}
+	}
+
+	f := &models.ProductFacets{Categories: []*models.FacetCount{}, Stores: []*models.FacetCount{}, Prices: []*models.PriceFacet{}}
+	hits, searching, err := r.searchHits(filters)
+	if err != nil {
+		return nil, err
+	}
+	if searching && len(hits) == 0 {
+		return f, nil
+	}
+
+	// each facet counts the products matching every other filter
+	where, args := listWhere(filters, hits, searching, "category_id")
+	f.Categories, err = r.facetCounts(fmt.Sprintf(`SELECT products.category_id, COALESCE(c.name, ''), COUNT(1) FROM products
+		LEFT JOIN categories c ON c.id = products.category_id WHERE %s
+		GROUP BY products.category_id, c.name ORDER BY COUNT(1) DESC, products.category_id`, where), args)
+	if err != nil {
+		return nil, err
+	}
+	where, args = listWhere(filters, hits, searching, "store_id")
+	f.Stores, err = r.facetCounts(fmt.Sprintf(`SELECT products.store_id, s.name, COUNT(1) FROM products
+		JOIN stores s ON s.id = products.store_id WHERE %s
+		GROUP BY products.store_id, s.name ORDER BY COUNT(1) DESC, products.store_id`, where), args)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args = listWhere(filters, hits, searching, "price")
+	bucket := "CASE"
+	for i, max := range priceBuckets {
+		bucket += fmt.Sprintf(" WHEN products.price < %.2f THEN %d", max, i)
+	}
+	bucket += fmt.Sprintf(" ELSE %d END", len(priceBuckets))
+	rows, err := r.db.Query(fmt.Sprintf("SELECT %s AS bucket, COUNT(1) FROM products WHERE %s GROUP BY bucket ORDER BY bucket", bucket, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i, n int
+		if err := rows.Scan(&i, &n); err != nil {
+			return nil, err
+		}
+		f.Prices = append(f.Prices, priceFacet(i, n))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Cache the facets for 5 minutes, like the list
+	if r.cache != nil {
+		r.cache.SetFacets(r.cache.GetFacetsCacheKey(filters), f, 5*time.Minute)
+	}
+	return f, nil
+}
+
+// priceFacet is the facet of price bucket i: [priceBuckets[i-1], priceBuckets[i])
+func priceFacet(i, count int) *models.PriceFacet {
+	p := &models.PriceFacet{Count: count}
+	if i > 0 {
+		p.Min = priceBuckets[i-1]
+	}
+	if i < len(priceBuckets) {
+		max := priceBuckets[i]
+		p.Max = &max
+	}
+	return p
+}
+
+// facetCounts reads rows of (id, name, count); a NULL id is products without one
+func (r *mysqlRepo) facetCounts(q string, args []interface{}) ([]*models.FacetCount, error) {
+	rows, err := r.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*models.FacetCount{}
+	for rows.Next() {
+		c := &models.FacetCount{}
+		var id sql.NullInt64
+		if err := rows.Scan(&id, &c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		if id.Valid {
+			c.ID = &id.Int64
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// inStockCondition matches products that can be ordered: products sold in
+// variants need a variant in stock, others stock of their own (see inStock)
+const inStockCondition = `(EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.stock > 0)
+	OR (products.stock > 0 AND NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id)))`
+
+// inStock reports whether a product with its variants loaded can be ordered
+func inStock(p *models.Product) bool {
+	if len(p.Variants) == 0 {
+		return p.Stock > 0
+	}
+	for _, v := range p.Variants {
+		if v.Stock > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// embedRelations sets the variants, options and images of products, with one
+// query per relation
+func (r *mysqlRepo) embedRelations(products []*models.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	variants, err := r.ListVariants(ids)
+	if err != nil {
+		return err
+	}
+	images, err := r.ListImages(ids)
+	if err != nil {
+		return err
+	}
+	for _, p := range products {
+		p.Variants = variants[p.ID]
+		p.Options = productOptions(p.Variants)
+		p.Images = images[p.ID]
+	}
+	return nil
+}
+
+// productOptions lists the options used by variants, by option name, with their
+// values in variant order
+func productOptions(variants []*models.ProductVariant) []*models.ProductOption {
+	byName := map[string]*models.ProductOption{}
+	seen := map[string]bool{}
+	for _, v := range variants {
+		for name, value := range v.Options {
+			o := byName[name]
+			if o == nil {
+				o = &models.ProductOption{Name: name, Values: []string{}}
+				byName[name] = o
+			}
+			if !seen[name+"\x00"+value] {
+				seen[name+"\x00"+value] = true
+				o.Values = append(o.Values, value)
+			}
+		}
+	}
+	out := make([]*models.ProductOption, 0, len(byName))
+	for _, o := range byName {
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+const variantColumns = "id,product_id,sku,name,options,price,stock,image_url,created_at"
+
+func scanVariant(row interface{ Scan(...interface{}) error }) (*models.ProductVariant, error) {
+	v := &models.ProductVariant{}
+	var options, imageURL sql.NullString
+	var price sql.NullFloat64
+	if err := row.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &options, &price, &v.Stock, &imageURL, &v.CreatedAt); err != nil {
+		return nil, err
+	}
+	v.Options = map[string]string{}
+	if options.Valid && options.String != "" {
+		if err := json.Unmarshal([]byte(options.String), &v.Options); err != nil {
+			return nil, fmt.Errorf("variant %d options: %w", v.ID, err)
+		}
+	}
+	if price.Valid {
+		p := price.Float64
+		v.Price = &p
+	}
+	v.ImageURL = imageURL.String
+	return v, nil
+}
+
+func (r *mysqlRepo) ListVariants(productIDs []int64) (map[int64][]*models.ProductVariant, error) {
+	out := map[int64][]*models.ProductVariant{}
+	if len(productIDs) == 0 {
+		return out, nil
+	}
+	args := make([]interface{}, len(productIDs))
+	for i, id := range productIDs {
+		args[i] = id
+	}
+	rows, err := r.db.Query("SELECT "+variantColumns+" FROM product_variants WHERE product_id IN ("+placeholders(len(args))+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v, err := scanVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		out[v.ProductID] = append(out[v.ProductID], v)
+	}
+	return out, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func (r *mysqlRepo) GetVariant(id int64) (*models.ProductVariant, error) {
+	v, err := scanVariant(r.db.QueryRow("SELECT "+variantColumns+" FROM product_variants WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (r *mysqlRepo) CreateVariant(storeID int64, v *models.ProductVariant) (int64, error) {
+	options, err := json.Marshal(v.Options)
+	if err != nil {
+		return 0, err
+	}
+	res, err := r.db.Exec("INSERT INTO product_variants (product_id,store_id,sku,name,options,price,stock,image_url) VALUES (?,?,?,?,?,?,?,?)",
+		v.ProductID, storeID, v.SKU, v.Name, string(options), v.Price, v.Stock, v.ImageURL)
+	if _, dup := db.DuplicateKey(err); dup {
+		return 0, errSKUExists
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *mysqlRepo) UpdateVariant(v *models.ProductVariant) error {
+	options, err := json.Marshal(v.Options)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("UPDATE product_variants SET sku=?, name=?, options=?, price=?, stock=?, image_url=? WHERE id=?",
+		v.SKU, v.Name, string(options), v.Price, v.Stock, v.ImageURL, v.ID)
+	if _, dup := db.DuplicateKey(err); dup {
+		return errSKUExists
+	}
+	return err
+}
+
+func (r *mysqlRepo) DeleteVariant(id int64) error {
+	_, err := r.db.Exec("DELETE FROM product_variants WHERE id=?", id)
+	return err
+}
+
+const imageColumns = "id,product_id,url,alt_text,position,is_primary,created_at"
+
+func scanImage(row interface{ Scan(...interface{}) error }) (*models.ProductImage, error) {
+	img := &models.ProductImage{}
+	if err := row.Scan(&img.ID, &img.ProductID, &img.URL, &img.AltText, &img.Position, &img.Primary, &img.CreatedAt); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (r *mysqlRepo) ListImages(productIDs []int64) (map[int64][]*models.ProductImage, error) {
+	out := map[int64][]*models.ProductImage{}
+	if len(productIDs) == 0 {
+		return out, nil
+	}
+	args := make([]interface{}, len(productIDs))
+	for i, id := range productIDs {
+		args[i] = id
+	}
+	rows, err := r.db.Query("SELECT "+imageColumns+" FROM product_images WHERE product_id IN ("+placeholders(len(args))+") ORDER BY position, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out[img.ProductID] = append(out[img.ProductID], img)
+	}
+	return out, rows.Err()
+}
+
+func (r *mysqlRepo) GetImage(id int64) (*models.ProductImage, error) {
+	img, err := scanImage(r.db.QueryRow("SELECT "+imageColumns+" FROM product_images WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return img, err
+}
+
+func (r *mysqlRepo) AddImage(img *models.ProductImage) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// lock the product so concurrent uploads get distinct positions
+	var locked int64
+	if err := tx.QueryRow("SELECT id FROM products WHERE id = ? FOR UPDATE", img.ProductID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	var n, next int
+	if err := tx.QueryRow("SELECT COUNT(1), COALESCE(MAX(position)+1, 0) FROM product_images WHERE product_id = ?", img.ProductID).Scan(&n, &next); err != nil {
+		return 0, err
+	}
+	if n >= maxProductImages {
+		return 0, errTooManyImages
+	}
+	img.Position = next
+	if n == 0 {
+		img.Primary = true
+	}
+	if img.Primary {
+		if _, err := tx.Exec("UPDATE product_images SET is_primary = 0 WHERE product_id = ?", img.ProductID); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec("INSERT INTO product_images (product_id,url,alt_text,position,is_primary) VALUES (?,?,?,?,?)",
+		img.ProductID, img.URL, img.AltText, img.Position, img.Primary)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	if err := syncPrimaryImage(tx, img.ProductID); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (r *mysqlRepo) UpdateImage(img *models.ProductImage) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if img.Primary {
+		if _, err := tx.Exec("UPDATE product_images SET is_primary = 0 WHERE product_id = ?", img.ProductID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE product_images SET alt_text = ?, is_primary = ? WHERE id = ?", img.AltText, img.Primary, img.ID); err != nil {
+		return err
+	}
+	if err := syncPrimaryImage(tx, img.ProductID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *mysqlRepo) ReorderImages(productID int64, ids []int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, id := range ids {
+		if _, err := tx.Exec("UPDATE product_images SET position = ? WHERE id = ? AND product_id = ?", i, id, productID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *mysqlRepo) DeleteImage(img *models.ProductImage) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM product_images WHERE id = ?", img.ID); err != nil {
+		return err
+	}
+	// variants showing the image fall back to the product's images
+	if _, err := tx.Exec("UPDATE product_variants SET image_url = NULL WHERE product_id = ? AND image_url = ?", img.ProductID, img.URL); err != nil {
+		return err
+	}
+	if err := syncPrimaryImage(tx, img.ProductID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncPrimaryImage makes the first image primary when none is (e.g. after the
+// primary image was removed or demoted) and copies the primary image's url to
+// products.image_url
+func syncPrimaryImage(tx *sql.Tx, productID int64) error {
+	var primaries int
+	if err := tx.QueryRow("SELECT COUNT(1) FROM product_images WHERE product_id = ? AND is_primary = 1", productID).Scan(&primaries); err != nil {
+		return err
+	}
+	if primaries == 0 {
+		if _, err := tx.Exec("UPDATE product_images SET is_primary = 1 WHERE product_id = ? ORDER BY position, id LIMIT 1", productID); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`UPDATE products SET image_url = COALESCE((SELECT url FROM product_images WHERE product_id = ? AND is_primary = 1 LIMIT 1), '')
+		WHERE id = ?`, productID, productID)
+	return err
+}
@@ -0,0 +1,142 @@
+package product
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/search"
+)
+
+// SearchIndex finds products by text for the "search" filter of product lists
+type SearchIndex interface {
+	// Index adds or replaces a product's document
+	Index(doc search.Document) error
+	Remove(id int64) error
+	// Search returns the matching products ordered by relevance, best first, at
+	// most limit
+	Search(query string, limit int) ([]search.Hit, error)
+}
+
+// maxSearchHits is how many search results product lists page through: only the
+// best matches are ranked, and the other filters apply to those. List totals
+// are capped accordingly and responses report the cap as max_total.
+const maxSearchHits = 1000
+
+// NewSearchIndex returns the index selected by SEARCH_INDEX: "mysql" (default,
+// FULLTEXT), "memory" (in-process, for tests and a single product service) or
+// "none" (substring match on name and description).
+func NewSearchIndex(db *sql.DB) SearchIndex {
+	switch strings.ToLower(os.Getenv("SEARCH_INDEX")) {
+	case "memory":
+		return search.NewMemory()
+	case "none":
+		return nil
+	default:
+		return &mysqlSearch{db: db}
+	}
+}
+
+// mysqlSearch keeps the analyzed terms of every product (stemmed, without
+// stopwords; the name twice so that it weighs more) in products.search_terms,
+// which has an ngram FULLTEXT index. Matching ngrams rather than whole words
+// makes queries with a typo still find the product, ranked lower.
+type mysqlSearch struct {
+	db *sql.DB
+}
+
+// minRelativeScore drops matches scoring below this fraction of the best one:
+// with ngrams a query shares a few letter pairs with many unrelated products
+const minRelativeScore = 0.25
+
+func searchTerms(doc search.Document) string {
+	name := strings.Join(search.Terms(doc.Name), " ")
+	return strings.TrimSpace(name + " " + name + " " + strings.Join(search.Terms(doc.Description), " "))
+}
+
+func (s *mysqlSearch) Index(doc search.Document) error {
+	_, err := s.db.Exec("UPDATE products SET search_terms = ? WHERE id = ?", searchTerms(doc), doc.ID)
+	return err
+}
+
+// Remove is a no-op: the terms are deleted with the product row
+func (s *mysqlSearch) Remove(id int64) error {
+	return nil
+}
+
+func (s *mysqlSearch) Search(query string, limit int) ([]search.Hit, error) {
+	terms := search.QueryTerms(query)
+	if len(terms) == 0 {
+		return []search.Hit{}, nil
+	}
+	q := strings.Join(terms, " ")
+	rows, err := s.db.Query(`SELECT id, MATCH(search_terms) AGAINST(? IN NATURAL LANGUAGE MODE) AS score
+		FROM products WHERE MATCH(search_terms) AGAINST(? IN NATURAL LANGUAGE MODE)
+		ORDER BY score DESC, id DESC LIMIT ?`, q, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hits := []search.Hit{}
+	for rows.Next() {
+		h := search.Hit{Terms: terms}
+		if err := rows.Scan(&h.ID, &h.Score); err != nil {
+			return nil, err
+		}
+		if len(hits) > 0 && h.Score < hits[0].Score*minRelativeScore {
+			break
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// syncSearchIndex indexes the products the index does not have yet: every
+// product for an in-memory index, products created before search_terms existed
+// for the MySQL one
+func syncSearchIndex(db *sql.DB, idx SearchIndex) error {
+	q := "SELECT id, name, COALESCE(description, '') FROM products"
+	if _, ok := idx.(*mysqlSearch); ok {
+		q += " WHERE search_terms IS NULL"
+	}
+	rows, err := db.Query(q)
+	if err != nil {
+		return err
+	}
+	docs := []search.Document{}
+	for rows.Next() {
+		var d search.Document
+		if err := rows.Scan(&d.ID, &d.Name, &d.Description); err != nil {
+			rows.Close()
+			return err
+		}
+		docs = append(docs, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, d := range docs {
+		if err := idx.Index(d); err != nil {
+			return err
+		}
+	}
+	if len(docs) > 0 {
+		log.Printf("search: indexed %d products", len(docs))
+	}
+	return nil
+}
+
+// highlights marks the query terms in a product's name and description
+func highlights(p *models.Product, terms []string) map[string]string {
+	out := map[string]string{}
+	if h, ok := search.Highlight(p.Name, terms, 0); ok {
+		out["name"] = h
+	}
+	if h, ok := search.Highlight(p.Description, terms, 160); ok {
+		out["description"] = h
+	}
+	return out
+}
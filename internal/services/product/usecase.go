@@ -1,18 +1,48 @@
 package product
 
 import (
+	"database/sql"
 	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/example/ms-ecommerce/internal/pkg/cache"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
+	"github.com/example/ms-ecommerce/internal/pkg/upload"
 )
 
 type Usecase interface {
-	CreateProduct(userID int64, role string, p *models.Product) (int64, error)
-	ListProducts(userID int64, role string, filters map[string]string, page, limit int) ([]*models.Product, int, error)
-	GetProduct(userID int64, role string, id int64) (*models.Product, error)
-	UpdateProduct(userID int64, role string, id int64, name, description string, price float64, stock int, categoryID *int64) error
-	DeleteProduct(userID int64, role string, id int64) error
+	CreateProduct(userID int64, perms rbac.Permissions, p *models.Product) (int64, error)
+	// ListProducts returns a page of products and the facets of all the products
+	// matching filters
+	ListProducts(userID int64, perms rbac.Permissions, filters map[string]string, page, limit int) ([]*models.Product, int, *models.ProductFacets, error)
+	GetProduct(userID int64, perms rbac.Permissions, id int64) (*models.Product, error)
+	UpdateProduct(userID int64, perms rbac.Permissions, id int64, name, description string, price float64, stock int, categoryID *int64, published *bool) error
+	DeleteProduct(userID int64, perms rbac.Permissions, id int64) error
+	CreateVariant(userID int64, perms rbac.Permissions, productID int64, v *models.ProductVariant) (int64, error)
+	UpdateVariant(userID int64, perms rbac.Permissions, productID int64, v *models.ProductVariant) error
+	DeleteVariant(userID int64, perms rbac.Permissions, productID, variantID int64) error
+	// AddImage stores an uploaded image (validated like /api/v1/files/upload) and
+	// appends it to the product's images
+	AddImage(userID int64, perms rbac.Permissions, productID int64, file io.Reader, header *multipart.FileHeader, altText string, primary bool) (*models.ProductImage, error)
+	// UpdateImage changes an image's alt text (when altText is not nil) or makes it primary
+	UpdateImage(userID int64, perms rbac.Permissions, productID, imageID int64, altText *string, primary bool) error
+	ReorderImages(userID int64, perms rbac.Permissions, productID int64, imageIDs []int64) error
+	DeleteImage(userID int64, perms rbac.Permissions, productID, imageID int64) error
+
+	// ListCatalog and GetCatalogProduct serve the public catalog: published
+	// products that are in stock, of every store
+	ListCatalog(filters map[string]string, page, limit int) ([]*models.Product, int, *models.ProductFacets, error)
+	GetCatalogProduct(id int64) (*models.Product, error)
+	// SearchLimit is how many matches a search considers (list totals never
+	// exceed it), or 0 when searches are not capped
+	SearchLimit() int
 }
 
 type productUsecase struct {
@@ -23,7 +53,7 @@ func NewUsecase(r Repository) Usecase {
 	return &productUsecase{repo: r}
 }
 
-func (u *productUsecase) CreateProduct(userID int64, role string, p *models.Product) (int64, error) {
+func (u *productUsecase) CreateProduct(userID int64, perms rbac.Permissions, p *models.Product) (int64, error) {
 	// find store id by user
 	var storeID int64
 	row := u.repo.(*mysqlRepo).db.QueryRow("SELECT id FROM stores WHERE user_id = ?", userID)
@@ -44,25 +74,52 @@ func (u *productUsecase) CreateProduct(userID int64, role string, p *models.Prod
 	return id, nil
 }
 
-func (u *productUsecase) ListProducts(userID int64, role string, filters map[string]string, page, limit int) ([]*models.Product, int, error) {
-	if role != "admin" {
+func (u *productUsecase) ListProducts(userID int64, perms rbac.Permissions, filters map[string]string, page, limit int) ([]*models.Product, int, *models.ProductFacets, error) {
+	if !perms.Has(rbac.ProductReadAny) {
 		// find store id by user
 		var storeID int64
 		row := u.repo.(*mysqlRepo).db.QueryRow("SELECT id FROM stores WHERE user_id = ?", userID)
 		if err := row.Scan(&storeID); err != nil {
-			return nil, 0, err
+			return nil, 0, nil, err
 		}
-		filters["store_id"] = strconv.FormatInt(storeID, 10)
+		filters[ownerStoreFilter] = strconv.FormatInt(storeID, 10)
+	}
+	return u.list(filters, page, limit)
+}
+
+// list validates the sort order and returns a page of products with the facets
+func (u *productUsecase) list(filters map[string]string, page, limit int) ([]*models.Product, int, *models.ProductFacets, error) {
+	if err := validateSort(filters["sort"]); err != nil {
+		return nil, 0, nil, err
+	}
+	products, total, err := u.repo.List(filters, page, limit)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	facets, err := u.repo.Facets(filters)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return products, total, facets, nil
+}
+
+// validateSort checks a product list's sort order; empty is the default
+func validateSort(sort string) error {
+	if sort == "" || sort == SortRelevance {
+		return nil
+	}
+	if _, ok := sortOrders[sort]; !ok {
+		return errors.New("invalid sort")
 	}
-	return u.repo.List(filters, page, limit)
+	return nil
 }
 
-func (u *productUsecase) GetProduct(userID int64, role string, id int64) (*models.Product, error) {
+func (u *productUsecase) GetProduct(userID int64, perms rbac.Permissions, id int64) (*models.Product, error) {
 	p, err := u.repo.GetByID(id)
 	if err != nil {
 		return nil, err
 	}
-	if role != "admin" {
+	if !perms.Has(rbac.ProductReadAny) {
 		// find store id by user
 		var storeID int64
 		row := u.repo.(*mysqlRepo).db.QueryRow("SELECT id FROM stores WHERE user_id = ?", userID)
@@ -76,8 +133,8 @@ func (u *productUsecase) GetProduct(userID int64, role string, id int64) (*model
 	return p, nil
 }
 
-func (u *productUsecase) UpdateProduct(userID int64, role string, id int64, name, description string, price float64, stock int, categoryID *int64) error {
-	if role != "admin" {
+func (u *productUsecase) UpdateProduct(userID int64, perms rbac.Permissions, id int64, name, description string, price float64, stock int, categoryID *int64, published *bool) error {
+	if !perms.Has(rbac.ProductWriteAny) {
 		// find store id by user
 		var storeID int64
 		row := u.repo.(*mysqlRepo).db.QueryRow("SELECT id FROM stores WHERE user_id = ?", userID)
@@ -96,7 +153,7 @@ func (u *productUsecase) UpdateProduct(userID int64, role string, id int64, name
 			return errors.New("forbidden")
 		}
 	}
-	err := u.repo.Update(id, name, description, price, stock, categoryID)
+	err := u.repo.Update(id, name, description, price, stock, categoryID, published)
 	if err != nil {
 		return err
 	}
@@ -109,8 +166,8 @@ func (u *productUsecase) UpdateProduct(userID int64, role string, id int64, name
 	return nil
 }
 
-func (u *productUsecase) DeleteProduct(userID int64, role string, id int64) error {
-	if role != "admin" {
+func (u *productUsecase) DeleteProduct(userID int64, perms rbac.Permissions, id int64) error {
+	if !perms.Has(rbac.ProductWriteAny) {
 		// find store id by user
 		var storeID int64
 		row := u.repo.(*mysqlRepo).db.QueryRow("SELECT id FROM stores WHERE user_id = ?", userID)
@@ -129,10 +186,18 @@ func (u *productUsecase) DeleteProduct(userID int64, role string, id int64) erro
 			return errors.New("forbidden")
 		}
 	}
-	err := u.repo.Delete(id)
+	images, err := u.repo.ListImages([]int64{id})
+	if err != nil {
+		return err
+	}
+	err = u.repo.Delete(id)
 	if err != nil {
 		return err
 	}
+	// the image rows are gone with the product, the files are removed here
+	for _, img := range images[id] {
+		removeUpload(img.URL)
+	}
 
 	// Invalidate cache after deleting product
 	if u.repo.(*mysqlRepo).cache != nil {
@@ -141,3 +206,292 @@ func (u *productUsecase) DeleteProduct(userID int64, role string, id int64) erro
 
 	return nil
 }
+
+// writableProduct loads a product the user may change: one of their store's,
+// or any with product:write:any
+func (u *productUsecase) writableProduct(userID int64, perms rbac.Permissions, id int64) (*models.Product, error) {
+	p, err := u.repo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, errors.New("not found")
+	}
+	if !perms.Has(rbac.ProductWriteAny) {
+		var storeID int64
+		row := u.repo.(*mysqlRepo).db.QueryRow("SELECT id FROM stores WHERE user_id = ?", userID)
+		if err := row.Scan(&storeID); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if p.StoreID != storeID {
+			return nil, errors.New("forbidden")
+		}
+	}
+	return p, nil
+}
+
+// normalizeVariant validates a variant and trims its fields. A variant without a
+// name is named after its option values, e.g. "Black / M".
+func normalizeVariant(v *models.ProductVariant) error {
+	v.SKU = strings.TrimSpace(v.SKU)
+	v.Name = strings.TrimSpace(v.Name)
+	if v.SKU == "" {
+		return errors.New("sku required")
+	}
+	if len(v.SKU) > 64 {
+		return errors.New("sku too long")
+	}
+	if v.Stock < 0 {
+		return errors.New("invalid stock")
+	}
+	if v.Price != nil && *v.Price < 0 {
+		return errors.New("invalid price")
+	}
+	options := map[string]string{}
+	names := []string{}
+	for name, value := range v.Options {
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || value == "" {
+			return errors.New("invalid options")
+		}
+		options[name] = value
+		names = append(names, name)
+	}
+	v.Options = options
+	if v.Name == "" {
+		sort.Strings(names)
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = options[name]
+		}
+		v.Name = strings.Join(values, " / ")
+	}
+	return nil
+}
+
+// checkVariantImage trims a variant's image_url and checks that it is one of
+// the product's images: variants only show images uploaded for their product.
+func checkVariantImage(p *models.Product, v *models.ProductVariant) error {
+	v.ImageURL = strings.TrimSpace(v.ImageURL)
+	if v.ImageURL == "" {
+		return nil
+	}
+	for _, img := range p.Images {
+		if img.URL == v.ImageURL {
+			return nil
+		}
+	}
+	return errors.New("invalid image_url")
+}
+
+// SearchLimit is maxSearchHits when a search index ranks the matches; substring
+// matching without an index is not capped
+func (u *productUsecase) SearchLimit() int {
+	if r, ok := u.repo.(*mysqlRepo); ok && r.search != nil {
+		return maxSearchHits
+	}
+	return 0
+}
+
+func (u *productUsecase) invalidateCache() {
+	if r, ok := u.repo.(*mysqlRepo); ok && r.cache != nil {
+		r.cache.InvalidateProductsCache()
+	}
+}
+
+func (u *productUsecase) CreateVariant(userID int64, perms rbac.Permissions, productID int64, v *models.ProductVariant) (int64, error) {
+	p, err := u.writableProduct(userID, perms, productID)
+	if err != nil {
+		return 0, err
+	}
+	if err := normalizeVariant(v); err != nil {
+		return 0, err
+	}
+	if err := checkVariantImage(p, v); err != nil {
+		return 0, err
+	}
+	v.ProductID = p.ID
+	id, err := u.repo.CreateVariant(p.StoreID, v)
+	if err != nil {
+		return 0, err
+	}
+	u.invalidateCache()
+	return id, nil
+}
+
+func (u *productUsecase) UpdateVariant(userID int64, perms rbac.Permissions, productID int64, v *models.ProductVariant) error {
+	p, err := u.writableProduct(userID, perms, productID)
+	if err != nil {
+		return err
+	}
+	existing, err := u.repo.GetVariant(v.ID)
+	if err != nil {
+		return err
+	}
+	if existing == nil || existing.ProductID != productID {
+		return errors.New("not found")
+	}
+	if err := normalizeVariant(v); err != nil {
+		return err
+	}
+	if err := checkVariantImage(p, v); err != nil {
+		return err
+	}
+	if err := u.repo.UpdateVariant(v); err != nil {
+		return err
+	}
+	u.invalidateCache()
+	return nil
+}
+
+func (u *productUsecase) DeleteVariant(userID int64, perms rbac.Permissions, productID, variantID int64) error {
+	if _, err := u.writableProduct(userID, perms, productID); err != nil {
+		return err
+	}
+	existing, err := u.repo.GetVariant(variantID)
+	if err != nil {
+		return err
+	}
+	if existing == nil || existing.ProductID != productID {
+		return errors.New("not found")
+	}
+	if err := u.repo.DeleteVariant(variantID); err != nil {
+		return err
+	}
+	u.invalidateCache()
+	return nil
+}
+
+// removeUpload deletes an image file that is no longer referenced. Images that
+// are not uploads (external URLs) are left alone.
+func removeUpload(url string) {
+	if err := upload.Remove(url); err != nil {
+		log.Printf("product: removing image %s: %v", url, err)
+	}
+}
+
+// productImage loads an image of a product the user may change
+func (u *productUsecase) productImage(userID int64, perms rbac.Permissions, productID, imageID int64) (*models.ProductImage, error) {
+	if _, err := u.writableProduct(userID, perms, productID); err != nil {
+		return nil, err
+	}
+	img, err := u.repo.GetImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil || img.ProductID != productID {
+		return nil, errors.New("not found")
+	}
+	return img, nil
+}
+
+func (u *productUsecase) AddImage(userID int64, perms rbac.Permissions, productID int64, file io.Reader, header *multipart.FileHeader, altText string, primary bool) (*models.ProductImage, error) {
+	p, err := u.writableProduct(userID, perms, productID)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Images) >= maxProductImages {
+		return nil, errTooManyImages
+	}
+	url, err := upload.Images.Save(userID, file, header)
+	if err != nil {
+		return nil, err
+	}
+	img := &models.ProductImage{ProductID: p.ID, URL: url, AltText: strings.TrimSpace(altText), Primary: primary}
+	img.ID, err = u.repo.AddImage(img)
+	if err != nil {
+		removeUpload(url)
+		return nil, err
+	}
+	u.invalidateCache()
+	return u.repo.GetImage(img.ID)
+}
+
+func (u *productUsecase) UpdateImage(userID int64, perms rbac.Permissions, productID, imageID int64, altText *string, primary bool) error {
+	img, err := u.productImage(userID, perms, productID, imageID)
+	if err != nil {
+		return err
+	}
+	if altText != nil {
+		img.AltText = strings.TrimSpace(*altText)
+	}
+	// the primary image changes by making another one primary
+	img.Primary = img.Primary || primary
+	if err := u.repo.UpdateImage(img); err != nil {
+		return err
+	}
+	u.invalidateCache()
+	return nil
+}
+
+func (u *productUsecase) ReorderImages(userID int64, perms rbac.Permissions, productID int64, imageIDs []int64) error {
+	p, err := u.writableProduct(userID, perms, productID)
+	if err != nil {
+		return err
+	}
+	// the new order must list every image of the product once
+	if len(imageIDs) != len(p.Images) {
+		return errors.New("invalid image order")
+	}
+	current := map[int64]bool{}
+	for _, img := range p.Images {
+		current[img.ID] = true
+	}
+	for _, id := range imageIDs {
+		if !current[id] {
+			return errors.New("invalid image order")
+		}
+		delete(current, id)
+	}
+	if err := u.repo.ReorderImages(productID, imageIDs); err != nil {
+		return err
+	}
+	u.invalidateCache()
+	return nil
+}
+
+func (u *productUsecase) DeleteImage(userID int64, perms rbac.Permissions, productID, imageID int64) error {
+	img, err := u.productImage(userID, perms, productID, imageID)
+	if err != nil {
+		return err
+	}
+	if err := u.repo.DeleteImage(img); err != nil {
+		return err
+	}
+	removeUpload(img.URL)
+	u.invalidateCache()
+	return nil
+}
+
+func (u *productUsecase) ListCatalog(filters map[string]string, page, limit int) ([]*models.Product, int, *models.ProductFacets, error) {
+	filters["published"] = "1"
+	filters["in_stock"] = "1"
+	// List and Facets cache under keys that include the filters above
+	return u.list(filters, page, limit)
+}
+
+func (u *productUsecase) GetCatalogProduct(id int64) (*models.Product, error) {
+	var productCache *cache.ProductCache
+	if r, ok := u.repo.(*mysqlRepo); ok {
+		productCache = r.cache
+	}
+	key := ""
+	if productCache != nil {
+		key = productCache.GetCatalogProductCacheKey(id)
+		if p, err := productCache.GetProduct(key); err == nil {
+			return p, nil
+		}
+	}
+	p, err := u.repo.GetByID(id)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if !p.Published || !inStock(p) {
+		return nil, nil
+	}
+	// Cache the product for 5 minutes, like product lists
+	if productCache != nil {
+		productCache.SetProduct(key, p, 5*time.Minute)
+	}
+	return p, nil
+}
@@ -1,9 +1,222 @@
 package product
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
+	"github.com/example/ms-ecommerce/internal/pkg/search"
 )
 
 func TestDummy(t *testing.T) {
 	// Dummy test to avoid no test files
 }
+
+func TestNormalizeVariant(t *testing.T) {
+	v := &models.ProductVariant{SKU: " HJB-BLK-M ", Options: map[string]string{"size": " M", "color": "Black "}}
+	if err := normalizeVariant(v); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if v.SKU != "HJB-BLK-M" || v.Name != "Black / M" || v.Options["size"] != "M" {
+		t.Fatalf("unexpected variant %+v", v)
+	}
+
+	price := -1.0
+	for _, bad := range []*models.ProductVariant{
+		{SKU: ""},
+		{SKU: "A", Stock: -1},
+		{SKU: "A", Price: &price},
+		{SKU: "A", Options: map[string]string{"size": ""}},
+	} {
+		if err := normalizeVariant(bad); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestCheckVariantImage(t *testing.T) {
+	p := &models.Product{ImageURL: "/uploads/3_1_hoodie.jpg", Images: []*models.ProductImage{
+		{ID: 1, URL: "/uploads/3_1_hoodie.jpg", Primary: true},
+		{ID: 2, URL: "/uploads/3_2_hoodie_navy.jpg"},
+	}}
+	for _, url := range []string{"", " /uploads/3_1_hoodie.jpg", "/uploads/3_2_hoodie_navy.jpg"} {
+		if err := checkVariantImage(p, &models.ProductVariant{ImageURL: url}); err != nil {
+			t.Fatalf("expected %q accepted, got %v", url, err)
+		}
+	}
+	for _, url := range []string{"https://example.com/x.jpg", "/uploads/4_1_other.jpg"} {
+		if err := checkVariantImage(p, &models.ProductVariant{ImageURL: url}); err == nil {
+			t.Fatalf("expected %q refused", url)
+		}
+	}
+}
+
+func TestProductOptions(t *testing.T) {
+	opts := productOptions([]*models.ProductVariant{
+		{Options: map[string]string{"size": "S", "color": "Black"}},
+		{Options: map[string]string{"size": "M", "color": "Black"}},
+		{Options: map[string]string{"size": "S", "color": "Navy"}},
+	})
+	if len(opts) != 2 || opts[0].Name != "color" || opts[1].Name != "size" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	if strings.Join(opts[0].Values, ",") != "Black,Navy" || strings.Join(opts[1].Values, ",") != "S,M" {
+		t.Fatalf("unexpected option values %v %v", opts[0].Values, opts[1].Values)
+	}
+	if len(productOptions(nil)) != 0 {
+		t.Fatalf("expected no options without variants")
+	}
+}
+
+// stubRepo implements the Repository methods used by the usecases under test
+type stubRepo struct {
+	Repository
+	product *models.Product
+	order   []int64
+}
+
+func (m *stubRepo) GetByID(id int64) (*models.Product, error) {
+	if m.product.ID != id {
+		return nil, nil
+	}
+	return m.product, nil
+}
+
+func (m *stubRepo) ReorderImages(productID int64, ids []int64) error {
+	m.order = ids
+	return nil
+}
+
+func TestReorderImages(t *testing.T) {
+	repo := &stubRepo{product: &models.Product{ID: 3, StoreID: 1, Images: []*models.ProductImage{{ID: 10}, {ID: 11}, {ID: 12}}}}
+	u := &productUsecase{repo: repo}
+	perms := rbac.NewPermissions(rbac.ProductWriteAny)
+
+	if err := u.ReorderImages(1, perms, 3, []int64{12, 10, 11}); err != nil {
+		t.Fatalf("reorder: %v", err)
+	}
+	if len(repo.order) != 3 || repo.order[0] != 12 {
+		t.Fatalf("unexpected order %v", repo.order)
+	}
+	// every image exactly once
+	for _, bad := range [][]int64{{12, 10}, {12, 10, 10}, {12, 10, 99}} {
+		if err := u.ReorderImages(1, perms, 3, bad); err == nil || err.Error() != "invalid image order" {
+			t.Fatalf("expected invalid order for %v, got %v", bad, err)
+		}
+	}
+	if err := u.ReorderImages(1, perms, 4, nil); err == nil || err.Error() != "not found" {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestGetCatalogProduct(t *testing.T) {
+	repo := &stubRepo{}
+	u := &productUsecase{repo: repo}
+	cases := []struct {
+		product *models.Product
+		visible bool
+	}{
+		{&models.Product{ID: 1, Published: true, Stock: 2}, true},
+		{&models.Product{ID: 1, Published: false, Stock: 2}, false},
+		{&models.Product{ID: 1, Published: true, Stock: 0}, false},
+		// products sold in variants need a variant in stock; their own stock is not used
+		{&models.Product{ID: 1, Published: true, Stock: 5, Variants: []*models.ProductVariant{{Stock: 0}}}, false},
+		{&models.Product{ID: 1, Published: true, Variants: []*models.ProductVariant{{Stock: 0}, {Stock: 1}}}, true},
+	}
+	for i, c := range cases {
+		repo.product = c.product
+		p, err := u.GetCatalogProduct(1)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if (p != nil) != c.visible {
+			t.Fatalf("case %d: expected visible=%v, got %+v", i, c.visible, p)
+		}
+	}
+	if p, err := u.GetCatalogProduct(2); p != nil || err != nil {
+		t.Fatalf("expected unknown product not found, got %+v %v", p, err)
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms(search.Document{Name: "Jualan Kemeja", Description: "Kemeja yang dijual murah"})
+	if got != "jual kemeja jual kemeja kemeja jual murah" {
+		t.Fatalf("unexpected search terms %q", got)
+	}
+	h := highlights(&models.Product{Name: "Kemeja Batik", Description: "Batik tulis"}, search.QueryTerms("kemja"))
+	if h["name"] != "<em>Kemeja</em> Batik" || h["description"] != "" {
+		t.Fatalf("unexpected highlights %v", h)
+	}
+}
+
+func (m *stubRepo) List(filters map[string]string, page, limit int) ([]*models.Product, int, error) {
+	return []*models.Product{m.product}, 1, nil
+}
+
+func (m *stubRepo) Facets(filters map[string]string) (*models.ProductFacets, error) {
+	return &models.ProductFacets{}, nil
+}
+
+func TestListCatalogSort(t *testing.T) {
+	u := &productUsecase{repo: &stubRepo{product: &models.Product{ID: 1}}}
+	for _, sort := range []string{"", SortRelevance, SortNewest, SortPriceAsc, SortPriceDesc, SortBestSelling, SortRating} {
+		if _, _, facets, err := u.ListCatalog(map[string]string{"sort": sort}, 1, 10); err != nil || facets == nil {
+			t.Fatalf("sort %q: %v", sort, err)
+		}
+	}
+	if _, _, _, err := u.ListCatalog(map[string]string{"sort": "price"}, 1, 10); err == nil || err.Error() != "invalid sort" {
+		t.Fatalf("expected invalid sort, got %v", err)
+	}
+}
+
+func TestListWhere(t *testing.T) {
+	filters := map[string]string{"category_id": "2,5", "store_id": "7", "min_price": "1000", "published": "1"}
+	where, args := listWhere(filters, nil, false, "")
+	if where != "1=1 AND products.category_id IN (?,?) AND products.store_id IN (?) AND products.price >= ? AND products.published = 1" || len(args) != 4 {
+		t.Fatalf("unexpected where %q %v", where, args)
+	}
+	// a facet leaves out its own filter
+	where, args = listWhere(filters, nil, false, "category_id")
+	if strings.Contains(where, "category_id") || len(args) != 2 {
+		t.Fatalf("unexpected facet where %q %v", where, args)
+	}
+	// a seller's own store restriction stays in the store facet
+	where, args = listWhere(map[string]string{"store_id": "7,8", ownerStoreFilter: "3"}, nil, false, "store_id")
+	if where != "1=1 AND products.store_id = ?" || len(args) != 1 || args[0] != "3" {
+		t.Fatalf("unexpected store facet where %q %v", where, args)
+	}
+	where, _ = listWhere(map[string]string{"store_id": "x"}, nil, false, "")
+	if !strings.Contains(where, "1=0") {
+		t.Fatalf("expected invalid ids to match nothing, got %q", where)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	query := map[string]string{"search": "kopi"}
+	// substring matching without an index is not capped
+	u := &productUsecase{repo: &stubRepo{}}
+	if p := listPagination(u, query, 1, 10, 1500); p["total"] != 1500 || p["max_total"] != nil {
+		t.Fatalf("unexpected pagination %v", p)
+	}
+	// searches through the index report their cap
+	u = &productUsecase{repo: &mysqlRepo{search: search.NewMemory()}}
+	if p := listPagination(u, query, 101, 10, maxSearchHits); p["max_total"] != maxSearchHits {
+		t.Fatalf("expected max_total, got %v", p)
+	}
+	if p := listPagination(u, map[string]string{}, 1, 10, 5000); p["max_total"] != nil {
+		t.Fatalf("expected no max_total without a search, got %v", p)
+	}
+}
+
+func TestIDList(t *testing.T) {
+	got, err := idList([]string{"5,2", "2", " 9 "})
+	if err != nil || got != "2,5,9" {
+		t.Fatalf("unexpected id list %q %v", got, err)
+	}
+	for _, bad := range [][]string{{"a"}, {"1,0"}, {"-3"}} {
+		if _, err := idList(bad); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+}
@@ -13,10 +13,10 @@ import (
 func RegisterRoutes(r *gin.Engine, dbConn *sql.DB) {
 	repo := NewRepo(dbConn)
 	uc := NewUsecase(repo)
-	r.POST("/api/v1/stores", middleware.GinJWTAuth(), makeCreateHandler(uc))
-	r.GET("/api/v1/stores/:id", middleware.GinJWTAuth(), makeGetHandler(uc))
-	r.PUT("/api/v1/stores/:id", middleware.GinJWTAuth(), makeUpdateHandler(uc))
-	r.DELETE("/api/v1/stores/:id", middleware.GinJWTAuth(), makeDeleteHandler(uc))
+	r.POST("/api/v1/stores", middleware.GinJWTOrAPIKeyAuth(), makeCreateHandler(uc))
+	r.GET("/api/v1/stores/:id", middleware.GinJWTOrAPIKeyAuth(), makeGetHandler(uc))
+	r.PUT("/api/v1/stores/:id", middleware.GinJWTOrAPIKeyAuth(), makeUpdateHandler(uc))
+	r.DELETE("/api/v1/stores/:id", middleware.GinJWTOrAPIKeyAuth(), makeDeleteHandler(uc))
 }
 
 func makeCreateHandler(uc Usecase) gin.HandlerFunc {
@@ -49,14 +49,14 @@ func makeGetHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 			return
 		}
-		s, err := uc.GetStore(uid, id, role)
+		s, err := uc.GetStore(uid, id, perms)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
@@ -80,7 +80,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
@@ -94,7 +94,7 @@ func makeUpdateHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		if err := uc.UpdateStore(uid, id, role, req.Name); err != nil {
+		if err := uc.UpdateStore(uid, id, perms, req.Name); err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 			} else if err.Error() == "not found" {
@@ -115,14 +115,14 @@ func makeDeleteHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 			return
 		}
-		if err := uc.DeleteStore(uid, id, role); err != nil {
+		if err := uc.DeleteStore(uid, id, perms); err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 			} else if err.Error() == "not found" {
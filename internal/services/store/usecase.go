@@ -4,13 +4,14 @@ import (
 	"errors"
 
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 )
 
 type Usecase interface {
 	CreateStore(userID int64, name string) (int64, error)
-	GetStore(requesterID, storeID int64, requesterRole string) (*models.Store, error)
-	UpdateStore(requesterID, storeID int64, requesterRole, name string) error
-	DeleteStore(requesterID, storeID int64, requesterRole string) error
+	GetStore(requesterID, storeID int64, perms rbac.Permissions) (*models.Store, error)
+	UpdateStore(requesterID, storeID int64, perms rbac.Permissions, name string) error
+	DeleteStore(requesterID, storeID int64, perms rbac.Permissions) error
 }
 
 type storeUsecase struct {
@@ -34,7 +35,7 @@ func (u *storeUsecase) CreateStore(userID int64, name string) (int64, error) {
 	return u.repo.Create(s)
 }
 
-func (u *storeUsecase) GetStore(requesterID, storeID int64, requesterRole string) (*models.Store, error) {
+func (u *storeUsecase) GetStore(requesterID, storeID int64, perms rbac.Permissions) (*models.Store, error) {
 	s, err := u.repo.GetByID(storeID)
 	if err != nil {
 		return nil, err
@@ -42,13 +43,13 @@ func (u *storeUsecase) GetStore(requesterID, storeID int64, requesterRole string
 	if s == nil {
 		return nil, nil
 	}
-	if requesterRole != "admin" && s.UserID != requesterID {
+	if !perms.Has(rbac.StoreReadAny) && s.UserID != requesterID {
 		return nil, errors.New("forbidden")
 	}
 	return s, nil
 }
 
-func (u *storeUsecase) UpdateStore(requesterID, storeID int64, requesterRole, name string) error {
+func (u *storeUsecase) UpdateStore(requesterID, storeID int64, perms rbac.Permissions, name string) error {
 	s, err := u.repo.GetByID(storeID)
 	if err != nil {
 		return err
@@ -56,13 +57,13 @@ func (u *storeUsecase) UpdateStore(requesterID, storeID int64, requesterRole, na
 	if s == nil {
 		return errors.New("not found")
 	}
-	if requesterRole != "admin" && s.UserID != requesterID {
+	if !perms.Has(rbac.StoreWriteAny) && s.UserID != requesterID {
 		return errors.New("forbidden")
 	}
 	return u.repo.Update(storeID, name)
 }
 
-func (u *storeUsecase) DeleteStore(requesterID, storeID int64, requesterRole string) error {
+func (u *storeUsecase) DeleteStore(requesterID, storeID int64, perms rbac.Permissions) error {
 	s, err := u.repo.GetByID(storeID)
 	if err != nil {
 		return err
@@ -70,7 +71,7 @@ func (u *storeUsecase) DeleteStore(requesterID, storeID int64, requesterRole str
 	if s == nil {
 		return errors.New("not found")
 	}
-	if requesterRole != "admin" && s.UserID != requesterID {
+	if !perms.Has(rbac.StoreWriteAny) && s.UserID != requesterID {
 		return errors.New("forbidden")
 	}
 	return u.repo.Delete(storeID)
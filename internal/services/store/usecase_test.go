@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 )
 
 // mockRepo implements minimal Repository for store tests.
@@ -30,7 +31,7 @@ func TestGetStore_Authorization(t *testing.T) {
 
 	// 1) Owner gets own store -> allowed
 	repo.store = &models.Store{ID: 1, UserID: 10}
-	s, err := u.GetStore(10, 1, "user")
+	s, err := u.GetStore(10, 1, nil)
 	if err != nil {
 		t.Fatalf("expected owner get allowed, got err: %v", err)
 	}
@@ -39,13 +40,13 @@ func TestGetStore_Authorization(t *testing.T) {
 	}
 
 	// 2) Non-owner non-admin gets another user's store -> forbidden
-	_, err = u.GetStore(11, 1, "user")
+	_, err = u.GetStore(11, 1, nil)
 	if err == nil || err.Error() != "forbidden" {
 		t.Fatalf("expected forbidden, got err: %v", err)
 	}
 
 	// 3) Admin gets any store -> allowed
-	s, err = u.GetStore(1, 1, "admin")
+	s, err = u.GetStore(1, 1, rbac.NewPermissions(rbac.StoreReadAny))
 	if err != nil {
 		t.Fatalf("expected admin get allowed, got err: %v", err)
 	}
@@ -55,7 +56,7 @@ func TestGetStore_Authorization(t *testing.T) {
 
 	// 4) Store not found
 	repo.store = nil
-	s, err = u.GetStore(10, 1, "user")
+	s, err = u.GetStore(10, 1, nil)
 	if err != nil {
 		t.Fatalf("expected nil for not found, got err: %v", err)
 	}
@@ -65,7 +66,7 @@ func TestGetStore_Authorization(t *testing.T) {
 
 	// 5) Repo error -> forwarded
 	repo.err = errors.New("db fail")
-	_, err = u.GetStore(10, 1, "user")
+	_, err = u.GetStore(10, 1, nil)
 	if err == nil {
 		t.Fatalf("expected repo error forwarded, got nil")
 	}
@@ -77,33 +78,33 @@ func TestUpdateStore_Authorization(t *testing.T) {
 
 	// 1) Owner updates own store -> allowed
 	repo.store = &models.Store{ID: 1, UserID: 10}
-	err := u.UpdateStore(10, 1, "user", "new name")
+	err := u.UpdateStore(10, 1, nil, "new name")
 	if err != nil {
 		t.Fatalf("expected owner update allowed, got err: %v", err)
 	}
 
 	// 2) Non-owner non-admin updates another user's store -> forbidden
-	err = u.UpdateStore(11, 1, "user", "new name")
+	err = u.UpdateStore(11, 1, nil, "new name")
 	if err == nil || err.Error() != "forbidden" {
 		t.Fatalf("expected forbidden, got err: %v", err)
 	}
 
 	// 3) Admin updates any store -> allowed
-	err = u.UpdateStore(1, 1, "admin", "new name")
+	err = u.UpdateStore(1, 1, rbac.NewPermissions(rbac.StoreWriteAny), "new name")
 	if err != nil {
 		t.Fatalf("expected admin update allowed, got err: %v", err)
 	}
 
 	// 4) Store not found
 	repo.store = nil
-	err = u.UpdateStore(10, 1, "user", "new name")
+	err = u.UpdateStore(10, 1, nil, "new name")
 	if err == nil || err.Error() != "not found" {
 		t.Fatalf("expected not found, got err: %v", err)
 	}
 
 	// 5) Repo error -> forwarded
 	repo.err = errors.New("db fail")
-	err = u.UpdateStore(10, 1, "user", "new name")
+	err = u.UpdateStore(10, 1, nil, "new name")
 	if err == nil {
 		t.Fatalf("expected repo error forwarded, got nil")
 	}
@@ -115,33 +116,33 @@ func TestDeleteStore_Authorization(t *testing.T) {
 
 	// 1) Owner deletes own store -> allowed
 	repo.store = &models.Store{ID: 1, UserID: 10}
-	err := u.DeleteStore(10, 1, "user")
+	err := u.DeleteStore(10, 1, nil)
 	if err != nil {
 		t.Fatalf("expected owner delete allowed, got err: %v", err)
 	}
 
 	// 2) Non-owner non-admin deletes another user's store -> forbidden
-	err = u.DeleteStore(11, 1, "user")
+	err = u.DeleteStore(11, 1, nil)
 	if err == nil || err.Error() != "forbidden" {
 		t.Fatalf("expected forbidden, got err: %v", err)
 	}
 
 	// 3) Admin deletes any store -> allowed
-	err = u.DeleteStore(1, 1, "admin")
+	err = u.DeleteStore(1, 1, rbac.NewPermissions(rbac.StoreWriteAny))
 	if err != nil {
 		t.Fatalf("expected admin delete allowed, got err: %v", err)
 	}
 
 	// 4) Store not found
 	repo.store = nil
-	err = u.DeleteStore(10, 1, "user")
+	err = u.DeleteStore(10, 1, nil)
 	if err == nil || err.Error() != "not found" {
 		t.Fatalf("expected not found, got err: %v", err)
 	}
 
 	// 5) Repo error -> forwarded
 	repo.err = errors.New("db fail")
-	err = u.DeleteStore(10, 1, "user")
+	err = u.DeleteStore(10, 1, nil)
 	if err == nil {
 		t.Fatalf("expected repo error forwarded, got nil")
 	}
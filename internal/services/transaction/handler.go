@@ -7,17 +7,18 @@ import (
 
 	"database/sql"
 
+	"github.com/example/ms-ecommerce/internal/pkg/cache"
 	"github.com/example/ms-ecommerce/internal/pkg/middleware"
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, dbConn *sql.DB) {
-	repo := NewRepo(dbConn)
+func RegisterRoutes(r *gin.Engine, dbConn *sql.DB, productCache *cache.ProductCache) {
+	repo := NewRepo(dbConn, productCache)
 	uc := NewUsecase(repo, dbConn)
 	// transactions require auth
-	r.POST("/api/v1/transactions", middleware.GinJWTAuth(), makeCreateHandler(uc))
-	r.GET("/api/v1/transactions", middleware.GinJWTAuth(), makeListHandler(uc))
-	r.GET("/api/v1/transactions/:id", middleware.GinJWTAuth(), makeGetHandler(uc))
+	r.POST("/api/v1/transactions", middleware.GinJWTOrAPIKeyAuth(), makeCreateHandler(uc))
+	r.GET("/api/v1/transactions", middleware.GinJWTOrAPIKeyAuth(), makeListHandler(uc))
+	r.GET("/api/v1/transactions/:id", middleware.GinJWTOrAPIKeyAuth(), makeGetHandler(uc))
 	r.GET("/test", func(c *gin.Context) {
 		c.String(200, "ok")
 	})
@@ -59,9 +60,7 @@ func makeListHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		c.String(200, "ok")
-		return
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		filters := map[string]string{}
 		if v := c.Query("status"); v != "" {
 			filters["status"] = v
@@ -88,7 +87,7 @@ func makeListHandler(uc Usecase) gin.HandlerFunc {
 				limit = li
 			}
 		}
-		data, total, err := uc.List(uid, role, filters, page, limit)
+		data, total, err := uc.List(uid, perms, filters, page, limit)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -104,10 +103,10 @@ func makeGetHandler(uc Usecase) gin.HandlerFunc {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			return
 		}
-		role, _ := middleware.GinGetRole(c)
+		perms := middleware.GinGetPermissions(c)
 		idStr := c.Param("id")
 		id, _ := strconv.ParseInt(idStr, 10, 64)
-		t, logs, err := uc.Get(uid, id, role)
+		t, logs, err := uc.Get(uid, id, perms)
 		if err != nil {
 			if err.Error() == "forbidden" {
 				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
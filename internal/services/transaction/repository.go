@@ -2,9 +2,12 @@ package transaction
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 
+	"github.com/example/ms-ecommerce/internal/pkg/cache"
 	"github.com/example/ms-ecommerce/internal/pkg/models"
 )
 
@@ -16,10 +19,13 @@ type Repository interface {
 
 type mysqlRepo struct {
 	db *sql.DB
+	// cache is the product service's cache; orders change stock, which the
+	// public catalog filters on. nil when Redis is unavailable.
+	cache *cache.ProductCache
 }
 
-func NewRepo(db *sql.DB) Repository {
-	return &mysqlRepo{db: db}
+func NewRepo(db *sql.DB, cache *cache.ProductCache) Repository {
+	return &mysqlRepo{db: db, cache: cache}
 }
 
 func (r *mysqlRepo) Create(txn *models.Transaction, logs []*models.ProductLog) (int64, error) {
@@ -41,24 +47,50 @@ func (r *mysqlRepo) Create(txn *models.Transaction, logs []*models.ProductLog) (
 
 	// insert logs and update stock
 	for _, l := range logs {
-		_, err = tx.Exec("INSERT INTO product_logs (transaction_id,product_id,product_name,product_price,quantity) VALUES (?,?,?,?,?)", tid, l.ProductID, l.ProductName, l.ProductPrice, l.Quantity)
+		var sku, name, options interface{}
+		if l.VariantID != nil {
+			var b []byte
+			if b, err = json.Marshal(l.VariantOptions); err != nil {
+				return 0, err
+			}
+			sku, name, options = l.VariantSKU, l.VariantName, string(b)
+		}
+		_, err = tx.Exec("INSERT INTO product_logs (transaction_id,product_id,product_name,product_price,quantity,variant_id,variant_sku,variant_name,variant_options) VALUES (?,?,?,?,?,?,?,?,?)",
+			tid, l.ProductID, l.ProductName, l.ProductPrice, l.Quantity, l.VariantID, sku, name, options)
 		if err != nil {
 			return 0, err
 		}
-		// decrease stock if possible
-		resu, err := tx.Exec("UPDATE products SET stock = stock - ? WHERE id = ? AND stock >= ?", l.Quantity, l.ProductID, l.Quantity)
+		// decrease stock if possible; variants keep their own stock
+		var resu sql.Result
+		if l.VariantID != nil {
+			resu, err = tx.Exec("UPDATE product_variants SET stock = stock - ? WHERE id = ? AND product_id = ? AND stock >= ?", l.Quantity, *l.VariantID, l.ProductID, l.Quantity)
+		} else {
+			resu, err = tx.Exec("UPDATE products SET stock = stock - ? WHERE id = ? AND stock >= ?", l.Quantity, l.ProductID, l.Quantity)
+		}
 		if err != nil {
 			return 0, err
 		}
 		ra, _ := resu.RowsAffected()
 		if ra == 0 {
-			return 0, fmt.Errorf("insufficient stock for product %d", l.ProductID)
+			if l.VariantID != nil {
+				err = fmt.Errorf("insufficient stock for variant %s", l.VariantSKU)
+			} else {
+				err = fmt.Errorf("insufficient stock for product %d", l.ProductID)
+			}
+			return 0, err
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
+	if err = tx.Commit(); err != nil {
 		return 0, err
 	}
+	// drop cached product lists and catalog entries so that products sold out
+	// by this order leave the catalog right away
+	if r.cache != nil {
+		if cerr := r.cache.InvalidateProductsCache(); cerr != nil {
+			log.Printf("transaction %d: invalidating product cache: %v", tid, cerr)
+		}
+	}
 	return tid, nil
 }
 
@@ -71,7 +103,7 @@ func (r *mysqlRepo) GetByID(id int64) (*models.Transaction, []*models.ProductLog
 		}
 		return nil, nil, err
 	}
-	rows, err := r.db.Query("SELECT id,transaction_id,product_id,product_name,product_price,quantity,created_at FROM product_logs WHERE transaction_id = ?", id)
+	rows, err := r.db.Query("SELECT id,transaction_id,product_id,product_name,product_price,quantity,variant_id,variant_sku,variant_name,variant_options,created_at FROM product_logs WHERE transaction_id = ?", id)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -79,9 +111,20 @@ func (r *mysqlRepo) GetByID(id int64) (*models.Transaction, []*models.ProductLog
 	logs := []*models.ProductLog{}
 	for rows.Next() {
 		l := &models.ProductLog{}
-		if err := rows.Scan(&l.ID, &l.TransactionID, &l.ProductID, &l.ProductName, &l.ProductPrice, &l.Quantity, &l.CreatedAt); err != nil {
+		var variantID sql.NullInt64
+		var sku, name, options sql.NullString
+		if err := rows.Scan(&l.ID, &l.TransactionID, &l.ProductID, &l.ProductName, &l.ProductPrice, &l.Quantity, &variantID, &sku, &name, &options, &l.CreatedAt); err != nil {
 			return nil, nil, err
 		}
+		if variantID.Valid {
+			l.VariantID = &variantID.Int64
+			l.VariantSKU, l.VariantName = sku.String, name.String
+			if options.Valid && options.String != "" {
+				if err := json.Unmarshal([]byte(options.String), &l.VariantOptions); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
 		logs = append(logs, l)
 	}
 	return t, logs, nil
@@ -2,20 +2,24 @@ package transaction
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 
 	"github.com/example/ms-ecommerce/internal/pkg/models"
+	"github.com/example/ms-ecommerce/internal/pkg/rbac"
 )
 
 type Usecase interface {
 	Create(userID int64, addressID int64, items []ItemReq) (int64, error)
-	Get(userID, id int64, role string) (*models.Transaction, []*models.ProductLog, error)
-	List(userID int64, role string, filters map[string]string, page, limit int) ([]*models.Transaction, int, error)
+	Get(userID, id int64, perms rbac.Permissions) (*models.Transaction, []*models.ProductLog, error)
+	List(userID int64, perms rbac.Permissions, filters map[string]string, page, limit int) ([]*models.Transaction, int, error)
 }
 
+// ItemReq is an order line. VariantID is required for products sold in variants.
 type ItemReq struct {
-	ProductID int64 `json:"product_id"`
-	Quantity  int   `json:"quantity"`
+	ProductID int64  `json:"product_id"`
+	VariantID *int64 `json:"variant_id,omitempty"`
+	Quantity  int    `json:"quantity"`
 }
 
 type txnUsecase struct {
@@ -48,16 +52,41 @@ func (u *txnUsecase) Create(userID int64, addressID int64, items []ItemReq) (int
 	total := 0.0
 	for _, it := range items {
 		p := &models.Product{}
-		row := u.db.QueryRow("SELECT id,store_id,name,price,stock FROM products WHERE id = ?", it.ProductID)
-		if err := row.Scan(&p.ID, &p.StoreID, &p.Name, &p.Price, &p.Stock); err != nil {
+		row := u.db.QueryRow("SELECT id,store_id,name,price,stock,published FROM products WHERE id = ?", it.ProductID)
+		if err := row.Scan(&p.ID, &p.StoreID, &p.Name, &p.Price, &p.Stock, &p.Published); err != nil {
 			if err == sql.ErrNoRows {
 				return 0, errors.New("product not found")
 			}
 			return 0, err
 		}
+		// drafts cannot be ordered
+		if !p.Published {
+			return 0, errors.New("product not found")
+		}
 		if it.Quantity <= 0 {
 			return 0, errors.New("invalid quantity")
 		}
+		l := &models.ProductLog{ProductID: p.ID, ProductName: p.Name, ProductPrice: p.Price, Quantity: it.Quantity}
+		if it.VariantID != nil {
+			v, err := u.loadVariant(*it.VariantID, p.ID)
+			if err != nil {
+				return 0, err
+			}
+			if v.Price != nil {
+				l.ProductPrice = *v.Price
+			}
+			l.VariantID, l.VariantSKU, l.VariantName, l.VariantOptions = &v.ID, v.SKU, v.Name, v.Options
+			p.Stock = v.Stock
+		} else {
+			// products sold in variants keep their stock per variant
+			var variants int
+			if err := u.db.QueryRow("SELECT COUNT(1) FROM product_variants WHERE product_id = ?", p.ID).Scan(&variants); err != nil {
+				return 0, err
+			}
+			if variants > 0 {
+				return 0, errors.New("variant_id required")
+			}
+		}
 		if p.Stock < it.Quantity {
 			return 0, errors.New("insufficient stock")
 		}
@@ -67,8 +96,8 @@ func (u *txnUsecase) Create(userID int64, addressID int64, items []ItemReq) (int
 		if p.StoreID != storeID {
 			return 0, errors.New("items must be from same store")
 		}
-		total += p.Price * float64(it.Quantity)
-		logs = append(logs, &models.ProductLog{ProductID: p.ID, ProductName: p.Name, ProductPrice: p.Price, Quantity: it.Quantity})
+		total += l.ProductPrice * float64(it.Quantity)
+		logs = append(logs, l)
 	}
 
 	txn := &models.Transaction{UserID: userID, StoreID: storeID, AddressID: addressID, Total: total, Status: "pending"}
@@ -79,21 +108,44 @@ func (u *txnUsecase) Create(userID int64, addressID int64, items []ItemReq) (int
 	return id, nil
 }
 
-func (u *txnUsecase) Get(userID, id int64, role string) (*models.Transaction, []*models.ProductLog, error) {
+// loadVariant loads a variant of productID for an order line
+func (u *txnUsecase) loadVariant(id, productID int64) (*models.ProductVariant, error) {
+	v := &models.ProductVariant{}
+	var options sql.NullString
+	var price sql.NullFloat64
+	row := u.db.QueryRow("SELECT id,sku,name,options,price,stock FROM product_variants WHERE id = ? AND product_id = ?", id, productID)
+	if err := row.Scan(&v.ID, &v.SKU, &v.Name, &options, &price, &v.Stock); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("variant not found")
+		}
+		return nil, err
+	}
+	if options.Valid && options.String != "" {
+		if err := json.Unmarshal([]byte(options.String), &v.Options); err != nil {
+			return nil, err
+		}
+	}
+	if price.Valid {
+		v.Price = &price.Float64
+	}
+	return v, nil
+}
+
+func (u *txnUsecase) Get(userID, id int64, perms rbac.Permissions) (*models.Transaction, []*models.ProductLog, error) {
 	t, logs, err := u.repo.GetByID(id)
 	if err != nil || t == nil {
 		return t, logs, err
 	}
-	if role != "admin" && t.UserID != userID {
+	if !perms.Has(rbac.TransactionReadAny) && t.UserID != userID {
 		return nil, nil, errors.New("forbidden")
 	}
 	return t, logs, nil
 }
 
-func (u *txnUsecase) List(userID int64, role string, filters map[string]string, page, limit int) ([]*models.Transaction, int, error) {
-	// If admin, list all transactions (userID=0), else list user's transactions
+func (u *txnUsecase) List(userID int64, perms rbac.Permissions, filters map[string]string, page, limit int) ([]*models.Transaction, int, error) {
+	// With transaction:read:any list all transactions (userID=0), else the user's own
 	listUserID := userID
-	if role == "admin" {
+	if perms.Has(rbac.TransactionReadAny) {
 		listUserID = 0
 	}
 	return u.repo.ListByUser(listUserID, filters, page, limit)
@@ -7,9 +7,12 @@ CREATE TABLE IF NOT EXISTS users (
   id BIGINT AUTO_INCREMENT PRIMARY KEY,
   name VARCHAR(255) NOT NULL,
   email VARCHAR(255) NOT NULL UNIQUE,
-  phone VARCHAR(50) NOT NULL UNIQUE,
+  phone VARCHAR(50) NULL UNIQUE,
   password VARCHAR(255) NOT NULL,
   role VARCHAR(50) NOT NULL DEFAULT 'user',
+  email_verified_at DATETIME NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'active', -- active, suspended or deleted (anonymized)
+  token_version INT NOT NULL DEFAULT 0,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -51,11 +54,56 @@ CREATE TABLE IF NOT EXISTS products (
   price DECIMAL(12,2) NOT NULL DEFAULT 0,
   stock INT NOT NULL DEFAULT 0,
   image_url VARCHAR(1024),
+  -- only published products are listed in the public catalog
+  published TINYINT(1) NOT NULL DEFAULT 1,
+  -- analyzed name and description for full-text search, maintained by the
+  -- product service (see internal/services/product/search.go)
+  search_terms TEXT NULL,
+  -- average rating out of 5 for sort=rating, 0 while unrated
+  rating DECIMAL(3,2) NOT NULL DEFAULT 0,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  FULLTEXT INDEX ft_products_search (search_terms) WITH PARSER ngram,
   FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE,
   FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE SET NULL
 );
 
+-- product variants (e.g. size and color). options holds the variant's option
+-- values as a JSON object ({"size": "M", "color": "Black"}); price overrides
+-- products.price when set. store_id is copied from the product so that SKUs
+-- are unique per store. Products with variants are ordered by variant and
+-- their stock is tracked per variant.
+CREATE TABLE IF NOT EXISTS product_variants (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  product_id BIGINT NOT NULL,
+  store_id BIGINT NOT NULL,
+  sku VARCHAR(64) NOT NULL,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  options JSON NULL,
+  price DECIMAL(12,2) NULL,
+  stock INT NOT NULL DEFAULT 0,
+  image_url VARCHAR(1024),
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_product_variants_sku (store_id, sku),
+  INDEX idx_product_variants_product (product_id),
+  FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+  FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE
+);
+
+-- product images in display order. The primary image's url is kept in
+-- products.image_url. Files are stored by the file service's upload rules
+-- (see internal/pkg/upload) and removed with the product.
+CREATE TABLE IF NOT EXISTS product_images (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  product_id BIGINT NOT NULL,
+  url VARCHAR(1024) NOT NULL,
+  alt_text VARCHAR(255) NOT NULL DEFAULT '',
+  position INT NOT NULL DEFAULT 0,
+  is_primary TINYINT(1) NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_product_images_product (product_id, position),
+  FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
 -- transactions
 CREATE TABLE IF NOT EXISTS transactions (
   id BIGINT AUTO_INCREMENT PRIMARY KEY,
@@ -78,18 +126,200 @@ CREATE TABLE IF NOT EXISTS product_logs (
   product_name VARCHAR(255) NOT NULL,
   product_price DECIMAL(12,2) NOT NULL,
   quantity INT NOT NULL,
+  -- variant snapshot, set when a variant was ordered (no FK: variants may be deleted)
+  variant_id BIGINT NULL,
+  variant_sku VARCHAR(64) NULL,
+  variant_name VARCHAR(255) NULL,
+  variant_options JSON NULL,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
 );
 
--- Refresh tokens for issuing long-lived refresh tokens (hashed)
+-- Refresh tokens for issuing long-lived refresh tokens (hashed).
+-- Every rotation creates a child row in the same family; the parent is kept with
+-- rotated_at set so that replaying it can be detected and the family revoked.
+-- A family is a login session: family_id is the session ID shown to users.
 CREATE TABLE IF NOT EXISTS refresh_tokens (
   id BIGINT AUTO_INCREMENT PRIMARY KEY,
   user_id BIGINT NOT NULL,
   token_hash VARCHAR(128) NOT NULL,
+  family_id VARCHAR(64) NOT NULL DEFAULT '',
+  parent_id BIGINT NULL,
+  rotated_at DATETIME NULL,
+  user_agent VARCHAR(255) NOT NULL DEFAULT '',
+  ip_address VARCHAR(64) NOT NULL DEFAULT '',
+  session_created_at DATETIME NULL,
+  last_used_at DATETIME NULL,
+  client_id VARCHAR(64) NULL,
+  scope VARCHAR(1024) NOT NULL DEFAULT '',
   expires_at DATETIME NOT NULL,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   INDEX (token_hash),
+  INDEX idx_refresh_tokens_family (family_id),
+  INDEX idx_refresh_tokens_client (client_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- external (OpenID Connect) identities linked to local users
+CREATE TABLE IF NOT EXISTS user_identities (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  provider VARCHAR(64) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  email VARCHAR(255) NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_user_identities_subject (provider, subject),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- security-relevant events (refresh token reuse, ...) for auditing/alerting
+CREATE TABLE IF NOT EXISTS security_events (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NULL,
+  event_type VARCHAR(64) NOT NULL,
+  detail TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX (user_id),
+  INDEX (event_type)
+);
+
+-- permissions granted to each role (see internal/pkg/rbac). "*" grants everything.
+-- Roles can be added or changed here without code changes; services pick up
+-- changes within a minute.
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role VARCHAR(50) NOT NULL,
+  permission VARCHAR(100) NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (role, permission)
+);
+
+INSERT IGNORE INTO role_permissions (role, permission) VALUES
+('admin', '*'),
+('support', 'user:read:any'),
+('support', 'user:sessions:any'),
+('support', 'user:unlock'),
+('support', 'address:read:any'),
+('support', 'transaction:read:any'),
+('support', 'store:read:any'),
+('catalog_moderator', 'product:read:any'),
+('catalog_moderator', 'product:write:any'),
+('catalog_moderator', 'category:manage');
+
+-- API keys for service accounts and integrations. Only a hash of the key is
+-- stored; scopes are space separated permissions (see internal/pkg/rbac).
+CREATE TABLE IF NOT EXISTS api_keys (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  name VARCHAR(100) NOT NULL,
+  prefix VARCHAR(32) NOT NULL,
+  key_hash VARCHAR(128) NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  expires_at DATETIME NULL,
+  last_used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_api_keys_hash (key_hash),
+  INDEX (user_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- single-use tokens sent to an email address or phone number: passwordless
+-- logins (channel email, sms) and confirmations of a new email or phone
+-- (email_change, phone_change; destination is the new value). Only hashes are
+-- stored; used_at makes every token single-use.
+CREATE TABLE IF NOT EXISTS login_tokens (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  channel VARCHAR(16) NOT NULL,
+  destination VARCHAR(255) NOT NULL,
+  token_hash VARCHAR(128) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_login_tokens_hash (token_hash),
+  INDEX idx_login_tokens_destination (channel, destination, created_at),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- OAuth 2.0 clients (partner apps). Only secret hashes are stored; public
+-- clients have none and must use PKCE. revoked_at disables a client for good.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  client_id VARCHAR(64) NOT NULL,
+  secret_hash VARCHAR(128) NULL,
+  name VARCHAR(100) NOT NULL,
+  owner_id BIGINT NOT NULL,
+  redirect_uris TEXT NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  grant_types VARCHAR(255) NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  revoked_at DATETIME NULL,
+  UNIQUE KEY uq_oauth_clients_client_id (client_id),
+  FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- single-use authorization codes (hashed); family_id is the refresh token
+-- family issued for the code, revoked when the code is replayed
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  code_hash VARCHAR(128) NOT NULL,
+  client_id VARCHAR(64) NOT NULL,
+  user_id BIGINT NOT NULL,
+  redirect_uri VARCHAR(1024) NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  code_challenge VARCHAR(128) NOT NULL,
+  family_id VARCHAR(64) NULL,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uq_oauth_codes_hash (code_hash),
   FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- scopes each user granted each client
+CREATE TABLE IF NOT EXISTS oauth_consents (
+  user_id BIGINT NOT NULL,
+  client_id VARCHAR(64) NOT NULL,
+  scopes VARCHAR(1024) NOT NULL DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, client_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- requests made by staff while impersonating a user (internal/pkg/audit).
+-- No foreign keys: the trail must outlive the accounts involved.
+CREATE TABLE IF NOT EXISTS audit_log (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  actor_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  method VARCHAR(10) NOT NULL,
+  path VARCHAR(255) NOT NULL,
+  status INT NOT NULL,
+  ip_address VARCHAR(64) NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  INDEX (actor_id),
+  INDEX (user_id, created_at)
+);
+
+-- TOTP two-factor authentication: one secret per user, enabled once the
+-- first code has been verified
+CREATE TABLE IF NOT EXISTS user_mfa (
+  user_id BIGINT PRIMARY KEY,
+  secret VARCHAR(64) NOT NULL,
+  enabled TINYINT(1) NOT NULL DEFAULT 0,
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- single-use 2FA recovery codes (hashed)
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  code_hash VARCHAR(128) NOT NULL,
+  used_at DATETIME NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX (user_id),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);